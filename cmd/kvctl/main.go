@@ -0,0 +1,244 @@
+// Command kvctl talks to a running kvstore over HTTP or its Unix socket.
+//
+//	kvctl get hello
+//	kvctl set --ttl 10m feature/beta true
+//	kvctl -socket /tmp/kvstore.sock list --prefix feature/
+//
+// Values given to set are parsed as JSON; anything that isn't JSON is sent
+// as a string. Responses are printed as indented JSON, and an ERR response
+// makes kvctl exit 1.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/UltraSive/rocksdb-configuration-distribution/internal/handler"
+	"github.com/UltraSive/rocksdb-configuration-distribution/internal/transport"
+)
+
+const usage = `usage: kvctl [flags] <command> [args]
+
+commands:
+  get KEY...                    read keys
+  set [--ttl D] KEY VALUE       write a key
+  del KEY...                    delete keys
+  list [--prefix P]             list keys and values, following cursors
+  stats                         show store statistics
+
+flags:
+`
+
+func main() {
+	addr := flag.String("addr", "http://localhost:8080", "HTTP address of the store")
+	socket := flag.String("socket", "", "Unix socket of the store; overrides -addr")
+	token := flag.String("token", "", "bearer token, if the store has AUTHORIZATION set")
+	timeout := flag.Duration("timeout", 10*time.Second, "time allowed for each request")
+	compress := flag.Bool("compress", false, "ask for compressed replies over -socket")
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	var c client
+	if *socket != "" {
+		sc, err := dialSocket(*socket, *token, *timeout, *compress)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "connect:", err)
+			os.Exit(1)
+		}
+		defer sc.conn.Close()
+		c = sc
+	} else {
+		c = &httpClient{url: *addr, token: *token, client: &http.Client{Timeout: *timeout}}
+	}
+
+	resp, err := run(c, flag.Arg(0), flag.Args()[1:])
+	if errors.Is(err, errUsage) {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "kvctl:", err)
+		os.Exit(1)
+	}
+	out, _ := json.MarshalIndent(resp, "", "  ")
+	fmt.Println(string(out))
+	if resp.Type == "ERR" {
+		os.Exit(1)
+	}
+}
+
+var errUsage = errors.New("usage")
+
+// run turns a command line into requests and returns the response to print.
+func run(c client, cmd string, args []string) (handler.Response, error) {
+	switch cmd {
+	case "get":
+		if len(args) == 0 {
+			return handler.Response{}, errUsage
+		}
+		return c.do(handler.Request{Type: "GET", Keys: args})
+
+	case "set":
+		fs := flag.NewFlagSet("set", flag.ExitOnError)
+		ttl := fs.String("ttl", "", "TTL for the key, e.g. 10s; default: the store's")
+		_ = fs.Parse(args)
+		if fs.NArg() != 2 {
+			return handler.Response{}, errUsage
+		}
+		key, value := fs.Arg(0), json.RawMessage(fs.Arg(1))
+		if !json.Valid(value) {
+			value, _ = json.Marshal(fs.Arg(1))
+		}
+		return c.do(handler.Request{Type: "UPDATE", Items: map[string]json.RawMessage{key: value}, TTL: *ttl})
+
+	case "del":
+		if len(args) == 0 {
+			return handler.Response{}, errUsage
+		}
+		return c.do(handler.Request{Type: "DELETE", Keys: args})
+
+	case "list":
+		fs := flag.NewFlagSet("list", flag.ExitOnError)
+		prefix := fs.String("prefix", "", "only keys under this prefix")
+		_ = fs.Parse(args)
+		if fs.NArg() != 0 {
+			return handler.Response{}, errUsage
+		}
+		return list(c, *prefix)
+
+	case "stats":
+		return c.do(handler.Request{Type: "STATS"})
+	}
+	return handler.Response{}, fmt.Errorf("%w: unknown command %q", errUsage, cmd)
+}
+
+// list scans prefix page by page and merges the pages into one response.
+func list(c client, prefix string) (handler.Response, error) {
+	all := handler.Response{Type: "OK", Data: make(map[string]interface{})}
+	req := handler.Request{Type: "SCAN", Prefix: prefix}
+	for {
+		resp, err := c.do(req)
+		if err != nil || resp.Type != "OK" {
+			return resp, err
+		}
+		for k, v := range resp.Data {
+			all.Data[k] = v
+		}
+		if !resp.Truncated || resp.NextCursor == "" {
+			return all, nil
+		}
+		req.Cursor = resp.NextCursor
+	}
+}
+
+type client interface {
+	do(req handler.Request) (handler.Response, error)
+}
+
+// decode reads a response, keeping numbers exactly as the store sent them.
+func decode(b []byte) (handler.Response, error) {
+	var resp handler.Response
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	if err := dec.Decode(&resp); err != nil {
+		return resp, fmt.Errorf("bad response: %v", err)
+	}
+	return resp, nil
+}
+
+type httpClient struct {
+	url    string
+	token  string
+	client *http.Client
+}
+
+func (c *httpClient) do(req handler.Request) (handler.Response, error) {
+	b, _ := json.Marshal(&req)
+	httpReq, err := http.NewRequest("POST", strings.TrimSuffix(c.url, "/")+"/", bytes.NewReader(b))
+	if err != nil {
+		return handler.Response{}, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	if c.token != "" {
+		httpReq.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	resp, err := c.client.Do(httpReq)
+	if err != nil {
+		return handler.Response{}, err
+	}
+	defer resp.Body.Close()
+	var buf bytes.Buffer
+	if _, err := buf.ReadFrom(resp.Body); err != nil {
+		return handler.Response{}, err
+	}
+	return decode(buf.Bytes())
+}
+
+type socketClient struct {
+	conn    net.Conn
+	timeout time.Duration
+}
+
+// dialSocket connects to the framed protocol, negotiating compressed replies
+// when asked and authenticating when a token is given.
+func dialSocket(path, token string, timeout time.Duration, compress bool) (*socketClient, error) {
+	conn, err := net.DialTimeout("unix", path, timeout)
+	if err != nil {
+		return nil, err
+	}
+	c := &socketClient{conn: conn, timeout: timeout}
+	if compress {
+		b, _ := json.Marshal(map[string]string{"type": "HELLO", "compression": transport.CompressionZstd})
+		if _, err := c.roundTrip(b); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if token == "" {
+		return c, nil
+	}
+	b, _ := json.Marshal(map[string]string{"type": "AUTH", "token": token})
+	resp, err := c.roundTrip(b)
+	if err == nil && resp.Type != "OK" {
+		err = fmt.Errorf("auth: %s", resp.Error)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *socketClient) do(req handler.Request) (handler.Response, error) {
+	b, _ := json.Marshal(&req)
+	return c.roundTrip(b)
+}
+
+func (c *socketClient) roundTrip(b []byte) (handler.Response, error) {
+	if c.timeout > 0 {
+		_ = c.conn.SetDeadline(time.Now().Add(c.timeout))
+	}
+	if err := transport.WriteMessage(c.conn, b); err != nil {
+		return handler.Response{}, err
+	}
+	reply, err := transport.ReadMessage(c.conn, 0)
+	if err != nil {
+		return handler.Response{}, err
+	}
+	return decode(reply)
+}
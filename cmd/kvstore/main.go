@@ -1,118 +1,494 @@
 package main
 
 import (
-    "context"
-    "encoding/json"
-    "fmt"
-    "net"
-    "net/http"
-    "os"
-    "os/signal"
-    "time"
-
-    "github.com/UltraSive/rocksdb-configuration-distribution/internal/cleaner"
-    "github.com/UltraSive/rocksdb-configuration-distribution/internal/datastore"
-    "github.com/UltraSive/rocksdb-configuration-distribution/internal/handler"
-    "github.com/UltraSive/rocksdb-configuration-distribution/internal/transport"
-    "github.com/UltraSive/rocksdb-configuration-distribution/internal/upstream"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/UltraSive/rocksdb-configuration-distribution/internal/admin"
+	"github.com/UltraSive/rocksdb-configuration-distribution/internal/audit"
+	"github.com/UltraSive/rocksdb-configuration-distribution/internal/cleaner"
+	"github.com/UltraSive/rocksdb-configuration-distribution/internal/config"
+	"github.com/UltraSive/rocksdb-configuration-distribution/internal/datastore"
+	"github.com/UltraSive/rocksdb-configuration-distribution/internal/handler"
+	"github.com/UltraSive/rocksdb-configuration-distribution/internal/hotkeys"
+	"github.com/UltraSive/rocksdb-configuration-distribution/internal/metrics"
+	"github.com/UltraSive/rocksdb-configuration-distribution/internal/ops"
+	"github.com/UltraSive/rocksdb-configuration-distribution/internal/quota"
+	"github.com/UltraSive/rocksdb-configuration-distribution/internal/reconciler"
+	"github.com/UltraSive/rocksdb-configuration-distribution/internal/replication"
+	"github.com/UltraSive/rocksdb-configuration-distribution/internal/ring"
+	"github.com/UltraSive/rocksdb-configuration-distribution/internal/transport"
+	"github.com/UltraSive/rocksdb-configuration-distribution/internal/upstream"
+	"github.com/UltraSive/rocksdb-configuration-distribution/internal/writethrough"
 )
 
 func main() {
-    // --- Config ---
-    socketPath := "/tmp/kvstore.sock" // could make this configurable via env
-    upstreamURL := os.Getenv("UPSTREAM_URL")
-    ttl := 30 * time.Second           // default TTL (0 = infinite)
-    janitorInterval := 60 * time.Second
-
-    // --- RocksDB Setup ---
-    db, err := datastore.NewRocksDB("./kvdb")
-    if err != nil {
-        panic(err)
-    }
-    defer db.Close()
-
-    // --- Upstream Client ---
-    var up *upstream.Client
-    if upstreamURL != "" {
-        up = upstream.New(upstreamURL, 5*time.Second)
-    }
-
-    // --- Handler ---
-    h := handler.New(db, up, ttl)
-
-    // --- Serve Function (used by HTTP + Unix transport) ---
-    serveFn := func(payload []byte) ([]byte, error) {
-        var req handler.Request
-        if err := json.Unmarshal(payload, &req); err != nil {
-            return nil, err
-        }
-        resp := h.Serve(req)
-        return json.Marshal(resp)
-    }
-
-		// Remove old socket if it exists
+	// --- Config ---
+	cfg, err := config.Load()
+	if err != nil {
+		panic(err)
+	}
+	socketPath := cfg.SocketPath
+	ttl := cfg.TTL.Duration
+
+	// --- RocksDB Setup ---
+	// rdb is only set for a single unsharded store; the change log and the
+	// replication leader need its global sequence.
+	dbOpts := datastore.Options{
+		ReadOnly:                  cfg.ReadOnly,
+		LazyDelete:                cfg.LazyDelete,
+		ExpiryGrace:               cfg.ExpiryGrace.Duration,
+		TrackCreated:              cfg.TrackCreated,
+		PinnedPrefixes:            cfg.PinnedPrefixes,
+		MaxPendingCompactionBytes: cfg.MaxPendingCompactionBytes,
+		LogRetention:              cfg.ChangeLogRetention,
+		LogRetentionAge:           cfg.ChangeLogRetentionAge.Duration,
+		CompressMinBytes:          cfg.CompressMinBytes,
+		BlockCacheBytes:           cfg.BlockCacheBytes,
+		Tuning: datastore.Tuning{
+			Preset:              cfg.RocksDBPreset,
+			CompactionStyle:     cfg.CompactionStyle,
+			L0CompactionTrigger: cfg.L0CompactionTrigger,
+			L0SlowdownTrigger:   cfg.L0SlowdownTrigger,
+			L0StopTrigger:       cfg.L0StopTrigger,
+			TargetFileBytes:     cfg.TargetFileBytes,
+			MaxBackgroundJobs:   cfg.MaxBackgroundJobs,
+			MemtableBytes:       cfg.MemtableBytes,
+			MaxMemtables:        cfg.MaxMemtables,
+		},
+	}
+	if cfg.ValueCompression != "none" {
+		dbOpts.Compression = cfg.ValueCompression
+	}
+	var db datastore.Datastore
+	var rdb *datastore.RocksDB
+	if cfg.Shards > 1 {
+		db, err = datastore.NewSharded(cfg.DBPath, cfg.Shards, dbOpts)
+	} else {
+		rdb, err = datastore.NewRocksDB(cfg.DBPath, dbOpts)
+		db = rdb
+	}
+	if errors.Is(err, datastore.ErrLocked) {
+		fmt.Println(err)
+		fmt.Printf("another kvstore already has %s open; stop it or set DB_PATH to another directory (READ_ONLY=true can share it with the writer)\n", cfg.DBPath)
+		os.Exit(1)
+	}
+	if err != nil {
+		panic(err)
+	}
+	if cfg.WriteBufferInterval.Duration > 0 && !cfg.ReadOnly {
+		db = datastore.NewBuffered(db, cfg.WriteBufferInterval.Duration, cfg.WriteBufferMaxBytes)
+	}
+	if cfg.ReadCacheBytes > 0 {
+		db = datastore.NewCached(db, cfg.ReadCacheBytes)
+	}
+	// Closing flushes the write buffer, if any. Shutdown closes the store
+	// itself to report the outcome; the deferred call covers early exits.
+	closeDB := sync.OnceValue(db.Close)
+	defer closeDB()
+
+	// --- Upstream Client ---
+	var up *upstream.Client
+	if cfg.UpstreamURL != "" {
+		up = upstream.New(cfg.UpstreamURL, 5*time.Second)
+		up.Mode = cfg.UpstreamMode
+		up.Limit(cfg.UpstreamLimit, cfg.UpstreamQueue)
+		up.Mapping = upstream.Mapping{
+			StatusField: cfg.UpstreamStatusField,
+			StatusOK:    cfg.UpstreamStatusOK,
+			ValuePath:   cfg.UpstreamValuePath,
+		}
+		if cfg.UpstreamCheck != "off" {
+			checkUpstream(up, cfg.UpstreamCheck, cfg.UpstreamCheckTimeout.Duration, closeDB)
+		}
+	}
+
+	// --- Cluster Ring ---
+	var rg *ring.Ring
+	if len(cfg.ClusterNodes) > 0 {
+		rg, err = ring.New(cfg.ClusterNodes, cfg.ClusterVNodes)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	// --- Handler ---
+	h := handler.New(db, up, ttl)
+	if cfg.ClusterEnforce {
+		h.Ring, h.Self = rg, cfg.ClusterSelf
+	}
+	h.CacheTTL = cfg.CacheTTL.Duration
+	h.ForwardUnknown = cfg.ForwardUnknown
+	h.CanonicalJSON = cfg.CanonicalJSON
+	h.ExpiryField = cfg.ExpiryField
+	if rdb != nil {
+		h.Changes = rdb.ChangeLog()
+	}
+	h.MaxResponseBytes = cfg.MaxResponseBytes
+	h.MaxBatchBytes = cfg.MaxBatchBytes
+	h.WarmMaxBytes = cfg.WarmMaxBytes
+	h.IdempotencyTTL = cfg.IdempotencyTTL.Duration
+	h.MaxKeyBytes = cfg.MaxKeyBytes
+	h.ReadyMaxCompactionBytes = cfg.ReadyMaxCompactionBytes
+	if cfg.KeyPattern != "" {
+		h.KeyPattern = regexp.MustCompile(cfg.KeyPattern)
+	}
+	h.SlidingTTLPrefixes = cfg.SlidingTTLPrefixes
+	h.PinnedPrefixes = cfg.PinnedPrefixes
+	h.Vars = make(map[string]string, len(cfg.TemplateEnv)+len(cfg.TemplateVars))
+	for _, name := range cfg.TemplateEnv {
+		if v, ok := os.LookupEnv(name); ok {
+			h.Vars[name] = v
+		} else if name == "HOSTNAME" {
+			h.Vars[name], _ = os.Hostname()
+		}
+	}
+	for name, v := range cfg.TemplateVars {
+		h.Vars[name] = v
+	}
+	h.StrictVars = cfg.TemplateMissing == "error"
+	h.PrefixTTLs = make(map[string]time.Duration, len(cfg.PrefixTTLs))
+	for p, d := range cfg.PrefixTTLs {
+		h.PrefixTTLs[p] = d.Duration
+	}
+	if cfg.HotKeySampleRate > 0 {
+		h.HotKeys = hotkeys.New(cfg.HotKeyCapacity, cfg.HotKeySampleRate, cfg.HotKeyWindow.Duration)
+	}
+	h.Ops = ops.New()
+	if cfg.AuditLog != "" {
+		h.Audit, err = audit.Open(cfg.AuditLog)
+		if err != nil {
+			panic(err)
+		}
+		defer h.Audit.Close()
+	}
+	if len(cfg.Quotas) > 0 {
+		h.Quotas = quota.New(db, cfg.Quotas)
+		if err := h.Quotas.Refresh(); err != nil {
+			fmt.Println("quota refresh error:", err)
+		}
+	}
+
+	// --- Start Replication Follower ---
+	// A follower isn't ready to enumerate until its first snapshot lands;
+	// it starts before the listeners so h.Ready is set before any request.
+	// Workers that use the store stop on stopWorkers once requests have
+	// drained, and shutdown waits for each done channel before closing it.
+	stopWorkers := make(chan struct{})
+	var workers []<-chan struct{}
+	if cfg.ReplicateFrom != "" {
+		var done <-chan struct{}
+		h.Ready, done = replication.Follow(db, cfg.ReplicateFrom, stopWorkers)
+		workers = append(workers, done)
+	}
+
+	// --- Start Upstream Write-Through ---
+	// Entries queued before a restart are sent once the worker starts.
+	if cfg.WriteThrough && !cfg.ReadOnly {
+		h.WriteThrough, err = writethrough.New(db, up, cfg.WriteThroughMaxQueue, cfg.WriteThroughMaxAge.Duration)
+		if err != nil {
+			panic(err)
+		}
+		workers = append(workers, h.WriteThrough.Start(stopWorkers))
+	}
+
+	// --- Start Replica Fan-out ---
+	if len(cfg.Replicas) > 0 {
+		need, _ := replication.Need(cfg.ReplicaAcks, len(cfg.Replicas))
+		h.Replicas = replication.NewFanout(h.Changes, rdb, cfg.Replicas, need, cfg.ReplicaTimeout.Duration, cfg.ReplicaToken)
+		workers = append(workers, h.Replicas.Start(stopWorkers))
+	}
+
+	// --- Systemd Socket Activation ---
+	// Inherited sockets replace the configured ones: a unix socket carries
+	// the framed protocol, a TCP socket carries HTTP.
+	var unixLn, httpLn net.Listener
+	inherited, err := transport.SystemdListeners()
+	if err != nil {
+		panic(err)
+	}
+	for _, l := range inherited {
+		if l.Addr().Network() == "unix" {
+			unixLn = l
+		} else {
+			httpLn = l
+		}
+	}
+
+	// Remove old socket if it exists
+	if unixLn == nil {
 		if _, err := os.Stat(socketPath); err == nil {
-				os.Remove(socketPath)
-		}
-
-    // --- Start Unix Socket Listener ---
-    go func() {
-        if err := transport.ServeUnix(socketPath, func(conn net.Conn) {
-            defer conn.Close()
-
-            // Read request
-            msg, err := transport.ReadMessage(conn)
-            if err != nil {
-                fmt.Println("error reading:", err)
-                return
-            }
-
-            // Process
-            resp, err := serveFn(msg)
-            if err != nil {
-                fmt.Println("handler error:", err)
-                return
-            }
-
-            // Write response
-            if err := transport.WriteMessage(conn, resp); err != nil {
-                fmt.Println("error writing:", err)
-            }
-        }); err != nil {
-            fmt.Println("unix socket server error:", err)
-        }
-    }()
-
-    // --- Start HTTP Server ---
-    httpSrv := &http.Server{
-        Addr:    ":8080",
-        Handler: transport.NewHTTPRouter(serveFn),
-    }
-    go func() {
-        if err := httpSrv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-            fmt.Println("http server error:", err)
-        }
-    }()
-
-    // --- Start Cleaner (only if TTL > 0) ---
-    stopCleaner := make(chan struct{})
-    if ttl > 0 {
-        cleaner.Start(db, janitorInterval, 1000, stopCleaner)
-    }
-
-    // --- Wait for Interrupt ---
-    stop := make(chan os.Signal, 1)
-    signal.Notify(stop, os.Interrupt)
-    <-stop
-    fmt.Println("shutting down...")
-
-    // Stop cleaner gracefully
-    if ttl > 0 {
-        close(stopCleaner)
-    }
-
-    ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-    defer cancel()
-    _ = httpSrv.Shutdown(ctx)
-    fmt.Println("shutdown complete")
+			os.Remove(socketPath)
+		}
+	}
+
+	// --- Start Unix Socket Listener ---
+	// With a token configured, each connection must open with an AUTH frame.
+	// With FRAMED_WORKERS set, requests from every framed connection share a
+	// fixed pool of workers instead of running on their own goroutines.
+	var pool *transport.Pool
+	if cfg.FramedWorkers > 0 {
+		pool = transport.NewPool(cfg.FramedWorkers, cfg.FramedQueue)
+	}
+	framed := transport.NewFramed(func(ctx context.Context, conn net.Conn) {
+		transport.ServeConn(ctx, conn, cfg.UnixIdleTimeout.Duration, cfg.MaxFrameBytes, transport.FramedAuth(cfg.Authorization, pool.Wrap(func(ctx context.Context, msg []byte) []byte {
+			resp, err := json.Marshal(h.ServeJSON(ctx, msg))
+			if err != nil {
+				fmt.Println("handler error:", err)
+				return nil
+			}
+			return resp
+		})))
+	})
+	go func() {
+		l := unixLn
+		if l == nil {
+			var err error
+			if l, err = net.Listen("unix", socketPath); err != nil {
+				fmt.Println("unix socket server error:", err)
+				return
+			}
+		}
+		if err := framed.Serve(l); err != nil && !errors.Is(err, net.ErrClosed) {
+			fmt.Println("unix socket server error:", err)
+		}
+	}()
+
+	// --- Share the HTTP Port with the Framed Protocol (optional) ---
+	if cfg.MuxTCP {
+		if httpLn == nil {
+			httpLn, err = net.Listen("tcp", cfg.HTTPAddr)
+			if err != nil {
+				panic(err)
+			}
+		}
+		var framedLn net.Listener
+		httpLn, framedLn = transport.Split(httpLn, cfg.HTTPReadHeaderTimeout.Duration)
+		go func() {
+			if err := framed.Serve(framedLn); err != nil && !errors.Is(err, net.ErrClosed) {
+				fmt.Println("shared port framed server error:", err)
+			}
+		}()
+	}
+
+	// --- Start TCP Listener (framed protocol, optional) ---
+	if cfg.TCPAddr != "" {
+		tcpLn, err := net.Listen("tcp", cfg.TCPAddr)
+		if err != nil {
+			panic(err)
+		}
+		go func() {
+			if err := framed.Serve(tcpLn); err != nil && !errors.Is(err, net.ErrClosed) {
+				fmt.Println("tcp server error:", err)
+			}
+		}()
+	}
+
+	// --- Start HTTP Server ---
+	router := transport.NewHTTPRouter(h.ServeJSON, cfg.Authorization, transport.AccessLog{
+		SampleRate: cfg.AccessLogSampleRate,
+		Exclude:    cfg.AccessLogExclude,
+		Slow:       cfg.AccessLogSlow.Duration,
+	})
+	router.Get("/scan", transport.ScanHandler(h.StreamScan))
+	router.Get("/readyz", transport.ReadyHandler(h.ReadyCheck))
+	router.Get("/healthz", transport.HealthHandler())
+	router.Get("/watch", transport.WatchHandler(h.Watch, 15*time.Second))
+	router.Get("/kv/*", transport.KVHandler(h.Lookup, h.Pinned))
+	router.With(transport.Authenticate(cfg.Authorization)).Put("/kv/*", transport.KVPutHandler(h.Serve, int64(cfg.MaxPutBytes)))
+	if rdb != nil {
+		router.Get("/replicate", replication.Handler(rdb, 15*time.Second))
+	}
+	router.Handle("/metrics", metrics.Handler())
+	if rg != nil {
+		router.Get("/cluster/ring", transport.RingHandler(rg, cfg.ClusterSelf))
+	}
+	adm := admin.New(db)
+	adm.HotKeys = h.HotKeys
+	adm.Ops = h.Ops
+	adm.Upstream = up
+	adm.Audit = h.Audit
+	adm.Unauthenticated = cfg.Authorization == ""
+	// Without a token /admin is served only on explicit opt-in.
+	if cfg.Authorization != "" || cfg.AdminOpen {
+		router.With(transport.RequireToken(cfg.Authorization)).Mount("/admin", adm.Routes())
+	}
+	if cfg.Authorization == "" {
+		if cfg.AdminOpen {
+			fmt.Println("WARNING: AUTHORIZATION is not set and ADMIN_OPEN=true; /admin is unauthenticated and open to anyone who can reach", cfg.HTTPAddr)
+		} else {
+			fmt.Println("AUTHORIZATION is not set; /admin is not served (set ADMIN_OPEN=true to serve it unauthenticated)")
+		}
+	}
+	httpSrv := &http.Server{
+		Addr:              cfg.HTTPAddr,
+		Handler:           router,
+		ReadTimeout:       cfg.HTTPReadTimeout.Duration,
+		ReadHeaderTimeout: cfg.HTTPReadHeaderTimeout.Duration,
+		WriteTimeout:      cfg.HTTPWriteTimeout.Duration,
+		IdleTimeout:       cfg.HTTPIdleTimeout.Duration,
+		MaxHeaderBytes:    cfg.HTTPMaxHeaderBytes,
+	}
+	go func() {
+		var err error
+		if httpLn != nil {
+			err = httpSrv.Serve(httpLn)
+		} else {
+			err = httpSrv.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
+			fmt.Println("http server error:", err)
+		}
+	}()
+
+	// --- Start Cleaner ---
+	// It reaps expired keys and trims the change log, so it runs on every
+	// writable node, even without a default TTL.
+	stopCleaner := make(chan struct{})
+	var cleanerDone <-chan struct{}
+	if !cfg.ReadOnly {
+		cleanerDone = cleaner.Start(db, cleaner.Options{
+			Interval:  cfg.JanitorInterval.Duration,
+			ChunkSize: 1000,
+			Retries:   cfg.CleanerRetries,
+			Backoff:   cfg.CleanerRetryBackoff.Duration,
+		}, stopCleaner)
+	}
+
+	// --- Start Quota Refresh ---
+	if h.Quotas != nil {
+		workers = append(workers, quota.Start(h.Quotas, cfg.QuotaRefreshInterval.Duration, stopWorkers))
+	}
+
+	// --- Start Reconciler (only with an upstream) ---
+	if up != nil && cfg.ReconcileInterval.Duration > 0 {
+		var pending func(string) bool
+		if h.WriteThrough != nil {
+			pending = h.WriteThrough.Pending
+		}
+		workers = append(workers, reconciler.Start(db, up, reconciler.Options{
+			Interval:   cfg.ReconcileInterval.Duration,
+			BatchSize:  cfg.ReconcileBatchSize,
+			SampleRate: cfg.ReconcileSampleRate,
+			TTL:        h.CacheTTLFor,
+			Pinned:     h.Pinned,
+			Pending:    pending,
+		}, stopWorkers))
+	}
+
+	// --- Start StatsD Exporter (optional) ---
+	stopStatsD := make(chan struct{})
+	if cfg.StatsDAddr != "" {
+		if err := metrics.StartStatsD(cfg.StatsDAddr, cfg.StatsDPrefix, cfg.StatsDInterval.Duration, stopStatsD); err != nil {
+			panic(err)
+		}
+	}
+
+	// --- Wait for Interrupt ---
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt)
+	<-stop
+	fmt.Println("shutting down...")
+
+	close(stopStatsD)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	report, closed := shutdown(ctx, httpSrv, framed, stopWorkers, workers, stopCleaner, cleanerDone, closeDB)
+	fmt.Println(report)
+	if !closed {
+		// Skip the deferred close rather than close under a running request
+		// or worker.
+		os.Exit(1)
+	}
+}
+
+// checkUpstream waits up to timeout for upstream to answer a ping, before
+// any listener is opened. If it doesn't, mode "fail" closes the store and
+// exits, and "warn" logs that misses will fail and carries on.
+func checkUpstream(up *upstream.Client, mode string, timeout time.Duration, closeDB func() error) {
+	fmt.Printf("upstream startup check: pinging %s for up to %s\n", up.URL, timeout)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	h := up.WaitReachable(ctx)
+	if h.OK {
+		fmt.Printf("upstream startup check: %s reachable (status %d, %.1fms)\n", up.URL, h.Status, h.LatencyMs)
+		return
+	}
+	reason := h.Error
+	if reason == "" {
+		reason = fmt.Sprintf("status %d", h.Status)
+	}
+	if mode == "fail" {
+		fmt.Printf("upstream startup check: %s unreachable after %s (%s); refusing to start (UPSTREAM_STARTUP_CHECK=fail)\n", up.URL, timeout, reason)
+		closeDB()
+		os.Exit(1)
+	}
+	fmt.Printf("upstream startup check: %s unreachable after %s (%s); starting anyway, misses will fail until it is back (UPSTREAM_STARTUP_CHECK=warn)\n", up.URL, timeout, reason)
+}
+
+// shutdown drains HTTP requests and framed connections, stops the workers
+// and the cleaner and waits for them, then closes the store, all within ctx,
+// and returns a one-line key=value report of how it went. graceful=false
+// means requests were cut off or the store may have lost writes. closed is
+// false if the store was left open because a request, worker or the cleaner
+// was still running at the deadline.
+func shutdown(ctx context.Context, srv *http.Server, framed *transport.Framed, stopWorkers chan struct{}, workers []<-chan struct{}, stopCleaner chan struct{}, cleanerDone <-chan struct{}, closeDB func() error) (report string, closed bool) {
+	inFlight := transport.HTTPInFlight()
+	httpErr := srv.Shutdown(ctx)
+	var cut int64
+	if httpErr != nil {
+		cut = transport.HTTPInFlight()
+		_ = srv.Close()
+	}
+	framedCut, _ := framed.Shutdown(ctx)
+
+	// Workers stop only now, so a write still draining above could wait for
+	// its replicas.
+	close(stopWorkers)
+	workerState := "stopped"
+	for _, done := range workers {
+		select {
+		case <-done:
+			continue
+		case <-ctx.Done():
+		}
+		workerState = "timeout"
+		break
+	}
+
+	cleanerState := "disabled"
+	if cleanerDone != nil {
+		close(stopCleaner)
+		select {
+		case <-cleanerDone:
+			cleanerState = "stopped"
+		case <-ctx.Done():
+			cleanerState = "timeout"
+		}
+	}
+
+	dbState := "ok"
+	if framedCut > 0 || workerState == "timeout" || cleanerState == "timeout" {
+		// Closing RocksDB under a running request, worker or pass could
+		// crash it.
+		dbState = "skipped"
+	} else if err := closeDB(); err != nil {
+		dbState = strconv.Quote(err.Error())
+	}
+
+	graceful := httpErr == nil && framedCut == 0 && dbState == "ok"
+	report = fmt.Sprintf("shutdown complete graceful=%t http_drained=%d http_cut=%d http_deadline_hit=%t framed_conns_cut=%d workers=%s cleaner=%s db_close=%s",
+		graceful, max(inFlight-cut, 0), cut, errors.Is(httpErr, context.DeadlineExceeded), framedCut, workerState, cleanerState, dbState)
+	return report, dbState != "skipped"
 }
@@ -0,0 +1,130 @@
+// Command migrate copies a legacy Badger store into a RocksDB store.
+//
+//	migrate -badger ./badgerdb -rocksdb ./kvdb
+//
+// Entries that have already expired are skipped; the rest keep their
+// remaining lifetime as an absolute expiry. Run it against a stopped Badger
+// node and a RocksDB directory the server isn't using.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"time"
+
+	"github.com/UltraSive/rocksdb-configuration-distribution/internal/datastore"
+	"github.com/dgraph-io/badger/v4"
+)
+
+func main() {
+	badgerPath := flag.String("badger", "", "path of the Badger store to read")
+	rocksPath := flag.String("rocksdb", "", "path of the RocksDB store to write")
+	batch := flag.Int("batch", 10000, "entries read from Badger per import call")
+	flag.Parse()
+	if *badgerPath == "" || *rocksPath == "" || *batch < 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	src, err := badger.Open(badger.DefaultOptions(*badgerPath).WithReadOnly(true).WithLogger(nil))
+	if err != nil {
+		fmt.Println("open badger:", err)
+		os.Exit(1)
+	}
+	defer src.Close()
+	dst, err := datastore.NewRocksDB(*rocksPath, datastore.Options{})
+	if err != nil {
+		fmt.Println("open rocksdb:", err)
+		os.Exit(1)
+	}
+	defer dst.Close()
+
+	var imported, expired, skipped int
+	start := time.Now()
+	muts := make([]datastore.Mutation, 0, *batch)
+	flush := func() error {
+		if err := dst.BulkImport(muts); err != nil {
+			return err
+		}
+		imported += len(muts)
+		muts = muts[:0]
+		fmt.Printf("imported %d entries (%d expired, %d skipped) in %s\n", imported, expired, skipped, time.Since(start).Round(time.Second))
+		return nil
+	}
+
+	now := time.Now()
+	err = src.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			item := it.Item()
+			key := string(item.KeyCopy(nil))
+			if datastore.IsReserved(key) {
+				fmt.Println("skipping reserved key:", key)
+				skipped++
+				continue
+			}
+			val, err := item.ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			m, ok := toMutation(key, val, item.ExpiresAt(), now)
+			if !ok {
+				if m.Expiry != 0 {
+					expired++
+				} else {
+					fmt.Println("skipping non-JSON value for key:", key)
+					skipped++
+				}
+				continue
+			}
+			muts = append(muts, m)
+			if len(muts) == *batch {
+				if err := flush(); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err == nil {
+		err = flush()
+	}
+	if err != nil {
+		fmt.Println("migration error:", err)
+		os.Exit(1)
+	}
+	fmt.Println("migration complete")
+}
+
+// toMutation converts one Badger entry. The legacy store wrapped values in
+// the same {"expiry","value"} shape as datastore.DBEntry; bare JSON values
+// are imported as they are. The earlier of the wrapper's expiry and Badger's
+// own TTL (unix seconds, 0 = none) wins. ok is false for expired entries
+// (Expiry set) and values that aren't JSON (Expiry 0).
+func toMutation(key string, val []byte, badgerExpiry uint64, now time.Time) (datastore.Mutation, bool) {
+	if !json.Valid(val) {
+		return datastore.Mutation{}, false
+	}
+	m := datastore.Mutation{Key: key, Value: val, Expiry: math.MaxInt64}
+	var wrapper map[string]json.RawMessage
+	if json.Unmarshal(val, &wrapper) == nil && len(wrapper) == 2 && wrapper["value"] != nil && wrapper["expiry"] != nil {
+		var e datastore.DBEntry
+		if json.Unmarshal(val, &e) == nil {
+			m.Value = e.Value
+			if e.Expiry > 0 {
+				m.Expiry = e.Expiry
+			}
+		}
+	}
+	if badgerExpiry > 0 {
+		m.Expiry = min(m.Expiry, time.Unix(int64(badgerExpiry), 0).UnixNano())
+	}
+	if m.Expiry != math.MaxInt64 && m.Expiry <= now.UnixNano() {
+		return m, false
+	}
+	return m, true
+}
@@ -3,6 +3,22 @@ module github.com/UltraSive/rocksdb-configuration-distribution
 go 1.24.3
 
 require (
+	github.com/dgraph-io/badger/v4 v4.5.1
 	github.com/go-chi/chi/v5 v5.2.3
+	github.com/klauspost/compress v1.17.11
 	github.com/linxGnu/grocksdb v1.10.2
+	golang.org/x/sync v0.16.0
+)
+
+require (
+	github.com/cespare/xxhash/v2 v2.3.0 // indirect
+	github.com/dgraph-io/ristretto/v2 v2.1.0 // indirect
+	github.com/dustin/go-humanize v1.0.1 // indirect
+	github.com/golang/groupcache v0.0.0-20200121045136-8c9f03a8e57e // indirect
+	github.com/google/flatbuffers v24.12.23+incompatible // indirect
+	github.com/pkg/errors v0.9.1 // indirect
+	go.opencensus.io v0.24.0 // indirect
+	golang.org/x/net v0.34.0 // indirect
+	golang.org/x/sys v0.29.0 // indirect
+	google.golang.org/protobuf v1.36.3 // indirect
 )
@@ -0,0 +1,205 @@
+package admin
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/UltraSive/rocksdb-configuration-distribution/internal/audit"
+	"github.com/UltraSive/rocksdb-configuration-distribution/internal/auth"
+	"github.com/UltraSive/rocksdb-configuration-distribution/internal/datastore"
+	"github.com/UltraSive/rocksdb-configuration-distribution/internal/handler"
+	"github.com/UltraSive/rocksdb-configuration-distribution/internal/hotkeys"
+	"github.com/UltraSive/rocksdb-configuration-distribution/internal/ops"
+	"github.com/UltraSive/rocksdb-configuration-distribution/internal/upstream"
+	"github.com/go-chi/chi/v5"
+)
+
+// Admin serves operator-only diagnostics. Mount it behind auth.
+type Admin struct {
+	DB       datastore.Datastore
+	HotKeys  *hotkeys.Tracker // nil disables /hotkeys
+	Ops      *ops.Registry    // nil disables /ops
+	Upstream *upstream.Client // nil: this node is authoritative
+	Audit    *audit.Log       // nil disables /audit
+
+	// Unauthenticated is set when no token guards the routes, and makes
+	// flushall refuse to run.
+	Unauthenticated bool
+}
+
+func New(db datastore.Datastore) *Admin {
+	return &Admin{DB: db}
+}
+
+// Routes returns the admin routes, relative to wherever they are mounted.
+func (a *Admin) Routes() chi.Router {
+	r := chi.NewRouter()
+	r.Get("/rocksdb", a.rocksdb)
+	r.Get("/hotkeys", a.hotKeys)
+	r.Post("/flushall", a.flushAll)
+	r.Get("/ops", a.listOps)
+	r.Post("/ops/{id}/cancel", a.cancelOp)
+	r.Get("/upstream/ping", a.pingUpstream)
+	r.Get("/audit", a.readAudit)
+	return r
+}
+
+func (a *Admin) rocksdb(w http.ResponseWriter, r *http.Request) {
+	props, err := a.DB.Properties()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, handler.CodeInternal, err.Error())
+		return
+	}
+	writeJSON(w, props)
+}
+
+// flushAllConfirm must be sent as {"confirm": ...} for flushall to run.
+const flushAllConfirm = "DELETE ALL KEYS"
+
+// flushAll irreversibly deletes every key in the store.
+func (a *Admin) flushAll(w http.ResponseWriter, r *http.Request) {
+	if a.Unauthenticated {
+		writeError(w, http.StatusForbidden, handler.CodeUnauthorized, "flushall needs AUTHORIZATION to be set")
+		return
+	}
+	var body struct {
+		Confirm string `json:"confirm"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Confirm != flushAllConfirm {
+		writeError(w, http.StatusBadRequest, handler.CodeInvalidRequest, `body must be {"confirm": "`+flushAllConfirm+`"}`)
+		return
+	}
+	err := a.DB.Clear()
+	e := audit.Entry{Type: "FLUSHALL", Result: "OK"}
+	e.Identity, _ = auth.Identity(r.Context())
+	if p, ok := auth.PeerOf(r.Context()); ok {
+		e.Transport, e.Remote = p.Transport, p.Addr
+	}
+	if err != nil {
+		e.Result = "ERR"
+	}
+	if aerr := a.Audit.Record(e); aerr != nil {
+		fmt.Println("audit log error:", aerr)
+	}
+	if err != nil {
+		if errors.Is(err, datastore.ErrReadOnly) {
+			writeError(w, http.StatusForbidden, handler.CodeReadOnly, err.Error())
+			return
+		}
+		writeError(w, http.StatusInternalServerError, handler.CodeInternal, err.Error())
+		return
+	}
+	writeJSON(w, map[string]string{"status": "flushed"})
+}
+
+// hotKeys lists the most requested keys, ?n= of them (default 20).
+func (a *Admin) hotKeys(w http.ResponseWriter, r *http.Request) {
+	if a.HotKeys == nil {
+		writeError(w, http.StatusNotFound, handler.CodeNotFound, "hot key tracking is disabled")
+		return
+	}
+	n := 20
+	if v := r.URL.Query().Get("n"); v != "" {
+		var err error
+		if n, err = strconv.Atoi(v); err != nil || n < 1 {
+			writeError(w, http.StatusBadRequest, handler.CodeInvalidRequest, "n must be a positive integer")
+			return
+		}
+	}
+	writeJSON(w, a.HotKeys.Top(n))
+}
+
+// listOps lists the scans currently running.
+func (a *Admin) listOps(w http.ResponseWriter, r *http.Request) {
+	if a.Ops == nil {
+		writeError(w, http.StatusNotFound, handler.CodeNotFound, "operation tracking is disabled")
+		return
+	}
+	writeJSON(w, a.Ops.List())
+}
+
+// cancelOp cancels a running scan. It stops at its next key, releasing its
+// iterator, and its client gets CANCELED.
+func (a *Admin) cancelOp(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, handler.CodeInvalidRequest, "id must be an operation id")
+		return
+	}
+	if !a.Ops.Cancel(id) {
+		writeError(w, http.StatusNotFound, handler.CodeNotFound, "no such operation")
+		return
+	}
+	writeJSON(w, map[string]string{"status": "canceled"})
+}
+
+// pingUpstream checks that upstream answers, reporting status and latency.
+// It responds 502 when upstream is unreachable or failing.
+func (a *Admin) pingUpstream(w http.ResponseWriter, r *http.Request) {
+	if a.Upstream == nil {
+		writeJSON(w, map[string]string{"status": "authoritative, no upstream"})
+		return
+	}
+	h := a.Upstream.Ping(r.Context())
+	if !h.OK {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadGateway)
+		_ = json.NewEncoder(w).Encode(h)
+		return
+	}
+	writeJSON(w, h)
+}
+
+// readAudit returns audit entries, oldest first, filtered by ?since= and
+// ?until= (RFC 3339) and ?prefix=, keeping the most recent ?limit= (default
+// 100).
+func (a *Admin) readAudit(w http.ResponseWriter, r *http.Request) {
+	if a.Audit == nil {
+		writeError(w, http.StatusNotFound, handler.CodeNotFound, "audit logging is disabled")
+		return
+	}
+	qs := r.URL.Query()
+	q := audit.Query{Prefix: qs.Get("prefix"), Limit: 100}
+	for _, p := range []struct {
+		name string
+		dst  *time.Time
+	}{{"since", &q.Since}, {"until", &q.Until}} {
+		if v := qs.Get(p.name); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, handler.CodeInvalidRequest, p.name+" must be an RFC 3339 time")
+				return
+			}
+			*p.dst = t
+		}
+	}
+	if v := qs.Get("limit"); v != "" {
+		var err error
+		if q.Limit, err = strconv.Atoi(v); err != nil || q.Limit < 1 {
+			writeError(w, http.StatusBadRequest, handler.CodeInvalidRequest, "limit must be a positive integer")
+			return
+		}
+	}
+	entries, err := a.Audit.Read(q)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, handler.CodeInternal, err.Error())
+		return
+	}
+	writeJSON(w, entries)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// writeError answers with the error envelope the rest of the HTTP API uses.
+func writeError(w http.ResponseWriter, status int, code, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(handler.Response{Type: "ERR", Code: code, Error: msg, Data: map[string]interface{}{}})
+}
@@ -0,0 +1,18 @@
+package admin
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestFlushAllRefusedWithoutToken(t *testing.T) {
+	a := &Admin{Unauthenticated: true}
+	req := httptest.NewRequest(http.MethodPost, "/flushall", strings.NewReader(`{"confirm": "`+flushAllConfirm+`"}`))
+	rec := httptest.NewRecorder()
+	a.Routes().ServeHTTP(rec, req)
+	if rec.Code != http.StatusForbidden {
+		t.Fatalf("status = %d, want 403", rec.Code)
+	}
+}
@@ -0,0 +1,139 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Entry records one mutating operation.
+type Entry struct {
+	Time     time.Time `json:"time"`
+	Identity string    `json:"identity,omitempty"` // empty for unauthenticated requests
+	// Transport ("http" or "framed") and Remote address the request came
+	// in on; Remote is empty for a unix socket.
+	Transport string   `json:"transport,omitempty"`
+	Remote    string   `json:"remote,omitempty"`
+	Type      string   `json:"type"`
+	Keys      []string `json:"keys,omitempty"`
+	Prefix    string   `json:"prefix,omitempty"`
+	Result    string   `json:"result"` // OK, or the error code returned
+}
+
+// Log appends entries to a file, one JSON object per line. Unlike the change
+// log it records who asked for a write and what they asked for, whether or
+// not it succeeded, and it is never trimmed; rotate the file externally. A
+// nil *Log records nothing.
+type Log struct {
+	path string
+
+	mu sync.Mutex
+	f  *os.File
+}
+
+// Open appends to the audit file at path, creating it if needed.
+func Open(path string) (*Log, error) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	return &Log{path: path, f: f}, nil
+}
+
+// Record appends e, stamping its time if unset. The entry is written before
+// Record returns but not synced.
+func (l *Log) Record(e Entry) error {
+	if l == nil {
+		return nil
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now().UTC()
+	}
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, err = l.f.Write(append(b, '\n'))
+	return err
+}
+
+// Query selects entries for Read. Zero fields don't filter.
+type Query struct {
+	Since, Until time.Time
+	// Prefix matches entries touching a key, or naming a prefix, under it.
+	Prefix string
+	// Limit keeps only the most recent matches.
+	Limit int
+}
+
+func (q Query) match(e Entry) bool {
+	if !q.Since.IsZero() && e.Time.Before(q.Since) {
+		return false
+	}
+	if !q.Until.IsZero() && !e.Time.Before(q.Until) {
+		return false
+	}
+	if q.Prefix == "" {
+		return true
+	}
+	if e.Prefix != "" && (strings.HasPrefix(e.Prefix, q.Prefix) || strings.HasPrefix(q.Prefix, e.Prefix)) {
+		return true
+	}
+	for _, k := range e.Keys {
+		if strings.HasPrefix(k, q.Prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Read scans the audit file and returns the matching entries, oldest first.
+// Lines that don't parse, such as one torn by a crash, are skipped.
+func (l *Log) Read(q Query) ([]Entry, error) {
+	f, err := os.Open(l.path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var out []Entry
+	br := bufio.NewReader(f)
+	for {
+		line, err := br.ReadBytes('\n')
+		if len(line) > 0 {
+			var e Entry
+			if json.Unmarshal(line, &e) == nil && q.match(e) {
+				out = append(out, e)
+				if q.Limit > 0 && len(out) > 2*q.Limit {
+					out = append(out[:0], out[len(out)-q.Limit:]...)
+				}
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if q.Limit > 0 && len(out) > q.Limit {
+		out = out[len(out)-q.Limit:]
+	}
+	return out, nil
+}
+
+// Close closes the audit file.
+func (l *Log) Close() error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.f.Close()
+}
@@ -0,0 +1,74 @@
+package auth
+
+import (
+	"context"
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+type (
+	identityKey struct{}
+	peerKey     struct{}
+)
+
+const (
+	// Anonymous is the identity granted to everyone when no token is
+	// configured.
+	Anonymous = "anonymous"
+	// Token is the identity of a caller that presented the configured
+	// token.
+	Token = "token"
+)
+
+// Peer is where a request came from: its transport ("http" or "framed")
+// and the remote address, empty for a unix socket.
+type Peer struct {
+	Transport string
+	Addr      string
+}
+
+// Granted returns the identity for a caller that passed Check against
+// configured.
+func Granted(configured string) string {
+	if configured == "" {
+		return Anonymous
+	}
+	return Token
+}
+
+// Check reports whether presented matches the configured token. An empty
+// configured token disables authentication.
+func Check(configured, presented string) bool {
+	if configured == "" {
+		return true
+	}
+	return subtle.ConstantTimeCompare([]byte(presented), []byte(configured)) == 1
+}
+
+// BearerToken extracts the token from an `Authorization: Bearer` header.
+func BearerToken(r *http.Request) string {
+	return strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+}
+
+// WithIdentity marks ctx as authenticated.
+func WithIdentity(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, identityKey{}, id)
+}
+
+// Identity returns who ctx was authenticated as, if anyone.
+func Identity(ctx context.Context) (string, bool) {
+	id, ok := ctx.Value(identityKey{}).(string)
+	return id, ok
+}
+
+// WithPeer records where the request on ctx came from.
+func WithPeer(ctx context.Context, p Peer) context.Context {
+	return context.WithValue(ctx, peerKey{}, p)
+}
+
+// PeerOf returns where the request on ctx came from, if recorded.
+func PeerOf(ctx context.Context) (Peer, bool) {
+	p, ok := ctx.Value(peerKey{}).(Peer)
+	return p, ok
+}
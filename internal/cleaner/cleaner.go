@@ -1,37 +1,164 @@
 package cleaner
 
 import (
+	"fmt"
+	"sync"
 	"time"
 
 	"github.com/UltraSive/rocksdb-configuration-distribution/internal/datastore"
+	"github.com/UltraSive/rocksdb-configuration-distribution/internal/metrics"
 )
 
-func Start(ds datastore.Datastore, interval time.Duration, chunkSize int, stop <-chan struct{}) {
-	t := time.NewTicker(interval)
+var (
+	runLatency = metrics.NewHistogram("kvstore_cleaner_run_seconds", "Time taken by each expired-key cleaner pass.", metrics.LatencyBuckets)
+	deleted    = metrics.NewCounter("kvstore_cleaner_deleted_total", "Expired keys deleted by the cleaner.")
+	failures   = metrics.NewCounter("kvstore_cleaner_errors_total", "Cleaner chunks that failed to scan or delete.")
+)
+
+// Options configures the cleaner.
+type Options struct {
+	Interval  time.Duration // time between passes
+	ChunkSize int           // keys examined per chunk
+	// Retries is how many times a failed chunk is retried within a pass,
+	// Backoff apart (doubling each time), before the pass gives up. The next
+	// pass resumes from that chunk rather than from the start.
+	Retries int
+	Backoff time.Duration
+}
+
+// Status reports the cleaner's progress, for STATS.
+type Status struct {
+	// ConsecutiveFailures counts failed chunks since the last one that
+	// succeeded; a number that keeps growing means the cleaner is stuck.
+	ConsecutiveFailures int    `json:"consecutiveFailures"`
+	LastError           string `json:"lastError,omitempty"`
+	// Cursor is where the running or next pass resumes; "" is the start.
+	Cursor string `json:"cursor"`
+}
+
+var state struct {
+	sync.Mutex
+	started bool
+	Status
+}
+
+// CurrentStatus returns the cleaner's status, or false if it isn't running
+// in this process.
+func CurrentStatus() (Status, bool) {
+	state.Lock()
+	defer state.Unlock()
+	return state.Status, state.started
+}
+
+// Start reaps expired keys every opts.Interval until stop is closed. The
+// returned channel is closed once the loop has exited, after finishing any
+// pass that was running, so the store can then be closed safely.
+func Start(ds datastore.Datastore, opts Options, stop <-chan struct{}) <-chan struct{} {
+	state.Lock()
+	state.started = true
+	state.Unlock()
+	t := time.NewTicker(opts.Interval)
+	done := make(chan struct{})
 	go func() {
+		defer close(done)
 		defer t.Stop()
+		cursor := ""
 		for {
 			select {
 			case <-t.C:
-				// simple implementation: call List to get keys and delete expired entries,
-				// or add a dedicated API to datastore for scanning+deleting.
-				_ = runOnce(ds, chunkSize)
+				start := time.Now()
+				cursor = runOnce(ds, opts, cursor, stop)
+				runLatency.Since(start)
+				if lt, ok := ds.(datastore.LogTrimmer); ok {
+					if _, err := lt.TrimLog(); err != nil {
+						fmt.Println("change log trim error:", err)
+					}
+				}
 			case <-stop:
 				return
 			}
 		}
 	}()
+	return done
+}
+
+// runOnce walks the keyspace from cursor opts.ChunkSize keys at a time and
+// deletes expired entries. Most expired data is already dropped by the
+// RocksDB compaction filter as SSTs are rewritten; this pass catches what
+// compaction hasn't reached yet (memtables, cold levels) and records the
+// deletes in the change log so followers and CHANGES pollers see them. A
+// chunk that fails is retried with backoff; if it keeps failing the pass
+// ends and runOnce returns that chunk's cursor to resume from. It stops
+// between chunks once stop is closed, and otherwise returns "" after
+// reaching the end of the keyspace.
+func runOnce(ds datastore.Datastore, opts Options, cursor string, stop <-chan struct{}) string {
+	backoff := opts.Backoff
+	attempt := 0
+	for {
+		setCursor(cursor)
+		select {
+		case <-stop:
+			return cursor
+		default:
+		}
+		next, err := chunk(ds, cursor, opts.ChunkSize)
+		if err == nil {
+			recordSuccess()
+			if next == "" {
+				setCursor("")
+				return ""
+			}
+			cursor, attempt, backoff = next, 0, opts.Backoff
+			continue
+		}
+		recordFailure(err)
+		fmt.Printf("cleaner error at %q (attempt %d): %v\n", cursor, attempt+1, err)
+		if attempt >= opts.Retries {
+			return cursor
+		}
+		attempt++
+		select {
+		case <-stop:
+			return cursor
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
 }
 
-// runOnce inspects the db and deletes expired entries in batches.
-// To avoid exposing rocks internals here, you may add a Datastore.ScanExpired API for efficiency.
-func runOnce(ds datastore.Datastore, chunkSize int) error {
-	// naive: list and remove expired entries (fine for small/medium DBs).
-	// For very large DBs implement ScanExpired in the datastore impl.
-	all, err := ds.List()
+// chunk deletes the expired keys among the next limit keys from cursor and
+// returns where the following chunk starts.
+func chunk(ds datastore.Datastore, cursor string, limit int) (string, error) {
+	expired, next, err := ds.ScanExpired(cursor, limit)
 	if err != nil {
-		return err
+		return "", err
+	}
+	if len(expired) > 0 {
+		n, err := ds.DeleteExpired(expired)
+		deleted.Add(int64(n))
+		if err != nil {
+			return "", err
+		}
 	}
-	_ = all // loop and remove expired using ds.Delete for entries that are expired
-	return nil
+	return next, nil
+}
+
+func setCursor(cursor string) {
+	state.Lock()
+	state.Cursor = cursor
+	state.Unlock()
+}
+
+func recordSuccess() {
+	state.Lock()
+	state.ConsecutiveFailures = 0
+	state.Unlock()
+}
+
+func recordFailure(err error) {
+	failures.Inc()
+	state.Lock()
+	state.ConsecutiveFailures++
+	state.LastError = err.Error()
+	state.Unlock()
 }
@@ -0,0 +1,592 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/UltraSive/rocksdb-configuration-distribution/internal/quota"
+	"github.com/UltraSive/rocksdb-configuration-distribution/internal/replication"
+)
+
+// Config holds the server's runtime settings. Values come from defaults, then
+// the JSON file named by CONFIG_FILE (if any), then environment variables.
+type Config struct {
+	SocketPath       string    `json:"socket"`
+	UnixIdleTimeout  Duration  `json:"unixIdleTimeout"` // close socket connections idle this long; 0 = never
+	HTTPAddr         string    `json:"httpAddr"`
+	TCPAddr          string    `json:"tcpAddr"` // framed protocol over TCP; empty = off
+	MuxTCP           bool      `json:"muxTCP"`  // also serve the framed protocol on the HTTP port
+	DBPath           string    `json:"dbPath"`
+	Shards           int       `json:"shards"` // RocksDB instances under DBPath; fixed once created
+	UpstreamURL      string    `json:"upstreamURL"`
+	UpstreamMode     string    `json:"upstreamMode"`  // "envelope" (POST the request envelope) or "rest" (GET /kv/{key})
+	UpstreamLimit    int       `json:"upstreamLimit"` // concurrent upstream fetches; 0 = unlimited
+	UpstreamQueue    int       `json:"upstreamQueue"` // fetches that may wait for a slot before failing fast
+	ReplicateFrom    string    `json:"replicateFrom"` // leader's /replicate URL; empty = not a follower
+	Authorization    string    `json:"authorization"` // bearer token for admin routes; empty = no /admin unless AdminOpen
+	AdminOpen        bool      `json:"adminOpen"`     // serve /admin without AUTHORIZATION, open to anyone
+	TTL              Duration  `json:"ttl"`           // default TTL (0 = infinite)
+	CacheTTL         *Duration `json:"cacheTTL"`      // TTL of values fetched from upstream; nil = TTL
+	JanitorInterval  Duration  `json:"janitorInterval"`
+	MaxResponseBytes int       `json:"maxResponseBytes"` // 0 = unlimited
+	MaxFrameBytes    int       `json:"maxFrameBytes"`    // largest framed-protocol request; 0 = unlimited
+	FramedWorkers    int       `json:"framedWorkers"`    // framed requests served at once; 0 = a goroutine per connection
+	FramedQueue      int       `json:"framedQueue"`      // framed requests that may wait for a worker before being shed
+	MaxBatchBytes    int       `json:"maxBatchBytes"`    // largest single UPDATE write batch; 0 = unlimited
+	WarmMaxBytes     int       `json:"warmMaxBytes"`     // most one WARM request loads from upstream; 0 = unlimited
+	MaxPutBytes      int       `json:"maxPutBytes"`      // largest PUT /kv/ value; 0 = unlimited
+	MaxKeyBytes      int       `json:"maxKeyBytes"`      // 0 = unlimited
+	KeyPattern       string    `json:"keyPattern"`       // regexp every key must match; empty = any
+	ReadOnly         bool      `json:"readOnly"`         // open the DB read-only; forces LazyDelete off
+	LazyDelete       bool      `json:"lazyDelete"`       // delete expired keys inline on read
+	ExpiryGrace      Duration  `json:"expiryGrace"`      // keep expired keys on disk this long before deleting them
+	TrackCreated     bool      `json:"trackCreated"`     // record when each key was first written
+	AuditLog         string    `json:"auditLog"`         // file recording mutating requests; empty = off
+	IdempotencyTTL   Duration  `json:"idempotencyTTL"`   // how long idempotency keys are remembered; 0 = disabled
+
+	// WriteBufferInterval, if set, buffers writes and commits them in one
+	// batch that often, or once WriteBufferMaxBytes are pending. Buffered
+	// writes are acknowledged before they are durable.
+	WriteBufferInterval Duration `json:"writeBufferInterval"`
+	WriteBufferMaxBytes int      `json:"writeBufferMaxBytes"`
+
+	// Where envelope-mode upstream GET responses keep their answer, for
+	// upstreams that don't reply exactly like this store (see
+	// upstream.Mapping).
+	UpstreamStatusField string `json:"upstreamStatusField"`
+	UpstreamStatusOK    string `json:"upstreamStatusOK"`
+	UpstreamValuePath   string `json:"upstreamValuePath"`
+
+	// CanonicalJSON is "off", "rewrite" (re-encode written values with
+	// sorted keys and no insignificant whitespace) or "reject" (refuse
+	// values that aren't already in that form).
+	CanonicalJSON string `json:"canonicalJSON"`
+
+	// ExpiryField names a top-level field of written object values whose
+	// timestamp (RFC 3339 or unix seconds) sets the entry's expiry instead
+	// of a TTL. Empty disables it.
+	ExpiryField string `json:"expiryField"`
+
+	// Replicas are request endpoints every write is pushed to. ReplicaAcks
+	// is how many must acknowledge a write request before it returns: "none",
+	// "quorum", "all" or a number. ReplicaTimeout bounds that wait and each
+	// push; ReplicaToken is sent to replicas as a bearer token.
+	Replicas       []string `json:"replicas"`
+	ReplicaAcks    string   `json:"replicaAcks"`
+	ReplicaTimeout Duration `json:"replicaTimeout"`
+	ReplicaToken   string   `json:"replicaToken"`
+
+	// UpstreamCheck is "off", "warn" or "fail": whether startup pings
+	// upstream, for up to UpstreamCheckTimeout, and what it does if
+	// upstream stays unreachable, log and carry on or exit.
+	UpstreamCheck        string   `json:"upstreamCheck"`
+	UpstreamCheckTimeout Duration `json:"upstreamCheckTimeout"`
+
+	// ForwardUnknown forwards requests of types this node doesn't implement
+	// to the envelope-mode upstream and relays its response.
+	ForwardUnknown bool `json:"forwardUnknown"`
+
+	// WriteThrough sends client writes on to the envelope-mode upstream
+	// through a queue in the store of at most WriteThroughMaxQueue entries
+	// (0 = unlimited). Entries upstream won't take are retried until they
+	// are WriteThroughMaxAge old, then dropped.
+	WriteThrough         bool     `json:"writeThrough"`
+	WriteThroughMaxQueue int      `json:"writeThroughMaxQueue"`
+	WriteThroughMaxAge   Duration `json:"writeThroughMaxAge"`
+
+	// ReadCacheBytes, if set, keeps about that many bytes of recently read
+	// entries in memory in front of RocksDB.
+	ReadCacheBytes int `json:"readCacheBytes"`
+
+	// BlockCacheBytes sizes RocksDB's block cache, split between shards
+	// (0 = RocksDB's default of 32 MiB).
+	BlockCacheBytes int `json:"blockCacheBytes"`
+
+	// RocksDBPreset ("read-optimized" or "write-optimized"; empty = RocksDB's
+	// defaults) tunes compaction for the node's role. The fields after it
+	// override single knobs of the preset; 0 or empty keeps the preset's.
+	RocksDBPreset       string `json:"rocksdbPreset"`
+	CompactionStyle     string `json:"compactionStyle"` // "level" or "universal"
+	L0CompactionTrigger int    `json:"l0CompactionTrigger"`
+	L0SlowdownTrigger   int    `json:"l0SlowdownTrigger"`
+	L0StopTrigger       int    `json:"l0StopTrigger"`
+	TargetFileBytes     uint64 `json:"targetFileBytes"`
+	MaxBackgroundJobs   int    `json:"maxBackgroundJobs"`
+	MemtableBytes       uint64 `json:"memtableBytes"`
+	MaxMemtables        int    `json:"maxMemtables"`
+
+	// ValueCompression ("none", "zstd" or "gzip") compresses stored values of
+	// at least CompressMinBytes.
+	ValueCompression string `json:"valueCompression"`
+	CompressMinBytes int    `json:"compressMinBytes"`
+
+	// ClusterNodes lists every instance's address for the consistent-hash
+	// ring served on /cluster/ring; ClusterSelf is this instance's entry.
+	// ClusterEnforce refuses keys the ring assigns to another instance.
+	ClusterNodes   []string `json:"clusterNodes"`
+	ClusterSelf    string   `json:"clusterSelf"`
+	ClusterVNodes  int      `json:"clusterVNodes"`
+	ClusterEnforce bool     `json:"clusterEnforce"`
+
+	// HTTP server limits. Streaming routes (/scan, /replicate) are exempt
+	// from HTTPWriteTimeout.
+	HTTPReadTimeout       Duration `json:"httpReadTimeout"`
+	HTTPReadHeaderTimeout Duration `json:"httpReadHeaderTimeout"`
+	HTTPWriteTimeout      Duration `json:"httpWriteTimeout"`
+	HTTPIdleTimeout       Duration `json:"httpIdleTimeout"`
+	HTTPMaxHeaderBytes    int      `json:"httpMaxHeaderBytes"`
+
+	// MaxPendingCompactionBytes sheds writes once compaction debt reaches it;
+	// 0 only sheds when RocksDB itself delays or stops writes.
+	MaxPendingCompactionBytes uint64 `json:"maxPendingCompactionBytes"`
+
+	// ReadyMaxCompactionBytes fails /readyz once compaction debt reaches it;
+	// 0 leaves readiness alone.
+	ReadyMaxCompactionBytes uint64 `json:"readyMaxCompactionBytes"`
+
+	// Durable change log retention for followers and CHANGES; 0 keeps the
+	// default count and no age limit.
+	ChangeLogRetention    int      `json:"changeLogRetention"`
+	ChangeLogRetentionAge Duration `json:"changeLogRetentionAge"`
+
+	// Anti-entropy against upstream; ReconcileInterval 0 disables it.
+	ReconcileInterval   Duration `json:"reconcileInterval"`
+	ReconcileBatchSize  int      `json:"reconcileBatchSize"`
+	ReconcileSampleRate float64  `json:"reconcileSampleRate"`
+
+	// A cleaner chunk that fails is retried this many times, backing off
+	// from CleanerRetryBackoff, before the pass gives up until the next one.
+	CleanerRetries      int      `json:"cleanerRetries"`
+	CleanerRetryBackoff Duration `json:"cleanerRetryBackoff"`
+
+	// Hot key sampling for /admin/hotkeys; HotKeySampleRate 0 disables it.
+	HotKeySampleRate float64  `json:"hotKeySampleRate"`
+	HotKeyWindow     Duration `json:"hotKeyWindow"`
+	HotKeyCapacity   int      `json:"hotKeyCapacity"`
+
+	// HTTP access logging: failed and slow requests are always logged, the
+	// rest sampled, with AccessLogExclude paths (probes, metrics) skipped.
+	AccessLogSampleRate float64  `json:"accessLogSampleRate"`
+	AccessLogExclude    []string `json:"accessLogExclude"`
+	AccessLogSlow       Duration `json:"accessLogSlow"`
+
+	// Push metrics to StatsD over UDP; StatsDAddr "" disables it.
+	StatsDAddr     string   `json:"statsdAddr"`
+	StatsDPrefix   string   `json:"statsdPrefix"`
+	StatsDInterval Duration `json:"statsdInterval"`
+
+	// PrefixTTLs overrides TTL for keys under a prefix; the longest matching
+	// prefix wins.
+	PrefixTTLs map[string]Duration `json:"prefixTTLs"`
+	// Quotas caps keys and/or bytes under a prefix (config file only); the
+	// longest matching prefix applies. Usage estimates are refreshed every
+	// QuotaRefreshInterval.
+	Quotas               map[string]quota.Limit `json:"quotas"`
+	QuotaRefreshInterval Duration               `json:"quotaRefreshInterval"`
+	// SlidingTTLPrefixes renews a key's TTL on every GET that finds it, for
+	// keys under any of these prefixes.
+	SlidingTTLPrefixes []string `json:"slidingTTLPrefixes"`
+	// PinnedPrefixes makes keys under any of these prefixes never expire,
+	// overriding every TTL.
+	PinnedPrefixes []string `json:"pinnedPrefixes"`
+
+	// Variables a GET with resolve substitutes into values: TemplateVars
+	// as given, plus the environment variables named in TemplateEnv, read
+	// at startup. TemplateMissing is "keep" to leave undefined placeholders
+	// as they are or "error" to fail the GET.
+	TemplateVars    map[string]string `json:"templateVars"`
+	TemplateEnv     []string          `json:"templateEnv"`
+	TemplateMissing string            `json:"templateMissing"`
+}
+
+// Duration is a time.Duration written as a Go duration string ("30s") in the
+// config file.
+type Duration struct {
+	time.Duration
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	d.Duration = v
+	return nil
+}
+
+// Load builds the config from defaults, the optional file and the environment.
+func Load() (Config, error) {
+	c := Config{
+		SocketPath:            "/tmp/kvstore.sock",
+		UnixIdleTimeout:       Duration{5 * time.Minute},
+		HTTPAddr:              ":8080",
+		DBPath:                "./kvdb",
+		Shards:                1,
+		UpstreamMode:          "envelope",
+		UpstreamLimit:         64,
+		UpstreamQueue:         256,
+		UpstreamStatusField:   "type",
+		UpstreamStatusOK:      "OK",
+		UpstreamValuePath:     "data.{key}",
+		TemplateMissing:       "keep",
+		UpstreamCheck:         "off",
+		UpstreamCheckTimeout:  Duration{30 * time.Second},
+		WriteThroughMaxQueue:  100000,
+		WriteThroughMaxAge:    Duration{24 * time.Hour},
+		ReplicaAcks:           "none",
+		CanonicalJSON:         "off",
+		ReplicaTimeout:        Duration{5 * time.Second},
+		TTL:                   Duration{30 * time.Second},
+		JanitorInterval:       Duration{60 * time.Second},
+		CleanerRetries:        3,
+		CleanerRetryBackoff:   Duration{time.Second},
+		MaxResponseBytes:      32 << 20,
+		MaxFrameBytes:         32 << 20,
+		FramedQueue:           1024,
+		MaxBatchBytes:         16 << 20,
+		WarmMaxBytes:          64 << 20,
+		MaxPutBytes:           16 << 20,
+		IdempotencyTTL:        Duration{time.Hour},
+		MaxKeyBytes:           1024,
+		LazyDelete:            true,
+		WriteBufferMaxBytes:   1 << 20,
+		ValueCompression:      "none",
+		CompressMinBytes:      4096,
+		HTTPReadTimeout:       Duration{15 * time.Second},
+		HTTPReadHeaderTimeout: Duration{5 * time.Second},
+		HTTPWriteTimeout:      Duration{15 * time.Second},
+		HTTPIdleTimeout:       Duration{60 * time.Second},
+		HTTPMaxHeaderBytes:    1 << 20,
+		ChangeLogRetention:    100000,
+		ReconcileBatchSize:    100,
+		ReconcileSampleRate:   1,
+		HotKeyWindow:          Duration{time.Minute},
+		HotKeyCapacity:        1000,
+		StatsDInterval:        Duration{10 * time.Second},
+		AccessLogSampleRate:   1,
+		AccessLogExclude:      []string{"/healthz", "/readyz", "/metrics"},
+		AccessLogSlow:         Duration{time.Second},
+		QuotaRefreshInterval:  Duration{time.Minute},
+	}
+	if path := os.Getenv("CONFIG_FILE"); path != "" {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return c, err
+		}
+		if err := json.Unmarshal(b, &c); err != nil {
+			return c, err
+		}
+	}
+
+	var env envReader
+	env.string(&c.SocketPath, "SOCKET")
+	env.duration(&c.UnixIdleTimeout, "UNIX_IDLE_TIMEOUT")
+	if v, ok := os.LookupEnv("PORT"); ok {
+		c.HTTPAddr = ":" + v
+	}
+	env.string(&c.TCPAddr, "TCP_ADDR")
+	env.bool(&c.MuxTCP, "MUX_TCP")
+	env.string(&c.DBPath, "DB_PATH")
+	env.int(&c.Shards, "SHARDS")
+	env.string(&c.UpstreamURL, "UPSTREAM_URL")
+	env.string(&c.UpstreamMode, "UPSTREAM_MODE")
+	env.int(&c.UpstreamLimit, "UPSTREAM_MAX_IN_FLIGHT")
+	env.int(&c.UpstreamQueue, "UPSTREAM_MAX_QUEUED")
+	env.string(&c.UpstreamStatusField, "UPSTREAM_STATUS_FIELD")
+	env.string(&c.UpstreamStatusOK, "UPSTREAM_STATUS_OK")
+	env.string(&c.UpstreamValuePath, "UPSTREAM_VALUE_PATH")
+	env.bool(&c.ForwardUnknown, "FORWARD_UNKNOWN_TYPES")
+	env.string(&c.UpstreamCheck, "UPSTREAM_STARTUP_CHECK")
+	env.duration(&c.UpstreamCheckTimeout, "UPSTREAM_STARTUP_TIMEOUT")
+	env.bool(&c.WriteThrough, "UPSTREAM_WRITE_THROUGH")
+	env.int(&c.WriteThroughMaxQueue, "WRITE_THROUGH_MAX_QUEUE")
+	env.duration(&c.WriteThroughMaxAge, "WRITE_THROUGH_MAX_AGE")
+	env.string(&c.ReplicateFrom, "REPLICATE_FROM")
+	env.string(&c.Authorization, "AUTHORIZATION")
+	env.bool(&c.AdminOpen, "ADMIN_OPEN")
+	env.duration(&c.TTL, "TTL")
+	if _, ok := env.lookup("CACHE_TTL"); ok {
+		c.CacheTTL = &Duration{}
+		env.duration(c.CacheTTL, "CACHE_TTL")
+	}
+	env.duration(&c.JanitorInterval, "JANITOR_INTERVAL")
+	env.int(&c.CleanerRetries, "CLEANER_RETRIES")
+	env.duration(&c.CleanerRetryBackoff, "CLEANER_RETRY_BACKOFF")
+	env.int(&c.MaxResponseBytes, "MAX_RESPONSE_BYTES")
+	env.int(&c.MaxFrameBytes, "MAX_FRAME_BYTES")
+	env.int(&c.FramedWorkers, "FRAMED_WORKERS")
+	env.int(&c.FramedQueue, "FRAMED_QUEUE")
+	env.int(&c.MaxBatchBytes, "MAX_BATCH_BYTES")
+	env.int(&c.WarmMaxBytes, "WARM_MAX_BYTES")
+	env.int(&c.MaxPutBytes, "MAX_PUT_BYTES")
+	env.int(&c.MaxKeyBytes, "MAX_KEY_BYTES")
+	env.string(&c.KeyPattern, "KEY_PATTERN")
+	env.duration(&c.IdempotencyTTL, "IDEMPOTENCY_TTL")
+	env.bool(&c.ReadOnly, "READ_ONLY")
+	env.bool(&c.LazyDelete, "LAZY_DELETE")
+	env.duration(&c.ExpiryGrace, "EXPIRY_GRACE")
+	env.bool(&c.TrackCreated, "TRACK_CREATED")
+	env.string(&c.AuditLog, "AUDIT_LOG")
+	env.uint(&c.MaxPendingCompactionBytes, "MAX_PENDING_COMPACTION_BYTES")
+	env.uint(&c.ReadyMaxCompactionBytes, "READY_MAX_PENDING_COMPACTION_BYTES")
+	env.duration(&c.WriteBufferInterval, "WRITE_BUFFER_INTERVAL")
+	env.int(&c.WriteBufferMaxBytes, "WRITE_BUFFER_MAX_BYTES")
+	env.int(&c.ReadCacheBytes, "READ_CACHE_BYTES")
+	env.int(&c.BlockCacheBytes, "BLOCK_CACHE_BYTES")
+	env.string(&c.RocksDBPreset, "ROCKSDB_PRESET")
+	env.string(&c.CompactionStyle, "ROCKSDB_COMPACTION_STYLE")
+	env.int(&c.L0CompactionTrigger, "ROCKSDB_L0_COMPACTION_TRIGGER")
+	env.int(&c.L0SlowdownTrigger, "ROCKSDB_L0_SLOWDOWN_TRIGGER")
+	env.int(&c.L0StopTrigger, "ROCKSDB_L0_STOP_TRIGGER")
+	env.uint(&c.TargetFileBytes, "ROCKSDB_TARGET_FILE_BYTES")
+	env.int(&c.MaxBackgroundJobs, "ROCKSDB_MAX_BACKGROUND_JOBS")
+	env.uint(&c.MemtableBytes, "ROCKSDB_MEMTABLE_BYTES")
+	env.int(&c.MaxMemtables, "ROCKSDB_MAX_MEMTABLES")
+	env.list(&c.ClusterNodes, "CLUSTER_NODES")
+	env.string(&c.ClusterSelf, "CLUSTER_SELF")
+	env.int(&c.ClusterVNodes, "CLUSTER_VNODES")
+	env.bool(&c.ClusterEnforce, "CLUSTER_ENFORCE_OWNERSHIP")
+	env.string(&c.ValueCompression, "VALUE_COMPRESSION")
+	env.int(&c.CompressMinBytes, "COMPRESS_MIN_BYTES")
+	env.duration(&c.HTTPReadTimeout, "HTTP_READ_TIMEOUT")
+	env.duration(&c.HTTPReadHeaderTimeout, "HTTP_READ_HEADER_TIMEOUT")
+	env.duration(&c.HTTPWriteTimeout, "HTTP_WRITE_TIMEOUT")
+	env.duration(&c.HTTPIdleTimeout, "HTTP_IDLE_TIMEOUT")
+	env.int(&c.HTTPMaxHeaderBytes, "HTTP_MAX_HEADER_BYTES")
+	env.int(&c.ChangeLogRetention, "CHANGELOG_RETENTION")
+	env.duration(&c.ChangeLogRetentionAge, "CHANGELOG_RETENTION_AGE")
+	env.duration(&c.ReconcileInterval, "RECONCILE_INTERVAL")
+	env.int(&c.ReconcileBatchSize, "RECONCILE_BATCH_SIZE")
+	env.float(&c.ReconcileSampleRate, "RECONCILE_SAMPLE_RATE")
+	env.float(&c.HotKeySampleRate, "HOTKEY_SAMPLE_RATE")
+	env.duration(&c.HotKeyWindow, "HOTKEY_WINDOW")
+	env.list(&c.SlidingTTLPrefixes, "SLIDING_TTL_PREFIXES")
+	env.list(&c.PinnedPrefixes, "PINNED_PREFIXES")
+	env.duration(&c.QuotaRefreshInterval, "QUOTA_REFRESH_INTERVAL")
+	env.int(&c.HotKeyCapacity, "HOTKEY_CAPACITY")
+	env.float(&c.AccessLogSampleRate, "ACCESS_LOG_SAMPLE_RATE")
+	env.list(&c.AccessLogExclude, "ACCESS_LOG_EXCLUDE")
+	env.duration(&c.AccessLogSlow, "ACCESS_LOG_SLOW")
+	env.string(&c.StatsDAddr, "STATSD_ADDR")
+	env.string(&c.StatsDPrefix, "STATSD_PREFIX")
+	env.duration(&c.StatsDInterval, "STATSD_INTERVAL")
+	env.string(&c.CanonicalJSON, "CANONICAL_JSON")
+	env.string(&c.ExpiryField, "EXPIRY_FIELD")
+	env.list(&c.Replicas, "REPLICAS")
+	env.string(&c.ReplicaAcks, "REPLICA_ACKS")
+	env.duration(&c.ReplicaTimeout, "REPLICA_TIMEOUT")
+	env.string(&c.ReplicaToken, "REPLICA_TOKEN")
+	env.list(&c.TemplateEnv, "TEMPLATE_ENV")
+	env.string(&c.TemplateMissing, "TEMPLATE_MISSING")
+	var vars []string
+	env.list(&vars, "TEMPLATE_VARS")
+	if err := errors.Join(env.errs...); err != nil {
+		return c, err
+	}
+	for _, kv := range vars {
+		name, value, ok := strings.Cut(kv, "=")
+		if !ok {
+			return c, fmt.Errorf("template var %q is not NAME=value", kv)
+		}
+		if c.TemplateVars == nil {
+			c.TemplateVars = make(map[string]string)
+		}
+		c.TemplateVars[name] = value
+	}
+
+	if c.UpstreamMode != "envelope" && c.UpstreamMode != "rest" {
+		return c, fmt.Errorf("unknown upstream mode %q (want envelope or rest)", c.UpstreamMode)
+	}
+	switch c.UpstreamCheck {
+	case "off", "warn", "fail":
+	default:
+		return c, fmt.Errorf("unknown upstream startup check %q (want off, warn or fail)", c.UpstreamCheck)
+	}
+	if c.WriteThrough {
+		if c.UpstreamURL == "" || c.UpstreamMode != "envelope" {
+			return c, fmt.Errorf("write-through needs an envelope-mode upstream")
+		}
+		if c.WriteThroughMaxQueue < 0 {
+			return c, fmt.Errorf("write-through max queue must not be negative, got %d", c.WriteThroughMaxQueue)
+		}
+		if c.WriteThroughMaxAge.Duration <= 0 {
+			return c, fmt.Errorf("write-through max age must be positive, got %s", c.WriteThroughMaxAge.Duration)
+		}
+	}
+	if c.CacheTTL == nil {
+		c.CacheTTL = &Duration{c.TTL.Duration}
+	}
+	if c.FramedQueue < 0 {
+		return c, fmt.Errorf("framed queue must not be negative, got %d", c.FramedQueue)
+	}
+	if c.CleanerRetries < 0 {
+		return c, fmt.Errorf("cleaner retries must not be negative, got %d", c.CleanerRetries)
+	}
+	if c.ExpiryGrace.Duration < 0 {
+		return c, fmt.Errorf("expiry grace must not be negative, got %s", c.ExpiryGrace.Duration)
+	}
+	if c.AccessLogSampleRate < 0 || c.AccessLogSampleRate > 1 {
+		return c, fmt.Errorf("access log sample rate must be between 0 and 1, got %g", c.AccessLogSampleRate)
+	}
+	if c.StatsDAddr != "" && c.StatsDInterval.Duration <= 0 {
+		return c, fmt.Errorf("statsd interval must be positive, got %s", c.StatsDInterval.Duration)
+	}
+	switch c.CanonicalJSON {
+	case "off", "rewrite", "reject":
+	default:
+		return c, fmt.Errorf("unknown canonical JSON mode %q (want off, rewrite or reject)", c.CanonicalJSON)
+	}
+	if len(c.Replicas) > 0 {
+		need, err := replication.Need(c.ReplicaAcks, len(c.Replicas))
+		if err != nil {
+			return c, err
+		}
+		if c.Shards > 1 {
+			return c, fmt.Errorf("replicas need the change log, which a sharded store doesn't have")
+		}
+		if need > 0 && c.WriteBufferInterval.Duration > 0 {
+			return c, fmt.Errorf("replica acks need writes in the change log when write requests return; disable the write buffer")
+		}
+		if c.ReplicaTimeout.Duration <= 0 {
+			return c, fmt.Errorf("replica timeout must be positive, got %s", c.ReplicaTimeout.Duration)
+		}
+	}
+	if c.TemplateMissing != "keep" && c.TemplateMissing != "error" {
+		return c, fmt.Errorf("unknown template missing mode %q (want keep or error)", c.TemplateMissing)
+	}
+	if c.ClusterSelf != "" && !slices.Contains(c.ClusterNodes, c.ClusterSelf) {
+		return c, fmt.Errorf("cluster self %q is not among the cluster nodes", c.ClusterSelf)
+	}
+	if c.ClusterEnforce && c.ClusterSelf == "" {
+		return c, fmt.Errorf("enforcing cluster ownership needs CLUSTER_SELF")
+	}
+	switch c.RocksDBPreset {
+	case "", "read-optimized", "write-optimized":
+	default:
+		return c, fmt.Errorf("unknown rocksdb preset %q (want read-optimized or write-optimized)", c.RocksDBPreset)
+	}
+	switch c.CompactionStyle {
+	case "", "level", "universal":
+	default:
+		return c, fmt.Errorf("unknown compaction style %q (want level or universal)", c.CompactionStyle)
+	}
+	switch c.ValueCompression {
+	case "none", "zstd", "gzip":
+	default:
+		return c, fmt.Errorf("unknown value compression %q (want none, zstd or gzip)", c.ValueCompression)
+	}
+	return c, nil
+}
+
+// envReader reads settings from environment variables. A variable that is
+// unset or empty leaves its setting alone; one that doesn't parse is
+// recorded in errs, so Load can refuse the config instead of quietly
+// keeping the default.
+type envReader struct {
+	errs []error
+}
+
+// lookup returns the variable's value, if it is set and not empty.
+func (e *envReader) lookup(name string) (string, bool) {
+	v, ok := os.LookupEnv(name)
+	return v, ok && v != ""
+}
+
+func (e *envReader) fail(name, v string, err error) {
+	e.errs = append(e.errs, fmt.Errorf("%s=%q: %w", name, v, err))
+}
+
+func (e *envReader) string(dst *string, name string) {
+	if v, ok := os.LookupEnv(name); ok {
+		*dst = v
+	}
+}
+
+// list reads a comma-separated list; an empty value clears it.
+func (e *envReader) list(dst *[]string, name string) {
+	v, ok := os.LookupEnv(name)
+	if !ok {
+		return
+	}
+	*dst = nil
+	for _, s := range strings.Split(v, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			*dst = append(*dst, s)
+		}
+	}
+}
+
+func (e *envReader) duration(dst *Duration, name string) {
+	v, ok := e.lookup(name)
+	if !ok {
+		return
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		e.fail(name, v, err)
+		return
+	}
+	dst.Duration = d
+}
+
+func (e *envReader) int(dst *int, name string) {
+	v, ok := e.lookup(name)
+	if !ok {
+		return
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		e.fail(name, v, err)
+		return
+	}
+	*dst = n
+}
+
+func (e *envReader) uint(dst *uint64, name string) {
+	v, ok := e.lookup(name)
+	if !ok {
+		return
+	}
+	n, err := strconv.ParseUint(v, 10, 64)
+	if err != nil {
+		e.fail(name, v, err)
+		return
+	}
+	*dst = n
+}
+
+func (e *envReader) bool(dst *bool, name string) {
+	v, ok := e.lookup(name)
+	if !ok {
+		return
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		e.fail(name, v, err)
+		return
+	}
+	*dst = b
+}
+
+func (e *envReader) float(dst *float64, name string) {
+	v, ok := e.lookup(name)
+	if !ok {
+		return
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		e.fail(name, v, err)
+		return
+	}
+	*dst = f
+}
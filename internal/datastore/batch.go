@@ -0,0 +1,175 @@
+package datastore
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// Kinds of Op.
+const (
+	OpSet    = "set"
+	OpDelete = "delete"
+	OpIncr   = "incr"
+	OpCAS    = "cas"
+)
+
+var (
+	// ErrConflict is returned by Apply for a compare-and-set whose key
+	// doesn't hold the expected value.
+	ErrConflict = errors.New("current value differs from the expected one")
+	// ErrCrossShard is returned by Sharded.Apply for operations on keys in
+	// more than one shard, which can't be committed atomically.
+	ErrCrossShard = errors.New("operations span shards and can't be applied atomically")
+)
+
+// Op is one operation of an atomic Apply. Set and CAS write Value with
+// Expiry; Incr adds to a counter like an Increment, creating a missing key
+// with Expiry. CAS writes only if the key's live value equals Expect, where
+// a nil Expect means the key must not be live; values are compared as JSON,
+// ignoring object key order and whitespace.
+type Op struct {
+	Kind     string
+	Key      string
+	Value    json.RawMessage
+	Expiry   int64
+	Expect   json.RawMessage
+	By       int64
+	Min, Max *int64
+	Reject   bool
+}
+
+// OpResult is what one operation did.
+type OpResult struct {
+	Op      string `json:"op"`
+	Key     string `json:"key"`
+	Value   *int64 `json:"value,omitempty"`   // incr: the stored value
+	Clamped bool   `json:"clamped,omitempty"` // incr: held at min or max
+	Existed *bool  `json:"existed,omitempty"` // delete: the key was live
+}
+
+// OpError is returned by Apply when an operation fails, in which case
+// nothing was written.
+type OpError struct {
+	Index int
+	Key   string
+	Err   error
+}
+
+func (e *OpError) Error() string {
+	return fmt.Sprintf("operation %d on %q: %v", e.Index, e.Key, e.Err)
+}
+
+func (e *OpError) Unwrap() error { return e.Err }
+
+// sameJSON compares two JSON documents ignoring object key order and
+// whitespace.
+func sameJSON(a, b json.RawMessage) bool {
+	norm := func(raw json.RawMessage) ([]byte, bool) {
+		dec := json.NewDecoder(bytes.NewReader(raw))
+		dec.UseNumber()
+		var v interface{}
+		if dec.Decode(&v) != nil {
+			return nil, false
+		}
+		out, err := json.Marshal(v)
+		return out, err == nil
+	}
+	na, ok := norm(a)
+	if !ok {
+		return false
+	}
+	nb, ok := norm(b)
+	return ok && bytes.Equal(na, nb)
+}
+
+// Apply runs ops in order and commits everything they write in one batch,
+// under the write lock, so no other write interleaves and either every
+// operation takes effect or, if any fails, none does. Each operation sees
+// the effects of those before it. A non-nil rec is recorded in the same
+// batch with the results, under "results", as its response data, as are
+// extra.
+func (r *RocksDB) Apply(ops []Op, rec *Idempotency, extra ...Mutation) ([]OpResult, error) {
+	if r.opts.ReadOnly {
+		return nil, ErrReadOnly
+	}
+	for i, op := range ops {
+		if err := ValidateKey(op.Key); err != nil {
+			return nil, &OpError{Index: i, Key: op.Key, Err: err}
+		}
+	}
+	if err := validateExtra(extra); err != nil {
+		return nil, err
+	}
+	r.writeMu.Lock()
+	defer r.writeMu.Unlock()
+	now := time.Now().UnixNano()
+	pending := make(map[string]Mutation) // the latest write to each key
+	current := func(key string) (DBEntry, bool, error) {
+		if m, ok := pending[key]; ok {
+			return DBEntry{Value: m.Value, Expiry: m.Expiry, Encoding: m.Encoding}, !m.Delete, nil
+		}
+		v, err := r.db.GetBytes(r.readOpts, []byte(key))
+		if err != nil || v == nil {
+			return DBEntry{}, false, err
+		}
+		e, err := r.decode(key, v)
+		if err != nil {
+			return DBEntry{}, false, err
+		}
+		return e, !e.Expired(now), nil
+	}
+	res := make([]OpResult, len(ops))
+	muts := make([]Mutation, 0, len(ops))
+	for i, op := range ops {
+		res[i] = OpResult{Op: op.Kind, Key: op.Key}
+		cur, live, err := current(op.Key)
+		if err != nil {
+			return nil, err
+		}
+		var m Mutation
+		switch op.Kind {
+		case OpSet:
+			m = Mutation{Key: op.Key, Value: op.Value, Expiry: op.Expiry}
+		case OpDelete:
+			res[i].Existed = &live
+			m = Mutation{Key: op.Key, Delete: true}
+		case OpCAS:
+			if live != (op.Expect != nil) || live && !sameJSON(cur.Value, op.Expect) {
+				return nil, &OpError{Index: i, Key: op.Key, Err: ErrConflict}
+			}
+			m = Mutation{Key: op.Key, Value: op.Value, Expiry: op.Expiry}
+		case OpIncr:
+			inc := Increment{Key: op.Key, By: op.By, Min: op.Min, Max: op.Max, Reject: op.Reject, Expiry: op.Expiry}
+			var n int64
+			if live {
+				var ok bool
+				if n, ok = parseInt(cur.Value); !ok {
+					return nil, &OpError{Index: i, Key: op.Key, Err: ErrNotInteger}
+				}
+				inc.Expiry = cur.Expiry
+			}
+			out, err := inc.apply(n)
+			if err != nil {
+				return nil, &OpError{Index: i, Key: op.Key, Err: err}
+			}
+			res[i].Value, res[i].Clamped = &out.Value, out.Clamped
+			m = Mutation{Key: op.Key, Value: json.RawMessage(strconv.FormatInt(out.Value, 10)), Expiry: inc.Expiry}
+		default:
+			return nil, &OpError{Index: i, Key: op.Key, Err: fmt.Errorf("unknown operation %q", op.Kind)}
+		}
+		pending[op.Key] = m
+		muts = append(muts, m)
+	}
+	if rec != nil {
+		data, _ := json.Marshal(map[string][]OpResult{"results": res})
+		muts = append(muts, rec.Mutation(data))
+	}
+	if err := r.writeLocked(r.writeOpts, append(muts, extra...)); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
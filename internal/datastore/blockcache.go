@@ -0,0 +1,78 @@
+package datastore
+
+import (
+	"sync"
+
+	"github.com/UltraSive/rocksdb-configuration-distribution/internal/metrics"
+	"github.com/linxGnu/grocksdb"
+)
+
+// DefaultBlockCacheBytes sizes the block cache when Options leaves it unset,
+// matching RocksDB's own default.
+const DefaultBlockCacheBytes = 32 << 20
+
+// openStores tracks every open RocksDB so the block cache and compaction
+// metrics can sum over shards.
+var openStores = struct {
+	sync.Mutex
+	m map[*RocksDB]struct{}
+}{m: make(map[*RocksDB]struct{})}
+
+func sumStores(fn func(r *RocksDB) uint64) func() int64 {
+	return func() int64 {
+		openStores.Lock()
+		defer openStores.Unlock()
+		var n uint64
+		for r := range openStores.m {
+			n += fn(r)
+		}
+		return int64(n)
+	}
+}
+
+func init() {
+	metrics.NewCounterFunc("kvstore_rocksdb_block_cache_hits_total", "Reads served from the RocksDB block cache.",
+		sumStores(func(r *RocksDB) uint64 { return r.dbOpts.GetTickerCount(grocksdb.TickerType_BLOCK_CACHE_HIT) }))
+	metrics.NewCounterFunc("kvstore_rocksdb_block_cache_misses_total", "Reads that missed the RocksDB block cache and went to disk.",
+		sumStores(func(r *RocksDB) uint64 { return r.dbOpts.GetTickerCount(grocksdb.TickerType_BLOCK_CACHE_MISS) }))
+	metrics.NewGaugeFunc("kvstore_rocksdb_block_cache_usage_bytes", "Memory held by the RocksDB block cache.",
+		sumStores(func(r *RocksDB) uint64 { return r.blockCache.GetUsage() }))
+	metrics.NewGaugeFunc("kvstore_rocksdb_block_cache_capacity_bytes", "Configured size of the RocksDB block cache.",
+		sumStores(func(r *RocksDB) uint64 { return r.blockCache.GetCapacity() }))
+	metrics.NewGaugeFunc("kvstore_rocksdb_pending_compaction_bytes", "Bytes RocksDB estimates compaction still has to rewrite, summed over shards.",
+		sumStores(func(r *RocksDB) uint64 { return r.PendingCompactionBytes() }))
+}
+
+// newBlockCache sets opts up with an LRU block cache of size bytes (0 =
+// DefaultBlockCacheBytes) and enables the statistics its hit rate is read
+// from. The caller destroys the returned cache and table options after the
+// database is closed.
+func newBlockCache(opts *grocksdb.Options, size int) (*grocksdb.Cache, *grocksdb.BlockBasedTableOptions) {
+	if size <= 0 {
+		size = DefaultBlockCacheBytes
+	}
+	cache := grocksdb.NewLRUCache(uint64(size))
+	bbto := grocksdb.NewDefaultBlockBasedTableOptions()
+	bbto.SetBlockCache(cache)
+	opts.SetBlockBasedTableFactory(bbto)
+	opts.EnableStatistics()
+	return cache, bbto
+}
+
+// blockCacheStats reports the block cache's size and hit rate since open.
+func (r *RocksDB) blockCacheStats() map[string]interface{} {
+	hits := r.dbOpts.GetTickerCount(grocksdb.TickerType_BLOCK_CACHE_HIT)
+	misses := r.dbOpts.GetTickerCount(grocksdb.TickerType_BLOCK_CACHE_MISS)
+	stats := map[string]interface{}{
+		"capacityBytes": r.blockCache.GetCapacity(),
+		"usageBytes":    r.blockCache.GetUsage(),
+		"pinnedBytes":   r.blockCache.GetPinnedUsage(),
+		"hits":          hits,
+		"misses":        misses,
+		"hitRatio":      nil,
+	}
+	if hits+misses > 0 {
+		stats["hitRatio"] = float64(hits) / float64(hits+misses)
+	}
+	return stats
+}
@@ -0,0 +1,327 @@
+package datastore
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Buffered coalesces writes in memory and commits them to the wrapped store
+// in one batch every interval, or as soon as maxBytes are pending. Write
+// returns once a mutation is buffered, so an acknowledged write is lost if
+// the process dies before the next flush, and a flush that fails is retried
+// rather than reported to the writer: Flush returns it and Stats reports the
+// last one. Only the latest mutation per key is
+// kept, so a burst of updates to one key costs a single write.
+//
+// Get and GetEntry see buffered writes. Everything that enumerates the store
+// flushes first, so it sees them too.
+type Buffered struct {
+	Datastore
+	maxBytes int
+
+	mu       sync.Mutex
+	pending  map[string]Mutation
+	inflight map[string]Mutation // being committed by flush
+	size     int
+	flushErr error // of the last flush, nil once one succeeds
+
+	flushMu sync.Mutex // one flush at a time
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+// NewBuffered wraps ds with a write buffer flushed every interval.
+func NewBuffered(ds Datastore, interval time.Duration, maxBytes int) *Buffered {
+	b := &Buffered{
+		Datastore: ds,
+		maxBytes:  maxBytes,
+		pending:   make(map[string]Mutation),
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	go b.loop(interval)
+	return b
+}
+
+func (b *Buffered) loop(interval time.Duration) {
+	defer close(b.done)
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			if err := b.Flush(); err != nil {
+				fmt.Println("write buffer flush error:", err)
+			}
+		case <-b.stop:
+			return
+		}
+	}
+}
+
+func (b *Buffered) Put(key string, value json.RawMessage, ttl time.Duration) error {
+	return b.Write([]Mutation{{Key: key, Value: value, Expiry: ExpiryFor(ttl)}})
+}
+
+func (b *Buffered) Delete(key string) error {
+	return b.Write([]Mutation{{Key: key, Delete: true}})
+}
+
+func (b *Buffered) DeleteRange(start, end string) error {
+	return b.Write([]Mutation{{Key: start, End: end, Delete: true}})
+}
+
+// Write buffers muts, flushing straight away once maxBytes are pending.
+// Mutations written together are committed in the same batch unless that
+// flush fails part way through a retry. A failed flush doesn't fail the
+// write: muts are buffered either way and retried with the rest, so an
+// error here would tell the client a write that later lands was refused. Writes carrying a write-through
+// queue entry are committed straight away instead, so upstream is only
+// promised writes that are durable.
+func (b *Buffered) Write(muts []Mutation) error {
+	for _, m := range muts {
+		if err := validateWrite(m); err != nil {
+			return err
+		}
+	}
+	if hasRange(muts) || hasWriteThrough(muts) {
+		// A range can't be buffered per key; commit what is pending so the
+		// range deletes it, or the entry's write lands after it, then write
+		// through.
+		if err := b.Flush(); err != nil {
+			return err
+		}
+		return b.Datastore.Write(muts)
+	}
+	b.mu.Lock()
+	for _, m := range muts {
+		if old, ok := b.pending[m.Key]; ok {
+			b.size -= len(old.Key) + len(old.Value)
+		}
+		b.pending[m.Key] = m
+		b.size += len(m.Key) + len(m.Value)
+	}
+	full := b.maxBytes > 0 && b.size >= b.maxBytes
+	b.mu.Unlock()
+	if full {
+		if err := b.Flush(); err != nil {
+			fmt.Println("write buffer flush error:", err)
+		}
+	}
+	return nil
+}
+
+// Flush commits everything buffered so far in one batch. On failure the
+// mutations go back in the buffer, behind any newer writes to their keys.
+func (b *Buffered) Flush() error {
+	b.flushMu.Lock()
+	defer b.flushMu.Unlock()
+	b.mu.Lock()
+	if len(b.pending) == 0 {
+		b.mu.Unlock()
+		return nil
+	}
+	b.inflight, b.pending, b.size = b.pending, make(map[string]Mutation), 0
+	b.mu.Unlock()
+
+	muts := make([]Mutation, 0, len(b.inflight))
+	for _, m := range b.inflight {
+		muts = append(muts, m)
+	}
+	sort.Slice(muts, func(i, j int) bool { return muts[i].Key < muts[j].Key })
+	err := b.Datastore.Write(muts)
+
+	b.mu.Lock()
+	if err != nil {
+		for k, m := range b.inflight {
+			if _, newer := b.pending[k]; !newer {
+				b.pending[k] = m
+				b.size += len(m.Key) + len(m.Value)
+			}
+		}
+	}
+	b.inflight = nil
+	b.flushErr = err
+	b.mu.Unlock()
+	return err
+}
+
+// buffered returns the latest buffered mutation for key, if any.
+func (b *Buffered) buffered(key string) (Mutation, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if m, ok := b.pending[key]; ok {
+		return m, true
+	}
+	m, ok := b.inflight[key]
+	return m, ok
+}
+
+func (b *Buffered) Get(key string) (json.RawMessage, bool, error) {
+	m, ok := b.buffered(key)
+	if !ok {
+		return b.Datastore.Get(key)
+	}
+	if m.Delete || (DBEntry{Expiry: m.Expiry}).Expired(time.Now().UnixNano()) {
+		return nil, false, nil
+	}
+	return append(json.RawMessage(nil), m.Value...), true, nil
+}
+
+// GetEntry reports a buffered write as an entry without Seq or Modified,
+// which are only assigned on commit.
+func (b *Buffered) GetEntry(key string) (DBEntry, bool, error) {
+	m, ok := b.buffered(key)
+	if !ok {
+		return b.Datastore.GetEntry(key)
+	}
+	if m.Delete {
+		return DBEntry{}, false, nil
+	}
+	return DBEntry{Expiry: m.Expiry, Value: append(json.RawMessage(nil), m.Value...), Encoding: m.Encoding}, true, nil
+}
+
+func (b *Buffered) List() (map[string]interface{}, error) {
+	if err := b.Flush(); err != nil {
+		return nil, err
+	}
+	return b.Datastore.List()
+}
+
+func (b *Buffered) Scan(prefix, start string, fn func(key string, value json.RawMessage) bool) error {
+	if err := b.Flush(); err != nil {
+		return err
+	}
+	return b.Datastore.Scan(prefix, start, fn)
+}
+
+func (b *Buffered) ScanReverse(prefix, start string, fn func(key string, value json.RawMessage) bool) error {
+	if err := b.Flush(); err != nil {
+		return err
+	}
+	return b.Datastore.ScanReverse(prefix, start, fn)
+}
+
+func (b *Buffered) ScanRaw(prefix, start string, fn func(key string, stored []byte) bool) error {
+	if err := b.Flush(); err != nil {
+		return err
+	}
+	return b.Datastore.ScanRaw(prefix, start, fn)
+}
+
+func (b *Buffered) ScanExpired(start string, limit int) ([]string, string, error) {
+	if err := b.Flush(); err != nil {
+		return nil, "", err
+	}
+	return b.Datastore.ScanExpired(start, limit)
+}
+
+func (b *Buffered) DeleteExpired(keys []string) (int, error) {
+	if err := b.Flush(); err != nil {
+		return 0, err
+	}
+	return b.Datastore.DeleteExpired(keys)
+}
+
+func (b *Buffered) Touch(key string, expiry int64) (bool, error) {
+	if err := b.Flush(); err != nil {
+		return false, err
+	}
+	return b.Datastore.Touch(key, expiry)
+}
+
+func (b *Buffered) TouchMany(keys []string, ttl time.Duration, extra ...Mutation) ([]string, error) {
+	if err := b.Flush(); err != nil {
+		return nil, err
+	}
+	return b.Datastore.TouchMany(keys, ttl, extra...)
+}
+
+// Increment flushes buffered writes first, so counters read what was
+// written before them.
+func (b *Buffered) Increment(incs []Increment, rec *Idempotency, extra ...Mutation) (map[string]IncrResult, error) {
+	if err := b.Flush(); err != nil {
+		return nil, err
+	}
+	return b.Datastore.Increment(incs, rec, extra...)
+}
+
+// Apply flushes buffered writes first, so operations see what was written
+// before them.
+func (b *Buffered) Apply(ops []Op, rec *Idempotency, extra ...Mutation) ([]OpResult, error) {
+	if err := b.Flush(); err != nil {
+		return nil, err
+	}
+	return b.Datastore.Apply(ops, rec, extra...)
+}
+
+// GetOrSet flushes buffered writes first, so a value written before it is
+// found.
+func (b *Buffered) GetOrSet(key string, value json.RawMessage, ttl time.Duration, extra ...Mutation) (DBEntry, bool, error) {
+	if err := b.Flush(); err != nil {
+		return DBEntry{}, false, err
+	}
+	return b.Datastore.GetOrSet(key, value, ttl, extra...)
+}
+
+// GetAndDelete flushes buffered writes first, so a value written before it
+// is popped.
+func (b *Buffered) GetAndDelete(key string, extra ...Mutation) (DBEntry, bool, error) {
+	if err := b.Flush(); err != nil {
+		return DBEntry{}, false, err
+	}
+	return b.Datastore.GetAndDelete(key, extra...)
+}
+
+func (b *Buffered) PrefixSize(prefix string) (size, keys int64, err error) {
+	if err := b.Flush(); err != nil {
+		return 0, 0, err
+	}
+	return b.Datastore.PrefixSize(prefix)
+}
+
+// TrimLog passes through when the wrapped store has a durable log.
+func (b *Buffered) TrimLog() (int, error) {
+	if lt, ok := b.Datastore.(LogTrimmer); ok {
+		return lt.TrimLog()
+	}
+	return 0, nil
+}
+
+// Clear drops whatever is buffered along with the store's contents.
+func (b *Buffered) Clear() error {
+	b.flushMu.Lock()
+	defer b.flushMu.Unlock()
+	b.mu.Lock()
+	b.pending, b.size = make(map[string]Mutation), 0
+	b.mu.Unlock()
+	return b.Datastore.Clear()
+}
+
+func (b *Buffered) Stats() map[string]interface{} {
+	stats := b.Datastore.Stats()
+	b.mu.Lock()
+	stats["writeBufferKeys"] = len(b.pending)
+	stats["writeBufferBytes"] = b.size
+	if b.flushErr != nil {
+		stats["writeBufferFlushError"] = b.flushErr.Error()
+	}
+	b.mu.Unlock()
+	return stats
+}
+
+// Close stops the flush loop, commits what is still buffered and closes the
+// wrapped store. A failed final flush is returned: those writes are lost.
+func (b *Buffered) Close() error {
+	close(b.stop)
+	<-b.done
+	flushErr := b.Flush()
+	if flushErr != nil {
+		flushErr = fmt.Errorf("write buffer flush: %w", flushErr)
+	}
+	return errors.Join(flushErr, b.Datastore.Close())
+}
@@ -0,0 +1,259 @@
+package datastore
+
+import (
+	"container/list"
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+// cachedOverhead approximates the per-entry bookkeeping of Cached.
+const cachedOverhead = 64
+
+// Cached keeps recently read entries in a bounded in-memory LRU so hot reads
+// skip RocksDB and decoding. Writes always go to the wrapped store first and
+// then drop the keys they touched from the cache, so the cache never holds a
+// value the store has replaced. Enumerations are not cached.
+type Cached struct {
+	Datastore
+	maxBytes int
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List // front = most recently used
+	size    int
+	gen     uint64 // bumped by every invalidation
+	hits    int64
+	misses  int64
+}
+
+type cachedEntry struct {
+	key   string
+	entry DBEntry
+}
+
+// NewCached wraps ds with a read cache of about maxBytes of keys and values.
+func NewCached(ds Datastore, maxBytes int) *Cached {
+	return &Cached{
+		Datastore: ds,
+		maxBytes:  maxBytes,
+		entries:   make(map[string]*list.Element),
+		lru:       list.New(),
+	}
+}
+
+// lookup returns key's cached entry, marking it recently used.
+func (c *Cached) lookup(key string) (DBEntry, bool, uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[key]; ok {
+		c.lru.MoveToFront(el)
+		c.hits++
+		return el.Value.(*cachedEntry).entry, true, c.gen
+	}
+	c.misses++
+	return DBEntry{}, false, c.gen
+}
+
+// fill caches e for key unless a write invalidated anything since gen was
+// read, in which case e may already be stale.
+func (c *Cached) fill(key string, e DBEntry, gen uint64) {
+	n := len(key) + len(e.Value) + cachedOverhead
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if gen != c.gen || n > c.maxBytes {
+		return
+	}
+	if el, ok := c.entries[key]; ok {
+		c.remove(el)
+	}
+	c.entries[key] = c.lru.PushFront(&cachedEntry{key: key, entry: e})
+	c.size += n
+	for c.size > c.maxBytes {
+		c.remove(c.lru.Back())
+	}
+}
+
+// remove drops el; the caller holds mu.
+func (c *Cached) remove(el *list.Element) {
+	ce := c.lru.Remove(el).(*cachedEntry)
+	delete(c.entries, ce.key)
+	c.size -= len(ce.key) + len(ce.entry.Value) + cachedOverhead
+}
+
+// invalidate drops keys from the cache. It runs after the write reached the
+// wrapped store, so a read that started earlier can't refill an old value.
+func (c *Cached) invalidate(keys ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gen++
+	for _, k := range keys {
+		if el, ok := c.entries[k]; ok {
+			c.remove(el)
+		}
+	}
+}
+
+// invalidateRange drops every cached key in [start, end).
+func (c *Cached) invalidateRange(start, end string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gen++
+	for k, el := range c.entries {
+		if k >= start && k < end {
+			c.remove(el)
+		}
+	}
+}
+
+func (c *Cached) Get(key string) (json.RawMessage, bool, error) {
+	raw, ok, _, err := c.GetWithSource(key)
+	return raw, ok, err
+}
+
+// GetWithSource is Get, also reporting SourceCache when the value came from
+// the read cache.
+func (c *Cached) GetWithSource(key string) (json.RawMessage, bool, string, error) {
+	e, hit, gen := c.lookup(key)
+	if !hit {
+		var ok bool
+		var err error
+		if e, ok, err = c.Datastore.GetEntry(key); err != nil || !ok {
+			return nil, false, SourceLocal, err
+		}
+		c.fill(key, e, gen)
+	}
+	if e.Expired(time.Now().UnixNano()) {
+		// Let the wrapped store apply its lazy deletion.
+		c.invalidate(key)
+		raw, ok, err := c.Datastore.Get(key)
+		return raw, ok, SourceLocal, err
+	}
+	src := SourceLocal
+	if hit {
+		src = SourceCache
+	}
+	return append(json.RawMessage(nil), e.Value...), true, src, nil
+}
+
+func (c *Cached) GetEntry(key string) (DBEntry, bool, error) {
+	e, ok, gen := c.lookup(key)
+	if ok {
+		e.Value = append(json.RawMessage(nil), e.Value...)
+		return e, true, nil
+	}
+	e, ok, err := c.Datastore.GetEntry(key)
+	if err != nil || !ok {
+		return e, ok, err
+	}
+	c.fill(key, e, gen)
+	e.Value = append(json.RawMessage(nil), e.Value...)
+	return e, true, nil
+}
+
+func (c *Cached) Put(key string, value json.RawMessage, ttl time.Duration) error {
+	defer c.invalidate(key)
+	return c.Datastore.Put(key, value, ttl)
+}
+
+func (c *Cached) Delete(key string) error {
+	defer c.invalidate(key)
+	return c.Datastore.Delete(key)
+}
+
+func (c *Cached) DeleteRange(start, end string) error {
+	return c.Write([]Mutation{{Key: start, End: end, Delete: true}})
+}
+
+func (c *Cached) Write(muts []Mutation) error {
+	keys := make([]string, 0, len(muts))
+	for _, m := range muts {
+		if m.End != "" {
+			defer c.invalidateRange(m.Key, m.End)
+			continue
+		}
+		keys = append(keys, m.Key)
+	}
+	defer c.invalidate(keys...)
+	return c.Datastore.Write(muts)
+}
+
+func (c *Cached) DeleteExpired(keys []string) (int, error) {
+	defer c.invalidate(keys...)
+	return c.Datastore.DeleteExpired(keys)
+}
+
+func (c *Cached) Touch(key string, expiry int64) (bool, error) {
+	defer c.invalidate(key)
+	return c.Datastore.Touch(key, expiry)
+}
+
+func (c *Cached) TouchMany(keys []string, ttl time.Duration, extra ...Mutation) ([]string, error) {
+	defer c.invalidate(keys...)
+	return c.Datastore.TouchMany(keys, ttl, extra...)
+}
+
+func (c *Cached) Increment(incs []Increment, rec *Idempotency, extra ...Mutation) (map[string]IncrResult, error) {
+	keys := make([]string, len(incs), len(incs)+1)
+	for i, inc := range incs {
+		keys[i] = inc.Key
+	}
+	if rec != nil {
+		keys = append(keys, idemPrefix+rec.ID)
+	}
+	defer c.invalidate(keys...)
+	return c.Datastore.Increment(incs, rec, extra...)
+}
+
+func (c *Cached) Apply(ops []Op, rec *Idempotency, extra ...Mutation) ([]OpResult, error) {
+	keys := make([]string, len(ops), len(ops)+1)
+	for i, op := range ops {
+		keys[i] = op.Key
+	}
+	if rec != nil {
+		keys = append(keys, idemPrefix+rec.ID)
+	}
+	defer c.invalidate(keys...)
+	return c.Datastore.Apply(ops, rec, extra...)
+}
+
+func (c *Cached) GetOrSet(key string, value json.RawMessage, ttl time.Duration, extra ...Mutation) (DBEntry, bool, error) {
+	defer c.invalidate(key)
+	return c.Datastore.GetOrSet(key, value, ttl, extra...)
+}
+
+func (c *Cached) GetAndDelete(key string, extra ...Mutation) (DBEntry, bool, error) {
+	defer c.invalidate(key)
+	return c.Datastore.GetAndDelete(key, extra...)
+}
+
+// TrimLog passes through when the wrapped store has a durable log.
+func (c *Cached) TrimLog() (int, error) {
+	if lt, ok := c.Datastore.(LogTrimmer); ok {
+		return lt.TrimLog()
+	}
+	return 0, nil
+}
+
+// Clear empties the cache along with the store.
+func (c *Cached) Clear() error {
+	defer func() {
+		c.mu.Lock()
+		c.entries, c.size = make(map[string]*list.Element), 0
+		c.lru.Init()
+		c.gen++
+		c.mu.Unlock()
+	}()
+	return c.Datastore.Clear()
+}
+
+func (c *Cached) Stats() map[string]interface{} {
+	stats := c.Datastore.Stats()
+	c.mu.Lock()
+	stats["readCacheKeys"] = len(c.entries)
+	stats["readCacheBytes"] = c.size
+	stats["readCacheHits"] = c.hits
+	stats["readCacheMisses"] = c.misses
+	c.mu.Unlock()
+	return stats
+}
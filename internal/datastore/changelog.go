@@ -0,0 +1,228 @@
+package datastore
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+)
+
+// DefaultChangeLogSize is how many recent mutations are kept for followers.
+const DefaultChangeLogSize = 10000
+
+// Change is a committed mutation tagged with its write sequence and commit
+// time (unix nanos).
+type Change struct {
+	Seq  uint64 `json:"seq"`
+	Time int64  `json:"time,omitempty"`
+	Mutation
+}
+
+// ChangeLog is a bounded, in-memory ring of recent changes, optionally
+// backed by a durable log for readers that have fallen out of the ring.
+// Readers further behind than both must resync from a snapshot.
+type ChangeLog struct {
+	mu     sync.Mutex
+	epoch  string
+	buf    []Change
+	start  int    // index of the oldest change in buf
+	n      int    // number of changes held
+	seq    uint64 // sequence of the newest change
+	origin uint64 // head when the log was created or last reset
+	time   int64  // commit time of the newest change, 0 if unknown
+	notify chan struct{}
+
+	// older, if set, serves a page of changes after a sequence the ring no
+	// longer holds.
+	older func(seq uint64) ([]Change, bool)
+	pins  map[*Pin]uint64
+
+	// olderAt, if set, finds the last change committed at or before a time
+	// the ring no longer reaches back to.
+	olderAt func(t int64) (uint64, bool)
+}
+
+// Pin marks a reader's position in the log so retention keeps the changes
+// after it.
+type Pin struct {
+	l *ChangeLog
+}
+
+// NewChangeLog returns an empty log whose next change follows seq.
+func NewChangeLog(size int, seq uint64) *ChangeLog {
+	if size <= 0 {
+		size = DefaultChangeLogSize
+	}
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return &ChangeLog{
+		epoch:  hex.EncodeToString(b),
+		buf:    make([]Change, size),
+		seq:    seq,
+		origin: seq,
+		notify: make(chan struct{}),
+		pins:   make(map[*Pin]uint64),
+	}
+}
+
+// Epoch identifies this log instance. Sequences are only comparable between
+// a leader and follower that agree on the epoch.
+func (l *ChangeLog) Epoch() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.epoch
+}
+
+// Seq returns the sequence of the most recent change.
+func (l *ChangeLog) Seq() uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.seq
+}
+
+// Head returns the sequence and commit time of the most recent change. The
+// time is 0 when unknown, as for a store never written to.
+func (l *ChangeLog) Head() (seq uint64, t int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.seq, l.time
+}
+
+// Append records changes, which must carry increasing sequences, and wakes
+// any waiters.
+func (l *ChangeLog) Append(changes ...Change) {
+	if len(changes) == 0 {
+		return
+	}
+	l.mu.Lock()
+	for _, c := range changes {
+		l.seq, l.time = c.Seq, c.Time
+		idx := (l.start + l.n) % len(l.buf)
+		l.buf[idx] = c
+		if l.n < len(l.buf) {
+			l.n++
+		} else {
+			l.start = (l.start + 1) % len(l.buf)
+		}
+	}
+	close(l.notify)
+	l.notify = make(chan struct{})
+	l.mu.Unlock()
+}
+
+// Reset empties the ring under a new epoch, for when the store's history no
+// longer describes its contents, and moves the head to seq, which must be
+// past it. No change is recorded at the sequences skipped, so Since fails
+// for every reader positioned before seq, caught-up ones included, and they
+// resync. Readers are woken.
+func (l *ChangeLog) Reset(epoch string, seq uint64) {
+	l.mu.Lock()
+	l.epoch, l.origin = epoch, seq
+	l.seq = seq
+	l.start, l.n = 0, 0
+	close(l.notify)
+	l.notify = make(chan struct{})
+	l.mu.Unlock()
+}
+
+// Origin returns the epoch and the sequence it started after at the last
+// Reset, or the sequence the log was created at if it hasn't been reset.
+func (l *ChangeLog) Origin() (epoch string, seq uint64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.epoch, l.origin
+}
+
+// Since returns the changes after seq: all of them when the ring still holds
+// seq, otherwise a page from the durable log, in which case the caller should
+// ask again from the last one returned. ok is false when seq has been trimmed
+// from both (or is ahead of the log) and the caller must resync.
+func (l *ChangeLog) Since(seq uint64) (changes []Change, ok bool) {
+	l.mu.Lock()
+	if seq > l.seq {
+		l.mu.Unlock()
+		return nil, false
+	}
+	oldest := l.seq - uint64(l.n) // last sequence no longer held
+	if seq < oldest {
+		older := l.older
+		l.mu.Unlock()
+		if older == nil {
+			return nil, false
+		}
+		return older(seq)
+	}
+	for i := int(seq - oldest); i < l.n; i++ {
+		changes = append(changes, l.buf[(l.start+i)%len(l.buf)])
+	}
+	l.mu.Unlock()
+	return changes, true
+}
+
+// SeqAt returns the sequence of the last change committed at or before t,
+// so that Since(seq) yields exactly the changes committed after t. ok is
+// false when the log no longer reaches back to t.
+func (l *ChangeLog) SeqAt(t int64) (seq uint64, ok bool) {
+	l.mu.Lock()
+	if l.n > 0 && l.buf[l.start].Time <= t {
+		for i := l.n - 1; i >= 0; i-- {
+			if c := l.buf[(l.start+i)%len(l.buf)]; c.Time <= t {
+				l.mu.Unlock()
+				return c.Seq, true
+			}
+		}
+	}
+	olderAt := l.olderAt
+	l.mu.Unlock()
+	if olderAt == nil {
+		return 0, false
+	}
+	return olderAt(t)
+}
+
+// Pin registers a reader positioned at seq. Release it when the reader goes
+// away.
+func (l *ChangeLog) Pin(seq uint64) *Pin {
+	p := &Pin{l: l}
+	l.mu.Lock()
+	l.pins[p] = seq
+	l.mu.Unlock()
+	return p
+}
+
+// Move records that the reader has consumed everything up to seq.
+func (p *Pin) Move(seq uint64) {
+	p.l.mu.Lock()
+	if _, ok := p.l.pins[p]; ok {
+		p.l.pins[p] = seq
+	}
+	p.l.mu.Unlock()
+}
+
+// Release drops the pin.
+func (p *Pin) Release() {
+	p.l.mu.Lock()
+	delete(p.l.pins, p)
+	p.l.mu.Unlock()
+}
+
+// Pinned returns the lowest pinned position, if any reader is pinned.
+func (l *ChangeLog) Pinned() (uint64, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var low uint64
+	ok := false
+	for _, seq := range l.pins {
+		if !ok || seq < low {
+			low, ok = seq, true
+		}
+	}
+	return low, ok
+}
+
+// Wait returns a channel closed on the next Append. Grab it before calling
+// Since so no change can slip between the two.
+func (l *ChangeLog) Wait() <-chan struct{} {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.notify
+}
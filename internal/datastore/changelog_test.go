@@ -0,0 +1,53 @@
+package datastore
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestCaughtUpReaderResyncsAcrossClear(t *testing.T) {
+	dir := t.TempDir()
+	r, err := NewRocksDB(dir, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Put("a", json.RawMessage(`1`), 0); err != nil {
+		t.Fatal(err)
+	}
+	log := r.ChangeLog()
+	seq := log.Seq()
+	if changes, ok := log.Since(seq); !ok || len(changes) != 0 {
+		t.Fatalf("Since(head) = %d changes, %v, want none, true", len(changes), ok)
+	}
+
+	if err := r.Clear(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := log.Since(seq); ok {
+		t.Error("a reader caught up before Clear isn't told to resync")
+	}
+	if err := r.Put("b", json.RawMessage(`2`), 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := log.Since(seq); ok {
+		t.Error("a reader caught up before Clear isn't told to resync after the next write")
+	}
+	epoch, origin := log.Origin()
+	if origin != seq+1 || epoch != log.Epoch() {
+		t.Errorf("Origin = %s, %d, want %s, %d", epoch, origin, log.Epoch(), seq+1)
+	}
+	if changes, ok := log.Since(origin); !ok || len(changes) != 1 || changes[0].Key != "b" {
+		t.Errorf("Since(origin) = %+v, %v, want the write of b", changes, ok)
+	}
+	r.Close()
+
+	// The gap is durable.
+	r, err = NewRocksDB(dir, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if _, ok := r.ChangeLog().Since(seq); ok {
+		t.Error("a reader caught up before Clear isn't told to resync after a restart")
+	}
+}
@@ -0,0 +1,164 @@
+package datastore
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// ErrUnknownEncoding is returned for a stored entry in an encoding this
+// binary can't read.
+var ErrUnknownEncoding = errors.New("unknown entry encoding")
+
+// Value compression algorithms for Options.Compression.
+const (
+	CompressionNone = ""
+	CompressionZstd = "zstd"
+	CompressionGzip = "gzip"
+)
+
+// DefaultCompressMinBytes is the value size at which compression starts when
+// Options.CompressMinBytes is 0.
+const DefaultCompressMinBytes = 4096
+
+// entryCodec converts between DBEntry and the bytes stored under a client
+// key. Every path that reads or writes entries goes through one, so changing
+// the stored encoding means a new codec plus a format version bump.
+type entryCodec interface {
+	Encode(e DBEntry) ([]byte, error)
+	Decode(b []byte) (DBEntry, error)
+}
+
+// defaultCodec is the codec stores are opened with.
+var defaultCodec entryCodec = jsonCodec{}
+
+// jsonCodec stores entries as a JSON object, the layout of format versions 0
+// to 2. Those carry no version byte: an entry starting with '{' is JSON, and
+// any other first byte is left free to tag later encodings, which Decode
+// refuses rather than misreads.
+//
+// With compression set, values of at least minSize bytes are compressed into
+// storedEntry.Compressed when that makes them smaller. Decode handles
+// compressed and plain entries alike, whatever the codec writes.
+type jsonCodec struct {
+	compression string
+	minSize     int
+}
+
+// newCodec returns the codec for o's compression settings.
+func newCodec(o Options) (entryCodec, error) {
+	switch o.Compression {
+	case CompressionNone, CompressionZstd, CompressionGzip:
+	default:
+		return nil, fmt.Errorf("unknown compression %q", o.Compression)
+	}
+	c := jsonCodec{compression: o.Compression, minSize: o.CompressMinBytes}
+	if c.minSize <= 0 {
+		c.minSize = DefaultCompressMinBytes
+	}
+	return c, nil
+}
+
+// storedEntry is the JSON written for an entry; a compressed value travels
+// base64 encoded in Compressed, with Value null.
+type storedEntry struct {
+	DBEntry
+	Compressed []byte `json:"compressed,omitempty"`
+}
+
+func (c jsonCodec) Encode(e DBEntry) ([]byte, error) {
+	s := storedEntry{DBEntry: e}
+	s.Compression = CompressionNone
+	if c.compression != CompressionNone && len(e.Value) >= c.minSize {
+		z, err := compress(c.compression, e.Value)
+		if err != nil {
+			return nil, err
+		}
+		// Base64 costs a third again in the JSON wrapper.
+		if len(z)*4/3 < len(e.Value) {
+			s.Compression, s.Compressed, s.Value = c.compression, z, nil
+		}
+	}
+	return json.Marshal(&s)
+}
+
+func (jsonCodec) Decode(b []byte) (DBEntry, error) {
+	if len(b) == 0 {
+		return DBEntry{}, fmt.Errorf("%w: empty entry", ErrUnknownEncoding)
+	}
+	if b[0] != '{' {
+		return DBEntry{}, fmt.Errorf("%w: tag %#x", ErrUnknownEncoding, b[0])
+	}
+	var s storedEntry
+	if err := json.Unmarshal(b, &s); err != nil {
+		return DBEntry{}, err
+	}
+	if s.Compression != CompressionNone {
+		v, err := decompress(s.Compression, s.Compressed)
+		if err != nil {
+			return DBEntry{}, err
+		}
+		s.Value = v
+	}
+	return s.DBEntry, nil
+}
+
+// DecodeEntry decodes stored entry bytes, as passed to ScanRaw for client
+// keys.
+func DecodeEntry(stored []byte) (DBEntry, error) {
+	return defaultCodec.Decode(stored)
+}
+
+// The zstd encoder and decoder are safe for concurrent EncodeAll/DecodeAll
+// and costly to set up, so one of each is shared.
+var (
+	zstdEncoder = sync.OnceValues(func() (*zstd.Encoder, error) { return zstd.NewWriter(nil) })
+	zstdDecoder = sync.OnceValues(func() (*zstd.Decoder, error) { return zstd.NewReader(nil) })
+)
+
+func compress(alg string, b []byte) ([]byte, error) {
+	switch alg {
+	case CompressionZstd:
+		enc, err := zstdEncoder()
+		if err != nil {
+			return nil, err
+		}
+		return enc.EncodeAll(b, nil), nil
+	case CompressionGzip:
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		if _, err := zw.Write(b); err != nil {
+			return nil, err
+		}
+		if err := zw.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+	return nil, fmt.Errorf("unknown compression %q", alg)
+}
+
+func decompress(alg string, b []byte) ([]byte, error) {
+	switch alg {
+	case CompressionZstd:
+		dec, err := zstdDecoder()
+		if err != nil {
+			return nil, err
+		}
+		return dec.DecodeAll(b, nil)
+	case CompressionGzip:
+		zr, err := gzip.NewReader(bytes.NewReader(b))
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		return io.ReadAll(zr)
+	}
+	return nil, fmt.Errorf("%w: compression %q", ErrUnknownEncoding, alg)
+}
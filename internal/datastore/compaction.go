@@ -0,0 +1,32 @@
+package datastore
+
+import "time"
+
+// expiryFilter is a RocksDB compaction filter that drops expired entries as
+// SSTs are rewritten, so expired data is reclaimed by normal background
+// compaction without a separate scan. Internal keys are never touched,
+// except idempotency records, which expire like client entries; anything that doesn't parse as a DBEntry is kept, as is anything still
+// within grace of its expiry or under a pinned prefix.
+type expiryFilter struct {
+	codec  entryCodec
+	grace  time.Duration
+	pinned []string
+}
+
+func (expiryFilter) Name() string { return "kvstore.expiry" }
+
+// Filter may run concurrently on several compaction threads; it holds no state.
+func (f expiryFilter) Filter(level int, key, val []byte) (remove bool, newVal []byte) {
+	if IsReserved(string(key)) && !isIdempotencyKey(string(key)) || pinned(f.pinned, string(key)) {
+		return false, nil
+	}
+	e, err := f.codec.Decode(val)
+	if err != nil || e.Expiry == 0 {
+		return false, nil
+	}
+	return e.Expired(time.Now().UnixNano() - int64(f.grace)), nil
+}
+
+func (expiryFilter) SetIgnoreSnapshots(bool) {}
+
+func (expiryFilter) Destroy() {}
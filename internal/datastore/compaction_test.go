@@ -0,0 +1,55 @@
+package datastore
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestPinnedEntriesAreNeverReclaimed(t *testing.T) {
+	dir := t.TempDir()
+	r, err := NewRocksDB(dir, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	past := time.Now().Add(-time.Second).UnixNano()
+	// Written with an expiry before the prefix was pinned.
+	if err := r.Write([]Mutation{
+		{Key: "boot/a", Value: json.RawMessage(`1`), Expiry: past},
+		{Key: "other", Value: json.RawMessage(`2`), Expiry: past},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	r.Close()
+
+	r, err = NewRocksDB(dir, Options{PinnedPrefixes: []string{"boot/"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if v, ok, err := r.Get("boot/a"); err != nil || !ok || string(v) != "1" {
+		t.Errorf("Get(boot/a) = %s, %v, %v, want the pinned value", v, ok, err)
+	}
+	expired, _, err := r.ScanExpired("", 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(expired) != 1 || expired[0] != "other" {
+		t.Errorf("ScanExpired = %q, want only other", expired)
+	}
+	if n, err := r.DeleteExpired([]string{"boot/a"}); err != nil || n != 0 {
+		t.Errorf("DeleteExpired(boot/a) = %d, %v, want 0", n, err)
+	}
+
+	stored, err := r.codec.Encode(DBEntry{Expiry: past, Value: []byte(`1`)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := expiryFilter{codec: r.codec, pinned: r.opts.PinnedPrefixes}
+	if remove, _ := f.Filter(0, []byte("boot/a"), stored); remove {
+		t.Error("compaction drops a pinned entry")
+	}
+	if remove, _ := f.Filter(0, []byte("other"), stored); !remove {
+		t.Error("compaction keeps an expired unpinned entry")
+	}
+}
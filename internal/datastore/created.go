@@ -0,0 +1,88 @@
+package datastore
+
+import "encoding/json"
+
+// createdTracker works out DBEntry.Created for the puts in one write batch.
+// A key keeps the creation time of its live entry, which is 0 for entries
+// written before tracking was on; a key with no live entry, or one deleted
+// earlier in the batch, is created now. A nil tracker leaves Created unset,
+// for stores with Options.TrackCreated off.
+type createdTracker struct {
+	r   *RocksDB
+	now int64
+	// batch holds the Created of keys already written in this batch, or
+	// gone for keys it deleted.
+	batch  map[string]int64
+	ranges [][2]string // [start, end) ranges deleted in this batch
+}
+
+// gone marks a key deleted earlier in the batch.
+const gone = -1
+
+func (t *createdTracker) put(key string) (int64, error) {
+	if t == nil || IsReserved(key) {
+		return 0, nil
+	}
+	created, ok := t.batch[key]
+	switch {
+	case ok && created == gone, !ok && t.inRange(key):
+		created = t.now
+	case !ok:
+		c, live, err := t.stored(key)
+		if err != nil {
+			return 0, err
+		}
+		created = t.now
+		if live {
+			created = c
+		}
+	}
+	t.batch[key] = created
+	return created, nil
+}
+
+func (t *createdTracker) delete(key string) {
+	if t != nil {
+		t.batch[key] = gone
+	}
+}
+
+func (t *createdTracker) deleteRange(start, end string) {
+	if t == nil {
+		return
+	}
+	for k := range t.batch {
+		if k >= start && k < end {
+			t.batch[k] = gone
+		}
+	}
+	t.ranges = append(t.ranges, [2]string{start, end})
+}
+
+func (t *createdTracker) inRange(key string) bool {
+	for _, rg := range t.ranges {
+		if key >= rg[0] && key < rg[1] {
+			return true
+		}
+	}
+	return false
+}
+
+// stored reads the Created of key's committed entry and whether that entry
+// is live. Only the metadata is decoded, so a compressed value stays
+// compressed.
+func (t *createdTracker) stored(key string) (created int64, live bool, err error) {
+	b, err := t.r.db.GetBytes(t.r.readOpts, []byte(key))
+	if err != nil || b == nil {
+		return 0, false, err
+	}
+	var meta struct {
+		Expiry  int64 `json:"expiry"`
+		Created int64 `json:"created"`
+	}
+	if json.Unmarshal(b, &meta) != nil {
+		return 0, false, nil
+	}
+	live = pinned(t.r.opts.PinnedPrefixes, key) || !(DBEntry{Expiry: meta.Expiry}).Expired(t.now)
+	return meta.Created, live, nil
+}
@@ -2,20 +2,199 @@ package datastore
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
 	"time"
 )
 
+// ReservedPrefix marks keys the store keeps for its own bookkeeping. They are
+// never returned from enumeration.
+const ReservedPrefix = "__"
+
+// seqKey persists the last write sequence handed out.
+const seqKey = ReservedPrefix + "meta/seq"
+
 // DBEntry matches your on-disk wrapper
 type DBEntry struct {
-	Expiry int64           `json:"expiry"`
-	Value  json.RawMessage `json:"value"`
+	Expiry int64  `json:"expiry"`
+	Seq    uint64 `json:"seq,omitempty"` // write sequence that produced this entry
+	// Modified is when the entry was written (unix nanos); 0 for entries
+	// written before it was recorded.
+	Modified int64 `json:"modified,omitempty"`
+	// Created is when the key was first written (unix nanos) and survives
+	// updates; 0 when unknown, because Options.TrackCreated is off or the
+	// entry predates it.
+	Created int64           `json:"created,omitempty"`
+	Value   json.RawMessage `json:"value"`
+	// Encoding is EncodingBase64 for a binary value, which Value then holds
+	// as a JSON string of its base64 encoding; empty for JSON values.
+	Encoding string `json:"encoding,omitempty"`
+	// Compression names the algorithm the value is stored compressed with;
+	// empty when stored as is. Value itself is always uncompressed.
+	Compression string `json:"compression,omitempty"`
+}
+
+// Expired reports whether the entry's expiry has passed at now (unix nanos).
+func (e DBEntry) Expired(now int64) bool {
+	return e.Expiry != math.MaxInt64 && e.Expiry <= now
+}
+
+// EncodingBase64 marks an entry whose value is binary, stored as a JSON
+// string of its standard base64 encoding. Since the value is still JSON,
+// every path that doesn't care what it holds treats it as a string.
+const EncodingBase64 = "base64"
+
+// Mutation is a single write applied as part of a batch. Expiry is absolute
+// (unix nanos) so a mutation replays identically on another node. A Delete
+// with End set deletes every client key in [Key, End). Encoding is stored
+// with the entry, see DBEntry.
+type Mutation struct {
+	Key      string          `json:"key"`
+	Value    json.RawMessage `json:"value,omitempty"`
+	Expiry   int64           `json:"expiry,omitempty"`
+	Delete   bool            `json:"delete,omitempty"`
+	End      string          `json:"end,omitempty"`
+	Encoding string          `json:"encoding,omitempty"`
+}
+
+// LogTrimmer is implemented by stores that keep a durable change log needing
+// periodic trimming.
+type LogTrimmer interface {
+	TrimLog() (int, error)
 }
 
 // Datastore defines the minimal operations we need.
+//
+// The read-modify-write operations take extra mutations, such as a
+// write-through queue entry, that are committed in the same batch as their
+// own writes, and are committed even when the operation itself writes
+// nothing, so a nil error means they landed.
 type Datastore interface {
 	Get(key string) (json.RawMessage, bool, error)
+	GetEntry(key string) (DBEntry, bool, error)
 	Put(key string, value json.RawMessage, ttl time.Duration) error
 	Delete(key string) error
+	DeleteRange(start, end string) error
+	Write(muts []Mutation) error
 	List() (map[string]interface{}, error)
+	Scan(prefix, start string, fn func(key string, value json.RawMessage) bool) error
+	ScanReverse(prefix, start string, fn func(key string, value json.RawMessage) bool) error
+	ScanRaw(prefix, start string, fn func(key string, stored []byte) bool) error
+	ScanExpired(start string, limit int) (expired []string, next string, err error)
+	DeleteExpired(keys []string) (int, error)
+	Touch(key string, expiry int64) (bool, error)
+	TouchMany(keys []string, ttl time.Duration, extra ...Mutation) (refreshed []string, err error)
+	Increment(incs []Increment, rec *Idempotency, extra ...Mutation) (map[string]IncrResult, error)
+	Apply(ops []Op, rec *Idempotency, extra ...Mutation) ([]OpResult, error)
+	GetOrSet(key string, value json.RawMessage, ttl time.Duration, extra ...Mutation) (DBEntry, bool, error)
+	GetAndDelete(key string, extra ...Mutation) (DBEntry, bool, error)
+	PrefixSize(prefix string) (size, keys int64, err error)
+	Stats() map[string]interface{}
+	Properties() (map[string]string, error)
+	WriteStalled() bool
+	PendingCompactionBytes() uint64
+	Clear() error
 	Close() error
-}
\ No newline at end of file
+}
+
+// Sources a read can report through SourceGetter.
+const (
+	SourceCache = "cache" // the in-memory read cache
+	SourceLocal = "local" // RocksDB, or writes still buffered for it
+)
+
+// SourceGetter is implemented by stores that can say which layer answered a
+// read. Stores without it answer every read from SourceLocal.
+type SourceGetter interface {
+	GetWithSource(key string) (json.RawMessage, bool, string, error)
+}
+
+// IsReserved reports whether key belongs to the store's internal keyspace.
+// Every client-facing enumeration path skips such keys through this check.
+func IsReserved(key string) bool {
+	return strings.HasPrefix(key, ReservedPrefix)
+}
+
+// prefixEnd returns the first key after every key starting with p.
+func prefixEnd(p string) []byte {
+	b := []byte(p)
+	b[len(b)-1]++
+	return b
+}
+
+// ErrInvalidKey is returned for writes to keys no client may use.
+var ErrInvalidKey = errors.New("invalid key")
+
+// ValidateKey rejects keys the store can never accept from clients: the
+// empty key and keys under ReservedPrefix.
+func ValidateKey(key string) error {
+	switch {
+	case key == "":
+		return fmt.Errorf("%w: empty", ErrInvalidKey)
+	case IsReserved(key):
+		return fmt.Errorf("%w: %q uses the reserved prefix %q", ErrInvalidKey, key, ReservedPrefix)
+	}
+	return nil
+}
+
+// pinned reports whether key falls under one of prefixes. Internal keys
+// never do.
+func pinned(prefixes []string, key string) bool {
+	if IsReserved(key) {
+		return false
+	}
+	for _, p := range prefixes {
+		if strings.HasPrefix(key, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// validateExtra runs validateWrite on the extra mutations of a
+// read-modify-write operation.
+func validateExtra(extra []Mutation) error {
+	for _, m := range extra {
+		if err := validateWrite(m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateWrite checks a mutation given to Write: ValidateKey, except that
+// idempotency records and write-through queue entries are allowed, plus a
+// sane end for range deletes.
+func validateWrite(m Mutation) error {
+	if isIdempotencyKey(m.Key) || isWriteThroughKey(m.Key) {
+		return nil
+	}
+	if err := ValidateKey(m.Key); err != nil {
+		return err
+	}
+	if m.End != "" && (!m.Delete || m.End <= m.Key) {
+		return fmt.Errorf("%w: range end %q must sort after start %q", ErrInvalidKey, m.End, m.Key)
+	}
+	return nil
+}
+
+// hasRange reports whether muts include a range delete.
+func hasRange(muts []Mutation) bool {
+	for _, m := range muts {
+		if m.End != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// ExpiryFor converts a TTL into the absolute expiry stored in DBEntry.
+// A zero TTL never expires.
+func ExpiryFor(ttl time.Duration) int64 {
+	if ttl == 0 {
+		return math.MaxInt64
+	}
+	return time.Now().Add(ttl).UnixNano()
+}
@@ -0,0 +1,203 @@
+package datastore
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/linxGnu/grocksdb"
+)
+
+const (
+	// logPrefix holds the durable change log, one record per write sequence,
+	// keyed so that key order is sequence order.
+	logPrefix = ReservedPrefix + "log/"
+	// logEnd sorts after every log key.
+	logEnd = ReservedPrefix + "log0"
+
+	// epochKey persists the change-log epoch so followers can resume across
+	// leader restarts.
+	epochKey = ReservedPrefix + "meta/epoch"
+
+	// DefaultLogRetention is how many changes the durable log keeps when no
+	// retention is configured.
+	DefaultLogRetention = 100000
+
+	// logReadPage bounds how many changes one read from disk returns.
+	logReadPage = 1000
+
+	// pinnedRetention is how many times the configured retention a pinned
+	// reader can hold back trimming, by count and by age. Past that the
+	// records go anyway and the reader has to resync.
+	pinnedRetention = 10
+)
+
+func logKey(seq uint64) []byte {
+	return []byte(fmt.Sprintf("%s%020d", logPrefix, seq))
+}
+
+func newEpoch() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// loadEpoch returns the persisted epoch, creating one on first open.
+func (r *RocksDB) loadEpoch() (string, error) {
+	v, err := r.db.GetBytes(r.readOpts, []byte(epochKey))
+	if err != nil || v != nil {
+		return string(v), err
+	}
+	epoch := newEpoch()
+	if r.opts.ReadOnly {
+		return epoch, nil
+	}
+	return epoch, r.db.Put(r.writeOpts, []byte(epochKey), []byte(epoch))
+}
+
+// logSince reads up to logReadPage changes after seq from the durable log.
+// ok is false when seq+1 has already been trimmed.
+func (r *RocksDB) logSince(seq uint64) ([]Change, bool) {
+	it := r.db.NewIterator(r.readOpts)
+	defer it.Close()
+	var changes []Change
+	for it.Seek(logKey(seq + 1)); it.ValidForPrefix([]byte(logPrefix)) && len(changes) < logReadPage; it.Next() {
+		var c Change
+		if err := json.Unmarshal(it.Value().Data(), &c); err != nil {
+			return nil, false
+		}
+		if len(changes) == 0 && c.Seq != seq+1 {
+			return nil, false
+		}
+		changes = append(changes, c)
+	}
+	if it.Err() != nil || len(changes) == 0 {
+		return nil, false
+	}
+	return changes, true
+}
+
+// logRecord reads the durable record of seq; ok is false if it is gone.
+func (r *RocksDB) logRecord(seq uint64) (c Change, ok bool) {
+	v, err := r.db.GetBytes(r.readOpts, logKey(seq))
+	if err != nil || v == nil || json.Unmarshal(v, &c) != nil {
+		return Change{}, false
+	}
+	return c, true
+}
+
+// logSeqAt finds the last change in the durable log committed at or before
+// t. Records are contiguous from the oldest kept to the head and in commit
+// order, so it bisects on sequence. ok is false when t predates the oldest
+// record and older ones have been trimmed.
+func (r *RocksDB) logSeqAt(t int64) (uint64, bool) {
+	it := r.db.NewIterator(r.readOpts)
+	it.Seek([]byte(logPrefix))
+	if !it.ValidForPrefix([]byte(logPrefix)) {
+		it.Close()
+		return 0, false
+	}
+	var first Change
+	err := json.Unmarshal(it.Value().Data(), &first)
+	it.Close()
+	if err != nil {
+		return 0, false
+	}
+	if first.Time > t {
+		// Everything is newer; that is only the whole story if nothing
+		// was ever trimmed.
+		return 0, first.Seq == 1
+	}
+	lo, hi := first.Seq, r.log.Seq()
+	for lo < hi {
+		mid := lo + (hi-lo+1)/2
+		c, ok := r.logRecord(mid)
+		if !ok {
+			return 0, false
+		}
+		if c.Time <= t {
+			lo = mid
+		} else {
+			hi = mid - 1
+		}
+	}
+	return lo, true
+}
+
+// TrimLog drops durable log records beyond the configured retention, by
+// count and by age, but not records a pinned reader still needs unless they
+// are also beyond pinnedRetention times the retention. It returns the number
+// of records dropped.
+func (r *RocksDB) TrimLog() (int, error) {
+	if r.opts.ReadOnly {
+		return 0, ErrReadOnly
+	}
+	keep := r.opts.LogRetention
+	if keep <= 0 {
+		keep = DefaultLogRetention
+	}
+	r.writeMu.Lock()
+	head := r.seq
+	r.writeMu.Unlock()
+
+	// Everything at or below limit may go on count alone; above it, only
+	// records older than the age cutoff.
+	var limit uint64
+	if head > uint64(keep) {
+		limit = head - uint64(keep)
+	}
+	// A pin holds records above ceiling, but only back to pinCutoff by age
+	// and only ever down to pinnedRetention*keep records below the head.
+	ceiling := head
+	if pin, ok := r.log.Pinned(); ok {
+		ceiling = pin
+		if head-pin > uint64(pinnedRetention*keep) {
+			ceiling = head - uint64(pinnedRetention*keep)
+		}
+	}
+	cutoff, pinCutoff := int64(0), int64(0)
+	if r.opts.LogRetentionAge > 0 {
+		now := time.Now()
+		cutoff = now.Add(-r.opts.LogRetentionAge).UnixNano()
+		pinCutoff = now.Add(-pinnedRetention * r.opts.LogRetentionAge).UnixNano()
+	}
+
+	it := r.db.NewIterator(r.readOpts)
+	defer it.Close()
+	var first, last uint64
+	n := 0
+	for it.Seek([]byte(logPrefix)); it.ValidForPrefix([]byte(logPrefix)); it.Next() {
+		seq, err := strconv.ParseUint(string(it.Key().Data()[len(logPrefix):]), 10, 64)
+		if err != nil {
+			break
+		}
+		if seq > ceiling || seq > limit {
+			var c Change
+			if json.Unmarshal(it.Value().Data(), &c) != nil {
+				break
+			}
+			if seq > ceiling && (pinCutoff == 0 || c.Time >= pinCutoff) {
+				break
+			}
+			if seq > limit && (cutoff == 0 || c.Time >= cutoff) {
+				break
+			}
+		}
+		if n == 0 {
+			first = seq
+		}
+		last = seq
+		n++
+	}
+	if err := it.Err(); err != nil || n == 0 {
+		return 0, err
+	}
+	// One range tombstone rather than a delete per record.
+	wb := grocksdb.NewWriteBatch()
+	defer wb.Destroy()
+	wb.DeleteRange(logKey(first), logKey(last+1))
+	return n, r.db.Write(r.writeOpts, wb)
+}
@@ -0,0 +1,72 @@
+package datastore
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// formatKey holds the on-disk format version the data was written in.
+const formatKey = ReservedPrefix + "meta/format"
+
+// FormatVersion is the on-disk format this binary writes. Bump it, and append
+// to migrations, whenever the stored encoding (see entryCodec) changes.
+//
+//	0: no marker; JSON DBEntry without seq (stores created before versioning)
+//	1: JSON DBEntry with seq
+//	2: values may be stored compressed
+const FormatVersion = 2
+
+// migration upgrades a store from version from to from+1. run must be safe to
+// re-run if it is interrupted, since the version is only bumped after it
+// succeeds. A nil run means the old format is still readable as is and only
+// the marker changes, so read-only opens need not refuse it.
+type migration struct {
+	from int
+	name string
+	run  func(r *RocksDB) error
+}
+
+var migrations = []migration{
+	{from: 0, name: "add format marker"},
+	{from: 1, name: "allow compressed values"},
+}
+
+// checkFormat reads the store's format version and brings it up to date. It
+// refuses stores newer than this binary understands, and read-only stores
+// that would need a real migration, rather than misparse their entries.
+func (r *RocksDB) checkFormat() error {
+	v, err := r.db.GetBytes(r.readOpts, []byte(formatKey))
+	if err != nil {
+		return err
+	}
+	version := 0
+	if v != nil {
+		if version, err = strconv.Atoi(string(v)); err != nil {
+			return fmt.Errorf("bad format version %q: %w", v, err)
+		}
+	}
+	if version > FormatVersion {
+		return fmt.Errorf("store format version %d is newer than this binary supports (%d); upgrade the server", version, FormatVersion)
+	}
+	for _, m := range migrations {
+		if m.from < version {
+			continue
+		}
+		if r.opts.ReadOnly {
+			if m.run != nil {
+				return fmt.Errorf("store format version %d needs migration %q; open it read-write once first", version, m.name)
+			}
+			continue
+		}
+		if m.run != nil {
+			if err := m.run(r); err != nil {
+				return fmt.Errorf("migration %q from format version %d: %w", m.name, m.from, err)
+			}
+		}
+		version = m.from + 1
+		if err := r.db.Put(r.writeOpts, []byte(formatKey), []byte(strconv.Itoa(version))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+package datastore
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+)
+
+// idemPrefix holds idempotency records. They are ordinary entries with an
+// expiry, and unlike other internal keys the cleaner and compaction reap
+// them once retention has passed. They ride the change log to followers like
+// any other write.
+const idemPrefix = ReservedPrefix + "idem/"
+
+// Idempotency identifies a request whose outcome is recorded in the same
+// batch as its writes, so a retry either finds the record or finds nothing
+// written.
+type Idempotency struct {
+	ID     string // the client's idempotency key
+	Type   string // request type, checked on replay
+	Hash   string // digest of the request, checked on replay
+	Expiry int64  // when the record may be forgotten
+}
+
+// IdempotencyRecord is what a recorded request left behind: enough to tell a
+// retry from a different request reusing the key, and the response data to
+// replay.
+type IdempotencyRecord struct {
+	Type string          `json:"type"`
+	Hash string          `json:"hash"`
+	Data json.RawMessage `json:"data,omitempty"`
+}
+
+// Mutation returns the write that records the request with data as its
+// response data (nil for none).
+func (i *Idempotency) Mutation(data json.RawMessage) Mutation {
+	b, _ := json.Marshal(IdempotencyRecord{Type: i.Type, Hash: i.Hash, Data: data})
+	return Mutation{Key: idemPrefix + i.ID, Value: b, Expiry: i.Expiry}
+}
+
+// isIdempotencyKey reports whether key holds an idempotency record; Write
+// accepts these even though they are reserved.
+func isIdempotencyKey(key string) bool {
+	return strings.HasPrefix(key, idemPrefix) && len(key) > len(idemPrefix)
+}
+
+// Recall returns the live record stored for idempotency key id, if any.
+func Recall(ds Datastore, id string) (IdempotencyRecord, bool, error) {
+	e, ok, err := ds.GetEntry(idemPrefix + id)
+	if err != nil || !ok || e.Expired(time.Now().UnixNano()) {
+		return IdempotencyRecord{}, false, err
+	}
+	var rec IdempotencyRecord
+	if err := json.Unmarshal(e.Value, &rec); err != nil {
+		return IdempotencyRecord{}, false, err
+	}
+	return rec, true, nil
+}
@@ -0,0 +1,54 @@
+package datastore
+
+import (
+	"testing"
+	"time"
+)
+
+func TestExpiredIdempotencyRecordsAreReaped(t *testing.T) {
+	r, err := NewRocksDB(t.TempDir(), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	rec := &Idempotency{ID: "req-1", Type: "UPDATE", Hash: "h", Expiry: time.Now().Add(-time.Second).UnixNano()}
+	if err := r.Write([]Mutation{rec.Mutation(nil)}); err != nil {
+		t.Fatal(err)
+	}
+	key := idemPrefix + rec.ID
+
+	expired, _, err := r.ScanExpired("", 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, k := range expired {
+		if k == key {
+			found = true
+		} else if IsReserved(k) {
+			t.Errorf("ScanExpired returned internal key %q", k)
+		}
+	}
+	if !found {
+		t.Fatalf("ScanExpired = %q, want it to include %q", expired, key)
+	}
+	if n, err := r.DeleteExpired(expired); err != nil || n != len(expired) {
+		t.Fatalf("DeleteExpired = %d, %v, want %d", n, err, len(expired))
+	}
+	if _, ok, err := r.GetEntry(key); err != nil || ok {
+		t.Errorf("GetEntry after reaping = %v, %v, want the record gone", ok, err)
+	}
+
+	stored, err := r.codec.Encode(DBEntry{Expiry: 1, Value: []byte(`{}`)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := expiryFilter{codec: r.codec}
+	if remove, _ := f.Filter(0, []byte(key), stored); !remove {
+		t.Errorf("compaction keeps expired idempotency record %q", key)
+	}
+	if remove, _ := f.Filter(0, []byte(seqKey), stored); remove {
+		t.Errorf("compaction drops internal key %q", seqKey)
+	}
+}
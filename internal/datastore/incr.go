@@ -0,0 +1,143 @@
+package datastore
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+)
+
+var (
+	// ErrNotInteger is returned by Increment for a live key whose value is
+	// not a JSON integer.
+	ErrNotInteger = errors.New("value is not an integer")
+	// ErrOutOfRange is returned by Increment when a result falls outside its
+	// bounds and the increment asked to be rejected rather than clamped, or
+	// when it would overflow an int64.
+	ErrOutOfRange = errors.New("result out of range")
+)
+
+// Increment adds By to the integer stored at Key. A missing or expired key
+// counts as 0 and is created with Expiry; a live key keeps its expiry. A
+// result outside [Min, Max] (nil = unbounded) is clamped to the bound it
+// crossed, or with Reject fails the whole batch with ErrOutOfRange.
+type Increment struct {
+	Key      string
+	By       int64
+	Min, Max *int64
+	Reject   bool
+	Expiry   int64
+}
+
+// IncrResult is the value an Increment stored.
+type IncrResult struct {
+	Value   int64 `json:"value"`
+	Clamped bool  `json:"clamped,omitempty"` // the result was held at Min or Max
+}
+
+// apply computes inc against the current value cur.
+func (inc Increment) apply(cur int64) (IncrResult, error) {
+	sum := cur + inc.By
+	if (inc.By > 0 && sum < cur) || (inc.By < 0 && sum > cur) {
+		return IncrResult{}, fmt.Errorf("%w: %q overflows", ErrOutOfRange, inc.Key)
+	}
+	res := IncrResult{Value: sum}
+	if inc.Max != nil && sum > *inc.Max {
+		res = IncrResult{Value: *inc.Max, Clamped: true}
+	}
+	if inc.Min != nil && sum < *inc.Min {
+		res = IncrResult{Value: *inc.Min, Clamped: true}
+	}
+	if res.Clamped && inc.Reject {
+		return IncrResult{}, fmt.Errorf("%w: %q would be %d", ErrOutOfRange, inc.Key, sum)
+	}
+	return res, nil
+}
+
+// parseInt reads a stored value as an int64. Integral numbers written with
+// an exponent or fraction, such as 1e3 or 5.0, are accepted.
+func parseInt(raw json.RawMessage) (int64, bool) {
+	s := string(bytes.TrimSpace(raw))
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return n, true
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil || f != math.Trunc(f) || f < math.MinInt64 || f >= math.MaxInt64 {
+		return 0, false
+	}
+	return int64(f), true
+}
+
+// Increment applies incs atomically in one batch, under the write lock so
+// no other write interleaves between reading and writing a counter. If any
+// increment fails nothing is written. A key named more than once is
+// incremented once per occurrence, in order. A non-nil rec is recorded in
+// the same batch with the results as its response data, as are extra.
+func (r *RocksDB) Increment(incs []Increment, rec *Idempotency, extra ...Mutation) (map[string]IncrResult, error) {
+	if r.opts.ReadOnly {
+		return nil, ErrReadOnly
+	}
+	for _, inc := range incs {
+		if err := ValidateKey(inc.Key); err != nil {
+			return nil, err
+		}
+	}
+	if err := validateExtra(extra); err != nil {
+		return nil, err
+	}
+	r.writeMu.Lock()
+	defer r.writeMu.Unlock()
+	now := time.Now().UnixNano()
+	res := make(map[string]IncrResult, len(incs))
+	pending := make(map[string]int) // key -> index in muts
+	muts := make([]Mutation, 0, len(incs))
+	for _, inc := range incs {
+		var cur int64
+		expiry := inc.Expiry
+		if i, ok := pending[inc.Key]; ok {
+			cur, _ = parseInt(muts[i].Value)
+			expiry = muts[i].Expiry
+		} else {
+			v, err := r.db.GetBytes(r.readOpts, []byte(inc.Key))
+			if err != nil {
+				return nil, err
+			}
+			if v != nil {
+				e, err := r.decode(inc.Key, v)
+				if err != nil {
+					return nil, err
+				}
+				if !e.Expired(now) {
+					n, ok := parseInt(e.Value)
+					if !ok {
+						return nil, fmt.Errorf("%w: %q", ErrNotInteger, inc.Key)
+					}
+					cur, expiry = n, e.Expiry
+				}
+			}
+		}
+		out, err := inc.apply(cur)
+		if err != nil {
+			return nil, err
+		}
+		res[inc.Key] = out
+		m := Mutation{Key: inc.Key, Value: json.RawMessage(strconv.FormatInt(out.Value, 10)), Expiry: expiry}
+		if i, ok := pending[inc.Key]; ok {
+			muts[i] = m
+		} else {
+			pending[inc.Key] = len(muts)
+			muts = append(muts, m)
+		}
+	}
+	if rec != nil {
+		data, _ := json.Marshal(res)
+		muts = append(muts, rec.Mutation(data))
+	}
+	if err := r.writeLocked(r.writeOpts, append(muts, extra...)); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
@@ -0,0 +1,91 @@
+package datastore
+
+import (
+	"bytes"
+
+	"github.com/linxGnu/grocksdb"
+)
+
+// prefixCountLimit bounds how many keys PrefixSize steps over to count them.
+const prefixCountLimit = 100000
+
+// PrefixSize estimates the bytes and number of keys stored under prefix. The
+// size comes from SST file metadata, so data still in memtables is missed
+// and entries awaiting deletion or compaction are included. Keys are counted
+// by walking them (expired ones included), up to prefixCountLimit; past that
+// the count is extrapolated from the size of the part walked. Both are cheap
+// next to a scan that decodes values.
+func (r *RocksDB) PrefixSize(prefix string) (size, keys int64, err error) {
+	start := []byte(prefix)
+	var limit []byte
+	it := r.db.NewIterator(r.readOpts)
+	defer it.Close()
+	if prefix == "" {
+		it.SeekToLast()
+		if !it.Valid() {
+			return 0, 0, it.Err()
+		}
+		// The range end is exclusive, so stop just past the last key.
+		limit = append(append([]byte(nil), it.Key().Data()...), 0)
+	} else {
+		limit = prefixEnd(prefix)
+	}
+
+	var last []byte
+	for it.Seek(start); it.ValidForPrefix(start); it.Next() {
+		k := it.Key().Data()
+		if IsReserved(string(k)) {
+			continue
+		}
+		if keys++; keys == prefixCountLimit {
+			last = append(append([]byte(nil), k...), 0)
+			break
+		}
+	}
+	if err := it.Err(); err != nil {
+		return 0, 0, err
+	}
+
+	ranges := clientRanges(start, limit)
+	n := len(ranges)
+	if last != nil {
+		ranges = append(ranges, clientRanges(start, last)...)
+	}
+	sizes, err := r.db.GetApproximateSizes(ranges)
+	if err != nil {
+		return 0, 0, err
+	}
+	var walked uint64
+	for i, s := range sizes {
+		if i < n {
+			size += int64(s)
+		} else {
+			walked += s
+		}
+	}
+	if last != nil && walked > 0 {
+		keys = int64(float64(keys) * float64(size) / float64(walked))
+	}
+	return size, keys, nil
+}
+
+// clientRanges returns [start, limit) with the reserved keyspace cut out.
+func clientRanges(start, limit []byte) []grocksdb.Range {
+	reserved, reservedEnd := []byte(ReservedPrefix), prefixEnd(ReservedPrefix)
+	var out []grocksdb.Range
+	if bytes.Compare(start, reserved) < 0 {
+		end := limit
+		if bytes.Compare(end, reserved) > 0 {
+			end = reserved
+		}
+		out = append(out, grocksdb.Range{Start: start, Limit: end})
+	}
+	if bytes.Compare(limit, reservedEnd) > 0 {
+		begin := start
+		if bytes.Compare(begin, reservedEnd) < 0 {
+			begin = reservedEnd
+		}
+		out = append(out, grocksdb.Range{Start: begin, Limit: limit})
+	}
+	return out
+}
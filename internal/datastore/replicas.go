@@ -0,0 +1,35 @@
+package datastore
+
+import "encoding/json"
+
+// replicaPrefix holds the position each pushed replica has acknowledged,
+// keyed by its URL. Positions are written outside the change log, so
+// recording an acknowledgement isn't itself a change to push.
+const replicaPrefix = ReservedPrefix + "meta/replica/"
+
+// ReplicaPosition is how far a pushed replica has applied the change log:
+// every change up to Seq in epoch Epoch.
+type ReplicaPosition struct {
+	Epoch string `json:"epoch"`
+	Seq   uint64 `json:"seq"`
+}
+
+// ReplicaPosition returns the position last recorded for the replica at
+// url; ok is false if none was.
+func (r *RocksDB) ReplicaPosition(url string) (p ReplicaPosition, ok bool, err error) {
+	v, err := r.db.GetBytes(r.readOpts, []byte(replicaPrefix+url))
+	if err != nil || v == nil {
+		return ReplicaPosition{}, false, err
+	}
+	err = json.Unmarshal(v, &p)
+	return p, err == nil, err
+}
+
+// SetReplicaPosition records the position of the replica at url.
+func (r *RocksDB) SetReplicaPosition(url string, p ReplicaPosition) error {
+	if r.opts.ReadOnly {
+		return ErrReadOnly
+	}
+	b, _ := json.Marshal(p)
+	return r.db.Put(r.writeOpts, []byte(replicaPrefix+url), b)
+}
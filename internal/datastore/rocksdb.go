@@ -1,31 +1,179 @@
 package datastore
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/linxGnu/grocksdb"
 )
 
+// ErrReadOnly is returned by writes against a store opened read-only.
+var ErrReadOnly = errors.New("datastore is read-only")
+
+// ErrLocked is returned by NewRocksDB when another process, or another store
+// in this one, already has the database open for writing.
+var ErrLocked = errors.New("database is locked by another process")
+
+// Options tunes how a RocksDB store is opened and behaves.
+type Options struct {
+	// ReadOnly opens the database without write access. Writes fail with
+	// ErrReadOnly and LazyDelete is forced off.
+	ReadOnly bool
+
+	// LazyDelete deletes expired keys inline when Get observes them. That
+	// turns reads into writes, so read-heavy nodes contend on the write path;
+	// with it off Get just reports a miss and reaping is left to the cleaner.
+	LazyDelete bool
+
+	// ExpiryGrace keeps an expired entry on disk this long past its expiry
+	// before lazy deletion, the cleaner or compaction remove it. Reads treat
+	// it as expired from the moment it expires either way.
+	ExpiryGrace time.Duration
+
+	// MaxPendingCompactionBytes reports the store as write-stalled once
+	// compaction debt reaches it, before RocksDB itself stops writes.
+	// 0 relies on RocksDB's own delay/stop signals only.
+	MaxPendingCompactionBytes uint64
+
+	// LogRetention caps how many recent changes TrimLog keeps in the durable
+	// change log (0 = DefaultLogRetention). LogRetentionAge, if set, also
+	// drops changes older than it.
+	LogRetention    int
+	LogRetentionAge time.Duration
+
+	// Compression (CompressionZstd or CompressionGzip) compresses values of
+	// at least CompressMinBytes (0 = DefaultCompressMinBytes) on write.
+	// Entries are read back whatever they were written with, so it can be
+	// changed on an existing store.
+	Compression      string
+	CompressMinBytes int
+
+	// BlockCacheBytes sizes the LRU cache of uncompressed data blocks
+	// (0 = DefaultBlockCacheBytes).
+	BlockCacheBytes int
+
+	// Tuning picks the compaction style and level settings.
+	Tuning Tuning
+
+	// TrackCreated stamps entries with the time their key was first
+	// written, at the cost of reading the old entry on every put.
+	TrackCreated bool
+
+	// PinnedPrefixes lists prefixes whose keys never expire. Entries under
+	// them read as live whatever expiry they were stored with, and the
+	// cleaner, lazy deletion and compaction never reclaim them.
+	PinnedPrefixes []string
+}
+
+// stallCheckInterval bounds how often the write-stall properties are polled.
+const stallCheckInterval = time.Second
+
 type RocksDB struct {
-	db        *grocksdb.DB
-	readOpts  *grocksdb.ReadOptions
-	writeOpts *grocksdb.WriteOptions
+	db         *grocksdb.DB
+	dbOpts     *grocksdb.Options // kept for the statistics it collects
+	bbto       *grocksdb.BlockBasedTableOptions
+	blockCache *grocksdb.Cache
+	readOpts   *grocksdb.ReadOptions
+	writeOpts  *grocksdb.WriteOptions
+	opts       Options
+	codec      entryCodec
+
+	// writeMu orders commits so sequences and the change log match commit
+	// order.
+	writeMu sync.Mutex
+	seq     uint64
+	log     *ChangeLog
+
+	stalled      atomic.Bool
+	stallChecked atomic.Int64 // unix nanos of the last stall poll
 }
 
-func NewRocksDB(path string) (*RocksDB, error) {
+func NewRocksDB(path string, o Options) (*RocksDB, error) {
+	codec, err := newCodec(o)
+	if err != nil {
+		return nil, err
+	}
+	if o.Tuning, err = o.Tuning.resolve(); err != nil {
+		return nil, err
+	}
 	opts := grocksdb.NewDefaultOptions()
 	opts.SetCreateIfMissing(true)
-	db, err := grocksdb.OpenDb(opts, path)
+	opts.SetCompactionFilter(expiryFilter{codec: codec, grace: o.ExpiryGrace, pinned: o.PinnedPrefixes})
+	o.Tuning.apply(opts)
+	cache, bbto := newBlockCache(opts, o.BlockCacheBytes)
+	var db *grocksdb.DB
+	if o.ReadOnly {
+		o.LazyDelete = false
+		db, err = grocksdb.OpenDbForReadOnly(opts, path, false)
+	} else {
+		db, err = grocksdb.OpenDb(opts, path)
+	}
+	if err != nil {
+		opts.Destroy()
+		bbto.Destroy()
+		cache.Destroy()
+		return nil, lockError(path, err)
+	}
+	r := &RocksDB{
+		db:         db,
+		dbOpts:     opts,
+		bbto:       bbto,
+		blockCache: cache,
+		readOpts:   grocksdb.NewDefaultReadOptions(),
+		writeOpts:  grocksdb.NewDefaultWriteOptions(),
+		opts:       o,
+		codec:      codec,
+	}
+	var epoch string
+	if err = r.checkFormat(); err == nil {
+		if r.seq, err = r.loadSeq(); err == nil {
+			epoch, err = r.loadEpoch()
+		}
+	}
 	if err != nil {
+		r.Close()
 		return nil, err
 	}
-	return &RocksDB{
-		db:        db,
-		readOpts:  grocksdb.NewDefaultReadOptions(),
-		writeOpts: grocksdb.NewDefaultWriteOptions(),
-	}, nil
+	r.log = NewChangeLog(DefaultChangeLogSize, r.seq)
+	r.log.epoch = epoch
+	r.log.older = r.logSince
+	r.log.olderAt = r.logSeqAt
+	if head, ok := r.logRecord(r.seq); ok {
+		r.log.time = head.Time
+	}
+	openStores.Lock()
+	openStores.m[r] = struct{}{}
+	openStores.Unlock()
+	return r, nil
+}
+
+// lockError turns RocksDB's failure to take the directory's LOCK file into
+// ErrLocked. The lock is an advisory file lock the kernel drops when its
+// holder exits, so it is never stale: a held lock means a live writer.
+func lockError(path string, err error) error {
+	msg := err.Error()
+	if strings.Contains(msg, "While lock file") || strings.Contains(msg, "lock hold by current process") {
+		return fmt.Errorf("%w: %s (%v)", ErrLocked, path, err)
+	}
+	return err
+}
+
+// loadSeq reads the last persisted write sequence so it keeps increasing
+// across restarts.
+func (r *RocksDB) loadSeq() (uint64, error) {
+	v, err := r.db.GetBytes(r.readOpts, []byte(seqKey))
+	if err != nil || v == nil {
+		return 0, err
+	}
+	return strconv.ParseUint(string(v), 10, 64)
 }
 
 func (r *RocksDB) Get(key string) (json.RawMessage, bool, error) {
@@ -37,13 +185,14 @@ func (r *RocksDB) Get(key string) (json.RawMessage, bool, error) {
 	if !v.Exists() {
 		return nil, false, nil
 	}
-	var e DBEntry
-	if err := json.Unmarshal(v.Data(), &e); err != nil {
+	e, err := r.decode(key, v.Data())
+	if err != nil {
 		return nil, false, err
 	}
-	now := time.Now().UnixNano()
-	if e.Expiry != math.MaxInt64 && now > e.Expiry {
-		_ = r.db.Delete(r.writeOpts, []byte(key))
+	if now := time.Now().UnixNano(); e.Expired(now) {
+		if r.opts.LazyDelete && r.reapable(e, now) {
+			_, _ = r.DeleteExpired([]string{key})
+		}
 		return nil, false, nil
 	}
 	raw := make([]byte, len(e.Value))
@@ -51,19 +200,106 @@ func (r *RocksDB) Get(key string) (json.RawMessage, bool, error) {
 	return json.RawMessage(raw), true, nil
 }
 
-func (r *RocksDB) Put(key string, value json.RawMessage, ttl time.Duration) error {
-	e := DBEntry{Value: value}
-	if ttl == 0 {
-		e.Expiry = math.MaxInt64
-	} else {
-		e.Expiry = time.Now().Add(ttl).UnixNano()
+// GetEntry returns the full stored wrapper, including expired entries, and
+// never deletes anything.
+func (r *RocksDB) GetEntry(key string) (DBEntry, bool, error) {
+	v, err := r.db.GetBytes(r.readOpts, []byte(key))
+	if err != nil || v == nil {
+		return DBEntry{}, false, err
+	}
+	e, err := r.decode(key, v)
+	if err != nil {
+		return DBEntry{}, false, err
 	}
-	data, _ := json.Marshal(&e)
-	return r.db.Put(r.writeOpts, []byte(key), data)
+	return e, true, nil
+}
+
+func (r *RocksDB) Put(key string, value json.RawMessage, ttl time.Duration) error {
+	return r.Write([]Mutation{{Key: key, Value: value, Expiry: ExpiryFor(ttl)}})
 }
 
 func (r *RocksDB) Delete(key string) error {
-	return r.db.Delete(r.writeOpts, []byte(key))
+	return r.Write([]Mutation{{Key: key, Delete: true}})
+}
+
+// DeleteRange deletes every key in [start, end) with RocksDB's range
+// tombstones rather than one tombstone per key. The store's reserved keys
+// are left alone even when the range spans them. The change log records the
+// range as a single change.
+func (r *RocksDB) DeleteRange(start, end string) error {
+	return r.Write([]Mutation{{Key: start, End: end, Delete: true}})
+}
+
+// Write commits muts atomically in a single WriteBatch. Each mutation,
+// deletes included, consumes the next write sequence; puts stamp it into
+// the stored entry. The new high-water mark and a durable change-log record
+// per mutation are persisted in the same batch.
+func (r *RocksDB) Write(muts []Mutation) error {
+	if r.opts.ReadOnly {
+		return ErrReadOnly
+	}
+	for _, m := range muts {
+		if err := validateWrite(m); err != nil {
+			return err
+		}
+	}
+	r.writeMu.Lock()
+	defer r.writeMu.Unlock()
+	return r.writeLocked(r.writeOpts, muts)
+}
+
+// writeLocked does the work of Write with wo; the caller holds writeMu.
+func (r *RocksDB) writeLocked(wo *grocksdb.WriteOptions, muts []Mutation) error {
+	if len(muts) == 0 {
+		return nil
+	}
+	wb := grocksdb.NewWriteBatch()
+	defer wb.Destroy()
+
+	changes := make([]Change, len(muts))
+	seq := r.seq
+	now := time.Now().UnixNano()
+	var created *createdTracker
+	if r.opts.TrackCreated {
+		created = &createdTracker{r: r, now: now, batch: make(map[string]int64)}
+	}
+	for i, m := range muts {
+		seq++
+		changes[i] = Change{Seq: seq, Time: now, Mutation: m}
+		rec, err := json.Marshal(&changes[i])
+		if err != nil {
+			return err
+		}
+		wb.Put(logKey(seq), rec)
+		if m.Delete && m.End != "" {
+			for _, rg := range clientRanges([]byte(m.Key), []byte(m.End)) {
+				wb.DeleteRange(rg.Start, rg.Limit)
+			}
+			created.deleteRange(m.Key, m.End)
+			continue
+		}
+		if m.Delete {
+			wb.Delete([]byte(m.Key))
+			created.delete(m.Key)
+			continue
+		}
+		e := DBEntry{Expiry: m.Expiry, Seq: seq, Modified: now, Value: m.Value, Encoding: m.Encoding}
+		if e.Created, err = created.put(m.Key); err != nil {
+			return err
+		}
+		data, err := r.codec.Encode(e)
+		if err != nil {
+			return err
+		}
+		wb.Put([]byte(m.Key), data)
+	}
+	wb.Put([]byte(seqKey), []byte(strconv.FormatUint(seq, 10)))
+	if err := r.db.Write(wo, wb); err != nil {
+		return err
+	}
+	r.seq = seq
+	r.log.Append(changes...)
+	return nil
 }
 
 func (r *RocksDB) List() (map[string]interface{}, error) {
@@ -72,23 +308,531 @@ func (r *RocksDB) List() (map[string]interface{}, error) {
 	defer it.Close()
 	now := time.Now().UnixNano()
 	for it.SeekToFirst(); it.Valid(); it.Next() {
-		var e DBEntry
-		if err := json.Unmarshal(it.Value().Data(), &e); err == nil {
-			if e.Expiry == math.MaxInt64 || e.Expiry > now {
+		if IsReserved(string(it.Key().Data())) {
+			continue
+		}
+		if e, err := r.decode(string(it.Key().Data()), it.Value().Data()); err == nil {
+			if !e.Expired(now) {
+				// UseNumber keeps numbers exactly as stored.
+				dec := json.NewDecoder(bytes.NewReader(e.Value))
+				dec.UseNumber()
 				var v interface{}
-				_ = json.Unmarshal(e.Value, &v)
+				_ = dec.Decode(&v)
 				out[string(it.Key().Data())] = v
 			}
 		}
 		it.Key().Free()
 		it.Value().Free()
 	}
+	if err := it.Err(); err != nil {
+		return nil, err
+	}
 	return out, nil
 }
 
+// Scan calls fn for each live entry under prefix in key order, beginning at
+// start (inclusive) when it sorts after the prefix. Iteration stops early when
+// fn returns false.
+func (r *RocksDB) Scan(prefix, start string, fn func(key string, value json.RawMessage) bool) error {
+	it := r.db.NewIterator(r.readOpts)
+	defer it.Close()
+	seek := prefix
+	if start > seek {
+		seek = start
+	}
+	now := time.Now().UnixNano()
+	for it.Seek([]byte(seek)); it.ValidForPrefix([]byte(prefix)); it.Next() {
+		key := string(it.Key().Data())
+		if IsReserved(key) {
+			continue
+		}
+		e, err := r.decode(key, it.Value().Data())
+		if err != nil {
+			continue
+		}
+		if e.Expired(now) {
+			continue
+		}
+		if !fn(key, e.Value) {
+			break
+		}
+	}
+	return it.Err()
+}
+
+// ScanReverse is Scan in descending key order: it calls fn for each live
+// entry under prefix from start (inclusive) downward, or from the last key
+// under prefix when start is "".
+func (r *RocksDB) ScanReverse(prefix, start string, fn func(key string, value json.RawMessage) bool) error {
+	it := r.db.NewIterator(r.readOpts)
+	defer it.Close()
+	var seek []byte
+	if prefix != "" {
+		seek = prefixEnd(prefix)
+	}
+	if start != "" && (seek == nil || start < string(seek)) {
+		seek = []byte(start)
+	}
+	if seek != nil {
+		// Lands on the last key at or before seek; the end bound of prefix
+		// itself is stepped past below.
+		it.SeekForPrev(seek)
+	} else {
+		it.SeekToLast()
+	}
+	now := time.Now().UnixNano()
+	for it.Valid() {
+		key := string(it.Key().Data())
+		switch {
+		case key >= logPrefix && key < logEnd:
+			// Jump over the change log rather than stepping through it.
+			it.SeekForPrev([]byte(logPrefix))
+			continue
+		case !strings.HasPrefix(key, prefix):
+			if key < prefix {
+				return it.Err()
+			}
+		case IsReserved(key):
+		default:
+			e, err := r.decode(key, it.Value().Data())
+			if err == nil && !e.Expired(now) && !fn(key, e.Value) {
+				return it.Err()
+			}
+		}
+		it.Prev()
+	}
+	return it.Err()
+}
+
+// ScanRaw calls fn with the stored bytes of every key under prefix from start
+// on, in key order: internal keys and expired entries included. It is for
+// debugging; client-facing enumeration uses Scan.
+func (r *RocksDB) ScanRaw(prefix, start string, fn func(key string, stored []byte) bool) error {
+	it := r.db.NewIterator(r.readOpts)
+	defer it.Close()
+	for it.Seek([]byte(max(prefix, start))); it.ValidForPrefix([]byte(prefix)); it.Next() {
+		stored := append([]byte(nil), it.Value().Data()...)
+		if !fn(string(it.Key().Data()), stored) {
+			break
+		}
+	}
+	return it.Err()
+}
+
+// ScanExpired examines up to limit keys starting at start and returns those
+// that have expired past ExpiryGrace, plus the key to resume from ("" once the keyspace is
+// exhausted). Bounding by keys examined, not found, keeps each call cheap.
+// Idempotency records are the only internal keys it returns.
+func (r *RocksDB) ScanExpired(start string, limit int) ([]string, string, error) {
+	it := r.db.NewIterator(r.readOpts)
+	defer it.Close()
+	var expired []string
+	now := time.Now().UnixNano()
+	n := 0
+	for it.Seek([]byte(start)); it.Valid(); it.Next() {
+		key := string(it.Key().Data())
+		if key >= logPrefix && key < logEnd {
+			// The change log is trimmed by TrimLog, not expiry; skip it whole.
+			it.Seek([]byte(logEnd))
+			if !it.Valid() {
+				break
+			}
+			key = string(it.Key().Data())
+		}
+		if n == limit {
+			return expired, key, it.Err()
+		}
+		n++
+		if IsReserved(key) && !isIdempotencyKey(key) {
+			continue
+		}
+		if e, err := r.decode(key, it.Value().Data()); err == nil && r.reapable(e, now) {
+			expired = append(expired, key)
+		}
+	}
+	return expired, "", it.Err()
+}
+
+// decode decodes the stored entry of key, dropping its expiry if key is
+// pinned.
+func (r *RocksDB) decode(key string, v []byte) (DBEntry, error) {
+	e, err := r.codec.Decode(v)
+	if err == nil && pinned(r.opts.PinnedPrefixes, key) {
+		e.Expiry = math.MaxInt64
+	}
+	return e, err
+}
+
+// reapable reports whether e has been expired for longer than ExpiryGrace
+// at now, so it may be deleted.
+func (r *RocksDB) reapable(e DBEntry, now int64) bool {
+	return e.Expired(now - int64(r.opts.ExpiryGrace))
+}
+
+// DeleteExpired deletes those keys that are still expired past ExpiryGrace,
+// re-checking each under the write lock so a concurrent Put of a fresh value
+// is never lost.
+func (r *RocksDB) DeleteExpired(keys []string) (int, error) {
+	if r.opts.ReadOnly {
+		return 0, ErrReadOnly
+	}
+	r.writeMu.Lock()
+	defer r.writeMu.Unlock()
+	now := time.Now().UnixNano()
+	var muts []Mutation
+	for _, k := range keys {
+		v, err := r.db.GetBytes(r.readOpts, []byte(k))
+		if err != nil {
+			return 0, err
+		}
+		if v == nil {
+			continue
+		}
+		if e, err := r.decode(k, v); err == nil && r.reapable(e, now) {
+			muts = append(muts, Mutation{Key: k, Delete: true})
+		}
+	}
+	return len(muts), r.writeLocked(r.writeOpts, muts)
+}
+
+// Touch sets a live key's expiry, keeping its value, and reports whether the
+// key was live. Missing and expired keys are left alone rather than revived.
+// The rewrite is a normal write: it takes a sequence and a change-log record.
+func (r *RocksDB) Touch(key string, expiry int64) (bool, error) {
+	refreshed, err := r.touch([]string{key}, expiry)
+	return len(refreshed) > 0, err
+}
+
+// GetOrSet returns key's live entry, or stores value with ttl when there is
+// none and returns the entry written; set reports which. The read and the write happen
+// under the write lock, so concurrent callers all get the same value.
+// Extra is committed either way, with the value if it is set.
+func (r *RocksDB) GetOrSet(key string, value json.RawMessage, ttl time.Duration, extra ...Mutation) (DBEntry, bool, error) {
+	if r.opts.ReadOnly {
+		return DBEntry{}, false, ErrReadOnly
+	}
+	m := Mutation{Key: key, Value: value, Expiry: ExpiryFor(ttl)}
+	if err := validateWrite(m); err != nil {
+		return DBEntry{}, false, err
+	}
+	if err := validateExtra(extra); err != nil {
+		return DBEntry{}, false, err
+	}
+	r.writeMu.Lock()
+	defer r.writeMu.Unlock()
+	v, err := r.db.GetBytes(r.readOpts, []byte(key))
+	if err != nil {
+		return DBEntry{}, false, err
+	}
+	if v != nil {
+		e, err := r.decode(key, v)
+		if err != nil {
+			return DBEntry{}, false, err
+		}
+		if !e.Expired(time.Now().UnixNano()) {
+			return e, false, r.writeLocked(r.writeOpts, extra)
+		}
+	}
+	if err := r.writeLocked(r.writeOpts, append([]Mutation{m}, extra...)); err != nil {
+		return DBEntry{}, false, err
+	}
+	return DBEntry{Expiry: m.Expiry, Value: value}, true, nil
+}
+
+// GetAndDelete returns key's live entry and deletes it; ok is false, and
+// nothing but extra is written, when there is none. The read and the delete
+// happen under the write lock, so of concurrent callers only one gets the
+// value.
+func (r *RocksDB) GetAndDelete(key string, extra ...Mutation) (DBEntry, bool, error) {
+	if r.opts.ReadOnly {
+		return DBEntry{}, false, ErrReadOnly
+	}
+	m := Mutation{Key: key, Delete: true}
+	if err := validateWrite(m); err != nil {
+		return DBEntry{}, false, err
+	}
+	if err := validateExtra(extra); err != nil {
+		return DBEntry{}, false, err
+	}
+	r.writeMu.Lock()
+	defer r.writeMu.Unlock()
+	v, err := r.db.GetBytes(r.readOpts, []byte(key))
+	if err != nil {
+		return DBEntry{}, false, err
+	}
+	if v == nil {
+		return DBEntry{}, false, r.writeLocked(r.writeOpts, extra)
+	}
+	e, err := r.decode(key, v)
+	if err != nil {
+		return DBEntry{}, false, err
+	}
+	if e.Expired(time.Now().UnixNano()) {
+		return DBEntry{}, false, r.writeLocked(r.writeOpts, extra)
+	}
+	if err := r.writeLocked(r.writeOpts, append([]Mutation{m}, extra...)); err != nil {
+		return DBEntry{}, false, err
+	}
+	return e, true, nil
+}
+
+// TouchMany is Touch for several keys, committed in one batch with extra,
+// with the new expiry ttl from now. It returns the keys that were live and
+// refreshed.
+func (r *RocksDB) TouchMany(keys []string, ttl time.Duration, extra ...Mutation) ([]string, error) {
+	return r.touch(keys, ExpiryFor(ttl), extra...)
+}
+
+func (r *RocksDB) touch(keys []string, expiry int64, extra ...Mutation) ([]string, error) {
+	if r.opts.ReadOnly {
+		return nil, ErrReadOnly
+	}
+	if err := validateExtra(extra); err != nil {
+		return nil, err
+	}
+	r.writeMu.Lock()
+	defer r.writeMu.Unlock()
+	now := time.Now().UnixNano()
+	var refreshed []string
+	var muts []Mutation
+	for _, k := range keys {
+		v, err := r.db.GetBytes(r.readOpts, []byte(k))
+		if err != nil {
+			return nil, err
+		}
+		if v == nil {
+			continue
+		}
+		e, err := r.decode(k, v)
+		if err != nil {
+			return nil, err
+		}
+		if e.Expired(now) {
+			continue
+		}
+		refreshed = append(refreshed, k)
+		muts = append(muts, Mutation{Key: k, Value: e.Value, Expiry: expiry, Encoding: e.Encoding})
+	}
+	if err := r.writeLocked(r.writeOpts, append(muts, extra...)); err != nil {
+		return nil, err
+	}
+	return refreshed, nil
+}
+
+// Clear deletes every key, and the change log with them, using range
+// deletes rather than one tombstone per key, then compacts to reclaim the
+// space. The log gets a new epoch, and the flush takes a write sequence of
+// its own with no change recorded at it, so every reader of the log, even
+// one that had read all of it, finds a gap and resyncs: followers, replica
+// fan-out, CHANGES and WATCH.
+func (r *RocksDB) Clear() error {
+	if r.opts.ReadOnly {
+		return ErrReadOnly
+	}
+	r.writeMu.Lock()
+	defer r.writeMu.Unlock()
+
+	wb := grocksdb.NewWriteBatch()
+	defer wb.Destroy()
+	// Client keys sort on both sides of the reserved prefix.
+	wb.DeleteRange([]byte(""), []byte(ReservedPrefix))
+	reservedEnd := prefixEnd(ReservedPrefix)
+	it := r.db.NewIterator(r.readOpts)
+	it.SeekToLast()
+	if it.Valid() {
+		// The range end is exclusive, so stop just past the last key.
+		last := append(append([]byte(nil), it.Key().Data()...), 0)
+		if string(last) > string(reservedEnd) {
+			wb.DeleteRange(reservedEnd, last)
+		}
+	}
+	err := it.Err()
+	it.Close()
+	if err != nil {
+		return err
+	}
+	wb.DeleteRange([]byte(logPrefix), prefixEnd(logPrefix))
+	epoch := newEpoch()
+	wb.Put([]byte(epochKey), []byte(epoch))
+	seq := r.seq + 1
+	wb.Put([]byte(seqKey), []byte(strconv.FormatUint(seq, 10)))
+	if err := r.db.Write(r.writeOpts, wb); err != nil {
+		return err
+	}
+	r.seq = seq
+	r.log.Reset(epoch, seq)
+	r.db.CompactRange(grocksdb.Range{})
+	return nil
+}
+
+// bulkBatchSize is how many mutations BulkImport commits per batch.
+const bulkBatchSize = 1000
+
+// BulkImport loads muts in batches of bulkBatchSize with the write-ahead log
+// disabled and flushes the memtables once done, which is much faster than
+// Write for seeding a store. It is not atomic and writes are not durable
+// until it returns, so only use it on a store that can be reloaded from
+// scratch if the import is interrupted.
+func (r *RocksDB) BulkImport(muts []Mutation) error {
+	if r.opts.ReadOnly {
+		return ErrReadOnly
+	}
+	wo := grocksdb.NewDefaultWriteOptions()
+	defer wo.Destroy()
+	wo.DisableWAL(true)
+	r.writeMu.Lock()
+	defer r.writeMu.Unlock()
+	for len(muts) > 0 {
+		n := min(len(muts), bulkBatchSize)
+		if err := r.writeLocked(wo, muts[:n]); err != nil {
+			return err
+		}
+		muts = muts[n:]
+	}
+	fo := grocksdb.NewDefaultFlushOptions()
+	defer fo.Destroy()
+	fo.SetWait(true)
+	return r.db.Flush(fo)
+}
+
+// Seq returns the sequence of the most recent committed write.
+func (r *RocksDB) Seq() uint64 {
+	r.writeMu.Lock()
+	defer r.writeMu.Unlock()
+	return r.seq
+}
+
+func (r *RocksDB) Stats() map[string]interface{} {
+	pending := r.PendingCompactionBytes()
+	delayed, _ := r.db.GetIntProperty("rocksdb.actual-delayed-write-rate")
+	return map[string]interface{}{
+		"sequence":               r.Seq(),
+		"writeStalled":           r.WriteStalled(),
+		"pendingCompactionBytes": pending,
+		"delayedWriteRate":       delayed,
+		"blockCache":             r.blockCacheStats(),
+		"tuning":                 r.opts.Tuning.stats(),
+	}
+}
+
+// WriteStalled reports whether RocksDB is stopping or delaying writes, or
+// compaction debt is over the configured limit. The answer is cached for
+// stallCheckInterval so it is cheap to ask on every write.
+func (r *RocksDB) WriteStalled() bool {
+	now := time.Now().UnixNano()
+	last := r.stallChecked.Load()
+	if now-last >= int64(stallCheckInterval) && r.stallChecked.CompareAndSwap(last, now) {
+		r.stalled.Store(r.checkStall())
+	}
+	return r.stalled.Load()
+}
+
+// PendingCompactionBytes is RocksDB's estimate of the bytes compaction must
+// rewrite to bring every level back under its target size.
+func (r *RocksDB) PendingCompactionBytes() uint64 {
+	v, _ := r.db.GetIntProperty("rocksdb.estimate-pending-compaction-bytes")
+	return v
+}
+
+func (r *RocksDB) checkStall() bool {
+	if v, ok := r.db.GetIntProperty("rocksdb.is-write-stopped"); ok && v > 0 {
+		return true
+	}
+	if v, ok := r.db.GetIntProperty("rocksdb.actual-delayed-write-rate"); ok && v > 0 {
+		return true
+	}
+	if max := r.opts.MaxPendingCompactionBytes; max > 0 && r.PendingCompactionBytes() >= max {
+		return true
+	}
+	return false
+}
+
+// properties is the curated set of RocksDB properties worth surfacing when
+// diagnosing performance.
+var properties = []string{
+	"rocksdb.stats",
+	"rocksdb.estimate-num-keys",
+	"rocksdb.estimate-live-data-size",
+	"rocksdb.total-sst-files-size",
+	"rocksdb.cur-size-all-mem-tables",
+	"rocksdb.compaction-pending",
+	"rocksdb.estimate-pending-compaction-bytes",
+	"rocksdb.num-running-compactions",
+	"rocksdb.num-running-flushes",
+	"rocksdb.actual-delayed-write-rate",
+	"rocksdb.is-write-stopped",
+	"rocksdb.block-cache-capacity",
+	"rocksdb.block-cache-usage",
+	"rocksdb.block-cache-pinned-usage",
+}
+
+// Properties returns the curated RocksDB properties plus per-level file
+// counts. Properties this RocksDB build doesn't know are omitted.
+func (r *RocksDB) Properties() (map[string]string, error) {
+	out := make(map[string]string, len(properties)+7)
+	for _, p := range properties {
+		if v := r.db.GetProperty(p); v != "" {
+			out[p] = v
+		}
+	}
+	for level := 0; level < 7; level++ {
+		p := "rocksdb.num-files-at-level" + strconv.Itoa(level)
+		if v := r.db.GetProperty(p); v != "" {
+			out[p] = v
+		}
+	}
+	return out, nil
+}
+
+// ChangeLog exposes the log of committed mutations for replication.
+func (r *RocksDB) ChangeLog() *ChangeLog {
+	return r.log
+}
+
+// Snapshot calls fn for every live entry as of a single point in time and
+// returns the change-log sequence that point corresponds to.
+func (r *RocksDB) Snapshot(fn func(Mutation) error) (uint64, error) {
+	r.writeMu.Lock()
+	snap := r.db.NewSnapshot()
+	seq := r.seq
+	r.writeMu.Unlock()
+	defer r.db.ReleaseSnapshot(snap)
+
+	ro := grocksdb.NewDefaultReadOptions()
+	defer ro.Destroy()
+	ro.SetSnapshot(snap)
+	it := r.db.NewIterator(ro)
+	defer it.Close()
+	now := time.Now().UnixNano()
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+		if IsReserved(string(it.Key().Data())) {
+			continue
+		}
+		e, err := r.decode(string(it.Key().Data()), it.Value().Data())
+		if err != nil {
+			continue
+		}
+		if e.Expired(now) {
+			continue
+		}
+		m := Mutation{Key: string(it.Key().Data()), Expiry: e.Expiry, Encoding: e.Encoding}
+		m.Value = append(json.RawMessage(nil), e.Value...)
+		if err := fn(m); err != nil {
+			return 0, err
+		}
+	}
+	return seq, it.Err()
+}
+
 func (r *RocksDB) Close() error {
+	openStores.Lock()
+	delete(openStores.m, r)
+	openStores.Unlock()
 	r.readOpts.Destroy()
 	r.writeOpts.Destroy()
 	r.db.Close()
+	r.dbOpts.Destroy()
+	r.bbto.Destroy()
+	r.blockCache.Destroy()
 	return nil
 }
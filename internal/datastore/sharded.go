@@ -0,0 +1,515 @@
+package datastore
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// shardsKey records the shard count in every shard so the store refuses to
+// open with a different count (which would silently misroute keys).
+const shardsKey = ReservedPrefix + "meta/shards"
+
+// Sharded spreads keys over N independent RocksDB instances, each in its own
+// directory, so writes, flushes and compaction proceed in parallel. Keys are
+// routed by FNV-1a(key) mod N; the count is fixed once the store is created.
+//
+// Batches are split per shard and each shard commits its part in one
+// WriteBatch, so a batch is atomic within a shard but not across shards.
+// Each shard keeps its own write sequence, so the store has no global change
+// log: replication and CHANGES need a single unsharded store.
+type Sharded struct {
+	shards []*RocksDB
+}
+
+// NewSharded opens (or creates) n shards under path/shard-NNN. The block
+// cache budget in o is split evenly between them.
+func NewSharded(path string, n int, o Options) (*Sharded, error) {
+	if n < 1 {
+		return nil, fmt.Errorf("shard count must be at least 1, got %d", n)
+	}
+	if o.BlockCacheBytes <= 0 {
+		o.BlockCacheBytes = DefaultBlockCacheBytes
+	}
+	o.BlockCacheBytes /= n
+	s := &Sharded{}
+	for i := 0; i < n; i++ {
+		r, err := NewRocksDB(filepath.Join(path, fmt.Sprintf("shard-%03d", i)), o)
+		if err == nil {
+			err = r.checkShardCount(n)
+			if err != nil {
+				r.Close()
+			}
+		}
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		s.shards = append(s.shards, r)
+	}
+	return s, nil
+}
+
+// checkShardCount stamps a fresh shard with n, or verifies an existing one.
+func (r *RocksDB) checkShardCount(n int) error {
+	v, err := r.db.GetBytes(r.readOpts, []byte(shardsKey))
+	if err != nil {
+		return err
+	}
+	if v == nil {
+		if r.opts.ReadOnly {
+			return nil
+		}
+		return r.db.Put(r.writeOpts, []byte(shardsKey), []byte(strconv.Itoa(n)))
+	}
+	if string(v) != strconv.Itoa(n) {
+		return fmt.Errorf("store was created with %s shards, not %d", v, n)
+	}
+	return nil
+}
+
+func (s *Sharded) shardFor(key string) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % uint32(len(s.shards)))
+}
+
+func (s *Sharded) shard(key string) *RocksDB {
+	return s.shards[s.shardFor(key)]
+}
+
+func (s *Sharded) Get(key string) (json.RawMessage, bool, error) {
+	return s.shard(key).Get(key)
+}
+
+func (s *Sharded) GetEntry(key string) (DBEntry, bool, error) {
+	return s.shard(key).GetEntry(key)
+}
+
+func (s *Sharded) Put(key string, value json.RawMessage, ttl time.Duration) error {
+	return s.shard(key).Put(key, value, ttl)
+}
+
+func (s *Sharded) Delete(key string) error {
+	return s.shard(key).Delete(key)
+}
+
+// DeleteRange deletes the range on every shard, since keys are spread by
+// hash; it is atomic per shard only.
+func (s *Sharded) DeleteRange(start, end string) error {
+	return s.Write([]Mutation{{Key: start, End: end, Delete: true}})
+}
+
+func (s *Sharded) Touch(key string, expiry int64) (bool, error) {
+	return s.shard(key).Touch(key, expiry)
+}
+
+// GetOrSet runs on key's shard. Extra goes to its own shards afterwards,
+// like an idempotency record.
+func (s *Sharded) GetOrSet(key string, value json.RawMessage, ttl time.Duration, extra ...Mutation) (DBEntry, bool, error) {
+	e, set, err := s.shard(key).GetOrSet(key, value, ttl)
+	if err != nil {
+		return DBEntry{}, false, err
+	}
+	return e, set, s.Write(extra)
+}
+
+// GetAndDelete runs on key's shard. Extra goes to its own shards
+// afterwards, like an idempotency record.
+func (s *Sharded) GetAndDelete(key string, extra ...Mutation) (DBEntry, bool, error) {
+	e, ok, err := s.shard(key).GetAndDelete(key)
+	if err != nil {
+		return DBEntry{}, false, err
+	}
+	return e, ok, s.Write(extra)
+}
+
+// TouchMany commits one batch per shard, in parallel, then extra.
+func (s *Sharded) TouchMany(keys []string, ttl time.Duration, extra ...Mutation) ([]string, error) {
+	groups := make(map[int][]Mutation)
+	for _, k := range keys {
+		i := s.shardFor(k)
+		groups[i] = append(groups[i], Mutation{Key: k})
+	}
+	var (
+		mu        sync.Mutex
+		refreshed []string
+	)
+	err := s.each(groups, func(r *RocksDB, muts []Mutation) error {
+		keys := make([]string, len(muts))
+		for i, m := range muts {
+			keys[i] = m.Key
+		}
+		done, err := r.TouchMany(keys, ttl)
+		mu.Lock()
+		refreshed = append(refreshed, done...)
+		mu.Unlock()
+		return err
+	})
+	if err != nil {
+		return refreshed, err
+	}
+	return refreshed, s.Write(extra)
+}
+
+// Increment applies each shard's increments atomically on that shard. A
+// batch spanning shards is not atomic as a whole: a rejected increment on
+// one shard doesn't undo those committed on another. A non-nil rec and
+// extra are written to their own shards once every shard has committed.
+func (s *Sharded) Increment(incs []Increment, rec *Idempotency, extra ...Mutation) (map[string]IncrResult, error) {
+	groups := make(map[int][]Increment)
+	for _, inc := range incs {
+		i := s.shardFor(inc.Key)
+		groups[i] = append(groups[i], inc)
+	}
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		firstErr error
+	)
+	res := make(map[string]IncrResult, len(incs))
+	for i, g := range groups {
+		wg.Add(1)
+		go func(r *RocksDB, g []Increment) {
+			defer wg.Done()
+			out, err := r.Increment(g, nil)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				if firstErr == nil {
+					firstErr = err
+				}
+				return
+			}
+			for k, v := range out {
+				res[k] = v
+			}
+		}(s.shards[i], g)
+	}
+	wg.Wait()
+	if firstErr != nil {
+		return res, firstErr
+	}
+	if rec != nil {
+		data, _ := json.Marshal(res)
+		extra = append([]Mutation{rec.Mutation(data)}, extra...)
+	}
+	return res, s.Write(extra)
+}
+
+// Apply runs ops on their shard, atomically, when they all fall in one;
+// ops spanning shards fail with ErrCrossShard, since they couldn't be
+// all-or-nothing. A non-nil rec and extra are written to their own shards
+// afterwards.
+func (s *Sharded) Apply(ops []Op, rec *Idempotency, extra ...Mutation) ([]OpResult, error) {
+	if len(ops) == 0 {
+		return nil, s.Write(extra)
+	}
+	i := s.shardFor(ops[0].Key)
+	for _, op := range ops[1:] {
+		if s.shardFor(op.Key) != i {
+			return nil, ErrCrossShard
+		}
+	}
+	res, err := s.shards[i].Apply(ops, nil)
+	if err != nil {
+		return res, err
+	}
+	if rec != nil {
+		data, _ := json.Marshal(map[string][]OpResult{"results": res})
+		extra = append([]Mutation{rec.Mutation(data)}, extra...)
+	}
+	return res, s.Write(extra)
+}
+
+// Write groups muts by shard and commits one WriteBatch per shard in
+// parallel. An idempotency record goes to its own shard like any key; a
+// range delete goes to every shard.
+func (s *Sharded) Write(muts []Mutation) error {
+	groups := make(map[int][]Mutation)
+	for _, m := range muts {
+		if m.End != "" {
+			for i := range s.shards {
+				groups[i] = append(groups[i], m)
+			}
+			continue
+		}
+		i := s.shardFor(m.Key)
+		groups[i] = append(groups[i], m)
+	}
+	return s.each(groups, func(r *RocksDB, muts []Mutation) error {
+		return r.Write(muts)
+	})
+}
+
+// each runs fn concurrently for every shard that has work and returns the
+// first error.
+func (s *Sharded) each(groups map[int][]Mutation, fn func(*RocksDB, []Mutation) error) error {
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		firstErr error
+	)
+	for i, g := range groups {
+		wg.Add(1)
+		go func(r *RocksDB, g []Mutation) {
+			defer wg.Done()
+			if err := fn(r, g); err != nil {
+				mu.Lock()
+				if firstErr == nil {
+					firstErr = err
+				}
+				mu.Unlock()
+			}
+		}(s.shards[i], g)
+	}
+	wg.Wait()
+	return firstErr
+}
+
+func (s *Sharded) List() (map[string]interface{}, error) {
+	out := make(map[string]interface{})
+	for _, r := range s.shards {
+		part, err := r.List()
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range part {
+			out[k] = v
+		}
+	}
+	return out, nil
+}
+
+// Scan merges the shards' ordered scans so fn still sees keys in global key
+// order.
+func (s *Sharded) Scan(prefix, start string, fn func(key string, value json.RawMessage) bool) error {
+	return s.merge(false, func(r *RocksDB, emit func(string, []byte) bool) error {
+		return r.Scan(prefix, start, func(k string, v json.RawMessage) bool { return emit(k, v) })
+	}, func(k string, v []byte) bool { return fn(k, v) })
+}
+
+func (s *Sharded) ScanReverse(prefix, start string, fn func(key string, value json.RawMessage) bool) error {
+	return s.merge(true, func(r *RocksDB, emit func(string, []byte) bool) error {
+		return r.ScanReverse(prefix, start, func(k string, v json.RawMessage) bool { return emit(k, v) })
+	}, func(k string, v []byte) bool { return fn(k, v) })
+}
+
+// ScanRaw merges the shards' raw scans. Every shard keeps its own internal
+// keys, so the same internal key can be reported once per shard.
+func (s *Sharded) ScanRaw(prefix, start string, fn func(key string, stored []byte) bool) error {
+	return s.merge(false, func(r *RocksDB, emit func(string, []byte) bool) error {
+		return r.ScanRaw(prefix, start, emit)
+	}, fn)
+}
+
+// merge runs scan on every shard concurrently and feeds fn the union of
+// their results in key order, descending if reverse. Values handed to emit
+// must stay valid after it returns.
+func (s *Sharded) merge(reverse bool, scan func(r *RocksDB, emit func(key string, value []byte) bool) error, fn func(key string, value []byte) bool) error {
+	type item struct {
+		key   string
+		value []byte
+	}
+	done := make(chan struct{})
+	streams := make([]chan item, len(s.shards))
+	errs := make([]error, len(s.shards))
+	var wg sync.WaitGroup
+	for i, r := range s.shards {
+		ch := make(chan item, 64)
+		streams[i] = ch
+		wg.Add(1)
+		go func(i int, r *RocksDB) {
+			defer wg.Done()
+			defer close(ch)
+			errs[i] = scan(r, func(k string, v []byte) bool {
+				select {
+				case ch <- item{k, v}:
+					return true
+				case <-done:
+					return false
+				}
+			})
+		}(i, r)
+	}
+
+	// A shard that fails ends the merge there: its stream closes after errs[i]
+	// is set, and going on would hand fn keys past a gap.
+	heads := make([]*item, len(streams))
+	failed := false
+	next := func(i int) {
+		if it, ok := <-streams[i]; ok {
+			heads[i] = &it
+		} else {
+			heads[i] = nil
+			failed = failed || errs[i] != nil
+		}
+	}
+	for i := range streams {
+		next(i)
+	}
+	for !failed {
+		min := -1
+		for i, h := range heads {
+			if h != nil && (min < 0 || (h.key < heads[min].key) != reverse) {
+				min = i
+			}
+		}
+		if min < 0 || !fn(heads[min].key, heads[min].value) {
+			break
+		}
+		next(min)
+	}
+	close(done)
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ScanExpired examines up to limit keys per shard. The resume point is the
+// smallest shard cursor; expired keys at or past it are left for the next
+// call so no shard skips ahead of the others.
+func (s *Sharded) ScanExpired(start string, limit int) ([]string, string, error) {
+	var (
+		all  []string
+		next string
+	)
+	for _, r := range s.shards {
+		keys, n, err := r.ScanExpired(start, limit)
+		if err != nil {
+			return nil, "", err
+		}
+		all = append(all, keys...)
+		if n != "" && (next == "" || n < next) {
+			next = n
+		}
+	}
+	if next == "" {
+		return all, "", nil
+	}
+	expired := all[:0]
+	for _, k := range all {
+		if k < next {
+			expired = append(expired, k)
+		}
+	}
+	return expired, next, nil
+}
+
+func (s *Sharded) DeleteExpired(keys []string) (int, error) {
+	groups := make(map[int][]Mutation)
+	for _, k := range keys {
+		i := s.shardFor(k)
+		groups[i] = append(groups[i], Mutation{Key: k, Delete: true})
+	}
+	var mu sync.Mutex
+	total := 0
+	err := s.each(groups, func(r *RocksDB, muts []Mutation) error {
+		keys := make([]string, len(muts))
+		for i, m := range muts {
+			keys[i] = m.Key
+		}
+		n, err := r.DeleteExpired(keys)
+		mu.Lock()
+		total += n
+		mu.Unlock()
+		return err
+	})
+	return total, err
+}
+
+// PrefixSize sums the shards' estimates.
+func (s *Sharded) PrefixSize(prefix string) (size, keys int64, err error) {
+	for _, r := range s.shards {
+		n, k, err := r.PrefixSize(prefix)
+		if err != nil {
+			return 0, 0, err
+		}
+		size, keys = size+n, keys+k
+	}
+	return size, keys, nil
+}
+
+func (s *Sharded) TrimLog() (int, error) {
+	total := 0
+	for _, r := range s.shards {
+		n, err := r.TrimLog()
+		total += n
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+func (s *Sharded) Stats() map[string]interface{} {
+	per := make([]map[string]interface{}, len(s.shards))
+	for i, r := range s.shards {
+		per[i] = r.Stats()
+	}
+	return map[string]interface{}{
+		"shards":       len(s.shards),
+		"writeStalled": s.WriteStalled(),
+		"shardStats":   per,
+	}
+}
+
+// Properties reports every shard's properties, keyed "shard-NNN/<property>".
+func (s *Sharded) Properties() (map[string]string, error) {
+	out := make(map[string]string)
+	for i, r := range s.shards {
+		props, err := r.Properties()
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range props {
+			out[fmt.Sprintf("shard-%03d/%s", i, k)] = v
+		}
+	}
+	return out, nil
+}
+
+// WriteStalled reports whether any shard is stalled; writes are routed by
+// key, so one stalled shard is enough to shed load.
+func (s *Sharded) WriteStalled() bool {
+	for _, r := range s.shards {
+		if r.WriteStalled() {
+			return true
+		}
+	}
+	return false
+}
+
+// PendingCompactionBytes reports the most behind shard, since each shard
+// stalls on its own debt.
+func (s *Sharded) PendingCompactionBytes() uint64 {
+	var most uint64
+	for _, r := range s.shards {
+		most = max(most, r.PendingCompactionBytes())
+	}
+	return most
+}
+
+func (s *Sharded) Clear() error {
+	for _, r := range s.shards {
+		if err := r.Clear(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Sharded) Close() error {
+	for _, r := range s.shards {
+		r.Close()
+	}
+	return nil
+}
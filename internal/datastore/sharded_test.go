@@ -0,0 +1,55 @@
+package datastore
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestMergeStopsAtFailedShard(t *testing.T) {
+	errInjected := errors.New("injected iterator error")
+	tests := []struct {
+		name    string
+		reverse bool
+		shards  [][]string // keys each shard emits, in scan order
+		fail    int        // shard whose scan then fails
+		want    []string
+	}{
+		{"mid-scan", false, [][]string{{"a", "d", "g"}, {"b"}, {"c", "e"}}, 1, []string{"a", "b"}},
+		{"before any key", false, [][]string{{"a", "d"}, {}, {"c"}}, 1, nil},
+		{"reverse", true, [][]string{{"g", "d", "a"}, {"f"}, {"e", "c"}}, 1, []string{"g", "f"}},
+		{"last key", false, [][]string{{"a"}, {"b"}}, 0, []string{"a"}},
+	}
+	for _, tt := range tests {
+		s := &Sharded{}
+		keys := make(map[*RocksDB][]string)
+		fails := make(map[*RocksDB]bool)
+		for i, ks := range tt.shards {
+			r := &RocksDB{}
+			s.shards = append(s.shards, r)
+			keys[r] = ks
+			fails[r] = i == tt.fail
+		}
+		var got []string
+		err := s.merge(tt.reverse, func(r *RocksDB, emit func(string, []byte) bool) error {
+			for _, k := range keys[r] {
+				if !emit(k, nil) {
+					return nil
+				}
+			}
+			if fails[r] {
+				return errInjected
+			}
+			return nil
+		}, func(k string, _ []byte) bool {
+			got = append(got, k)
+			return true
+		})
+		if !errors.Is(err, errInjected) {
+			t.Errorf("%s: err = %v, want the shard's error", tt.name, err)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: merged %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package datastore
+
+import (
+	"fmt"
+
+	"github.com/linxGnu/grocksdb"
+)
+
+// Tuning presets, named for the workload they favour.
+const (
+	// PresetReadOptimized keeps few, well-compacted levels so a point read
+	// touches as few files as possible. It suits caches and edge nodes that
+	// are read far more than they are written.
+	PresetReadOptimized = "read-optimized"
+	// PresetWriteOptimized uses universal compaction, bigger memtables and
+	// more background jobs so bursts of writes are absorbed with less write
+	// amplification. It suits authoritative nodes taking config pushes.
+	PresetWriteOptimized = "write-optimized"
+)
+
+// Tuning selects RocksDB's compaction behaviour. Preset ("" = RocksDB's
+// defaults) sets every knob; any non-zero field below overrides it.
+type Tuning struct {
+	Preset string
+
+	// CompactionStyle is "level" or "universal".
+	CompactionStyle string
+	// Level-0 file counts at which compaction starts, writes are slowed, and
+	// writes stop.
+	L0CompactionTrigger int
+	L0SlowdownTrigger   int
+	L0StopTrigger       int
+	// TargetFileBytes sizes the SST files compaction writes.
+	TargetFileBytes uint64
+	// MaxBackgroundJobs bounds concurrent flushes and compactions.
+	MaxBackgroundJobs int
+	// MemtableBytes sizes each memtable; MaxMemtables bounds how many are
+	// held before writes stall.
+	MemtableBytes uint64
+	MaxMemtables  int
+}
+
+var presets = map[string]Tuning{
+	PresetReadOptimized: {
+		CompactionStyle:     "level",
+		L0CompactionTrigger: 2,
+		L0SlowdownTrigger:   12,
+		L0StopTrigger:       20,
+		TargetFileBytes:     64 << 20,
+		MaxBackgroundJobs:   2,
+		MemtableBytes:       32 << 20,
+		MaxMemtables:        2,
+	},
+	PresetWriteOptimized: {
+		CompactionStyle:     "universal",
+		L0CompactionTrigger: 8,
+		L0SlowdownTrigger:   40,
+		L0StopTrigger:       64,
+		TargetFileBytes:     128 << 20,
+		MaxBackgroundJobs:   6,
+		MemtableBytes:       128 << 20,
+		MaxMemtables:        4,
+	},
+}
+
+// resolve merges t's explicit settings over its preset.
+func (t Tuning) resolve() (Tuning, error) {
+	out := Tuning{Preset: t.Preset}
+	if t.Preset != "" {
+		p, ok := presets[t.Preset]
+		if !ok {
+			return out, fmt.Errorf("unknown tuning preset %q (want %s or %s)", t.Preset, PresetReadOptimized, PresetWriteOptimized)
+		}
+		out = p
+		out.Preset = t.Preset
+	}
+	if t.CompactionStyle != "" {
+		out.CompactionStyle = t.CompactionStyle
+	}
+	switch out.CompactionStyle {
+	case "", "level", "universal":
+	default:
+		return out, fmt.Errorf("unknown compaction style %q (want level or universal)", out.CompactionStyle)
+	}
+	if t.L0CompactionTrigger > 0 {
+		out.L0CompactionTrigger = t.L0CompactionTrigger
+	}
+	if t.L0SlowdownTrigger > 0 {
+		out.L0SlowdownTrigger = t.L0SlowdownTrigger
+	}
+	if t.L0StopTrigger > 0 {
+		out.L0StopTrigger = t.L0StopTrigger
+	}
+	if t.TargetFileBytes > 0 {
+		out.TargetFileBytes = t.TargetFileBytes
+	}
+	if t.MaxBackgroundJobs > 0 {
+		out.MaxBackgroundJobs = t.MaxBackgroundJobs
+	}
+	if t.MemtableBytes > 0 {
+		out.MemtableBytes = t.MemtableBytes
+	}
+	if t.MaxMemtables > 0 {
+		out.MaxMemtables = t.MaxMemtables
+	}
+	return out, nil
+}
+
+// apply sets the resolved tuning on opts, leaving unset knobs at RocksDB's
+// defaults.
+func (t Tuning) apply(opts *grocksdb.Options) {
+	switch t.CompactionStyle {
+	case "level":
+		opts.SetCompactionStyle(grocksdb.LevelCompactionStyle)
+	case "universal":
+		opts.SetCompactionStyle(grocksdb.UniversalCompactionStyle)
+	}
+	if t.L0CompactionTrigger > 0 {
+		opts.SetLevel0FileNumCompactionTrigger(t.L0CompactionTrigger)
+	}
+	if t.L0SlowdownTrigger > 0 {
+		opts.SetLevel0SlowdownWritesTrigger(t.L0SlowdownTrigger)
+	}
+	if t.L0StopTrigger > 0 {
+		opts.SetLevel0StopWritesTrigger(t.L0StopTrigger)
+	}
+	if t.TargetFileBytes > 0 {
+		opts.SetTargetFileSizeBase(t.TargetFileBytes)
+	}
+	if t.MaxBackgroundJobs > 0 {
+		opts.SetMaxBackgroundJobs(t.MaxBackgroundJobs)
+	}
+	if t.MemtableBytes > 0 {
+		opts.SetWriteBufferSize(t.MemtableBytes)
+	}
+	if t.MaxMemtables > 0 {
+		opts.SetMaxWriteBufferNumber(t.MaxMemtables)
+	}
+}
+
+// stats reports the tuning the store was opened with.
+func (t Tuning) stats() map[string]interface{} {
+	return map[string]interface{}{
+		"preset":              t.Preset,
+		"compactionStyle":     t.CompactionStyle,
+		"l0CompactionTrigger": t.L0CompactionTrigger,
+		"l0SlowdownTrigger":   t.L0SlowdownTrigger,
+		"l0StopTrigger":       t.L0StopTrigger,
+		"targetFileBytes":     t.TargetFileBytes,
+		"maxBackgroundJobs":   t.MaxBackgroundJobs,
+		"memtableBytes":       t.MemtableBytes,
+		"maxMemtables":        t.MaxMemtables,
+	}
+}
@@ -0,0 +1,24 @@
+package datastore
+
+import "strings"
+
+// WriteThroughPrefix holds the upstream write-through queue. Its entries
+// have no expiry: each stays until the queue's worker has sent it upstream
+// or given up on it.
+const WriteThroughPrefix = ReservedPrefix + "wtq/"
+
+// isWriteThroughKey reports whether key holds a write-through queue entry;
+// Write accepts these even though they are reserved.
+func isWriteThroughKey(key string) bool {
+	return strings.HasPrefix(key, WriteThroughPrefix) && len(key) > len(WriteThroughPrefix)
+}
+
+// hasWriteThrough reports whether muts write or delete a queue entry.
+func hasWriteThrough(muts []Mutation) bool {
+	for _, m := range muts {
+		if isWriteThroughKey(m.Key) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,132 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/UltraSive/rocksdb-configuration-distribution/internal/datastore"
+)
+
+// BatchOp is one operation of a BATCH request.
+type BatchOp struct {
+	Op     string          `json:"op"` // set, delete, incr or cas
+	Key    string          `json:"key"`
+	Value  json.RawMessage `json:"value,omitempty"`  // set, cas: the value written
+	Expect json.RawMessage `json:"expect,omitempty"` // cas: the value the key must hold; omitted, it must not exist
+	TTL    string          `json:"ttl,omitempty"`    // set, cas, incr creating the key: overrides the request's TTL
+	By     int64           `json:"by,omitempty"`     // incr
+	Min    *int64          `json:"min,omitempty"`    // incr
+	Max    *int64          `json:"max,omitempty"`    // incr
+	Reject bool            `json:"reject,omitempty"` // incr: fail instead of clamping at a bound
+}
+
+// batch applies req.Ops in order, all or nothing, in one write batch. Each
+// operation sees the effects of those before it. Written values get the
+// op's ttl, else req.TTL, else what an UPDATE of the key would get; an incr
+// of an existing counter keeps its expiry. A failing operation, such as a
+// cas whose key holds something else, fails the request with nothing
+// written, naming the operation's index under "failed".
+func (h *Handler) batch(req Request, rec *datastore.Idempotency) Response {
+	if len(req.Ops) == 0 {
+		return fail(CodeInvalidRequest, "ops are required")
+	}
+	if h.DB.WriteStalled() {
+		return fail(CodeOverloaded, "overloaded")
+	}
+	var explicit *time.Duration
+	if req.TTL != "" {
+		d, err := time.ParseDuration(req.TTL)
+		if err != nil {
+			return fail(CodeInvalidRequest, "invalid ttl: "+err.Error())
+		}
+		explicit = &d
+	}
+	errs := make(map[string]string)
+	ops := make([]datastore.Op, 0, len(req.Ops))
+	var muts []datastore.Mutation // what the sets and cases would write, for quotas
+	size := 0
+	for i, o := range req.Ops {
+		reject := func(msg string) {
+			errs[o.Key] = fmt.Sprintf("operation %d: %s", i, msg)
+		}
+		if err := h.CheckKey(o.Key); err != nil {
+			reject(err.Error())
+			continue
+		}
+		ttl := explicit
+		if o.TTL != "" {
+			d, err := time.ParseDuration(o.TTL)
+			if err != nil {
+				reject("invalid ttl: " + err.Error())
+				continue
+			}
+			ttl = &d
+		}
+		op := datastore.Op{Kind: o.Op, Key: o.Key, Expiry: datastore.ExpiryFor(h.ttlFor(o.Key, ttl))}
+		switch o.Op {
+		case datastore.OpSet, datastore.OpCAS:
+			if o.Value == nil {
+				reject("value is required")
+				continue
+			}
+			raw, err := h.canonical(o.Value)
+			if err != nil {
+				reject(err.Error())
+				continue
+			}
+			if op.Expiry, err = h.expiryFor(o.Key, raw, ttl); err != nil {
+				reject(err.Error())
+				continue
+			}
+			op.Value, op.Expect = raw, o.Expect
+			muts = append(muts, datastore.Mutation{Key: o.Key, Value: raw})
+		case datastore.OpDelete:
+		case datastore.OpIncr:
+			if o.Min != nil && o.Max != nil && *o.Min > *o.Max {
+				reject("min is greater than max")
+				continue
+			}
+			op.By, op.Min, op.Max, op.Reject = o.By, o.Min, o.Max, o.Reject
+		default:
+			reject(fmt.Sprintf("unknown op %q (want set, delete, incr or cas)", o.Op))
+			continue
+		}
+		size += len(o.Key) + len(op.Value) + 64
+		ops = append(ops, op)
+	}
+	if len(errs) > 0 {
+		resp := fail(CodeInvalidRequest, "invalid ops; nothing was written")
+		resp.Errors = errs
+		return resp
+	}
+	if h.MaxBatchBytes > 0 && size > h.MaxBatchBytes {
+		return fail(CodeTooLarge, fmt.Sprintf("batch exceeds the %d byte batch limit and can't be split", h.MaxBatchBytes))
+	}
+	delta, errResp := h.reserveQuota(muts)
+	if errResp != nil {
+		return *errResp
+	}
+	keys := make([]string, len(ops))
+	for i, op := range ops {
+		keys[i] = op.Key
+	}
+	var res []datastore.OpResult
+	err := h.queued(dedupe(keys), "", "", "", func(extra ...datastore.Mutation) (err error) {
+		res, err = h.DB.Apply(ops, rec, extra...)
+		return err
+	})
+	if err != nil {
+		h.Quotas.Release(delta)
+		resp := storeFail(err)
+		var opErr *datastore.OpError
+		if errors.As(err, &opErr) {
+			resp.Error = opErr.Error() + "; nothing was written"
+			resp.Errors = map[string]string{opErr.Key: opErr.Err.Error()}
+			resp.Data = map[string]interface{}{"failed": opErr.Index}
+		}
+		return resp
+	}
+	return Response{Type: "OK", Data: map[string]interface{}{"results": res}}
+}
@@ -0,0 +1,56 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+)
+
+// Canonical JSON modes for values written by UPDATE, REPLACE_PREFIX and
+// GETORSET.
+const (
+	CanonicalOff     = "off"     // store values as sent
+	CanonicalRewrite = "rewrite" // re-encode values into canonical form
+	CanonicalReject  = "reject"  // refuse values not already in canonical form
+)
+
+// errNotCanonical is the per-key reason a value is refused in reject mode.
+var errNotCanonical = errors.New("value is not canonical JSON (sorted object keys, no insignificant whitespace)")
+
+// canonicalJSON re-encodes raw with object keys sorted and no insignificant
+// whitespace, so semantically equal values come out byte-equal. Numbers keep
+// the text they were sent with, so 1 and 1.0 still differ, and strings are
+// re-escaped the same way every time, without HTML escaping. When an object
+// repeats a key the last one wins, as it does on read.
+func canonicalJSON(raw json.RawMessage) (json.RawMessage, error) {
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
+
+// canonical applies the CanonicalJSON mode to a value about to be written.
+func (h *Handler) canonical(raw json.RawMessage) (json.RawMessage, error) {
+	switch h.CanonicalJSON {
+	case CanonicalRewrite:
+		return canonicalJSON(raw)
+	case CanonicalReject:
+		c, err := canonicalJSON(raw)
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(c, raw) {
+			return nil, errNotCanonical
+		}
+	}
+	return raw, nil
+}
@@ -0,0 +1,48 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+func TestCanonicalJSON(t *testing.T) {
+	tests := []struct{ in, want string }{
+		{`{"a":1,"b":2}`, `{"a":1,"b":2}`},
+		{`{"b":2,"a":1}`, `{"a":1,"b":2}`},
+		{` { "b" : 2 ,
+		  "a" : 1 } `, `{"a":1,"b":2}`},
+		{`{"z":{"y":[3,{"d":1,"c":2}]},"a":null}`, `{"a":null,"z":{"y":[3,{"c":2,"d":1}]}}`},
+		{`{"n":1.0,"m":1e6}`, `{"m":1e6,"n":1.0}`},
+		{`{"a":1,"a":2}`, `{"a":2}`},
+		{`"<A>"`, `"<A>"`},
+	}
+	for _, tt := range tests {
+		got, err := canonicalJSON(json.RawMessage(tt.in))
+		if err != nil || string(got) != tt.want {
+			t.Errorf("canonicalJSON(%s) = %s, %v; want %s", tt.in, got, err, tt.want)
+		}
+	}
+}
+
+func TestCanonicalModes(t *testing.T) {
+	sorted, unsorted := json.RawMessage(`{"a":1,"b":2}`), json.RawMessage(`{"b":2,"a":1}`)
+
+	h := &Handler{CanonicalJSON: CanonicalRewrite}
+	if got, err := h.canonical(unsorted); err != nil || string(got) != string(sorted) {
+		t.Errorf("rewrite: %s, %v; want %s", got, err, sorted)
+	}
+
+	h.CanonicalJSON = CanonicalReject
+	if got, err := h.canonical(sorted); err != nil || string(got) != string(sorted) {
+		t.Errorf("reject, canonical input: %s, %v", got, err)
+	}
+	if _, err := h.canonical(unsorted); !errors.Is(err, errNotCanonical) {
+		t.Errorf("reject, unsorted input: err = %v, want errNotCanonical", err)
+	}
+
+	h.CanonicalJSON = CanonicalOff
+	if got, err := h.canonical(unsorted); err != nil || string(got) != string(unsorted) {
+		t.Errorf("off: %s, %v; want the input unchanged", got, err)
+	}
+}
@@ -0,0 +1,81 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+)
+
+// children lists the immediate children of req.Prefix, splitting keys at
+// req.Delimiter ("/" by default) the way S3 delimiter listings do: "dirs"
+// holds each distinct prefix ending in the delimiter that has live keys
+// under it, "keys" the live keys with no delimiter past the prefix. A
+// directory costs one seek rather than a walk over its keys: the scan stops
+// at the first key under it and resumes after the whole subtree.
+// Truncated and NextCursor work as for SCAN.
+func (h *Handler) children(ctx context.Context, req Request) Response {
+	delim := req.Delimiter
+	if delim == "" {
+		delim = "/"
+	}
+	ctx, op := h.Ops.Start(ctx, "CHILDREN", req.Prefix)
+	defer op.Done()
+	resp := Response{Type: "OK"}
+	dirs, keys := []string{}, []string{}
+	b := budget{max: h.MaxResponseBytes}
+	cursor := req.Cursor
+	for {
+		var next string // set when a directory was found: resume after it
+		err := h.Scan(req.Prefix, cursor, func(k string, _ json.RawMessage) bool {
+			if ctx.Err() != nil {
+				return false
+			}
+			op.Add(1)
+			child, isDir := k, false
+			if i := strings.Index(k[len(req.Prefix):], delim); i >= 0 {
+				child, isDir = k[:len(req.Prefix)+i+len(delim)], true
+			}
+			if !b.add(child, nil) {
+				resp.Truncated, resp.NextCursor = true, k
+				return false
+			}
+			if !isDir {
+				keys = append(keys, k)
+				return true
+			}
+			dirs = append(dirs, child)
+			next = after(child)
+			return false
+		})
+		if err != nil {
+			return fail(CodeInternal, err.Error())
+		}
+		if ctx.Err() != nil {
+			return fail(CodeCanceled, "children canceled")
+		}
+		if resp.Truncated || next == "" {
+			break
+		}
+		cursor = next
+	}
+	resp.Data = map[string]interface{}{
+		"prefix": req.Prefix,
+		"dirs":   dirs,
+		"keys":   keys,
+	}
+	return resp
+}
+
+// after returns the first key sorting after every key starting with p, or
+// "" if there is none.
+func after(p string) string {
+	b := []byte(p)
+	for len(b) > 0 && b[len(b)-1] == 0xff {
+		b = b[:len(b)-1]
+	}
+	if len(b) == 0 {
+		return ""
+	}
+	b[len(b)-1]++
+	return string(b)
+}
@@ -0,0 +1,87 @@
+package handler
+
+import (
+	"encoding/json"
+	"sort"
+)
+
+// diff reports how each of req.Items differs from the key's live stored
+// value, without writing anything, so a change can be reviewed before it is
+// sent as an UPDATE. Each key maps to its op: "create" when there is no live
+// value, "update" when both values are objects, "replace" when either isn't,
+// or "unchanged". Changed keys carry an RFC 7386 merge patch that turns the
+// current value into the proposed one, and the current value itself.
+// Upstream is not consulted: the diff is against what this node stores.
+func (h *Handler) diff(req Request) Response {
+	if len(req.Items) == 0 {
+		return fail(CodeInvalidRequest, "items are required")
+	}
+	keys := make([]string, 0, len(req.Items))
+	for k := range req.Items {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	resp := Response{Type: "OK", Data: make(map[string]interface{}, len(keys))}
+	b := budget{max: h.MaxResponseBytes}
+	for _, k := range keys {
+		proposed := decodeValue(req.Items[k])
+		d := map[string]interface{}{"op": "create", "patch": proposed}
+		raw, found, err := h.DB.Get(k)
+		if err != nil {
+			return storeFail(err)
+		}
+		if found {
+			current := decodeValue(raw)
+			patch, changed := mergePatch(current, proposed)
+			_, curObj := current.(map[string]interface{})
+			_, newObj := proposed.(map[string]interface{})
+			switch {
+			case !changed:
+				d = map[string]interface{}{"op": "unchanged"}
+			case curObj && newObj:
+				d = map[string]interface{}{"op": "update", "patch": patch, "current": current}
+			default:
+				d = map[string]interface{}{"op": "replace", "patch": patch, "current": current}
+			}
+		}
+		enc, _ := json.Marshal(d)
+		if !b.add(k, enc) {
+			resp.Truncated = true
+			return resp
+		}
+		resp.Data[k] = d
+	}
+	return resp
+}
+
+// mergePatch returns the RFC 7386 merge patch that turns cur into next, and
+// whether they differ. Objects are compared member by member, with removed
+// members patched to null; anything else, arrays included, is replaced
+// whole. A member next sets to null can't be told apart from a removal.
+func mergePatch(cur, next interface{}) (interface{}, bool) {
+	co, curObj := cur.(map[string]interface{})
+	no, nextObj := next.(map[string]interface{})
+	if !curObj || !nextObj {
+		if sameValue(cur, next) {
+			return nil, false
+		}
+		return next, true
+	}
+	patch := make(map[string]interface{})
+	for k, cv := range co {
+		nv, ok := no[k]
+		if !ok {
+			patch[k] = nil
+			continue
+		}
+		if p, changed := mergePatch(cv, nv); changed {
+			patch[k] = p
+		}
+	}
+	for k, nv := range no {
+		if _, ok := co[k]; !ok {
+			patch[k] = nv
+		}
+	}
+	return patch, len(patch) > 0
+}
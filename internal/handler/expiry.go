@@ -0,0 +1,82 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/UltraSive/rocksdb-configuration-distribution/internal/datastore"
+)
+
+// maxExpirySeconds is the latest unix time, in seconds, an expiry in unix
+// nanos can hold.
+const maxExpirySeconds = math.MaxInt64 / int64(time.Second)
+
+// valueExpiry reads the timestamp in raw's ExpiryField: an RFC 3339 string
+// or unix seconds. ok is false when the field is off, raw isn't an object,
+// or the field is absent or null. A timestamp that doesn't parse, or has
+// already passed, is an error.
+func (h *Handler) valueExpiry(raw json.RawMessage) (expiry int64, ok bool, err error) {
+	if h.ExpiryField == "" {
+		return 0, false, nil
+	}
+	var obj map[string]json.RawMessage
+	if json.Unmarshal(raw, &obj) != nil {
+		return 0, false, nil
+	}
+	field, found := obj[h.ExpiryField]
+	if !found || string(field) == "null" {
+		return 0, false, nil
+	}
+	var t time.Time
+	var v interface{}
+	if err := json.Unmarshal(field, &v); err != nil {
+		return 0, false, err
+	}
+	switch v := v.(type) {
+	case string:
+		if t, err = time.Parse(time.RFC3339Nano, v); err != nil {
+			return 0, false, fmt.Errorf("%s is not an RFC 3339 time: %q", h.ExpiryField, v)
+		}
+	case float64:
+		if v < 0 || v > float64(maxExpirySeconds) {
+			return 0, false, fmt.Errorf("%s is out of range: %s (want unix seconds)", h.ExpiryField, field)
+		}
+		sec, frac := math.Modf(v)
+		t = time.Unix(int64(sec), int64(frac*float64(time.Second)))
+	default:
+		return 0, false, fmt.Errorf("%s must be an RFC 3339 string or unix seconds", h.ExpiryField)
+	}
+	if !t.After(time.Now()) {
+		return 0, false, fmt.Errorf("%s is in the past: %s", h.ExpiryField, t.UTC().Format(time.RFC3339))
+	}
+	if t.Unix() >= maxExpirySeconds {
+		return 0, false, fmt.Errorf("%s is out of range: %s", h.ExpiryField, t.UTC().Format(time.RFC3339))
+	}
+	return t.UnixNano(), true, nil
+}
+
+// expiryFor resolves the absolute expiry of a write of raw to key: a pinned
+// key never expires, otherwise the value's own ExpiryField wins, and without
+// one the TTL ttlFor picks applies.
+func (h *Handler) expiryFor(key string, raw json.RawMessage, explicit *time.Duration) (int64, error) {
+	if !h.Pinned(key) {
+		expiry, ok, err := h.valueExpiry(raw)
+		if err != nil || ok {
+			return expiry, err
+		}
+	}
+	return datastore.ExpiryFor(h.ttlFor(key, explicit)), nil
+}
+
+// getOrSetTTL is expiryFor for GETORSET, whose store call takes a TTL.
+func (h *Handler) getOrSetTTL(key string, raw json.RawMessage, explicit *time.Duration) (time.Duration, error) {
+	if !h.Pinned(key) {
+		expiry, ok, err := h.valueExpiry(raw)
+		if err != nil || ok {
+			return time.Until(time.Unix(0, expiry)), err
+		}
+	}
+	return h.ttlFor(key, explicit), nil
+}
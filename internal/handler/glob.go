@@ -0,0 +1,218 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/UltraSive/rocksdb-configuration-distribution/internal/datastore"
+)
+
+// isGlob reports whether a GET key is a pattern: one containing * or ?,
+// escaped or not.
+func isGlob(key string) bool {
+	return strings.ContainsAny(key, "*?")
+}
+
+// globPrefix returns the literal text before pattern's first unescaped
+// wildcard; every match starts with it.
+func globPrefix(pattern string) string {
+	var b strings.Builder
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; c {
+		case '*', '?':
+			return b.String()
+		case '\\':
+			if i+1 < len(pattern) {
+				i++
+			}
+			b.WriteByte(pattern[i])
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// Kinds of globToken.
+const (
+	globLiteral    = iota // one byte, compared exactly
+	globOne               // ?: one character other than /
+	globStar              // *: any run of characters other than /
+	globDoubleStar        // **: any run of characters
+)
+
+type globToken struct {
+	kind int
+	c    byte // for globLiteral
+}
+
+// glob is a compiled GET pattern. * matches any run of characters other
+// than /, ** any run including /, ? one character other than /, and \ makes
+// the next character literal.
+type glob []globToken
+
+// compileGlob parses pattern. A run of three or more * is the same as **.
+func compileGlob(pattern string) glob {
+	var g glob
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; c {
+		case '*':
+			kind := globStar
+			for i+1 < len(pattern) && pattern[i+1] == '*' {
+				kind = globDoubleStar
+				i++
+			}
+			g = append(g, globToken{kind: kind})
+		case '?':
+			g = append(g, globToken{kind: globOne})
+		case '\\':
+			if i+1 < len(pattern) {
+				i++
+			}
+			g = append(g, globToken{kind: globLiteral, c: pattern[i]})
+		default:
+			g = append(g, globToken{kind: globLiteral, c: c})
+		}
+	}
+	return g
+}
+
+// match reports whether key matches g. Rather than backtrack, which is
+// exponential in the number of wildcards, it tracks every pattern position
+// reachable after each byte of key, so it runs in O(len(g)·len(key)). A ?
+// consumes a whole character of up to utf8.UTFMax bytes, so positions are
+// kept for the next utf8.UTFMax+1 bytes in a small ring.
+func (g glob) match(key string) bool {
+	const window = utf8.UTFMax + 1
+	var rows [window][]bool
+	for i := range rows {
+		rows[i] = make([]bool, len(g)+1)
+	}
+	rows[0][0] = true
+	for i := 0; ; i++ {
+		row := rows[i%window]
+		// Stars may match nothing.
+		for j, t := range g {
+			if row[j] && (t.kind == globStar || t.kind == globDoubleStar) {
+				row[j+1] = true
+			}
+		}
+		if i == len(key) {
+			return row[len(g)]
+		}
+		live := false
+		for j, t := range g {
+			if !row[j] {
+				continue
+			}
+			live = true
+			switch t.kind {
+			case globLiteral:
+				if key[i] == t.c {
+					rows[(i+1)%window][j+1] = true
+				}
+			case globOne:
+				r, n := utf8.DecodeRuneInString(key[i:])
+				if r != '/' {
+					rows[(i+n)%window][j+1] = true
+				}
+			case globStar:
+				if key[i] != '/' {
+					rows[(i+1)%window][j] = true
+				}
+			case globDoubleStar:
+				rows[(i+1)%window][j] = true
+			}
+		}
+		clear(row)
+		if !live && !rowsSet(rows[:]) {
+			return false
+		}
+	}
+}
+
+// rowsSet reports whether any position is reachable in rows.
+func rowsSet(rows [][]bool) bool {
+	for _, row := range rows {
+		for _, ok := range row {
+			if ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// globMatch reports whether key matches pattern; see glob.
+func globMatch(pattern, key string) bool {
+	return compileGlob(pattern).match(key)
+}
+
+// checkPattern validates a GET pattern. Patterns aren't keys, so KeyPattern
+// doesn't apply; they are held to the same length and character limits.
+func (h *Handler) checkPattern(pattern string) error {
+	if h.MaxKeyBytes > 0 && len(pattern) > h.MaxKeyBytes {
+		return fmt.Errorf("%w: longer than %d bytes", datastore.ErrInvalidKey, h.MaxKeyBytes)
+	}
+	for _, c := range pattern {
+		if unicode.IsControl(c) {
+			return fmt.Errorf("%w: contains control character %U", datastore.ErrInvalidKey, c)
+		}
+	}
+	return nil
+}
+
+// getGlob adds every live key matching pattern to resp, scanning only the
+// keys under the pattern's literal prefix. It reports false once b is
+// exhausted, with resp marked truncated.
+func (h *Handler) getGlob(ctx context.Context, pattern string, fields []string, resolve bool, resp *Response, b *budget) (bool, error) {
+	prefix := globPrefix(pattern)
+	g := compileGlob(pattern)
+	ctx, op := h.Ops.Start(ctx, "GET", prefix)
+	defer op.Done()
+	full := false
+	var shapeErr, stampErr error
+	err := h.Scan(prefix, "", func(k string, raw json.RawMessage) bool {
+		if ctx.Err() != nil {
+			return false
+		}
+		op.Add(1)
+		if !g.match(k) {
+			return true
+		}
+		raw, shapeErr = h.shape(raw, fields, resolve)
+		if shapeErr != nil {
+			shapeErr = fmt.Errorf("key %q: %w", k, shapeErr)
+			return false
+		}
+		if !b.add(k, raw) {
+			full = true
+			return false
+		}
+		resp.Data[k] = decodeValue(raw)
+		if resp.Source != nil {
+			resp.Source[k] = datastore.SourceLocal
+		}
+		if stampErr = h.stamp(resp, k); stampErr != nil {
+			return false
+		}
+		return true
+	})
+	if err == nil {
+		err = shapeErr
+	}
+	if err == nil {
+		err = stampErr
+	}
+	if err == nil {
+		err = ctx.Err()
+	}
+	if full {
+		resp.Truncated = true
+	}
+	return !full, err
+}
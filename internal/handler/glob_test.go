@@ -0,0 +1,49 @@
+package handler
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGlobMatch(t *testing.T) {
+	tests := []struct {
+		pattern, key string
+		want         bool
+	}{
+		{"app/*", "app/a", true},
+		{"app/*", "app/a/b", false},
+		{"app/**", "app/a/b", true},
+		{"app/**/x", "app/a/b/x", true},
+		{"app/*/x", "app/a/b/x", false},
+		{"app/?", "app/é", true},
+		{"app/?", "app/ab", false},
+		{"app/?", "app//", false},
+		{"a*b*c", "abc", true},
+		{"a*b*c", "aXbYbZc", true},
+		{"a*b*c", "aXbYc/", false},
+		{`a\*`, "a*", true},
+		{`a\*`, "ab", false},
+		{"", "", true},
+		{"*", "", true},
+		{"**", "a/b", true},
+		{"*?", "", false},
+	}
+	for _, tt := range tests {
+		if got := globMatch(tt.pattern, tt.key); got != tt.want {
+			t.Errorf("globMatch(%q, %q) = %v, want %v", tt.pattern, tt.key, got, tt.want)
+		}
+	}
+}
+
+func TestGlobMatchManyWildcards(t *testing.T) {
+	pattern := strings.Repeat("*a", 30) + "b"
+	key := strings.Repeat("a", 200)
+	start := time.Now()
+	if globMatch(pattern, key) {
+		t.Errorf("globMatch(%q, %q) = true", pattern, key)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("globMatch took %s", d)
+	}
+}
@@ -1,90 +1,1922 @@
 package handler
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
+	"unicode"
 
+	"github.com/UltraSive/rocksdb-configuration-distribution/internal/audit"
+	"github.com/UltraSive/rocksdb-configuration-distribution/internal/auth"
+	"github.com/UltraSive/rocksdb-configuration-distribution/internal/cleaner"
 	"github.com/UltraSive/rocksdb-configuration-distribution/internal/datastore"
+	"github.com/UltraSive/rocksdb-configuration-distribution/internal/hotkeys"
+	"github.com/UltraSive/rocksdb-configuration-distribution/internal/metrics"
+	"github.com/UltraSive/rocksdb-configuration-distribution/internal/ops"
+	"github.com/UltraSive/rocksdb-configuration-distribution/internal/quota"
+	"github.com/UltraSive/rocksdb-configuration-distribution/internal/replication"
+	"github.com/UltraSive/rocksdb-configuration-distribution/internal/ring"
 	"github.com/UltraSive/rocksdb-configuration-distribution/internal/upstream"
+	"github.com/UltraSive/rocksdb-configuration-distribution/internal/writethrough"
+	"golang.org/x/sync/singleflight"
 )
 
 type Request struct {
-    Type  string                     `json:"type"`
-    Keys  []string                   `json:"keys,omitempty"`
-    Items map[string]json.RawMessage `json:"items,omitempty"`
+	Type   string                     `json:"type"`
+	Keys   []string                   `json:"keys,omitempty"`
+	Items  map[string]json.RawMessage `json:"items,omitempty"`
+	Delete []string                   `json:"delete,omitempty"` // UPDATE: keys deleted in the same batch as items
+	Prefix string                     `json:"prefix,omitempty"` // SCAN: only keys under this prefix; REPLACE_PREFIX: the prefix replaced
+	Cursor string                     `json:"cursor,omitempty"` // LIST/SCAN: resume from a previous NextCursor
+	TTL    string                     `json:"ttl,omitempty"`    // UPDATE, INCR: overrides prefix and default TTLs, e.g. "10s"
+	TTLs   map[string]string          `json:"ttls,omitempty"`   // UPDATE: per-key TTLs, override TTL
+	Since  uint64                     `json:"since,omitempty"`  // CHANGES: return changes after this sequence
+	Values bool                       `json:"values,omitempty"` // CHANGES: include current values, not just sequences
+	Where  *Predicate                 `json:"where,omitempty"`  // QUERY: which values match
+	Fields map[string][]string        `json:"fields,omitempty"` // GET: top-level fields to return, per key
+	Debug  bool                       `json:"debug,omitempty"`  // GET: report in Source where each value came from
+	Split  bool                       `json:"split,omitempty"`  // UPDATE: allow non-atomic batches past MaxBatchBytes
+	Start  string                     `json:"start,omitempty"`  // DELETE_RANGE: first key deleted
+	End    string                     `json:"end,omitempty"`    // DELETE_RANGE: first key after the range
+
+	// Delimiter splits keys into path segments for CHILDREN; "" means "/".
+	Delimiter string `json:"delimiter,omitempty"`
+
+	// Ops are BATCH's operations, applied in order.
+	Ops []BatchOp `json:"ops,omitempty"`
+
+	// IdempotencyKey makes an UPDATE, REPLACE_PREFIX, INCR or BATCH safe to retry:
+	// a repeat within IdempotencyTTL replays the first response instead of
+	// applying the request again.
+	IdempotencyKey string `json:"idempotencyKey,omitempty"`
+
+	// Timestamps adds each found key's creation and modification times to
+	// a GET response.
+	Timestamps bool `json:"timestamps,omitempty"`
+
+	// Encodings marks UPDATE items whose value is binary, sent as a JSON
+	// string of its base64 encoding: {"key": "base64"}.
+	Encodings map[string]string `json:"encodings,omitempty"`
+
+	// Binary makes GET report, in the response's Encodings, which of the
+	// values it returns are binary and so base64 encoded.
+	Binary bool `json:"binary,omitempty"`
+
+	// Resolve substitutes ${NAME} placeholders in GET values from the
+	// node's Vars; without it values are returned raw.
+	Resolve bool `json:"resolve,omitempty"`
+
+	// Reverse walks LIST/SCAN in descending key order; a cursor then
+	// resumes downward from the key it names.
+	Reverse bool `json:"reverse,omitempty"`
+
+	// IncludeInternal adds the store's reserved keys to LIST/SCAN; it needs
+	// an authenticated caller.
+	IncludeInternal bool `json:"includeInternal,omitempty"`
+
+	// ModifiedSince (unix nanos) limits LIST/SCAN to entries written after
+	// it, and adds the keys deleted since to the first page.
+	ModifiedSince int64 `json:"modifiedSince,omitempty"`
 }
 
 type Response struct {
-    Type  string                 `json:"type"`
-    Error string                 `json:"error,omitempty"`
-    Data  map[string]interface{} `json:"data,omitempty"`
+	Type       string                 `json:"type"`
+	Code       string                 `json:"code,omitempty"` // set on ERR, see Code* constants
+	Error      string                 `json:"error,omitempty"`
+	Data       map[string]interface{} `json:"data"` // never nil, so an empty result is {} rather than absent
+	Truncated  bool                   `json:"truncated,omitempty"`
+	NextCursor string                 `json:"nextCursor,omitempty"`
+	Seq        uint64                 `json:"seq,omitempty"`      // CHANGES: poll again with since=seq
+	Deleted    []string               `json:"deleted,omitempty"`  // CHANGES, LIST/SCAN with modifiedSince: keys removed since
+	Errors     map[string]string      `json:"errors,omitempty"`   // per-key reasons a request was rejected
+	Replayed   bool                   `json:"replayed,omitempty"` // the response was recorded under the request's idempotency key
+
+	// Source says, for a GET with debug set, where each key's value came
+	// from: "cache", "local", "upstream", or "missing" if nowhere had it.
+	Source map[string]string `json:"source,omitempty"`
+
+	// DeletedRanges lists the [start, end) ranges CHANGES, or LIST/SCAN with
+	// modifiedSince, saw deleted; apply them before Deleted and Data.
+	DeletedRanges [][2]string `json:"deletedRanges,omitempty"`
+
+	// Now is, for LIST/SCAN with modifiedSince, the time to pass as
+	// modifiedSince on the next poll.
+	Now int64 `json:"now,omitempty"`
+
+	// Timestamps gives, for a GET with timestamps set, when each found key
+	// was created and last modified.
+	Timestamps map[string]Timestamps `json:"timestamps,omitempty"`
+
+	// Encodings names, for a GET with binary set and for POP and GETORSET,
+	// the encoding of each returned value that is binary ("base64"); JSON
+	// values aren't listed.
+	Encodings map[string]string `json:"encodings,omitempty"`
+
+	// Forwarded is upstream's response to a request forwarded to it, sent
+	// to the client as is in place of the other fields, of which only Type,
+	// Code and Error are set from it.
+	Forwarded json.RawMessage `json:"-"`
 }
 
+// MarshalJSON encodes a forwarded response as upstream sent it.
+func (r Response) MarshalJSON() ([]byte, error) {
+	if r.Forwarded != nil {
+		return r.Forwarded, nil
+	}
+	type plain Response
+	return json.Marshal(plain(r))
+}
+
+// Timestamps are unix nanoseconds, 0 when unknown: the entry was written
+// before the time was recorded, or (Created) TRACK_CREATED is off.
+type Timestamps struct {
+	Created  int64 `json:"created"`
+	Modified int64 `json:"modified"`
+}
+
+// Machine-readable error codes carried in Response.Code alongside the
+// human-readable Error message.
+const (
+	CodeInvalidRequest = "INVALID_REQUEST" // malformed JSON, unknown type, bad arguments
+	CodeUpstreamError  = "UPSTREAM_ERROR"  // the upstream fetch failed
+	CodeRateLimited    = "RATE_LIMITED"    // the client should back off and retry
+	CodeTooLarge       = "TOO_LARGE"       // the request exceeds a size limit
+	CodeReadOnly       = "READ_ONLY"       // writes are not accepted by this node
+	CodeInternal       = "INTERNAL"        // the local datastore failed
+	CodeResync         = "RESYNC_REQUIRED" // CHANGES: since predates the change log; re-LIST
+	CodeOverloaded     = "OVERLOADED"      // writes are being shed while RocksDB is stalled, upstream fetches are saturated, or the write-through queue is full
+	CodeUnauthorized   = "UNAUTHORIZED"    // the request type needs an authenticated caller
+	CodeNotFound       = "NOT_FOUND"       // REST: no such key or route
+	CodeCanceled       = "CANCELED"        // an operator canceled the operation
+	CodeQuotaExceeded  = "QUOTA_EXCEEDED"  // the write would take a prefix over its quota
+	CodeOutOfRange     = "OUT_OF_RANGE"    // INCR: a result falls outside the bounds it must respect
+	CodeNotReady       = "NOT_READY"       // the store hasn't loaded its initial data yet; retry shortly
+	CodeNoQuorum       = "NO_QUORUM"       // a write committed locally, but too few replicas acknowledged it in time
+	CodeConflict       = "CONFLICT"        // BATCH: a cas found a different value; nothing was written
+	CodeWrongShard     = "WRONG_SHARD"     // a key belongs to another cluster node, named in data.owners
+)
+
+// ErrWrongShard is returned by Lookup for a key the ring assigns to another
+// node.
+var ErrWrongShard = errors.New("key belongs to another cluster node")
+
+// ErrUpstream wraps errors from fetching a miss from upstream.
+var ErrUpstream = errors.New("upstream fetch failed")
+
+// ErrNotReady is returned by StreamScan until the store is ready.
+var ErrNotReady = errors.New("store is not ready; it hasn't loaded its initial data")
+
+// ErrCompactionBehind is returned by ReadyCheck while compaction debt is
+// over ReadyMaxCompactionBytes.
+var ErrCompactionBehind = errors.New("compaction is falling behind")
+
 type Handler struct {
 	DB       datastore.Datastore
-	Upstream *upstream.Client // nil if none
-	TTL      time.Duration   // 0 == infinite
+	Upstream *upstream.Client     // nil if none
+	TTL      time.Duration        // 0 == infinite
+	CacheTTL time.Duration        // for values fetched from upstream; 0 == infinite
+	Changes  *datastore.ChangeLog // nil disables CHANGES
+
+	// PrefixTTLs overrides TTL for keys under a prefix when a request carries
+	// no explicit TTL. The longest matching prefix wins.
+	PrefixTTLs map[string]time.Duration
+	// SlidingTTLPrefixes lists prefixes whose keys get their TTL renewed on
+	// every GET that finds them.
+	SlidingTTLPrefixes []string
+	// PinnedPrefixes lists prefixes whose keys never expire, whatever TTL a
+	// request, prefix rule or cache fill would give them.
+	PinnedPrefixes []string
+
+	// MaxResponseBytes caps the approximate encoded size of Data; 0 == unlimited.
+	MaxResponseBytes int
+
+	// MaxKeyBytes caps key length; 0 == unlimited. KeyPattern, if set, must
+	// match every key a request names.
+	MaxKeyBytes int
+	KeyPattern  *regexp.Regexp
+
+	// MaxBatchBytes caps the approximate size of one UPDATE write batch;
+	// 0 == unlimited. Larger UPDATEs are refused unless they ask to be split.
+	MaxBatchBytes int
+
+	// WarmMaxBytes caps how much a WARM request loads from upstream;
+	// 0 == unlimited.
+	WarmMaxBytes int
+
+	// HotKeys, if set, samples GET keys for the admin hot key report.
+	HotKeys *hotkeys.Tracker
+
+	// Quotas, if set, caps what UPDATE and REPLACE_PREFIX may store under
+	// configured prefixes.
+	Quotas *quota.Enforcer
+
+	// Audit, if set, records every UPDATE, DELETE, REPLACE_PREFIX,
+	// DELETE_RANGE, TOUCH, INCR, GETORSET, POP, BATCH and WARM with the
+	// identity that sent it.
+	Audit *audit.Log
+
+	// IdempotencyTTL is how long a request's idempotency key is remembered;
+	// 0 disables idempotency keys.
+	IdempotencyTTL time.Duration
+
+	// Ops, if set, tracks scans (LIST, SCAN, QUERY, CHANGES, CHILDREN and
+	// streamed scans) so operators can list and cancel them.
+	Ops *ops.Registry
+
+	// Ready, if set, is closed once the store holds its initial data, such
+	// as a follower's first snapshot. Until then LIST, SCAN, QUERY, CHANGES
+	// and streamed scans fail with NOT_READY rather than return an empty
+	// result that looks like an empty store.
+	Ready <-chan struct{}
+
+	// Vars are the variables a GET with resolve substitutes into values.
+	// StrictVars fails such a GET on a placeholder naming a variable not
+	// in Vars, instead of leaving the placeholder as is.
+	Vars       map[string]string
+	StrictVars bool
+
+	// CanonicalJSON is CanonicalOff, CanonicalRewrite or CanonicalReject:
+	// whether written values are stored as sent, re-encoded into canonical
+	// form, or refused unless already canonical. "" means off.
+	CanonicalJSON string
+
+	// ExpiryField, if set, names a top-level field of object values whose
+	// timestamp becomes the written entry's expiry, in place of any TTL.
+	ExpiryField string
+
+	// Ring, if set, makes the handler refuse keys the consistent-hash ring
+	// assigns to a node other than Self, naming the owner, so a misrouted
+	// request fails loudly instead of landing on the wrong node.
+	Ring *ring.Ring
+	Self string
+
+	// Replicas, if set, pushes every write to replica nodes; mutating
+	// requests wait for as many of them to acknowledge it as the fan-out
+	// needs.
+	Replicas *replication.Fanout
+
+	// WriteThrough, if set, queues every client write to be sent on to
+	// upstream; see queued.
+	WriteThrough *writethrough.Queue
+
+	// ForwardUnknown sends requests of a type this node doesn't implement to
+	// upstream unchanged and relays the response, so an edge node supports
+	// request types added upstream. Callers must be authenticated.
+	ForwardUnknown bool
+
+	// ReadyMaxCompactionBytes, if set, makes ReadyCheck fail while RocksDB's
+	// pending compaction bytes are at or above it, so orchestrators drain the
+	// node before writes stall.
+	ReadyMaxCompactionBytes uint64
+
+	fetches singleflight.Group // upstream fetches in flight, by key
+	idem    singleflight.Group // idempotent requests in flight, by idempotency key
+	hits    hitRate
 }
 
 func New(db datastore.Datastore, up *upstream.Client, ttl time.Duration) *Handler {
-	return &Handler{DB: db, Upstream: up, TTL: ttl}
+	return &Handler{DB: db, Upstream: up, TTL: ttl, CacheTTL: ttl}
+}
+
+// ServeJSON decodes a request envelope and serves it. With ForwardUnknown
+// a request of an unknown type is forwarded upstream as the original
+// payload, so fields this node doesn't know about reach upstream too.
+func (h *Handler) ServeJSON(ctx context.Context, payload []byte) Response {
+	var req Request
+	if err := json.Unmarshal(payload, &req); err != nil {
+		return withData(fail(CodeInvalidRequest, err.Error()))
+	}
+	resp := h.Serve(ctx, req)
+	if h.ForwardUnknown && h.Upstream != nil && resp.Code == CodeInvalidRequest && resp.Error == msgUnknownType {
+		return h.audit(ctx, req, h.forward(ctx, payload, resp))
+	}
+	return resp
+}
+
+// msgUnknownType is the error for request types serve doesn't implement.
+const msgUnknownType = "unknown type"
+
+// forward relays payload to upstream, returning unknown (the local answer)
+// when upstream can't take it.
+func (h *Handler) forward(ctx context.Context, payload []byte, unknown Response) Response {
+	if _, ok := auth.Identity(ctx); !ok {
+		return withData(fail(CodeUnauthorized, "forwarding to upstream requires authentication"))
+	}
+	raw, err := h.Upstream.Forward(ctx, payload)
+	switch {
+	case errors.Is(err, upstream.ErrForwardUnsupported):
+		return unknown
+	case errors.Is(err, upstream.ErrBusy):
+		return withData(fail(CodeOverloaded, err.Error()))
+	case err != nil:
+		return withData(fail(CodeUpstreamError, err.Error()))
+	}
+	resp := Response{Forwarded: raw}
+	_ = json.Unmarshal(raw, &struct {
+		Type  *string `json:"type"`
+		Code  *string `json:"code"`
+		Error *string `json:"error"`
+	}{&resp.Type, &resp.Code, &resp.Error})
+	return resp
+}
+
+// ReadyCheck reports why the node shouldn't take traffic, if it shouldn't:
+// ErrNotReady before it has loaded its initial data, or ErrCompactionBehind
+// while compaction debt is over ReadyMaxCompactionBytes.
+func (h *Handler) ReadyCheck() error {
+	if !h.IsReady() {
+		return ErrNotReady
+	}
+	if max := h.ReadyMaxCompactionBytes; max > 0 {
+		if pending := h.DB.PendingCompactionBytes(); pending >= max {
+			return fmt.Errorf("%w: %d bytes pending, limit %d", ErrCompactionBehind, pending, max)
+		}
+	}
+	return nil
 }
 
-func (h *Handler) Serve(req Request) Response {
+// IsReady reports whether the store has loaded its initial data.
+func (h *Handler) IsReady() bool {
+	if h.Ready == nil {
+		return true
+	}
+	select {
+	case <-h.Ready:
+		return true
+	default:
+		return false
+	}
+}
+
+// Serve handles one request. Debug request types require ctx to carry an
+// identity (see auth.WithIdentity). A key listed more than once in Keys is
+// served once, at its first position; in Items, TTLs and Fields, which are
+// JSON objects, the last occurrence of a repeated key wins. Data is never
+// nil in the response.
+func (h *Handler) Serve(ctx context.Context, req Request) Response {
+	return withData(h.serve(ctx, req))
+}
+
+// withData gives resp an empty Data map if it has none, so clients always
+// find an object to read.
+func withData(resp Response) Response {
+	if resp.Data == nil {
+		resp.Data = map[string]interface{}{}
+	}
+	return resp
+}
+
+func (h *Handler) serve(ctx context.Context, req Request) Response {
+	req.Keys = dedupe(req.Keys)
+	if errs := h.checkKeys(req); len(errs) > 0 {
+		resp := fail(CodeInvalidRequest, "invalid keys; nothing was done")
+		resp.Errors = errs
+		return resp
+	}
+	if owners := h.misrouted(req); len(owners) > 0 {
+		resp := fail(CodeWrongShard, fmt.Sprintf("%d keys belong to other cluster nodes; nothing was done", len(owners)))
+		resp.Errors = make(map[string]string, len(owners))
+		data := make(map[string]interface{}, len(owners))
+		for k, node := range owners {
+			resp.Errors[k] = "owned by " + node
+			data[k] = node
+		}
+		resp.Data = map[string]interface{}{"owners": data}
+		return resp
+	}
+	switch req.Type {
+	case "LIST", "SCAN", "QUERY", "CHANGES", "CHILDREN":
+		if !h.IsReady() {
+			return fail(CodeNotReady, ErrNotReady.Error())
+		}
+	}
 	switch req.Type {
 	case "GET":
+		defer getLatency.Since(time.Now())
 		res := make(map[string]interface{})
+		resp := Response{Type: "OK", Data: res}
+		if req.Debug {
+			resp.Source = make(map[string]string, len(req.Keys))
+		}
+		if req.Timestamps {
+			resp.Timestamps = make(map[string]Timestamps, len(req.Keys))
+		}
+		if req.Binary {
+			resp.Encodings = make(map[string]string)
+		}
+		b := budget{max: h.MaxResponseBytes}
 		for _, k := range req.Keys {
-			raw, ok, err := h.DB.Get(k)
+			if isGlob(k) {
+				more, err := h.getGlob(ctx, k, req.Fields[k], req.Resolve, &resp, &b)
+				if errors.Is(err, context.Canceled) {
+					return fail(CodeCanceled, "get canceled")
+				}
+				if errors.Is(err, ErrUndefinedVar) {
+					return fail(CodeInvalidRequest, err.Error())
+				}
+				if err != nil {
+					return fail(CodeInternal, err.Error())
+				}
+				if !more {
+					return resp
+				}
+				continue
+			}
+			if h.HotKeys != nil {
+				h.HotKeys.Record(k)
+			}
+			raw, ok, src, err := h.get(k, req.Debug)
 			if err != nil {
-				return Response{Type: "ERR", Error: err.Error()}
+				return fail(CodeInternal, err.Error())
 			}
+			h.hits.record(ok)
 			if ok {
-				var v interface{}
-				_ = json.Unmarshal(raw, &v)
-				res[k] = v
+				h.slide(k)
+				if raw, err = h.shape(raw, req.Fields[k], req.Resolve); err != nil {
+					return fail(CodeInvalidRequest, fmt.Sprintf("key %q: %v", k, err))
+				}
+				if !b.add(k, raw) {
+					resp.Truncated = true
+					return resp
+				}
+				res[k] = decodeValue(raw)
+				if resp.Source != nil {
+					resp.Source[k] = src
+				}
+				if err := h.stamp(&resp, k); err != nil {
+					return fail(CodeInternal, err.Error())
+				}
 				continue
 			}
 			// miss -> ask upstream if configured
 			if h.Upstream != nil {
-				rawUp, found, err := h.Upstream.Fetch(k)
+				rawUp, found, err := h.fetch(ctx, k)
+				if errors.Is(err, upstream.ErrBusy) {
+					return fail(CodeOverloaded, err.Error())
+				}
 				if err != nil {
-					return Response{Type: "ERR", Error: err.Error()}
+					return fail(CodeUpstreamError, err.Error())
 				}
 				if found {
-					_ = h.DB.Put(k, rawUp, h.TTL)
-					var v interface{}
-					_ = json.Unmarshal(rawUp, &v)
-					res[k] = v
+					if rawUp, err = h.shape(rawUp, req.Fields[k], req.Resolve); err != nil {
+						return fail(CodeInvalidRequest, fmt.Sprintf("key %q: %v", k, err))
+					}
+					if !b.add(k, rawUp) {
+						resp.Truncated = true
+						return resp
+					}
+					res[k] = decodeValue(rawUp)
+					if resp.Source != nil {
+						resp.Source[k] = "upstream"
+					}
+					if err := h.stamp(&resp, k); err != nil {
+						return fail(CodeInternal, err.Error())
+					}
 					continue
 				}
 			}
+			if !b.add(k, nil) {
+				resp.Truncated = true
+				return resp
+			}
 			res[k] = nil
+			if resp.Source != nil {
+				resp.Source[k] = "missing"
+			}
 		}
-		return Response{Type: "OK", Data: res}
+		return resp
 
-	case "LIST":
-		all, err := h.DB.List()
+	case "LIST", "SCAN":
+		if req.Type == "LIST" {
+			req.Prefix = ""
+		}
+		scan := h.Scan
+		if req.Reverse {
+			scan = h.DB.ScanReverse
+		}
+		if req.IncludeInternal {
+			if _, ok := auth.Identity(ctx); !ok {
+				return fail(CodeUnauthorized, "includeInternal requires authentication")
+			}
+			if req.Reverse {
+				return fail(CodeInvalidRequest, "reverse can't be combined with includeInternal")
+			}
+			scan = h.scanInternal
+		}
+		ctx, op := h.Ops.Start(ctx, req.Type, req.Prefix)
+		defer op.Done()
+		resp := Response{Type: "OK", Data: make(map[string]interface{})}
+		if req.ModifiedSince != 0 {
+			if req.Reverse || req.IncludeInternal {
+				return fail(CodeInvalidRequest, "modifiedSince can't be combined with reverse or includeInternal")
+			}
+			if h.Changes == nil {
+				return fail(CodeInvalidRequest, "modifiedSince needs the change log")
+			}
+			// Writes committing while this runs are stamped after the
+			// newest change so far, so the next poll from its time sees them.
+			head, at := h.Changes.Head()
+			if at == 0 {
+				at = time.Now().UnixNano()
+			}
+			resp.Now = at
+			if req.Cursor == "" {
+				keys, ranges, ok, err := h.deletedSince(ctx, req.Prefix, req.ModifiedSince, head)
+				if ctx.Err() != nil {
+					return fail(CodeCanceled, "scan canceled")
+				}
+				if err != nil {
+					return fail(CodeInternal, err.Error())
+				}
+				if !ok {
+					resp := fail(CodeResync, "modifiedSince is outside the change log; re-LIST without it")
+					resp.Now = at
+					return resp
+				}
+				resp.Deleted, resp.DeletedRanges = keys, ranges
+			}
+			scan = h.scanModified(req.ModifiedSince)
+		}
+		b := budget{max: h.MaxResponseBytes}
+		canceled := false
+		err := scan(req.Prefix, req.Cursor, func(k string, raw json.RawMessage) bool {
+			if canceled = ctx.Err() != nil; canceled {
+				return false
+			}
+			op.Add(1)
+			if !b.add(k, raw) {
+				resp.Truncated, resp.NextCursor = true, k
+				return false
+			}
+			resp.Data[k] = decodeValue(raw)
+			return true
+		})
 		if err != nil {
-			return Response{Type: "ERR", Error: err.Error()}
+			return fail(CodeInternal, err.Error())
+		}
+		if canceled {
+			return fail(CodeCanceled, "scan canceled")
 		}
-		return Response{Type: "OK", Data: all}
+		return resp
+
+	case "CHILDREN":
+		return h.children(ctx, req)
 
 	case "UPDATE":
-		for k, raw := range req.Items {
-			if len(raw) == 0 {
-				if err := h.DB.Delete(k); err != nil {
-					return Response{Type: "ERR", Error: err.Error()}
+		defer updateLatency.Since(time.Now())
+		return h.audit(ctx, req, h.replicated(ctx, h.once(req, func(rec *datastore.Idempotency) Response { return h.update(req, rec) })))
+
+	case "DELETE":
+		if len(req.Keys) == 0 {
+			return fail(CodeInvalidRequest, "keys are required")
+		}
+		return h.audit(ctx, req, h.replicated(ctx, h.update(Request{Type: "UPDATE", Delete: req.Keys}, nil)))
+
+	case "REPLACE_PREFIX":
+		return h.audit(ctx, req, h.replicated(ctx, h.once(req, func(rec *datastore.Idempotency) Response { return h.replacePrefix(req, rec) })))
+
+	case "DELETE_RANGE":
+		return h.audit(ctx, req, h.replicated(ctx, h.deleteRange(req)))
+
+	case "EXISTS":
+		return h.exists(req)
+
+	case "DIFF":
+		return h.diff(req)
+
+	case "WARM":
+		return h.audit(ctx, req, h.replicated(ctx, h.warm(ctx, req)))
+
+	case "TOUCH":
+		return h.audit(ctx, req, h.replicated(ctx, h.touch(req)))
+
+	case "INCR":
+		return h.audit(ctx, req, h.replicated(ctx, h.once(req, func(rec *datastore.Idempotency) Response { return h.incr(req, rec) })))
+
+	case "GETORSET":
+		return h.audit(ctx, req, h.replicated(ctx, h.getOrSet(req)))
+
+	case "POP":
+		return h.audit(ctx, req, h.replicated(ctx, h.pop(req)))
+
+	case "BATCH":
+		return h.audit(ctx, req, h.replicated(ctx, h.once(req, func(rec *datastore.Idempotency) Response { return h.batch(req, rec) })))
+
+	case "CHANGES":
+		return h.changes(ctx, req)
+
+	case "PREFIX_STATS":
+		size, keys, err := h.DB.PrefixSize(req.Prefix)
+		if err != nil {
+			return storeFail(err)
+		}
+		return Response{Type: "OK", Data: map[string]interface{}{
+			"prefix": req.Prefix,
+			"bytes":  size,
+			"keys":   keys,
+		}}
+
+	case "GET_RAW":
+		if _, ok := auth.Identity(ctx); !ok {
+			return fail(CodeUnauthorized, "GET_RAW requires authentication")
+		}
+		return h.getRaw(req)
+
+	case "QUERY":
+		if _, ok := auth.Identity(ctx); !ok {
+			return fail(CodeUnauthorized, "QUERY requires authentication")
+		}
+		return h.query(ctx, req)
+
+	case "PING":
+		return Response{Type: "PONG"}
+
+	case "STATS":
+		stats := h.DB.Stats()
+		stats["ready"] = true
+		if err := h.ReadyCheck(); err != nil {
+			stats["ready"], stats["notReadyReason"] = false, err.Error()
+		}
+		stats["hitRatio"] = h.hits.ratios()
+		stats["latency"] = metrics.Latencies()
+		if st, ok := cleaner.CurrentStatus(); ok {
+			stats["cleaner"] = st
+		}
+		if h.Replicas != nil {
+			stats["replicas"] = h.Replicas.Status()
+		}
+		if h.Quotas != nil {
+			stats["quotaUsage"] = h.Quotas.Usage()
+		}
+		if h.WriteThrough != nil {
+			stats["writeThrough"] = h.WriteThrough.Status()
+		}
+		if h.Upstream != nil {
+			if health, ok := h.Upstream.LastHealth(); ok {
+				stats["upstreamHealth"] = health
+			}
+		}
+		return Response{Type: "OK", Data: stats}
+
+	default:
+		return fail(CodeInvalidRequest, msgUnknownType)
+	}
+}
+
+// dedupe drops repeats from keys, keeping the first occurrence of each.
+func dedupe(keys []string) []string {
+	if len(keys) < 2 {
+		return keys
+	}
+	seen := make(map[string]struct{}, len(keys))
+	out := make([]string, 0, len(keys))
+	for _, k := range keys {
+		if _, dup := seen[k]; !dup {
+			seen[k] = struct{}{}
+			out = append(out, k)
+		}
+	}
+	return out
+}
+
+// checkKeys validates every key a request names and returns the reasons for
+// those that are rejected.
+func (h *Handler) checkKeys(req Request) map[string]string {
+	var errs map[string]string
+	check := func(k string) {
+		err := h.CheckKey(k)
+		if req.Type == "GET" && isGlob(k) {
+			err = h.checkPattern(k)
+		}
+		if err != nil {
+			if errs == nil {
+				errs = make(map[string]string)
+			}
+			errs[k] = err.Error()
+		}
+	}
+	for _, k := range req.Keys {
+		check(k)
+	}
+	for k := range req.Items {
+		check(k)
+	}
+	for _, k := range req.Delete {
+		check(k)
+	}
+	return errs
+}
+
+// misrouted returns, for each key a request names that the ring assigns to
+// another node, that node. GET patterns aren't checked, since they only
+// match keys this node holds.
+func (h *Handler) misrouted(req Request) map[string]string {
+	if h.Ring == nil {
+		return nil
+	}
+	var owners map[string]string
+	check := func(k string) {
+		if node := h.Ring.Owner(k); node != h.Self {
+			if owners == nil {
+				owners = make(map[string]string)
+			}
+			owners[k] = node
+		}
+	}
+	for _, k := range req.Keys {
+		if req.Type != "GET" || !isGlob(k) {
+			check(k)
+		}
+	}
+	for k := range req.Items {
+		check(k)
+	}
+	for _, k := range req.Delete {
+		check(k)
+	}
+	for _, op := range req.Ops {
+		check(op.Key)
+	}
+	return owners
+}
+
+// CheckKey reports why key is not acceptable, or nil. Beyond the store's own
+// rules (not empty, not reserved) keys may not contain control characters,
+// which would break line-oriented logs and streams, and must respect
+// MaxKeyBytes and KeyPattern.
+func (h *Handler) CheckKey(key string) error {
+	if err := datastore.ValidateKey(key); err != nil {
+		return err
+	}
+	if h.MaxKeyBytes > 0 && len(key) > h.MaxKeyBytes {
+		return fmt.Errorf("%w: longer than %d bytes", datastore.ErrInvalidKey, h.MaxKeyBytes)
+	}
+	for _, c := range key {
+		if unicode.IsControl(c) {
+			return fmt.Errorf("%w: contains control character %U", datastore.ErrInvalidKey, c)
+		}
+	}
+	if h.KeyPattern != nil && !h.KeyPattern.MatchString(key) {
+		return fmt.Errorf("%w: does not match %s", datastore.ErrInvalidKey, h.KeyPattern)
+	}
+	return nil
+}
+
+// Lookup returns the live stored entry for key, filling a miss from upstream
+// the way GET does. Upstream failures wrap ErrUpstream.
+func (h *Handler) Lookup(ctx context.Context, key string) (datastore.DBEntry, bool, error) {
+	if err := h.CheckKey(key); err != nil {
+		return datastore.DBEntry{}, false, err
+	}
+	if h.Ring != nil {
+		if node := h.Ring.Owner(key); node != h.Self {
+			return datastore.DBEntry{}, false, fmt.Errorf("%w: %q is owned by %s", ErrWrongShard, key, node)
+		}
+	}
+	if h.HotKeys != nil {
+		h.HotKeys.Record(key)
+	}
+	e, ok, err := h.DB.GetEntry(key)
+	if err != nil {
+		return datastore.DBEntry{}, false, err
+	}
+	if ok && !e.Expired(time.Now().UnixNano()) {
+		h.hits.record(true)
+		h.slide(key)
+		return e, true, nil
+	}
+	h.hits.record(false)
+	if h.Upstream == nil {
+		return datastore.DBEntry{}, false, nil
+	}
+	_, found, err := h.fetch(ctx, key)
+	if err != nil {
+		return datastore.DBEntry{}, false, fmt.Errorf("%w: %w", ErrUpstream, err)
+	}
+	if !found {
+		return datastore.DBEntry{}, false, nil
+	}
+	// Re-read for the sequence and write time the fill was stored with.
+	return h.DB.GetEntry(key)
+}
+
+// stamp adds key's timestamps and, if its value is binary, its encoding to
+// resp, for whichever of the two resp asked for, from the stored entry.
+func (h *Handler) stamp(resp *Response, key string) error {
+	if resp.Timestamps == nil && resp.Encodings == nil {
+		return nil
+	}
+	e, ok, err := h.DB.GetEntry(key)
+	if err != nil || !ok {
+		return err
+	}
+	if resp.Timestamps != nil {
+		resp.Timestamps[key] = Timestamps{Created: e.Created, Modified: e.Modified}
+	}
+	if resp.Encodings != nil && e.Encoding != "" {
+		resp.Encodings[key] = e.Encoding
+	}
+	return nil
+}
+
+// get reads key locally. With debug it also asks the store which layer
+// answered, which only a read cache can tell apart.
+func (h *Handler) get(key string, debug bool) (json.RawMessage, bool, string, error) {
+	if sg, ok := h.DB.(datastore.SourceGetter); ok && debug {
+		return sg.GetWithSource(key)
+	}
+	raw, ok, err := h.DB.Get(key)
+	return raw, ok, datastore.SourceLocal, err
+}
+
+// fetch asks upstream for key, sharing one call (and one store write) among
+// concurrent misses for the same key. Errors and not-found results reach only
+// the callers already waiting on that call; nothing but a found value is
+// stored, so the next miss asks upstream again. The shared call holds one of
+// the upstream client's fetch slots, so duplicate misses never take more.
+//
+// The shared call runs under the context of the caller that started it. If
+// that caller goes away the call is canceled, and waiters that are still
+// around start a new one rather than inherit the cancellation.
+func (h *Handler) fetch(ctx context.Context, key string) (json.RawMessage, bool, error) {
+	type result struct {
+		raw   json.RawMessage
+		found bool
+	}
+	for {
+		ch := h.fetches.DoChan(key, func() (interface{}, error) {
+			raw, found, err := h.Upstream.Fetch(ctx, key)
+			if err != nil {
+				return nil, err
+			}
+			if found {
+				_ = h.DB.Put(key, raw, h.CacheTTLFor(key))
+			}
+			return result{raw, found}, nil
+		})
+		select {
+		case <-ctx.Done():
+			return nil, false, ctx.Err()
+		case res := <-ch:
+			if res.Err != nil {
+				if ctx.Err() == nil && (errors.Is(res.Err, context.Canceled) || errors.Is(res.Err, context.DeadlineExceeded)) {
+					continue
+				}
+				return nil, false, res.Err
+			}
+			r := res.Val.(result)
+			return r.raw, r.found, nil
+		}
+	}
+}
+
+// audit records a mutating request and its outcome, then returns resp. A
+// failure to record is logged but doesn't fail the request, which has
+// already run.
+func (h *Handler) audit(ctx context.Context, req Request, resp Response) Response {
+	if h.Audit == nil {
+		return resp
+	}
+	e := audit.Entry{Type: req.Type, Prefix: req.Prefix, Result: resp.Type}
+	e.Identity, _ = auth.Identity(ctx)
+	if p, ok := auth.PeerOf(ctx); ok {
+		e.Transport, e.Remote = p.Transport, p.Addr
+	}
+	if resp.Code != "" {
+		e.Result = resp.Code
+	}
+	e.Keys = append(e.Keys, req.Keys...)
+	e.Keys = append(e.Keys, req.Delete...)
+	for _, op := range req.Ops {
+		e.Keys = append(e.Keys, op.Key)
+	}
+	if req.Start != "" {
+		e.Keys = append(e.Keys, req.Start, req.End)
+	}
+	for k := range req.Items {
+		e.Keys = append(e.Keys, k)
+	}
+	sort.Strings(e.Keys)
+	if err := h.Audit.Record(e); err != nil {
+		fmt.Println("audit log error:", err)
+	}
+	return resp
+}
+
+// MaxIdempotencyKeyBytes caps the length of a request's idempotency key.
+const MaxIdempotencyKeyBytes = 256
+
+type onceResult struct {
+	resp Response
+	hash string
+}
+
+// once runs a mutating request at most once per idempotency key. Without a
+// key it just runs. With one, a live record for the key is replayed if it was
+// left by the same request, and refused if the key was used for a different
+// one; otherwise run writes the record in the same batch as the request, so
+// only a request that took effect is remembered. Concurrent requests with the
+// same key share one execution.
+func (h *Handler) once(req Request, run func(*datastore.Idempotency) Response) Response {
+	id := req.IdempotencyKey
+	if id == "" {
+		return run(nil)
+	}
+	switch {
+	case h.IdempotencyTTL <= 0:
+		return fail(CodeInvalidRequest, "idempotency keys are disabled")
+	case len(id) > MaxIdempotencyKeyBytes:
+		return fail(CodeInvalidRequest, fmt.Sprintf("idempotency key exceeds %d bytes", MaxIdempotencyKeyBytes))
+	}
+	req.IdempotencyKey = ""
+	b, _ := json.Marshal(&req)
+	sum := sha256.Sum256(b)
+	hash := hex.EncodeToString(sum[:])
+
+	v, _, _ := h.idem.Do(id, func() (interface{}, error) {
+		prev, ok, err := datastore.Recall(h.DB, id)
+		if err != nil {
+			return onceResult{storeFail(err), hash}, nil
+		}
+		if !ok {
+			rec := &datastore.Idempotency{ID: id, Type: req.Type, Hash: hash, Expiry: datastore.ExpiryFor(h.IdempotencyTTL)}
+			return onceResult{run(rec), hash}, nil
+		}
+		if prev.Type != req.Type || prev.Hash != hash {
+			return onceResult{fail(CodeInvalidRequest, "idempotency key was used for a different request"), hash}, nil
+		}
+		resp := Response{Type: "OK", Replayed: true}
+		if len(prev.Data) > 0 && string(prev.Data) != "null" {
+			dec := json.NewDecoder(bytes.NewReader(prev.Data))
+			dec.UseNumber()
+			if err := dec.Decode(&resp.Data); err != nil {
+				return onceResult{fail(CodeInternal, "bad idempotency record: "+err.Error()), hash}, nil
+			}
+		}
+		return onceResult{resp, hash}, nil
+	})
+	res := v.(onceResult)
+	if res.hash != hash {
+		// Shared with a concurrent request that used the key differently.
+		return fail(CodeInvalidRequest, "idempotency key was used for a different request")
+	}
+	return res.resp
+}
+
+func fail(code, msg string) Response {
+	return Response{Type: "ERR", Code: code, Error: msg}
+}
+
+// storeFail maps a datastore error onto the matching code.
+func storeFail(err error) Response {
+	switch {
+	case errors.Is(err, datastore.ErrReadOnly):
+		return fail(CodeReadOnly, err.Error())
+	case errors.Is(err, datastore.ErrInvalidKey), errors.Is(err, datastore.ErrNotInteger):
+		return fail(CodeInvalidRequest, err.Error())
+	case errors.Is(err, datastore.ErrOutOfRange):
+		return fail(CodeOutOfRange, err.Error())
+	case errors.Is(err, datastore.ErrConflict):
+		return fail(CodeConflict, err.Error())
+	case errors.Is(err, datastore.ErrCrossShard):
+		return fail(CodeInvalidRequest, err.Error())
+	case errors.Is(err, writethrough.ErrFull):
+		return fail(CodeOverloaded, err.Error())
+	}
+	return fail(CodeInternal, err.Error())
+}
+
+// update validates every item's TTL up front and then commits all items in a
+// single WriteBatch, so an invalid item rejects the whole request.
+func (h *Handler) update(req Request, rec *datastore.Idempotency) Response {
+	if h.DB.WriteStalled() {
+		return fail(CodeOverloaded, "overloaded")
+	}
+	errs := make(map[string]string)
+	for _, k := range req.Delete {
+		if _, ok := req.Items[k]; ok {
+			errs[k] = "key is both written and deleted"
+		}
+	}
+	muts, errResp := h.itemMutations(req, errs)
+	if errResp != nil {
+		return *errResp
+	}
+	for _, k := range dedupe(req.Delete) {
+		muts = append(muts, datastore.Mutation{Key: k, Delete: true})
+	}
+	batches := splitBatch(muts, h.MaxBatchBytes)
+	if len(batches) > 1 && !req.Split {
+		return fail(CodeTooLarge, fmt.Sprintf("update exceeds the %d byte batch limit; send smaller updates, or set split to apply it in %d non-atomic batches", h.MaxBatchBytes, len(batches)))
+	}
+	deltas, errResp := h.reserveBatches(batches)
+	if errResp != nil {
+		return *errResp
+	}
+	if rec != nil {
+		// Record in the last batch, so a retry after a partial failure
+		// applies the update again.
+		last := len(batches) - 1
+		batches[last] = append(batches[last], rec.Mutation(nil))
+	}
+	written := 0
+	for i, b := range batches {
+		// Each batch queues its own keys for upstream, as it may be the
+		// last to land.
+		err := h.queued(mutationKeys(b), "", "", "", func(extra ...datastore.Mutation) error {
+			return h.DB.Write(append(b, extra...))
+		})
+		if err != nil {
+			h.releaseBatches(deltas[i:])
+			resp := storeFail(err)
+			if written == 0 {
+				return resp
+			}
+			resp.Error = fmt.Sprintf("partially applied, %d of %d keys written: %v", written, len(muts), err)
+			resp.Errors = make(map[string]string)
+			for _, rest := range batches[i:] {
+				for _, k := range mutationKeys(rest) {
+					resp.Errors[k] = "not written"
 				}
-			} else {
-				if err := h.DB.Put(k, raw, h.TTL); err != nil {
-					return Response{Type: "ERR", Error: err.Error()}
+			}
+			return resp
+		}
+		written += len(b)
+	}
+	return Response{Type: "OK"}
+}
+
+// replicated waits, after a successful write, for the replicas to
+// acknowledge everything committed so far. Every mutating request type goes
+// through it, so ReplicaAcks holds for all of them, not just UPDATE. A
+// replayed response waits too, so retrying with the idempotency key waits
+// again without rewriting.
+func (h *Handler) replicated(ctx context.Context, resp Response) Response {
+	if resp.Type != "OK" || h.Replicas == nil || h.Changes == nil {
+		return resp
+	}
+	if err := h.Replicas.Wait(ctx, h.Changes.Seq()); err != nil {
+		// The write stands, so keep what it returned: a POP's values are
+		// gone from the store and an INCR's results were applied.
+		resp.Type, resp.Code, resp.Error = "ERR", CodeNoQuorum, err.Error()
+		return withData(resp)
+	}
+	return resp
+}
+
+// warm loads every key under req.Prefix from upstream in one paged scan and
+// stores them as cache fills, with the cache TTL, in batches of at most
+// MaxBatchBytes. Nothing is stored unless the whole prefix was fetched.
+func (h *Handler) warm(ctx context.Context, req Request) Response {
+	if h.Upstream == nil {
+		return fail(CodeInvalidRequest, "WARM needs an upstream")
+	}
+	if h.DB.WriteStalled() {
+		return fail(CodeOverloaded, "overloaded")
+	}
+	ctx, op := h.Ops.Start(ctx, "WARM", req.Prefix)
+	defer op.Done()
+	items, err := h.Upstream.FetchPrefix(ctx, req.Prefix, h.WarmMaxBytes)
+	switch {
+	case errors.Is(err, upstream.ErrPrefixUnsupported):
+		return fail(CodeInvalidRequest, err.Error())
+	case errors.Is(err, upstream.ErrPrefixTooLarge):
+		return fail(CodeTooLarge, err.Error())
+	case errors.Is(err, upstream.ErrBusy):
+		return fail(CodeOverloaded, err.Error())
+	case ctx.Err() != nil:
+		return fail(CodeCanceled, "warm canceled")
+	case err != nil:
+		return fail(CodeUpstreamError, err.Error())
+	}
+
+	muts := make([]datastore.Mutation, 0, len(items))
+	for k, raw := range items {
+		if h.CheckKey(k) != nil {
+			continue
+		}
+		muts = append(muts, datastore.Mutation{Key: k, Value: raw, Expiry: datastore.ExpiryFor(h.CacheTTLFor(k))})
+	}
+	if len(muts) > 0 {
+		batches := splitBatch(muts, h.MaxBatchBytes)
+		deltas, errResp := h.reserveBatches(batches)
+		if errResp != nil {
+			return *errResp
+		}
+		for i, b := range batches {
+			if err := h.DB.Write(b); err != nil {
+				h.releaseBatches(deltas[i:])
+				return storeFail(err)
+			}
+			op.Add(int64(len(b)))
+		}
+	}
+	return Response{Type: "OK", Data: map[string]interface{}{
+		"prefix": req.Prefix,
+		"keys":   len(muts),
+	}}
+}
+
+// reserveQuota charges the growth muts would cause to the quota prefixes
+// they fall under, failing with QUOTA_EXCEEDED if any would go over. A put
+// adds a key unless the key is already live, and the size of its key and
+// value less what it replaces. Deletes are not credited; the next quota
+// refresh picks them up.
+func (h *Handler) reserveQuota(muts []datastore.Mutation) (map[string]quota.Usage, *Response) {
+	if h.Quotas == nil {
+		return nil, nil
+	}
+	delta := make(map[string]quota.Usage)
+	now := time.Now().UnixNano()
+	for _, m := range muts {
+		p, ok := h.Quotas.PrefixFor(m.Key)
+		if m.Delete || !ok {
+			continue
+		}
+		d := delta[p]
+		d.Bytes += int64(len(m.Key) + len(m.Value))
+		e, found, err := h.DB.GetEntry(m.Key)
+		if err != nil {
+			resp := storeFail(err)
+			return nil, &resp
+		}
+		if found && !e.Expired(now) {
+			d.Bytes -= int64(len(m.Key) + len(e.Value))
+		} else {
+			d.Keys++
+		}
+		delta[p] = d
+	}
+	if err := h.Quotas.Reserve(delta); err != nil {
+		resp := fail(CodeQuotaExceeded, err.Error())
+		return nil, &resp
+	}
+	return delta, nil
+}
+
+// reserveBatches charges each of batches with reserveQuota, all of them or
+// none, so that a caller whose writes fail part way can give back the
+// charges of the batches it didn't write.
+func (h *Handler) reserveBatches(batches [][]datastore.Mutation) ([]map[string]quota.Usage, *Response) {
+	deltas := make([]map[string]quota.Usage, len(batches))
+	for i, b := range batches {
+		delta, errResp := h.reserveQuota(b)
+		if errResp != nil {
+			h.releaseBatches(deltas[:i])
+			return nil, errResp
+		}
+		deltas[i] = delta
+	}
+	return deltas, nil
+}
+
+// releaseBatches gives back charges made by reserveBatches.
+func (h *Handler) releaseBatches(deltas []map[string]quota.Usage) {
+	for _, d := range deltas {
+		h.Quotas.Release(d)
+	}
+}
+
+// splitBatch cuts muts, in key order, into runs of at most max approximate
+// bytes each (0 = no limit). A single mutation larger than max gets a batch
+// of its own. Muts itself is left in its order.
+func splitBatch(muts []datastore.Mutation, max int) [][]datastore.Mutation {
+	if max <= 0 {
+		return [][]datastore.Mutation{muts}
+	}
+	muts = append([]datastore.Mutation(nil), muts...)
+	sort.Slice(muts, func(i, j int) bool { return muts[i].Key < muts[j].Key })
+	var batches [][]datastore.Mutation
+	start, size := 0, 0
+	for i, m := range muts {
+		n := len(m.Key) + len(m.Value) + 64 // wrapper, sequence and log record
+		if i > start && size+n > max {
+			// Capped, so appending to a batch can't overwrite the next.
+			batches = append(batches, muts[start:i:i])
+			start, size = i, 0
+		}
+		size += n
+	}
+	return append(batches, muts[start:])
+}
+
+// itemMutations turns req.Items into mutations, resolving each key's TTL.
+// Every value is stored as given, "" and {} included; deletes are asked for
+// separately. Problems are collected per key into errs
+// (which may arrive with entries already) and, if there are any, returned as
+// an INVALID_REQUEST response instead.
+func (h *Handler) itemMutations(req Request, errs map[string]string) ([]datastore.Mutation, *Response) {
+	var explicit *time.Duration
+	if req.TTL != "" {
+		d, err := time.ParseDuration(req.TTL)
+		if err != nil {
+			resp := fail(CodeInvalidRequest, "invalid ttl: "+err.Error())
+			return nil, &resp
+		}
+		explicit = &d
+	}
+
+	for k := range req.TTLs {
+		if _, ok := req.Items[k]; !ok {
+			errs[k] = "ttl given for a key not in items"
+		}
+	}
+	for k := range req.Encodings {
+		if _, ok := req.Items[k]; !ok {
+			errs[k] = "encoding given for a key not in items"
+		}
+	}
+	muts := make([]datastore.Mutation, 0, len(req.Items))
+	for k, raw := range req.Items {
+		ttl := explicit
+		if s, ok := req.TTLs[k]; ok {
+			d, err := time.ParseDuration(s)
+			if err != nil {
+				errs[k] = "invalid ttl: " + err.Error()
+				continue
+			}
+			ttl = &d
+		}
+		enc := req.Encodings[k]
+		if err := checkEncoding(enc, raw); err != nil {
+			errs[k] = err.Error()
+			continue
+		}
+		raw, err := h.canonical(raw)
+		if err != nil {
+			errs[k] = err.Error()
+			continue
+		}
+		expiry, err := h.expiryFor(k, raw, ttl)
+		if err != nil {
+			errs[k] = err.Error()
+			continue
+		}
+		muts = append(muts, datastore.Mutation{Key: k, Value: raw, Expiry: expiry, Encoding: enc})
+	}
+	if len(errs) > 0 {
+		resp := fail(CodeInvalidRequest, "invalid items; nothing was written")
+		resp.Errors = errs
+		return nil, &resp
+	}
+	return muts, nil
+}
+
+// checkEncoding validates an UPDATE item's value against its encoding: a
+// binary value must be a JSON string holding standard base64.
+func checkEncoding(enc string, raw json.RawMessage) error {
+	switch enc {
+	case "":
+		return nil
+	case datastore.EncodingBase64:
+		var s string
+		if json.Unmarshal(raw, &s) != nil {
+			return errors.New("a base64 value must be a JSON string")
+		}
+		if _, err := base64.StdEncoding.DecodeString(s); err != nil {
+			return fmt.Errorf("invalid base64 value: %v", err)
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown encoding %q (want base64)", enc)
+}
+
+// replacePrefix makes req.Items the complete set of keys under req.Prefix:
+// every existing key under the prefix that is not in Items is deleted, in the
+// same batch that writes Items. Readers see either the old set or the new one.
+// The old keys are listed before the batch is built, so the request holds
+// one key string per existing key in memory, and a key written under the
+// prefix concurrently with the replace may survive it.
+func (h *Handler) replacePrefix(req Request, rec *datastore.Idempotency) Response {
+	if req.Prefix == "" {
+		return fail(CodeInvalidRequest, "prefix is required")
+	}
+	if h.DB.WriteStalled() {
+		return fail(CodeOverloaded, "overloaded")
+	}
+	errs := make(map[string]string)
+	for k := range req.Items {
+		if !strings.HasPrefix(k, req.Prefix) {
+			errs[k] = "key is outside prefix"
+		}
+	}
+	muts, errResp := h.itemMutations(req, errs)
+	if errResp != nil {
+		return *errResp
+	}
+	deleted := 0
+	err := h.DB.Scan(req.Prefix, "", func(k string, _ json.RawMessage) bool {
+		if _, ok := req.Items[k]; !ok {
+			muts = append(muts, datastore.Mutation{Key: k, Delete: true})
+			deleted++
+		}
+		return true
+	})
+	if err != nil {
+		return storeFail(err)
+	}
+	delta, errResp := h.reserveQuota(muts)
+	if errResp != nil {
+		return *errResp
+	}
+	data := map[string]interface{}{
+		"written": len(req.Items),
+		"deleted": deleted,
+	}
+	if rec != nil {
+		b, _ := json.Marshal(data)
+		muts = append(muts, rec.Mutation(b))
+	}
+	err = h.queued(nil, req.Prefix, "", "", func(extra ...datastore.Mutation) error {
+		return h.DB.Write(append(muts, extra...))
+	})
+	if err != nil {
+		h.Quotas.Release(delta)
+		return storeFail(err)
+	}
+	return Response{Type: "OK", Data: data}
+}
+
+// deleteRange deletes every key in [req.Start, req.End) with range
+// tombstones. It can't say how many keys that was without reading them all.
+func (h *Handler) deleteRange(req Request) Response {
+	if req.Start == "" || req.End == "" {
+		return fail(CodeInvalidRequest, "start and end are required")
+	}
+	if req.End <= req.Start {
+		return fail(CodeInvalidRequest, "end must sort after start")
+	}
+	if h.DB.WriteStalled() {
+		return fail(CodeOverloaded, "overloaded")
+	}
+	err := h.queued(nil, "", req.Start, req.End, func(extra ...datastore.Mutation) error {
+		return h.DB.Write(append([]datastore.Mutation{{Key: req.Start, End: req.End, Delete: true}}, extra...))
+	})
+	if err != nil {
+		return storeFail(err)
+	}
+	return Response{Type: "OK"}
+}
+
+// touch renews the TTL of every live key in req.Keys without changing its
+// value, reporting per key whether it was refreshed; missing and expired keys
+// are not revived. The TTL is req.TTL or, without one, what an UPDATE of the
+// key would get. Keys sharing a TTL are refreshed in one batch.
+func (h *Handler) touch(req Request) Response {
+	if len(req.Keys) == 0 {
+		return fail(CodeInvalidRequest, "keys are required")
+	}
+	if h.DB.WriteStalled() {
+		return fail(CodeOverloaded, "overloaded")
+	}
+	var explicit *time.Duration
+	if req.TTL != "" {
+		d, err := time.ParseDuration(req.TTL)
+		if err != nil {
+			return fail(CodeInvalidRequest, "invalid ttl: "+err.Error())
+		}
+		explicit = &d
+	}
+	byTTL := make(map[time.Duration][]string)
+	res := make(map[string]interface{}, len(req.Keys))
+	for _, k := range req.Keys {
+		if _, dup := res[k]; dup {
+			continue
+		}
+		res[k] = false
+		ttl := h.ttlFor(k, explicit)
+		byTTL[ttl] = append(byTTL[ttl], k)
+	}
+	for ttl, keys := range byTTL {
+		var refreshed []string
+		err := h.queued(keys, "", "", "", func(extra ...datastore.Mutation) (err error) {
+			refreshed, err = h.DB.TouchMany(keys, ttl, extra...)
+			return err
+		})
+		if err != nil {
+			return storeFail(err)
+		}
+		for _, k := range refreshed {
+			res[k] = true
+		}
+	}
+	return Response{Type: "OK", Data: res}
+}
+
+// incrItem is one INCR item. A bare number is shorthand for {"by": n}.
+type incrItem struct {
+	By     int64  `json:"by"`
+	Min    *int64 `json:"min,omitempty"`
+	Max    *int64 `json:"max,omitempty"`
+	Reject bool   `json:"reject,omitempty"` // fail instead of clamping at a bound
+}
+
+// incr adds to integer counters, all in one batch. A counter created by the
+// request gets req.TTL or what an UPDATE of the key would get; an existing
+// one keeps its expiry. Results outside an item's bounds are clamped unless
+// the item sets reject, which fails the request with nothing written.
+func (h *Handler) incr(req Request, rec *datastore.Idempotency) Response {
+	if len(req.Items) == 0 {
+		return fail(CodeInvalidRequest, "items are required")
+	}
+	if h.DB.WriteStalled() {
+		return fail(CodeOverloaded, "overloaded")
+	}
+	var explicit *time.Duration
+	if req.TTL != "" {
+		d, err := time.ParseDuration(req.TTL)
+		if err != nil {
+			return fail(CodeInvalidRequest, "invalid ttl: "+err.Error())
+		}
+		explicit = &d
+	}
+	errs := make(map[string]string)
+	incs := make([]datastore.Increment, 0, len(req.Items))
+	for k, raw := range req.Items {
+		var it incrItem
+		if err := json.Unmarshal(raw, &it.By); err != nil {
+			if err := json.Unmarshal(raw, &it); err != nil {
+				errs[k] = "want an integer or {\"by\", \"min\", \"max\", \"reject\"}"
+				continue
+			}
+		}
+		if it.Min != nil && it.Max != nil && *it.Min > *it.Max {
+			errs[k] = "min is greater than max"
+			continue
+		}
+		incs = append(incs, datastore.Increment{
+			Key:    k,
+			By:     it.By,
+			Min:    it.Min,
+			Max:    it.Max,
+			Reject: it.Reject,
+			Expiry: datastore.ExpiryFor(h.ttlFor(k, explicit)),
+		})
+	}
+	if len(errs) > 0 {
+		resp := fail(CodeInvalidRequest, "invalid items; nothing was written")
+		resp.Errors = errs
+		return resp
+	}
+	keys := make([]string, len(incs))
+	for i, inc := range incs {
+		keys[i] = inc.Key
+	}
+	var out map[string]datastore.IncrResult
+	err := h.queued(keys, "", "", "", func(extra ...datastore.Mutation) (err error) {
+		out, err = h.DB.Increment(incs, rec, extra...)
+		return err
+	})
+	if err != nil {
+		return storeFail(err)
+	}
+	res := make(map[string]interface{}, len(out))
+	for k, v := range out {
+		res[k] = v
+	}
+	return Response{Type: "OK", Data: res}
+}
+
+// getOrSet returns each item's live value, storing the item's value first
+// for keys that have none, with req.TTL or what an UPDATE of the key would
+// get. Each key is read and set atomically on its own; items are not one
+// batch. Upstream is not consulted.
+func (h *Handler) getOrSet(req Request) Response {
+	if len(req.Items) == 0 {
+		return fail(CodeInvalidRequest, "items are required")
+	}
+	if h.DB.WriteStalled() {
+		return fail(CodeOverloaded, "overloaded")
+	}
+	var explicit *time.Duration
+	if req.TTL != "" {
+		d, err := time.ParseDuration(req.TTL)
+		if err != nil {
+			return fail(CodeInvalidRequest, "invalid ttl: "+err.Error())
+		}
+		explicit = &d
+	}
+	keys := make([]string, 0, len(req.Items))
+	for k := range req.Items {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	values := make(map[string]json.RawMessage, len(keys))
+	ttls := make(map[string]time.Duration, len(keys))
+	for _, k := range keys {
+		raw, err := h.canonical(req.Items[k])
+		if err == nil {
+			ttls[k], err = h.getOrSetTTL(k, raw, explicit)
+		}
+		if err != nil {
+			resp := fail(CodeInvalidRequest, "invalid items; nothing was written")
+			resp.Errors = map[string]string{k: err.Error()}
+			return resp
+		}
+		values[k] = raw
+	}
+	res := make(map[string]interface{}, len(keys))
+	encodings := make(map[string]string)
+	for _, k := range keys {
+		var e datastore.DBEntry
+		var set bool
+		err := h.queued([]string{k}, "", "", "", func(extra ...datastore.Mutation) (err error) {
+			e, set, err = h.DB.GetOrSet(k, values[k], ttls[k], extra...)
+			return err
+		})
+		if err != nil {
+			resp := storeFail(err)
+			resp.Data, resp.Encodings = res, encodings
+			return resp
+		}
+		res[k] = map[string]interface{}{"value": decodeValue(e.Value), "set": set}
+		if e.Encoding != "" {
+			encodings[k] = e.Encoding
+		}
+	}
+	return Response{Type: "OK", Data: res, Encodings: encodings}
+}
+
+// pop returns each key's live value and deletes it, one atomic read and
+// delete per key, so when consumers race to pop the same key only one of
+// them gets the value. Keys without a live value come back null. Keys are
+// popped in order, not as one batch; if the store fails partway through,
+// the error response's data holds the keys already popped, which stay
+// deleted. Upstream is not consulted.
+func (h *Handler) pop(req Request) Response {
+	if len(req.Keys) == 0 {
+		return fail(CodeInvalidRequest, "keys are required")
+	}
+	if h.DB.WriteStalled() {
+		return fail(CodeOverloaded, "overloaded")
+	}
+	res := make(map[string]interface{}, len(req.Keys))
+	encodings := make(map[string]string)
+	for _, k := range req.Keys {
+		var e datastore.DBEntry
+		var ok bool
+		err := h.queued([]string{k}, "", "", "", func(extra ...datastore.Mutation) (err error) {
+			e, ok, err = h.DB.GetAndDelete(k, extra...)
+			return err
+		})
+		if err != nil {
+			resp := storeFail(err)
+			resp.Data, resp.Encodings = res, encodings
+			return resp
+		}
+		if !ok {
+			res[k] = nil
+			continue
+		}
+		res[k] = decodeValue(e.Value)
+		if e.Encoding != "" {
+			encodings[k] = e.Encoding
+		}
+	}
+	return Response{Type: "OK", Data: res, Encodings: encodings}
+}
+
+// existsScanMin is the smallest EXISTS batch that is answered with one prefix
+// scan rather than per-key lookups. A scan also walks any unrequested keys
+// between the smallest and largest requested key, so it only pays off for
+// larger batches sharing a prefix, where it saves a point lookup per key.
+// BenchmarkExists compares the two around it.
+const existsScanMin = 64
+
+// exists reports whether each key is present (and unexpired) locally. It
+// never consults upstream.
+func (h *Handler) exists(req Request) Response {
+	res := make(map[string]interface{}, len(req.Keys))
+	for _, k := range req.Keys {
+		res[k] = false
+	}
+	if len(res) == 0 {
+		return Response{Type: "OK", Data: res}
+	}
+	var err error
+	if prefix := commonPrefix(req.Keys); len(res) < existsScanMin || prefix == "" {
+		err = h.existsByGet(res)
+	} else {
+		err = h.existsByScan(res, prefix)
+	}
+	if err != nil {
+		return storeFail(err)
+	}
+	return Response{Type: "OK", Data: res}
+}
+
+// existsByGet marks the keys of res that are present with one lookup each.
+func (h *Handler) existsByGet(res map[string]interface{}) error {
+	for k := range res {
+		_, ok, err := h.DB.Get(k)
+		if err != nil {
+			return err
+		}
+		res[k] = ok
+	}
+	return nil
+}
+
+// existsByScan marks the keys of res that are present with one scan of
+// prefix, from the smallest key of res to the largest.
+func (h *Handler) existsByScan(res map[string]interface{}, prefix string) error {
+	var first, last string
+	for k := range res {
+		if first == "" || k < first {
+			first = k
+		}
+		last = max(last, k)
+	}
+	return h.DB.Scan(prefix, first, func(k string, _ json.RawMessage) bool {
+		if k > last {
+			return false
+		}
+		if _, ok := res[k]; ok {
+			res[k] = true
+		}
+		return true
+	})
+}
+
+// commonPrefix returns the longest prefix shared by all keys.
+func commonPrefix(keys []string) string {
+	p := keys[0]
+	for _, k := range keys[1:] {
+		n := 0
+		for n < len(p) && n < len(k) && p[n] == k[n] {
+			n++
+		}
+		p = p[:n]
+	}
+	return p
+}
+
+// rawEntry is the GET_RAW view of a stored entry.
+type rawEntry struct {
+	datastore.DBEntry
+	Expired bool `json:"expired"`
+	Pinned  bool `json:"pinned,omitempty"`
+}
+
+// getRaw returns the stored wrapper for each key, expired or not, without
+// triggering delete-on-read.
+func (h *Handler) getRaw(req Request) Response {
+	res := make(map[string]interface{}, len(req.Keys))
+	now := time.Now().UnixNano()
+	for _, k := range req.Keys {
+		e, ok, err := h.DB.GetEntry(k)
+		if err != nil {
+			return storeFail(err)
+		}
+		if !ok {
+			res[k] = nil
+			continue
+		}
+		res[k] = rawEntry{DBEntry: e, Expired: e.Expired(now), Pinned: h.Pinned(k)}
+	}
+	return Response{Type: "OK", Data: res}
+}
+
+// changes collapses the change log after req.Since into the latest state of
+// each touched key. Deletes (and puts that have since expired) are reported
+// in Deleted. The walk stops once the response budget is spent; Seq is then
+// the last change included so the client can poll again from there.
+func (h *Handler) changes(ctx context.Context, req Request) Response {
+	if h.Changes == nil {
+		return fail(CodeInvalidRequest, "change log not available")
+	}
+	log, ok := h.Changes.Since(req.Since)
+	if !ok {
+		resp := fail(CodeResync, "since is outside the change log; re-LIST and poll from seq")
+		resp.Seq = h.Changes.Seq()
+		return resp
+	}
+
+	ctx, op := h.Ops.Start(ctx, "CHANGES", strconv.FormatUint(req.Since, 10))
+	defer op.Done()
+	resp := Response{Type: "OK", Data: make(map[string]interface{}), Seq: req.Since}
+	deleted := make(map[string]bool)
+	b := budget{max: h.MaxResponseBytes}
+	now := time.Now().UnixNano()
+	for _, c := range log {
+		if ctx.Err() != nil {
+			return fail(CodeCanceled, "changes canceled")
+		}
+		op.Add(1)
+		if datastore.IsReserved(c.Key) {
+			resp.Seq = c.Seq
+			continue
+		}
+		if !b.add(c.Key, c.Value) {
+			resp.Truncated = true
+			break
+		}
+		resp.Seq = c.Seq
+		if c.End != "" {
+			for k := range resp.Data {
+				if k >= c.Key && k < c.End {
+					delete(resp.Data, k)
 				}
 			}
+			for k := range deleted {
+				if k >= c.Key && k < c.End {
+					delete(deleted, k)
+				}
+			}
+			resp.DeletedRanges = append(resp.DeletedRanges, [2]string{c.Key, c.End})
+			continue
+		}
+		if c.Delete || (c.Expiry != math.MaxInt64 && c.Expiry <= now) {
+			delete(resp.Data, c.Key)
+			deleted[c.Key] = true
+			continue
+		}
+		delete(deleted, c.Key)
+		if req.Values {
+			resp.Data[c.Key] = decodeValue(c.Value)
+		} else {
+			resp.Data[c.Key] = c.Seq
+		}
+	}
+	if resp.Seq < h.Changes.Seq() {
+		// The log served a page, or the budget ran out; there is more.
+		resp.Truncated = true
+	}
+	for k := range deleted {
+		resp.Deleted = append(resp.Deleted, k)
+	}
+	sort.Strings(resp.Deleted)
+	return resp
+}
+
+// ttlFor resolves the TTL for a write to key: a pinned key never expires,
+// otherwise an explicit request TTL wins, then the longest matching prefix
+// rule, then the global default.
+func (h *Handler) ttlFor(key string, explicit *time.Duration) time.Duration {
+	if h.Pinned(key) {
+		return 0
+	}
+	if explicit != nil {
+		return *explicit
+	}
+	ttl, best := h.TTL, -1
+	for p, d := range h.PrefixTTLs {
+		if len(p) > best && strings.HasPrefix(key, p) {
+			ttl, best = d, len(p)
 		}
-		return Response{Type: "OK"}
+	}
+	return ttl
+}
 
-	default:
-		return Response{Type: "ERR", Error: "unknown type"}
+// CacheTTLFor resolves the TTL for a value of key fetched from upstream:
+// none for a pinned key, otherwise CacheTTL.
+func (h *Handler) CacheTTLFor(key string) time.Duration {
+	if h.Pinned(key) {
+		return 0
+	}
+	return h.CacheTTL
+}
+
+// Pinned reports whether key falls under a pinned prefix.
+func (h *Handler) Pinned(key string) bool {
+	for _, p := range h.PinnedPrefixes {
+		if strings.HasPrefix(key, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// slide renews key's TTL if it falls under a sliding prefix. The refresh is a
+// write, so it is skipped while writes are shed, and a failed one doesn't
+// fail the read.
+func (h *Handler) slide(key string) {
+	if h.Pinned(key) {
+		return
+	}
+	for _, p := range h.SlidingTTLPrefixes {
+		if strings.HasPrefix(key, p) {
+			if !h.DB.WriteStalled() {
+				_, _ = h.DB.Touch(key, datastore.ExpiryFor(h.ttlFor(key, nil)))
+			}
+			return
+		}
+	}
+}
+
+// Scan walks live entries under prefix in key order without buffering them,
+// for transports that stream results.
+func (h *Handler) Scan(prefix, cursor string, fn func(key string, value json.RawMessage) bool) error {
+	return h.DB.Scan(prefix, cursor, fn)
+}
+
+// StreamScan is Scan as a tracked operation: it stops early, returning the
+// context's error, once ctx is canceled by the client or an operator. It
+// returns ErrNotReady, scanning nothing, until the store is ready.
+func (h *Handler) StreamScan(ctx context.Context, prefix, cursor string, fn func(key string, value json.RawMessage) bool) error {
+	if !h.IsReady() {
+		return ErrNotReady
+	}
+	ctx, op := h.Ops.Start(ctx, "STREAM", prefix)
+	defer op.Done()
+	err := h.DB.Scan(prefix, cursor, func(k string, v json.RawMessage) bool {
+		if ctx.Err() != nil {
+			return false
+		}
+		op.Add(1)
+		return fn(k, v)
+	})
+	if err == nil {
+		err = ctx.Err()
+	}
+	return err
+}
+
+// project keeps only the named top-level fields of a JSON object value.
+// Values that aren't objects, and keys without a projection, pass through
+// whole.
+func project(raw json.RawMessage, fields []string) json.RawMessage {
+	if len(fields) == 0 {
+		return raw
+	}
+	var obj map[string]json.RawMessage
+	if json.Unmarshal(raw, &obj) != nil || obj == nil {
+		return raw
+	}
+	out := make(map[string]json.RawMessage, len(fields))
+	for _, f := range fields {
+		if v, ok := obj[f]; ok {
+			out[f] = v
+		}
+	}
+	b, err := json.Marshal(out)
+	if err != nil {
+		return raw
+	}
+	return b
+}
+
+// scanInternal is Scan with the store's internal keys included, for
+// debugging. Their stored bytes are returned as they are, or as a JSON string
+// when they aren't JSON.
+func (h *Handler) scanInternal(prefix, cursor string, fn func(key string, value json.RawMessage) bool) error {
+	now := time.Now().UnixNano()
+	return h.DB.ScanRaw(prefix, cursor, func(k string, stored []byte) bool {
+		if datastore.IsReserved(k) {
+			if !json.Valid(stored) {
+				stored, _ = json.Marshal(string(stored))
+			}
+			return fn(k, stored)
+		}
+		e, err := datastore.DecodeEntry(stored)
+		if err != nil || e.Expired(now) {
+			return true
+		}
+		return fn(k, e.Value)
+	})
+}
+
+// decodeValue decodes a stored JSON value for a response, keeping numbers as
+// json.Number so they are written back exactly as stored: large integers
+// keep their precision and 1e6 isn't rewritten as 1000000. Invalid JSON
+// decodes to nil.
+func decodeValue(raw json.RawMessage) interface{} {
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	var v interface{}
+	if dec.Decode(&v) != nil {
+		return nil
+	}
+	return v
+}
+
+// budget tracks the approximate encoded size of a response's Data as entries
+// are added, so oversized results are cut off before anything is marshaled.
+type budget struct {
+	max, used int
+}
+
+// add charges one "key":value pair and reports whether it fits. The first
+// entry is always admitted so a single oversized value still makes progress.
+func (b *budget) add(key string, raw json.RawMessage) bool {
+	n := len(key) + len(raw) + 4 // quotes, colon, comma
+	if raw == nil {
+		n += len("null")
+	}
+	if b.max > 0 && b.used > 0 && b.used+n > b.max {
+		return false
 	}
+	b.used += n
+	return true
 }
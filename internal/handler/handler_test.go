@@ -0,0 +1,273 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/UltraSive/rocksdb-configuration-distribution/internal/datastore"
+	"github.com/UltraSive/rocksdb-configuration-distribution/internal/replication"
+)
+
+func TestTTLForOverlappingPrefixes(t *testing.T) {
+	h := &Handler{
+		TTL: time.Minute,
+		PrefixTTLs: map[string]time.Duration{
+			"a/":    10 * time.Second,
+			"a/b/":  20 * time.Second,
+			"a/b/c": 0,
+		},
+	}
+	explicit := 5 * time.Second
+	tests := []struct {
+		key      string
+		explicit *time.Duration
+		want     time.Duration
+	}{
+		{"a/x", nil, 10 * time.Second},
+		{"a/b", nil, 10 * time.Second}, // "a/b/" needs the trailing slash
+		{"a/b/x", nil, 20 * time.Second},
+		{"a/b/c", nil, 0},
+		{"a/b/cd/e", nil, 0},
+		{"a/b/d", nil, 20 * time.Second},
+		{"b/x", nil, time.Minute},
+		{"a", nil, time.Minute},
+		{"", nil, time.Minute},
+		{"a/b/c", &explicit, explicit},
+		{"b/x", &explicit, explicit},
+	}
+	for _, tt := range tests {
+		if got := h.ttlFor(tt.key, tt.explicit); got != tt.want {
+			t.Errorf("ttlFor(%q, explicit=%v) = %v, want %v", tt.key, tt.explicit != nil, got, tt.want)
+		}
+	}
+}
+
+func TestTTLForPinnedOverridesRules(t *testing.T) {
+	h := &Handler{
+		TTL:            time.Minute,
+		PrefixTTLs:     map[string]time.Duration{"a/": 10 * time.Second},
+		PinnedPrefixes: []string{"a/pinned/"},
+	}
+	explicit := 5 * time.Second
+	if got := h.ttlFor("a/pinned/k", &explicit); got != 0 {
+		t.Errorf("pinned key got TTL %v, want 0", got)
+	}
+	if got := h.ttlFor("a/k", nil); got != 10*time.Second {
+		t.Errorf("unpinned key got TTL %v, want 10s", got)
+	}
+}
+
+func TestDecodeValueRoundTripsNumbers(t *testing.T) {
+	for _, raw := range []string{
+		`9007199254740993`,
+		`-9223372036854775808`,
+		`18446744073709551615`,
+		`123456789012345678901234567890`,
+		`1e6`,
+		`1.5E-300`,
+		`-2.5e+10`,
+		`0.1`,
+		`{"id":9007199254740993,"n":[1e6,2E3]}`,
+	} {
+		got, err := json.Marshal(decodeValue(json.RawMessage(raw)))
+		if err != nil || string(got) != raw {
+			t.Errorf("round trip of %s = %s, %v", raw, got, err)
+		}
+	}
+}
+
+// sortedStore serves ScanReverse from a sorted key list, each key's value
+// being the number 1, as RocksDB.ScanReverse does: descending, under prefix,
+// from start inclusive.
+type sortedStore struct {
+	datastore.Datastore
+	keys []string
+}
+
+func (s sortedStore) ScanReverse(prefix, start string, fn func(key string, value json.RawMessage) bool) error {
+	for i := len(s.keys) - 1; i >= 0; i-- {
+		k := s.keys[i]
+		if (start != "" && k > start) || !strings.HasPrefix(k, prefix) {
+			continue
+		}
+		if !fn(k, json.RawMessage(`1`)) {
+			break
+		}
+	}
+	return nil
+}
+
+func TestReverseScanPagesAcrossCursor(t *testing.T) {
+	var want []string
+	keys := []string{"o/9", "q/0"}
+	for i := 0; i < 10; i++ {
+		k := "p/0" + string(rune('0'+i))
+		keys = append(keys, k)
+		want = append([]string{k}, want...)
+	}
+	sort.Strings(keys)
+	// Each "p/0N":1 pair costs 9 bytes, so pages hold three keys.
+	h := &Handler{DB: sortedStore{keys: keys}, MaxResponseBytes: 27}
+
+	var got []string
+	cursor := ""
+	for pages := 0; ; pages++ {
+		if pages > len(want) {
+			t.Fatalf("no end after %d pages; got %q", pages, got)
+		}
+		resp := h.Serve(context.Background(), Request{Type: "SCAN", Prefix: "p/", Reverse: true, Cursor: cursor})
+		if resp.Type != "OK" {
+			t.Fatalf("page %d: %s %s", pages, resp.Code, resp.Error)
+		}
+		var page []string
+		for k := range resp.Data {
+			page = append(page, k)
+		}
+		sort.Sort(sort.Reverse(sort.StringSlice(page)))
+		if len(got) > 0 && len(page) > 0 && page[0] >= got[len(got)-1] {
+			t.Fatalf("page %d starts at %q, not below the previous page's %q", pages, page[0], got[len(got)-1])
+		}
+		got = append(got, page...)
+		if !resp.Truncated {
+			break
+		}
+		if resp.NextCursor == "" || resp.Data[resp.NextCursor] != nil {
+			t.Fatalf("page %d: nextCursor %q must name the first key left out", pages, resp.NextCursor)
+		}
+		cursor = resp.NextCursor
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("reverse pages = %q, want %q", got, want)
+	}
+}
+
+// BenchmarkExists times EXISTS batches of increasing size answered by
+// per-key lookups and by one scan, against a store where the requested keys
+// are every other key in their range, so the scan also steps over as many
+// keys it wasn't asked about. existsScanMin sits where scan starts winning.
+// It needs a real RocksDB.
+func BenchmarkExists(b *testing.B) {
+	db, err := datastore.NewRocksDB(b.TempDir(), datastore.Options{})
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer db.Close()
+	const stored = 100000
+	var muts []datastore.Mutation
+	for i := 0; i < stored; i++ {
+		muts = append(muts, datastore.Mutation{Key: fmt.Sprintf("bench/%08d", i), Value: json.RawMessage(`{"v":1}`), Expiry: datastore.ExpiryFor(0)})
+		if len(muts) == 1000 {
+			if err := db.Write(muts); err != nil {
+				b.Fatal(err)
+			}
+			muts = muts[:0]
+		}
+	}
+	h := &Handler{DB: db}
+
+	for _, n := range []int{8, 16, 32, 64, 128, 256, 1024} {
+		keys := make([]string, n)
+		for i := range keys {
+			keys[i] = fmt.Sprintf("bench/%08d", stored/2+2*i)
+		}
+		for _, path := range []struct {
+			name string
+			fn   func(map[string]interface{}) error
+		}{
+			{"get", h.existsByGet},
+			{"scan", func(res map[string]interface{}) error { return h.existsByScan(res, "bench/") }},
+		} {
+			b.Run(fmt.Sprintf("%s/%d", path.name, n), func(b *testing.B) {
+				res := make(map[string]interface{}, n)
+				for i := 0; i < b.N; i++ {
+					for _, k := range keys {
+						res[k] = false
+					}
+					if err := path.fn(res); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestReplicatedKeepsDataWithoutQuorum(t *testing.T) {
+	log := datastore.NewChangeLog(0, 1)
+	h := &Handler{
+		Changes:  log,
+		Replicas: replication.NewFanout(log, nil, []string{"http://127.0.0.1:1/"}, 1, 10*time.Millisecond, ""),
+	}
+	resp := h.replicated(context.Background(), Response{Type: "OK", Data: map[string]interface{}{"k": "popped"}})
+	if resp.Type != "ERR" || resp.Code != CodeNoQuorum {
+		t.Fatalf("replicated = %s %s, want ERR %s", resp.Type, resp.Code, CodeNoQuorum)
+	}
+	if resp.Data["k"] != "popped" {
+		t.Errorf("replicated dropped the write's data: %v", resp.Data)
+	}
+}
+
+func TestCheckEncoding(t *testing.T) {
+	tests := []struct {
+		enc, raw string
+		ok       bool
+	}{
+		{"", `{"a":1}`, true},
+		{"base64", `"3q2+7w=="`, true},
+		{"base64", `""`, true},
+		{"base64", `"not base64!"`, false},
+		{"base64", `{"a":1}`, false},
+		{"hex", `"00"`, false},
+	}
+	for _, tt := range tests {
+		if err := checkEncoding(tt.enc, json.RawMessage(tt.raw)); (err == nil) != tt.ok {
+			t.Errorf("checkEncoding(%q, %s) = %v, want ok %v", tt.enc, tt.raw, err, tt.ok)
+		}
+	}
+}
+
+func TestDeletedSinceReportsKeysExpiredInTheWindow(t *testing.T) {
+	db, err := datastore.NewRocksDB(t.TempDir(), datastore.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.Write([]datastore.Mutation{
+		{Key: "a/live", Value: json.RawMessage(`1`), Expiry: datastore.ExpiryFor(0)},
+		{Key: "a/short", Value: json.RawMessage(`1`), Expiry: datastore.ExpiryFor(20 * time.Millisecond)},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	h := &Handler{DB: db, Changes: db.ChangeLog()}
+	_, since := h.Changes.Head()
+	time.Sleep(40 * time.Millisecond)
+	// Neither expiry nor the later write logs a delete of a/short.
+	if err := db.Put("a/other", json.RawMessage(`1`), 0); err != nil {
+		t.Fatal(err)
+	}
+	head, _ := h.Changes.Head()
+	keys, _, ok, err := h.deletedSince(context.Background(), "a/", since, head)
+	if err != nil || !ok {
+		t.Fatalf("deletedSince = ok %v, err %v", ok, err)
+	}
+	if !reflect.DeepEqual(keys, []string{"a/short"}) {
+		t.Errorf("deleted = %v, want [a/short]", keys)
+	}
+}
+
+func TestSplitBatchLeavesMutsInOrder(t *testing.T) {
+	muts := []datastore.Mutation{{Key: "c"}, {Key: "a"}, {Key: "b"}}
+	batches := splitBatch(muts, 70)
+	if len(batches) != 3 || batches[0][0].Key != "a" || batches[2][0].Key != "c" {
+		t.Fatalf("batches = %v, want a, b and c each on their own", batches)
+	}
+	if muts[0].Key != "c" || muts[1].Key != "a" || muts[2].Key != "b" {
+		t.Errorf("splitBatch reordered its input to %v", muts)
+	}
+}
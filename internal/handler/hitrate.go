@@ -0,0 +1,81 @@
+package handler
+
+import (
+	"sync"
+	"time"
+
+	"github.com/UltraSive/rocksdb-configuration-distribution/internal/metrics"
+)
+
+var (
+	cacheHits   = metrics.NewCounter("kvstore_cache_hits_total", "Key reads answered from the local store.")
+	cacheMisses = metrics.NewCounter("kvstore_cache_misses_total", "Key reads not found locally (then filled from upstream if configured).")
+
+	getLatency    = metrics.NewHistogram("kvstore_get_seconds", "Time to answer GET requests, upstream fills included.", metrics.LatencyBuckets)
+	updateLatency = metrics.NewHistogram("kvstore_update_seconds", "Time to apply UPDATE requests.", metrics.LatencyBuckets)
+)
+
+// hitWindow is the longest window hitRate reports on, in one-second buckets.
+const hitWindow = 15 * 60
+
+// hitRate counts hits and misses in per-second buckets over the last
+// hitWindow seconds, in fixed memory whatever the traffic.
+type hitRate struct {
+	mu      sync.Mutex
+	buckets [hitWindow]struct {
+		sec          int64
+		hits, misses int64
+	}
+}
+
+func (r *hitRate) record(hit bool) {
+	if hit {
+		cacheHits.Inc()
+	} else {
+		cacheMisses.Inc()
+	}
+	sec := time.Now().Unix()
+	r.mu.Lock()
+	b := &r.buckets[sec%hitWindow]
+	if b.sec != sec {
+		b.sec, b.hits, b.misses = sec, 0, 0
+	}
+	if hit {
+		b.hits++
+	} else {
+		b.misses++
+	}
+	r.mu.Unlock()
+}
+
+// ratios returns the hit ratio over the last 1, 5 and 15 minutes, with nil
+// for a window that saw no reads.
+func (r *hitRate) ratios() map[string]interface{} {
+	now := time.Now().Unix()
+	windows := []struct {
+		name         string
+		secs         int64
+		hits, misses int64
+	}{{name: "1m", secs: 60}, {name: "5m", secs: 300}, {name: "15m", secs: hitWindow}}
+	r.mu.Lock()
+	for _, b := range r.buckets {
+		age := now - b.sec
+		for i := range windows {
+			if age >= 0 && age < windows[i].secs {
+				windows[i].hits += b.hits
+				windows[i].misses += b.misses
+			}
+		}
+	}
+	r.mu.Unlock()
+
+	out := make(map[string]interface{}, len(windows))
+	for _, w := range windows {
+		if total := w.hits + w.misses; total > 0 {
+			out[w.name] = float64(w.hits) / float64(total)
+		} else {
+			out[w.name] = nil
+		}
+	}
+	return out
+}
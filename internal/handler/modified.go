@@ -0,0 +1,111 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/UltraSive/rocksdb-configuration-distribution/internal/datastore"
+)
+
+// scanModified is Scan limited to entries written after since (unix nanos).
+// Entries written before write times were recorded have none to compare, so
+// they are always included.
+func (h *Handler) scanModified(since int64) func(prefix, cursor string, fn func(key string, value json.RawMessage) bool) error {
+	return func(prefix, cursor string, fn func(key string, value json.RawMessage) bool) error {
+		now := time.Now().UnixNano()
+		return h.DB.ScanRaw(prefix, cursor, func(k string, stored []byte) bool {
+			if datastore.IsReserved(k) {
+				return true
+			}
+			e, err := datastore.DecodeEntry(stored)
+			if err != nil || (e.Expired(now) && !h.Pinned(k)) || (e.Modified != 0 && e.Modified <= since) {
+				return true
+			}
+			return fn(k, e.Value)
+		})
+	}
+}
+
+// deletedSince replays the change log from since (unix nanos) up to the
+// change at head and returns the keys under prefix that were deleted, or
+// written already expired, and not written again, along with the range
+// deletes that reach into prefix. Expiring isn't logged until the cleaner
+// reclaims the key, so the keys still stored under prefix that expired after
+// since are added from a scan. ok is false when the log no longer goes back
+// to since.
+func (h *Handler) deletedSince(ctx context.Context, prefix string, since int64, head uint64) (keys []string, ranges [][2]string, ok bool, err error) {
+	seq, ok := h.Changes.SeqAt(since)
+	if !ok {
+		return nil, nil, false, nil
+	}
+	deleted := make(map[string]bool)
+	now := time.Now().UnixNano()
+	for seq < head {
+		log, ok := h.Changes.Since(seq)
+		if !ok {
+			return nil, nil, false, nil
+		}
+		if len(log) == 0 {
+			break
+		}
+		for _, c := range log {
+			if err := ctx.Err(); err != nil {
+				return nil, nil, false, err
+			}
+			if c.Seq > head {
+				break
+			}
+			seq = c.Seq
+			if c.End != "" {
+				if !(strings.HasPrefix(c.Key, prefix) || (c.Key < prefix && c.End > prefix)) {
+					continue
+				}
+				for k := range deleted {
+					if k >= c.Key && k < c.End {
+						delete(deleted, k)
+					}
+				}
+				ranges = append(ranges, [2]string{c.Key, c.End})
+				continue
+			}
+			if datastore.IsReserved(c.Key) || !strings.HasPrefix(c.Key, prefix) {
+				continue
+			}
+			if c.Delete || (c.Expiry != math.MaxInt64 && c.Expiry <= now) {
+				deleted[c.Key] = true
+				continue
+			}
+			delete(deleted, c.Key)
+		}
+		if log[len(log)-1].Seq >= head {
+			break
+		}
+	}
+	err = h.DB.ScanRaw(prefix, "", func(k string, stored []byte) bool {
+		if ctx.Err() != nil {
+			return false
+		}
+		if datastore.IsReserved(k) || h.Pinned(k) {
+			return true
+		}
+		if e, derr := datastore.DecodeEntry(stored); derr == nil && e.Expiry > since && e.Expired(now) {
+			deleted[k] = true
+		}
+		return true
+	})
+	if err == nil {
+		err = ctx.Err()
+	}
+	if err != nil {
+		return nil, nil, false, err
+	}
+	for k := range deleted {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys, ranges, true, nil
+}
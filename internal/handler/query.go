@@ -0,0 +1,117 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strconv"
+	"strings"
+)
+
+// Predicate matches a value by the JSON found at a dotted path into it.
+// Path segments index objects by key and arrays by position, e.g.
+// "servers.0.region"; an empty path is the whole value. There is deliberately
+// no expression language beyond these operators.
+type Predicate struct {
+	Path  string          `json:"path"`
+	Op    string          `json:"op,omitempty"`    // "eq" (default), "ne" or "exists"
+	Value json.RawMessage `json:"value,omitempty"` // compared against for eq/ne
+}
+
+// query walks every live key under req.Prefix, decoding each value, and
+// returns those matching req.Where. It is a full scan of the prefix however
+// few keys match; Truncated and NextCursor work as for SCAN.
+func (h *Handler) query(ctx context.Context, req Request) Response {
+	p := req.Where
+	if p == nil {
+		return fail(CodeInvalidRequest, "where is required")
+	}
+	var want interface{}
+	switch p.Op {
+	case "", "eq", "ne":
+		if err := json.Unmarshal(p.Value, &want); err != nil {
+			return fail(CodeInvalidRequest, "invalid where.value: "+err.Error())
+		}
+	case "exists":
+	default:
+		return fail(CodeInvalidRequest, "unknown op "+strconv.Quote(p.Op))
+	}
+	var path []string
+	if p.Path != "" {
+		path = strings.Split(p.Path, ".")
+	}
+
+	ctx, op := h.Ops.Start(ctx, "QUERY", req.Prefix)
+	defer op.Done()
+	resp := Response{Type: "OK", Data: make(map[string]interface{})}
+	b := budget{max: h.MaxResponseBytes}
+	canceled := false
+	err := h.Scan(req.Prefix, req.Cursor, func(k string, raw json.RawMessage) bool {
+		if canceled = ctx.Err() != nil; canceled {
+			return false
+		}
+		op.Add(1)
+		var v interface{}
+		if json.Unmarshal(raw, &v) != nil {
+			return true
+		}
+		got, found := lookup(v, path)
+		switch p.Op {
+		case "exists":
+			if !found {
+				return true
+			}
+		case "ne":
+			if found && sameValue(got, want) {
+				return true
+			}
+		default:
+			if !found || !sameValue(got, want) {
+				return true
+			}
+		}
+		if !b.add(k, raw) {
+			resp.Truncated, resp.NextCursor = true, k
+			return false
+		}
+		// v has lossy float64 numbers, fine for matching but not for output.
+		resp.Data[k] = decodeValue(raw)
+		return true
+	})
+	if err != nil {
+		return storeFail(err)
+	}
+	if canceled {
+		return fail(CodeCanceled, "query canceled")
+	}
+	return resp
+}
+
+// lookup follows path into a decoded JSON value.
+func lookup(v interface{}, path []string) (interface{}, bool) {
+	for _, seg := range path {
+		switch t := v.(type) {
+		case map[string]interface{}:
+			var ok bool
+			if v, ok = t[seg]; !ok {
+				return nil, false
+			}
+		case []interface{}:
+			i, err := strconv.Atoi(seg)
+			if err != nil || i < 0 || i >= len(t) {
+				return nil, false
+			}
+			v = t[i]
+		default:
+			return nil, false
+		}
+	}
+	return v, true
+}
+
+// sameValue compares decoded JSON values ignoring object key order.
+func sameValue(a, b interface{}) bool {
+	ja, _ := json.Marshal(a)
+	jb, _ := json.Marshal(b)
+	return bytes.Equal(ja, jb)
+}
@@ -0,0 +1,125 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrUndefinedVar is returned, with StrictVars, when a value being resolved
+// names a variable that isn't in Vars.
+var ErrUndefinedVar = errors.New("undefined variable")
+
+// shape applies a GET's field projection to a stored value and, if asked,
+// resolves its variables.
+func (h *Handler) shape(raw json.RawMessage, fields []string, resolve bool) (json.RawMessage, error) {
+	raw = project(raw, fields)
+	if !resolve {
+		return raw, nil
+	}
+	return h.resolve(raw)
+}
+
+// resolve replaces ${NAME} placeholders in the string values of raw with
+// Vars[NAME]. Only whole strings inside the JSON document are rewritten,
+// never its structure, so the result is always valid JSON. "$${" is a
+// literal "${". An undefined variable is left as is, or with StrictVars
+// fails with ErrUndefinedVar.
+func (h *Handler) resolve(raw json.RawMessage) (json.RawMessage, error) {
+	if !bytes.Contains(raw, []byte("${")) {
+		return raw, nil
+	}
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return raw, nil
+	}
+	v, err := h.expandValue(v)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
+
+func (h *Handler) expandValue(v interface{}) (interface{}, error) {
+	var err error
+	switch v := v.(type) {
+	case string:
+		return h.expand(v)
+	case []interface{}:
+		for i := range v {
+			if v[i], err = h.expandValue(v[i]); err != nil {
+				return nil, err
+			}
+		}
+	case map[string]interface{}:
+		for k, e := range v {
+			if v[k], err = h.expandValue(e); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return v, nil
+}
+
+// expand substitutes the placeholders in one string. A "${" not followed by
+// a variable name and "}" is not a placeholder.
+func (h *Handler) expand(s string) (string, error) {
+	var b strings.Builder
+	for {
+		i := strings.Index(s, "${")
+		if i < 0 {
+			b.WriteString(s)
+			return b.String(), nil
+		}
+		if i > 0 && s[i-1] == '$' {
+			b.WriteString(s[:i-1])
+			b.WriteString("${")
+			s = s[i+2:]
+			continue
+		}
+		end := strings.IndexByte(s[i+2:], '}')
+		if end < 0 || !isVarName(s[i+2:i+2+end]) {
+			b.WriteString(s[:i+2])
+			s = s[i+2:]
+			continue
+		}
+		name := s[i+2 : i+2+end]
+		v, ok := h.Vars[name]
+		if !ok {
+			if h.StrictVars {
+				return "", fmt.Errorf("%w ${%s}", ErrUndefinedVar, name)
+			}
+			v = s[i : i+3+end]
+		}
+		b.WriteString(s[:i])
+		b.WriteString(v)
+		s = s[i+3+end:]
+	}
+}
+
+// isVarName reports whether name is a valid variable name: letters, digits
+// and underscores, not starting with a digit.
+func isVarName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i, c := range name {
+		switch {
+		case c == '_', c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z':
+		case c >= '0' && c <= '9' && i > 0:
+		default:
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,134 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/UltraSive/rocksdb-configuration-distribution/internal/datastore"
+)
+
+var (
+	// ErrNoChangeLog is returned by Watch on stores without a change log.
+	ErrNoChangeLog = errors.New("change log not available")
+	// ErrWatchBehind is returned by Watch when a watcher fell so far behind
+	// that the changes it needed were trimmed; it should watch again.
+	ErrWatchBehind = errors.New("watcher fell behind the change log; watch again")
+)
+
+// WatchEvent is one line of a WATCH stream. "value" events carry each
+// watched key's current state and come first; "change" events follow for
+// every later write to a watched key; "heartbeat" events keep an idle stream
+// open and report how far the log has been read.
+type WatchEvent struct {
+	Type    string      `json:"type"`
+	Seq     uint64      `json:"seq"`
+	Key     string      `json:"key,omitempty"`
+	Value   interface{} `json:"value,omitempty"`
+	Deleted bool        `json:"deleted,omitempty"` // the key has no value (never set, deleted or expired)
+}
+
+// Watch sends the current value of each key to emit, then every change to
+// them, until ctx is done, emit fails or the watcher falls out of the change
+// log. The log position is taken before the values are read and changes
+// already reflected in a value (by its write sequence) are skipped, so no
+// write is missed between the two. A heartbeat is sent after heartbeat
+// without changes.
+func (h *Handler) Watch(ctx context.Context, keys []string, heartbeat time.Duration, emit func(WatchEvent) error) error {
+	if h.Changes == nil {
+		return ErrNoChangeLog
+	}
+	if !h.IsReady() {
+		return ErrNotReady
+	}
+	keys = dedupe(keys)
+	if len(keys) == 0 {
+		return fmt.Errorf("%w: at least one key is required", datastore.ErrInvalidKey)
+	}
+	for _, k := range keys {
+		if err := h.CheckKey(k); err != nil {
+			return fmt.Errorf("%q: %w", k, err)
+		}
+	}
+
+	ctx, op := h.Ops.Start(ctx, "WATCH", strings.Join(keys, ","))
+	defer op.Done()
+	since := h.Changes.Seq()
+	pin := h.Changes.Pin(since)
+	defer pin.Release()
+
+	// seen holds, per key, the sequence its value event already reflects.
+	seen := make(map[string]uint64, len(keys))
+	now := time.Now().UnixNano()
+	for _, k := range keys {
+		e, ok, err := h.DB.GetEntry(k)
+		if err != nil {
+			return err
+		}
+		ev := WatchEvent{Type: "value", Seq: since, Key: k}
+		if ok && !e.Expired(now) {
+			ev.Value = decodeValue(e.Value)
+			seen[k] = e.Seq
+		} else {
+			ev.Deleted = true
+		}
+		if err := emit(ev); err != nil {
+			return err
+		}
+	}
+
+	t := time.NewTicker(heartbeat)
+	defer t.Stop()
+	for {
+		wait := h.Changes.Wait()
+		changes, ok := h.Changes.Since(since)
+		if !ok {
+			return ErrWatchBehind
+		}
+		now := time.Now().UnixNano()
+		for _, c := range changes {
+			since = c.Seq
+			op.Add(1)
+			for _, k := range keys {
+				if c.Seq <= seen[k] || !touches(c.Mutation, k) {
+					continue
+				}
+				ev := WatchEvent{Type: "change", Seq: c.Seq, Key: k}
+				if c.End != "" || c.Delete || (c.Expiry != math.MaxInt64 && c.Expiry <= now) {
+					ev.Deleted = true
+				} else {
+					ev.Value = decodeValue(c.Value)
+				}
+				if err := emit(ev); err != nil {
+					return err
+				}
+			}
+		}
+		pin.Move(since)
+		if since < h.Changes.Seq() {
+			// A page from the durable log; keep catching up.
+			continue
+		}
+
+		select {
+		case <-wait:
+		case <-t.C:
+			if err := emit(WatchEvent{Type: "heartbeat", Seq: since}); err != nil {
+				return err
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// touches reports whether m writes key, directly or through a range delete.
+func touches(m datastore.Mutation, key string) bool {
+	if m.End != "" {
+		return key >= m.Key && key < m.End
+	}
+	return m.Key == key
+}
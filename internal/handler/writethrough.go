@@ -0,0 +1,41 @@
+package handler
+
+import (
+	"github.com/UltraSive/rocksdb-configuration-distribution/internal/datastore"
+)
+
+// queued runs write, a store call that commits extra with its own writes,
+// with the write-through queue entry naming what it changes: keys, the
+// prefix a REPLACE_PREFIX replaces, or the range [start, end) a
+// DELETE_RANGE deletes. The entry and the write land in the same batch, so
+// a crash can't keep one without the other. Without write-through it just
+// runs write. When the queue is full nothing is written and the error is
+// writethrough.ErrFull, which storeFail answers with OVERLOADED for the
+// client to retry later. WARM doesn't come through here, as what it loads
+// came from upstream.
+func (h *Handler) queued(keys []string, prefix, start, end string, write func(extra ...datastore.Mutation) error) error {
+	if h.WriteThrough == nil {
+		return write()
+	}
+	r, err := h.WriteThrough.Reserve(keys, prefix, start, end)
+	if err != nil {
+		return err
+	}
+	if err := write(r.Mutation); err != nil {
+		r.Cancel()
+		return err
+	}
+	r.Commit()
+	return nil
+}
+
+// mutationKeys returns the client keys muts write or delete.
+func mutationKeys(muts []datastore.Mutation) []string {
+	keys := make([]string, 0, len(muts))
+	for _, m := range muts {
+		if !datastore.IsReserved(m.Key) {
+			keys = append(keys, m.Key)
+		}
+	}
+	return keys
+}
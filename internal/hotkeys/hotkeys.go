@@ -0,0 +1,110 @@
+package hotkeys
+
+import (
+	"math/rand/v2"
+	"sort"
+	"sync"
+	"time"
+)
+
+// KeyCount is a tracked key and its estimated number of requests.
+type KeyCount struct {
+	Key   string `json:"key"`
+	Count int64  `json:"count"`
+}
+
+// Tracker estimates the most requested keys over a rolling window. It samples
+// a fraction of requests and counts them with the Space-Saving algorithm, so
+// memory stays at Capacity keys per window however large the keyspace is.
+// Counts of rare keys may be overestimated; hot keys are reliably kept.
+type Tracker struct {
+	rate     float64
+	capacity int
+	window   time.Duration
+
+	mu        sync.Mutex
+	cur, prev map[string]int64
+	rotated   time.Time
+}
+
+// New tracks up to capacity keys per window, sampling rate (0..1] of
+// requests. The reported window spans between one and two windows of traffic.
+func New(capacity int, rate float64, window time.Duration) *Tracker {
+	return &Tracker{
+		rate:     rate,
+		capacity: capacity,
+		window:   window,
+		cur:      make(map[string]int64, capacity),
+		rotated:  time.Now(),
+	}
+}
+
+// Record notes one request for key, subject to sampling.
+func (t *Tracker) Record(key string) {
+	if t.rate < 1 && rand.Float64() >= t.rate {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.rotate(time.Now())
+	if _, ok := t.cur[key]; ok || len(t.cur) < t.capacity {
+		t.cur[key]++
+		return
+	}
+	// Full: evict the smallest count and let key inherit it, which bounds how
+	// far any estimate can be off.
+	var minKey string
+	min := int64(-1)
+	for k, c := range t.cur {
+		if min < 0 || c < min {
+			minKey, min = k, c
+		}
+	}
+	delete(t.cur, minKey)
+	t.cur[key] = min + 1
+}
+
+// Top returns the n most requested keys, highest first, with counts scaled
+// back up by the sampling rate.
+func (t *Tracker) Top(n int) []KeyCount {
+	t.mu.Lock()
+	t.rotate(time.Now())
+	counts := make(map[string]int64, len(t.cur)+len(t.prev))
+	for k, c := range t.prev {
+		counts[k] += c
+	}
+	for k, c := range t.cur {
+		counts[k] += c
+	}
+	t.mu.Unlock()
+
+	top := make([]KeyCount, 0, len(counts))
+	for k, c := range counts {
+		top = append(top, KeyCount{Key: k, Count: int64(float64(c) / t.rate)})
+	}
+	sort.Slice(top, func(i, j int) bool {
+		if top[i].Count != top[j].Count {
+			return top[i].Count > top[j].Count
+		}
+		return top[i].Key < top[j].Key
+	})
+	if n > 0 && len(top) > n {
+		top = top[:n]
+	}
+	return top
+}
+
+// rotate starts a new window once the current one is over, keeping the last
+// full window so Top never reports from an almost empty one.
+func (t *Tracker) rotate(now time.Time) {
+	elapsed := now.Sub(t.rotated)
+	if elapsed < t.window {
+		return
+	}
+	t.prev = t.cur
+	if elapsed >= 2*t.window {
+		t.prev = nil
+	}
+	t.cur = make(map[string]int64, t.capacity)
+	t.rotated = now
+}
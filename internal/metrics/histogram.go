@@ -0,0 +1,133 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// LatencyBuckets are the upper bounds, in seconds, used for operation
+// latencies: 100µs to 10s, roughly 2.5x apart.
+var LatencyBuckets = []float64{
+	0.0001, 0.00025, 0.0005, 0.001, 0.0025, 0.005, 0.01,
+	0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10,
+}
+
+// Histogram counts durations into fixed buckets. Observe only touches
+// atomics, so it is safe on hot paths and never allocates.
+type Histogram struct {
+	name, help string
+	bounds     []float64
+	counts     []atomic.Uint64 // per bucket, the last one is +Inf
+	sum        atomic.Int64    // nanoseconds
+	count      atomic.Uint64
+}
+
+// NewHistogram creates and registers a histogram with the given bucket
+// upper bounds in seconds, which must be sorted.
+func NewHistogram(name, help string, buckets []float64) *Histogram {
+	h := &Histogram{name: name, help: help, bounds: buckets, counts: make([]atomic.Uint64, len(buckets)+1)}
+	register(name, h)
+	return h
+}
+
+// Observe records one duration.
+func (h *Histogram) Observe(d time.Duration) {
+	s := d.Seconds()
+	i := 0
+	for i < len(h.bounds) && s > h.bounds[i] {
+		i++
+	}
+	h.counts[i].Add(1)
+	h.sum.Add(int64(d))
+	h.count.Add(1)
+}
+
+// Since records the time elapsed since start; use it as
+// defer h.Since(time.Now()).
+func (h *Histogram) Since(start time.Time) { h.Observe(time.Since(start)) }
+
+func (h *Histogram) value() int64 { return int64(h.count.Load()) }
+func (h *Histogram) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	var cum uint64
+	for i, b := range h.bounds {
+		cum += h.counts[i].Load()
+		fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", h.name, strconv.FormatFloat(b, 'g', -1, 64), cum)
+	}
+	cum += h.counts[len(h.bounds)].Load()
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", h.name, cum)
+	fmt.Fprintf(w, "%s_sum %g\n%s_count %d\n", h.name, time.Duration(h.sum.Load()).Seconds(), h.name, cum)
+}
+
+// Quantile estimates the q-th quantile (0 < q <= 1) by interpolating within
+// the bucket it falls in. Observations past the last bound are reported as
+// that bound. It returns 0 when nothing has been observed.
+func (h *Histogram) Quantile(q float64) time.Duration {
+	counts := h.snapshot()
+	var total uint64
+	for _, n := range counts {
+		total += n
+	}
+	if total == 0 {
+		return 0
+	}
+	rank := q * float64(total)
+	var cum uint64
+	for i, n := range counts {
+		if n == 0 || float64(cum+n) < rank {
+			cum += n
+			continue
+		}
+		if i == len(h.bounds) {
+			break
+		}
+		lo := 0.0
+		if i > 0 {
+			lo = h.bounds[i-1]
+		}
+		frac := (rank - float64(cum)) / float64(n)
+		return secs(lo + (h.bounds[i]-lo)*frac)
+	}
+	return secs(h.bounds[len(h.bounds)-1])
+}
+
+// Summary reports the observation count and the p50, p95 and p99 latencies
+// in milliseconds, for STATS.
+func (h *Histogram) Summary() map[string]interface{} {
+	ms := func(q float64) float64 {
+		return math.Round(float64(h.Quantile(q))/1e3) / 1e3
+	}
+	return map[string]interface{}{
+		"count": h.count.Load(),
+		"p50Ms": ms(0.50),
+		"p95Ms": ms(0.95),
+		"p99Ms": ms(0.99),
+	}
+}
+
+// snapshot returns the per-bucket counts, +Inf last.
+func (h *Histogram) snapshot() []uint64 {
+	counts := make([]uint64, len(h.counts))
+	for i := range h.counts {
+		counts[i] = h.counts[i].Load()
+	}
+	return counts
+}
+
+func secs(s float64) time.Duration { return time.Duration(s * float64(time.Second)) }
+
+// Latencies summarises every registered histogram, keyed by metric name.
+func Latencies() map[string]interface{} {
+	names, snap := sorted()
+	out := make(map[string]interface{})
+	for _, n := range names {
+		if h, ok := snap[n].(*Histogram); ok {
+			out[n] = h.Summary()
+		}
+	}
+	return out
+}
@@ -0,0 +1,132 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// metric is anything the registry can report.
+type metric interface {
+	write(w io.Writer)
+	value() int64
+}
+
+var (
+	mu       sync.Mutex
+	registry = map[string]metric{}
+)
+
+func register(name string, m metric) {
+	mu.Lock()
+	defer mu.Unlock()
+	if _, ok := registry[name]; ok {
+		panic("metrics: duplicate metric " + name)
+	}
+	registry[name] = m
+}
+
+// Counter is a monotonically increasing count.
+type Counter struct {
+	name, help string
+	v          atomic.Int64
+}
+
+// NewCounter creates and registers a counter.
+func NewCounter(name, help string) *Counter {
+	c := &Counter{name: name, help: help}
+	register(name, c)
+	return c
+}
+
+func (c *Counter) Inc()         { c.v.Add(1) }
+func (c *Counter) Add(n int64)  { c.v.Add(n) }
+func (c *Counter) Value() int64 { return c.v.Load() }
+func (c *Counter) value() int64 { return c.Value() }
+func (c *Counter) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", c.name, c.help, c.name, c.name, c.Value())
+}
+
+// Gauge is a value that can go up and down.
+type Gauge struct {
+	name, help string
+	v          atomic.Int64
+}
+
+// NewGauge creates and registers a gauge.
+func NewGauge(name, help string) *Gauge {
+	g := &Gauge{name: name, help: help}
+	register(name, g)
+	return g
+}
+
+func (g *Gauge) Set(n int64)  { g.v.Store(n) }
+func (g *Gauge) Add(n int64)  { g.v.Add(n) }
+func (g *Gauge) Value() int64 { return g.v.Load() }
+func (g *Gauge) value() int64 { return g.Value() }
+func (g *Gauge) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %d\n", g.name, g.help, g.name, g.name, g.Value())
+}
+
+// Func reports a value computed when scraped, for counts kept elsewhere,
+// such as in RocksDB's own statistics.
+type Func struct {
+	name, help, typ string
+	fn              func() int64
+}
+
+// NewCounterFunc registers a counter whose value fn reports.
+func NewCounterFunc(name, help string, fn func() int64) *Func {
+	f := &Func{name: name, help: help, typ: "counter", fn: fn}
+	register(name, f)
+	return f
+}
+
+// NewGaugeFunc registers a gauge whose value fn reports.
+func NewGaugeFunc(name, help string, fn func() int64) *Func {
+	f := &Func{name: name, help: help, typ: "gauge", fn: fn}
+	register(name, f)
+	return f
+}
+
+func (f *Func) value() int64 { return f.fn() }
+func (f *Func) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %d\n", f.name, f.help, f.name, f.typ, f.name, f.value())
+}
+
+func sorted() ([]string, map[string]metric) {
+	mu.Lock()
+	defer mu.Unlock()
+	names := make([]string, 0, len(registry))
+	snap := make(map[string]metric, len(registry))
+	for n, m := range registry {
+		names = append(names, n)
+		snap[n] = m
+	}
+	sort.Strings(names)
+	return names, snap
+}
+
+// Snapshot returns the current value of every registered metric.
+func Snapshot() map[string]int64 {
+	names, snap := sorted()
+	out := make(map[string]int64, len(names))
+	for _, n := range names {
+		out[n] = snap[n].value()
+	}
+	return out
+}
+
+// Handler serves all registered metrics in the Prometheus text format.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		names, snap := sorted()
+		for _, n := range names {
+			snap[n].write(w)
+		}
+	})
+}
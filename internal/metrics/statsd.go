@@ -0,0 +1,123 @@
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+)
+
+// statsdPacketBytes keeps each datagram under a typical Ethernet MTU.
+const statsdPacketBytes = 1432
+
+// StartStatsD pushes every registered metric to the StatsD server at addr
+// (host:port, over UDP) every interval until stop is closed, so StatsD and
+// /metrics always report the same numbers. Counters are sent as the
+// increase since the last push, gauges as their value. A histogram becomes
+// a timer in milliseconds: each bucket that filled since the last push is
+// sent once, at its upper bound, with a sample rate that makes it count for
+// every observation in it. prefix, if set, is prepended to every name with a
+// dot.
+func StartStatsD(addr, prefix string, interval time.Duration, stop <-chan struct{}) error {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return err
+	}
+	if prefix != "" {
+		prefix += "."
+	}
+	s := &statsd{conn: conn, prefix: prefix, counters: map[string]int64{}, hists: map[string][]uint64{}}
+	t := time.NewTicker(interval)
+	go func() {
+		defer conn.Close()
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				if err := s.flush(); err != nil {
+					fmt.Println("statsd push error:", err)
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+type statsd struct {
+	conn   net.Conn
+	prefix string
+	// What was last pushed, to send counters as increases.
+	counters map[string]int64
+	hists    map[string][]uint64
+}
+
+func (s *statsd) flush() error {
+	names, snap := sorted()
+	var pkt bytes.Buffer
+	var firstErr error
+	send := func(line string) {
+		if pkt.Len() > 0 && pkt.Len()+1+len(line) > statsdPacketBytes {
+			if _, err := s.conn.Write(pkt.Bytes()); err != nil && firstErr == nil {
+				firstErr = err
+			}
+			pkt.Reset()
+		}
+		if pkt.Len() > 0 {
+			pkt.WriteByte('\n')
+		}
+		pkt.WriteString(line)
+	}
+	for _, n := range names {
+		name := s.prefix + n
+		switch m := snap[n].(type) {
+		case *Counter:
+			send(fmt.Sprintf("%s:%d|c", name, s.delta(n, m.Value())))
+		case *Gauge:
+			send(fmt.Sprintf("%s:%d|g", name, m.Value()))
+		case *Func:
+			if m.typ == "counter" {
+				send(fmt.Sprintf("%s:%d|c", name, s.delta(n, m.value())))
+			} else {
+				send(fmt.Sprintf("%s:%d|g", name, m.value()))
+			}
+		case *Histogram:
+			counts := m.snapshot()
+			prev := s.hists[n]
+			for i, c := range counts {
+				if i < len(prev) {
+					c -= prev[i]
+				}
+				if c == 0 {
+					continue
+				}
+				bound := m.bounds[len(m.bounds)-1]
+				if i < len(m.bounds) {
+					bound = m.bounds[i]
+				}
+				ms := strconv.FormatFloat(bound*1e3, 'g', -1, 64)
+				if c == 1 {
+					send(fmt.Sprintf("%s:%s|ms", name, ms))
+				} else {
+					send(fmt.Sprintf("%s:%s|ms|@%s", name, ms, strconv.FormatFloat(1/float64(c), 'g', 6, 64)))
+				}
+			}
+			s.hists[n] = counts
+		}
+	}
+	if pkt.Len() > 0 {
+		if _, err := s.conn.Write(pkt.Bytes()); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// delta returns how much counter n has grown since the last push.
+func (s *statsd) delta(n string, v int64) int64 {
+	d := v - s.counters[n]
+	s.counters[n] = v
+	return d
+}
@@ -0,0 +1,113 @@
+package ops
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Registry tracks long-running operations, such as full scans, so operators
+// can see and cancel them. A nil *Registry tracks nothing.
+type Registry struct {
+	mu   sync.Mutex
+	next uint64
+	ops  map[uint64]*Op
+}
+
+func New() *Registry {
+	return &Registry{ops: make(map[uint64]*Op)}
+}
+
+// Op is one tracked operation. Its methods are no-ops on a nil *Op.
+type Op struct {
+	reg     *Registry
+	id      uint64
+	typ     string
+	detail  string
+	started time.Time
+	keys    atomic.Int64
+	cancel  context.CancelFunc
+}
+
+// Info describes a running operation.
+type Info struct {
+	ID        uint64    `json:"id"`
+	Type      string    `json:"type"`
+	Detail    string    `json:"detail,omitempty"`
+	Started   time.Time `json:"started"`
+	ElapsedMs int64     `json:"elapsedMs"`
+	Keys      int64     `json:"keys"`
+}
+
+// Start registers an operation of type typ; detail is free text such as the
+// prefix being scanned. The returned ctx is canceled by Cancel, and the
+// operation must watch it and stop. Call Done when it finishes.
+func (r *Registry) Start(parent context.Context, typ, detail string) (context.Context, *Op) {
+	if r == nil {
+		return parent, nil
+	}
+	ctx, cancel := context.WithCancel(parent)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.next++
+	op := &Op{reg: r, id: r.next, typ: typ, detail: detail, started: time.Now(), cancel: cancel}
+	r.ops[op.id] = op
+	return ctx, op
+}
+
+// Add counts n more keys processed.
+func (o *Op) Add(n int64) {
+	if o != nil {
+		o.keys.Add(n)
+	}
+}
+
+// Done unregisters the operation and releases its context.
+func (o *Op) Done() {
+	if o == nil {
+		return
+	}
+	o.cancel()
+	o.reg.mu.Lock()
+	delete(o.reg.ops, o.id)
+	o.reg.mu.Unlock()
+}
+
+// List returns the running operations, oldest first.
+func (r *Registry) List() []Info {
+	if r == nil {
+		return nil
+	}
+	now := time.Now()
+	r.mu.Lock()
+	out := make([]Info, 0, len(r.ops))
+	for _, op := range r.ops {
+		out = append(out, Info{
+			ID:        op.id,
+			Type:      op.typ,
+			Detail:    op.detail,
+			Started:   op.started,
+			ElapsedMs: now.Sub(op.started).Milliseconds(),
+			Keys:      op.keys.Load(),
+		})
+	}
+	r.mu.Unlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out
+}
+
+// Cancel cancels operation id's context and reports whether it was running.
+func (r *Registry) Cancel(id uint64) bool {
+	if r == nil {
+		return false
+	}
+	r.mu.Lock()
+	op, ok := r.ops[id]
+	r.mu.Unlock()
+	if ok {
+		op.cancel()
+	}
+	return ok
+}
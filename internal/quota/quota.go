@@ -0,0 +1,145 @@
+package quota
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrExceeded is returned by Reserve when a write would take a prefix over
+// its quota.
+var ErrExceeded = errors.New("quota exceeded")
+
+// Limit caps what may be stored under a prefix; a zero field is unlimited.
+type Limit struct {
+	MaxKeys  int64 `json:"maxKeys"`
+	MaxBytes int64 `json:"maxBytes"`
+}
+
+// Usage is an estimate of what is stored under a prefix.
+type Usage struct {
+	Keys  int64 `json:"keys"`
+	Bytes int64 `json:"bytes"`
+}
+
+// Sizer estimates a prefix's size, as datastore.Datastore.PrefixSize does.
+type Sizer interface {
+	PrefixSize(prefix string) (size, keys int64, err error)
+}
+
+// Enforcer checks writes against per-prefix limits. Usage is the store's
+// estimate as of the last Refresh plus whatever has been reserved since, so
+// checks never touch the store.
+type Enforcer struct {
+	db     Sizer
+	limits map[string]Limit
+
+	mu    sync.Mutex
+	usage map[string]Usage
+}
+
+func New(db Sizer, limits map[string]Limit) *Enforcer {
+	return &Enforcer{db: db, limits: limits, usage: make(map[string]Usage)}
+}
+
+// PrefixFor returns the longest quota prefix key falls under.
+func (e *Enforcer) PrefixFor(key string) (string, bool) {
+	best, ok := "", false
+	for p := range e.limits {
+		if strings.HasPrefix(key, p) && (!ok || len(p) > len(best)) {
+			best, ok = p, true
+		}
+	}
+	return best, ok
+}
+
+// Reserve admits a write adding delta to each prefix if none of them would
+// go over its limit, and counts it towards their usage until the next
+// Refresh. Release it if the write then fails.
+func (e *Enforcer) Reserve(delta map[string]Usage) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for p, d := range delta {
+		l, u := e.limits[p], e.usage[p]
+		if l.MaxKeys > 0 && d.Keys > 0 && u.Keys+d.Keys > l.MaxKeys {
+			return fmt.Errorf("%w: %q would hold about %d keys, limit %d", ErrExceeded, p, u.Keys+d.Keys, l.MaxKeys)
+		}
+		if l.MaxBytes > 0 && d.Bytes > 0 && u.Bytes+d.Bytes > l.MaxBytes {
+			return fmt.Errorf("%w: %q would hold about %d bytes, limit %d", ErrExceeded, p, u.Bytes+d.Bytes, l.MaxBytes)
+		}
+	}
+	e.add(delta, 1)
+	return nil
+}
+
+// Release undoes a Reserve whose write didn't happen. It is a no-op on a nil
+// *Enforcer.
+func (e *Enforcer) Release(delta map[string]Usage) {
+	if e == nil {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.add(delta, -1)
+}
+
+func (e *Enforcer) add(delta map[string]Usage, sign int64) {
+	for p, d := range delta {
+		u := e.usage[p]
+		u.Keys += sign * d.Keys
+		u.Bytes += sign * d.Bytes
+		e.usage[p] = u
+	}
+}
+
+// Usage returns the current estimate for every quota prefix.
+func (e *Enforcer) Usage() map[string]Usage {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	out := make(map[string]Usage, len(e.usage))
+	for p, u := range e.usage {
+		out[p] = u
+	}
+	return out
+}
+
+// Refresh re-estimates every quota prefix from the store, dropping the
+// reservations made since the last refresh.
+func (e *Enforcer) Refresh() error {
+	fresh := make(map[string]Usage, len(e.limits))
+	for p := range e.limits {
+		size, keys, err := e.db.PrefixSize(p)
+		if err != nil {
+			return err
+		}
+		fresh[p] = Usage{Keys: keys, Bytes: size}
+	}
+	e.mu.Lock()
+	e.usage = fresh
+	e.mu.Unlock()
+	return nil
+}
+
+// Start refreshes e every interval until stop is closed. The returned
+// channel is closed once the loop has exited.
+func Start(e *Enforcer, interval time.Duration, stop <-chan struct{}) <-chan struct{} {
+	t := time.NewTicker(interval)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				if err := e.Refresh(); err != nil {
+					fmt.Println("quota refresh error:", err)
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+	return done
+}
@@ -0,0 +1,134 @@
+package reconciler
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/UltraSive/rocksdb-configuration-distribution/internal/datastore"
+	"github.com/UltraSive/rocksdb-configuration-distribution/internal/metrics"
+	"github.com/UltraSive/rocksdb-configuration-distribution/internal/upstream"
+)
+
+var (
+	checked = metrics.NewCounter("kvstore_reconcile_checked_total", "Local keys compared against upstream.")
+	updated = metrics.NewCounter("kvstore_reconcile_drift_updated_total", "Local keys rewritten because they differed from upstream.")
+	deleted = metrics.NewCounter("kvstore_reconcile_drift_deleted_total", "Local keys dropped because upstream no longer has them.")
+	failed  = metrics.NewCounter("kvstore_reconcile_errors_total", "Upstream fetches or local writes that failed during reconciliation.")
+)
+
+// Options bounds how much upstream load the reconciler generates.
+type Options struct {
+	Interval   time.Duration // time between passes
+	BatchSize  int           // local keys visited per pass
+	SampleRate float64       // fraction of visited keys checked against upstream
+	// TTL returns the TTL for a rewritten entry, the one an upstream fill
+	// of the key would get.
+	TTL func(key string) time.Duration
+	// Pinned, if set, reports keys that are never dropped, even when
+	// upstream no longer has them.
+	Pinned func(key string) bool
+	// Pending, if set, reports keys with a local write upstream hasn't
+	// taken yet; they are left alone, as upstream is the one behind.
+	Pending func(key string) bool
+}
+
+// Start runs a slow anti-entropy loop: each tick it walks the next BatchSize
+// local keys (wrapping around the keyspace), checks a SampleRate fraction of
+// them against upstream, and fixes any that drifted. The returned channel is
+// closed once the loop has exited.
+func Start(ds datastore.Datastore, up *upstream.Client, opts Options, stop <-chan struct{}) <-chan struct{} {
+	t := time.NewTicker(opts.Interval)
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-stop
+		cancel()
+	}()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer t.Stop()
+		cursor := ""
+		for {
+			select {
+			case <-t.C:
+				cursor = runOnce(ctx, ds, up, opts, cursor)
+			case <-stop:
+				return
+			}
+		}
+	}()
+	return done
+}
+
+// runOnce reconciles one batch starting at cursor and returns where the next
+// pass should resume ("" once the end of the keyspace is reached).
+func runOnce(ctx context.Context, ds datastore.Datastore, up *upstream.Client, opts Options, cursor string) string {
+	batch := make(map[string]json.RawMessage, opts.BatchSize)
+	var keys []string
+	next := ""
+	err := ds.Scan("", cursor, func(k string, v json.RawMessage) bool {
+		if len(keys) == opts.BatchSize {
+			next = k
+			return false
+		}
+		keys = append(keys, k)
+		batch[k] = v
+		return true
+	})
+	if err != nil {
+		fmt.Println("reconciler scan error:", err)
+		return cursor
+	}
+
+	for _, k := range keys {
+		if ctx.Err() != nil {
+			return cursor
+		}
+		if opts.SampleRate < 1 && rand.Float64() >= opts.SampleRate {
+			continue
+		}
+		checked.Inc()
+		remote, found, err := up.Fetch(ctx, k)
+		if err != nil {
+			failed.Inc()
+			continue
+		}
+		// Checked after the fetch, so a write queued while it ran counts.
+		if opts.Pending != nil && opts.Pending(k) {
+			continue
+		}
+		pinned := opts.Pinned != nil && opts.Pinned(k)
+		switch {
+		case !found && pinned:
+			// Kept: pinned keys are never dropped.
+		case !found:
+			if err := ds.Delete(k); err != nil {
+				failed.Inc()
+				continue
+			}
+			deleted.Inc()
+		case !sameJSON(batch[k], remote):
+			if err := ds.Put(k, remote, opts.TTL(k)); err != nil {
+				failed.Inc()
+				continue
+			}
+			updated.Inc()
+		}
+	}
+	return next
+}
+
+// sameJSON compares two JSON documents ignoring formatting and key order.
+func sameJSON(a, b json.RawMessage) bool {
+	var va, vb interface{}
+	if json.Unmarshal(a, &va) != nil || json.Unmarshal(b, &vb) != nil {
+		return bytes.Equal(a, b)
+	}
+	ca, _ := json.Marshal(va)
+	cb, _ := json.Marshal(vb)
+	return bytes.Equal(ca, cb)
+}
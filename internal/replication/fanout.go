@@ -0,0 +1,435 @@
+package replication
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/UltraSive/rocksdb-configuration-distribution/internal/datastore"
+	"github.com/UltraSive/rocksdb-configuration-distribution/internal/metrics"
+)
+
+// pushBatch bounds how many changes are sent to a replica per round.
+const pushBatch = 500
+
+var (
+	pushErrors     = metrics.NewCounter("kvstore_replica_push_errors_total", "Failed pushes of changes to a replica; each is retried from the change log.")
+	pushGaps       = metrics.NewCounter("kvstore_replica_gaps_total", "Times a replica fell out of the change log and skipped changes it never received.")
+	quorumFailures = metrics.NewCounter("kvstore_replica_quorum_failures_total", "Writes committed locally that too few replicas acknowledged in time.")
+)
+
+// ErrNoQuorum is returned by Fanout.Wait when too few replicas acknowledged
+// a write in time. The write is committed locally and still reaches them.
+var ErrNoQuorum = errors.New("too few replicas acknowledged the write")
+
+// Fanout pushes every change in a store's change log to a fixed list of
+// replicas through their request endpoints, as UPDATE and DELETE_RANGE
+// requests, and lets writers wait for replicas to acknowledge them. Each
+// replica has its own pusher and cursor in the log, so one that is down
+// doesn't hold up the others, and what it missed is retried from the log
+// once it is back. Each replica's acknowledged position is kept in the
+// store and pins the log, so a restart resumes where it left off and the
+// changes a replica still needs are kept for it, up to the log's pinned
+// retention.
+type Fanout struct {
+	log       *datastore.ChangeLog
+	positions Positions
+	need      int
+	timeout   time.Duration
+	token     string
+	client    *http.Client
+	replicas  []*replica
+
+	mu     sync.Mutex
+	notify chan struct{} // closed and replaced whenever a replica acknowledges
+}
+
+type replica struct {
+	url     string
+	acked   uint64 // every change up to here has been applied by the replica
+	lastErr string
+	pin     *datastore.Pin
+}
+
+// Positions keeps each replica's acknowledged position across restarts;
+// *datastore.RocksDB implements it.
+type Positions interface {
+	ReplicaPosition(url string) (datastore.ReplicaPosition, bool, error)
+	SetReplicaPosition(url string, p datastore.ReplicaPosition) error
+}
+
+// ReplicaStatus is one replica's progress, for STATS.
+type ReplicaStatus struct {
+	URL       string `json:"url"`
+	Acked     uint64 `json:"acked"`
+	Lag       uint64 `json:"lag"` // changes not yet acknowledged
+	LastError string `json:"lastError,omitempty"`
+}
+
+// Need returns how many replicas out of n must acknowledge a write for
+// acks: "none", "quorum" (a majority), "all", or a number up to n.
+func Need(acks string, n int) (int, error) {
+	switch acks {
+	case "none":
+		return 0, nil
+	case "quorum":
+		return n/2 + 1, nil
+	case "all":
+		return n, nil
+	}
+	need, err := strconv.Atoi(acks)
+	if err != nil || need < 0 || need > n {
+		return 0, fmt.Errorf("replica acks must be none, quorum, all or 0 to %d, got %q", n, acks)
+	}
+	return need, nil
+}
+
+// NewFanout returns a fan-out of log to urls, the replicas' request
+// endpoints, that keeps their positions in positions and waits for need of
+// them to acknowledge a write, for at most timeout; need 0 replicates
+// asynchronously. Requests carry token as a bearer token, if set, and also
+// time out after timeout.
+func NewFanout(log *datastore.ChangeLog, positions Positions, urls []string, need int, timeout time.Duration, token string) *Fanout {
+	f := &Fanout{
+		log:       log,
+		positions: positions,
+		need:      need,
+		timeout:   timeout,
+		token:     token,
+		client:    &http.Client{Timeout: timeout},
+		notify:    make(chan struct{}),
+	}
+	for _, u := range urls {
+		f.replicas = append(f.replicas, &replica{url: u})
+	}
+	return f
+}
+
+// Start runs a pusher per replica until stop is closed. Each resumes from
+// the position its replica last acknowledged, replaying a FLUSHALL made
+// since if the epoch has changed. A replica without one is assumed to hold
+// everything written so far and starts at the log's current sequence. The
+// returned channel is closed once every pusher has returned.
+func (f *Fanout) Start(stop <-chan struct{}) <-chan struct{} {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-stop
+		cancel()
+	}()
+	var wg sync.WaitGroup
+	for _, r := range f.replicas {
+		pos, ok, err := f.positions.ReplicaPosition(r.url)
+		if err != nil {
+			fmt.Println("replica", r.url, "position unreadable, starting at the head:", err)
+		}
+		if !ok {
+			pos = datastore.ReplicaPosition{Epoch: f.log.Epoch(), Seq: f.log.Seq()}
+		}
+		r.acked = pos.Seq
+		r.pin = f.log.Pin(pos.Seq)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			f.push(ctx, r, pos.Epoch, pos.Seq)
+		}()
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	return done
+}
+
+// Wait blocks until enough replicas have acknowledged every change up to
+// seq, failing with ErrNoQuorum if that takes longer than the timeout or
+// ctx ends first.
+func (f *Fanout) Wait(ctx context.Context, seq uint64) error {
+	if f.need == 0 {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, f.timeout)
+	defer cancel()
+	for {
+		f.mu.Lock()
+		n := 0
+		for _, r := range f.replicas {
+			if r.acked >= seq {
+				n++
+			}
+		}
+		wait := f.notify
+		f.mu.Unlock()
+		if n >= f.need {
+			return nil
+		}
+		select {
+		case <-wait:
+		case <-ctx.Done():
+			quorumFailures.Inc()
+			return fmt.Errorf("%w: %d of %d acknowledged, %d needed", ErrNoQuorum, n, len(f.replicas), f.need)
+		}
+	}
+}
+
+// Status reports each replica's progress.
+func (f *Fanout) Status() []ReplicaStatus {
+	head := f.log.Seq()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	out := make([]ReplicaStatus, 0, len(f.replicas))
+	for _, r := range f.replicas {
+		st := ReplicaStatus{URL: r.url, Acked: r.acked, LastError: r.lastErr}
+		if head > r.acked {
+			st.Lag = head - r.acked
+		}
+		out = append(out, st)
+	}
+	return out
+}
+
+// push sends r every change after seq in epoch, retrying a failed round
+// with backoff until it goes through.
+func (f *Fanout) push(ctx context.Context, r *replica, epoch string, seq uint64) {
+	defer r.pin.Release()
+	backoff := time.Second
+	for {
+		wait := f.log.Wait()
+		if f.log.Epoch() != epoch {
+			// FLUSHALL reset the log; what it did isn't in it, so do it
+			// on the replica before going on from where it left off.
+			e, origin := f.log.Origin()
+			if err := f.wipe(ctx, r.url); err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				pushErrors.Inc()
+				fmt.Println("replica", r.url, "flush error:", err)
+				f.mu.Lock()
+				r.lastErr = err.Error()
+				f.mu.Unlock()
+				select {
+				case <-time.After(backoff):
+				case <-ctx.Done():
+					return
+				}
+				if backoff < 30*time.Second {
+					backoff *= 2
+				}
+				continue
+			}
+			backoff = time.Second
+			epoch, seq = e, origin
+			f.ack(r, epoch, seq)
+			continue
+		}
+		changes, ok := f.log.Since(seq)
+		if !ok {
+			fmt.Println("replica", r.url, "fell out of the change log after sequence", seq, "and needs a resync")
+			pushGaps.Inc()
+			seq = f.log.Seq()
+			f.ack(r, epoch, seq)
+			continue
+		}
+		if len(changes) == 0 {
+			select {
+			case <-wait:
+			case <-ctx.Done():
+				return
+			}
+			continue
+		}
+		if len(changes) > pushBatch {
+			changes = changes[:pushBatch]
+		}
+		if err := f.send(ctx, r.url, changes); err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			pushErrors.Inc()
+			fmt.Println("replica", r.url, "push error:", err)
+			f.mu.Lock()
+			r.lastErr = err.Error()
+			f.mu.Unlock()
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+				return
+			}
+			if backoff < 30*time.Second {
+				backoff *= 2
+			}
+			continue
+		}
+		backoff = time.Second
+		seq = changes[len(changes)-1].Seq
+		f.ack(r, epoch, seq)
+	}
+}
+
+// ack records that r has applied every change up to seq in epoch, moving
+// its pin and saving its position, and wakes waiters.
+func (f *Fanout) ack(r *replica, epoch string, seq uint64) {
+	r.pin.Move(seq)
+	if err := f.positions.SetReplicaPosition(r.url, datastore.ReplicaPosition{Epoch: epoch, Seq: seq}); err != nil {
+		fmt.Println("replica", r.url, "position not saved:", err)
+	}
+	f.mu.Lock()
+	r.acked, r.lastErr = seq, ""
+	close(f.notify)
+	f.notify = make(chan struct{})
+	f.mu.Unlock()
+}
+
+// pushRequest is the subset of the request envelope that replays changes.
+type pushRequest struct {
+	Type      string                     `json:"type"`
+	Items     map[string]json.RawMessage `json:"items,omitempty"`
+	TTLs      map[string]string          `json:"ttls,omitempty"`
+	Encodings map[string]string          `json:"encodings,omitempty"`
+	Delete    []string                   `json:"delete,omitempty"`
+	Start     string                     `json:"start,omitempty"`
+	End       string                     `json:"end,omitempty"`
+}
+
+// send replays changes on the replica at url, in order.
+func (f *Fanout) send(ctx context.Context, url string, changes []datastore.Change) error {
+	for _, req := range pushRequests(changes, time.Now().UnixNano()) {
+		if err := f.call(ctx, url, req, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// wipe deletes every client key on the replica at url, a page of LIST at a
+// time, for a FLUSHALL. Each page is listed from the start, as the previous
+// one is gone.
+func (f *Fanout) wipe(ctx context.Context, url string) error {
+	for {
+		var page struct {
+			Data map[string]json.RawMessage `json:"data"`
+		}
+		if err := f.call(ctx, url, pushRequest{Type: "LIST"}, &page); err != nil {
+			return err
+		}
+		if len(page.Data) == 0 {
+			return nil
+		}
+		keys := make([]string, 0, len(page.Data))
+		for k := range page.Data {
+			keys = append(keys, k)
+		}
+		for len(keys) > 0 {
+			n := min(len(keys), pushBatch)
+			if err := f.call(ctx, url, pushRequest{Type: "UPDATE", Delete: keys[:n]}, nil); err != nil {
+				return err
+			}
+			keys = keys[n:]
+		}
+	}
+}
+
+// call posts req to the replica at url and fails unless it answers OK. The
+// rest of the answer is decoded into out, if not nil.
+func (f *Fanout) call(ctx context.Context, url string, req pushRequest, out interface{}) error {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	if f.token != "" {
+		httpReq.Header.Set("Authorization", "Bearer "+f.token)
+	}
+	resp, err := f.client.Do(httpReq)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	raw, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("%s: status %d: %w", req.Type, resp.StatusCode, err)
+	}
+	var status struct {
+		Type  string `json:"type"`
+		Code  string `json:"code"`
+		Error string `json:"error"`
+	}
+	if err := json.Unmarshal(raw, &status); err != nil {
+		return fmt.Errorf("%s: status %d: %w", req.Type, resp.StatusCode, err)
+	}
+	if status.Type != "OK" {
+		return fmt.Errorf("%s: %s: %s", req.Type, status.Code, status.Error)
+	}
+	if out != nil {
+		return json.Unmarshal(raw, out)
+	}
+	return nil
+}
+
+// pushRequests turns changes into the requests that replay them: runs of
+// puts and deletes become one UPDATE, split where a key repeats so order
+// within the run doesn't matter, and range deletes a DELETE_RANGE. Expiries
+// are sent as the TTL left at now, and an entry already expired as a
+// delete. Binary values keep their encoding. Reserved keys are left out, as
+// request endpoints refuse them.
+func pushRequests(changes []datastore.Change, now int64) []pushRequest {
+	var reqs []pushRequest
+	var cur *pushRequest
+	seen := make(map[string]bool)
+	flush := func() {
+		if cur != nil {
+			reqs = append(reqs, *cur)
+		}
+		cur = nil
+		clear(seen)
+	}
+	for _, c := range changes {
+		m := c.Mutation
+		if m.Delete && m.End != "" {
+			flush()
+			reqs = append(reqs, pushRequest{Type: "DELETE_RANGE", Start: m.Key, End: m.End})
+			continue
+		}
+		if datastore.ValidateKey(m.Key) != nil {
+			continue
+		}
+		if seen[m.Key] {
+			flush()
+		}
+		if cur == nil {
+			cur = &pushRequest{Type: "UPDATE", Items: make(map[string]json.RawMessage), TTLs: make(map[string]string)}
+		}
+		seen[m.Key] = true
+		switch {
+		case m.Delete, m.Expiry != math.MaxInt64 && m.Expiry <= now:
+			cur.Delete = append(cur.Delete, m.Key)
+		case m.Expiry == math.MaxInt64:
+			cur.Items[m.Key] = m.Value
+			cur.TTLs[m.Key] = "0s"
+		default:
+			cur.Items[m.Key] = m.Value
+			cur.TTLs[m.Key] = time.Duration(m.Expiry - now).String()
+		}
+		if _, put := cur.Items[m.Key]; put && m.Encoding != "" {
+			if cur.Encodings == nil {
+				cur.Encodings = make(map[string]string)
+			}
+			cur.Encodings[m.Key] = m.Encoding
+		}
+	}
+	flush()
+	return reqs
+}
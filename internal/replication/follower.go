@@ -0,0 +1,174 @@
+package replication
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/UltraSive/rocksdb-configuration-distribution/internal/datastore"
+)
+
+// snapshotBatch bounds how many snapshot entries are committed per WriteBatch.
+const snapshotBatch = 500
+
+// follower keeps a local store in sync with a leader's replication stream.
+type follower struct {
+	url    string // leader's replication endpoint
+	db     datastore.Datastore
+	client *http.Client
+	epoch  string
+	seq    uint64
+	synced chan struct{} // closed after the first full snapshot
+}
+
+// Follow starts replicating from leaderURL into ds until stop is closed,
+// reconnecting with backoff whenever the stream drops. synced is closed once
+// the first snapshot from the leader has been applied, when ds holds the
+// leader's data rather than whatever it started with. done is closed once
+// the follower has stopped writing to ds.
+func Follow(ds datastore.Datastore, leaderURL string, stop <-chan struct{}) (synced, done <-chan struct{}) {
+	f := &follower{url: leaderURL, db: ds, client: &http.Client{}, synced: make(chan struct{})}
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-stop
+		cancel()
+	}()
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+		backoff := time.Second
+		for {
+			err := f.stream(ctx)
+			if ctx.Err() != nil {
+				return
+			}
+			fmt.Println("replication stream error:", err)
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+				return
+			}
+			if backoff < 30*time.Second {
+				backoff *= 2
+			}
+		}
+	}()
+	return f.synced, exited
+}
+
+func (f *follower) stream(ctx context.Context) error {
+	u, err := url.Parse(f.url)
+	if err != nil {
+		return err
+	}
+	q := u.Query()
+	q.Set("since", strconv.FormatUint(f.seq, 10))
+	q.Set("epoch", f.epoch)
+	u.RawQuery = q.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("leader returned %s", resp.Status)
+	}
+	epoch := resp.Header.Get(EpochHeader)
+
+	var (
+		inSnapshot bool
+		seen       map[string]struct{}
+		pending    []datastore.Mutation
+	)
+	sc := bufio.NewScanner(resp.Body)
+	sc.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for sc.Scan() {
+		var ev Event
+		if err := json.Unmarshal(sc.Bytes(), &ev); err != nil {
+			return err
+		}
+		switch ev.Type {
+		case "change":
+			if ev.Mutation == nil {
+				continue
+			}
+			if err := f.db.Write([]datastore.Mutation{*ev.Mutation}); err != nil {
+				return err
+			}
+			f.seq = ev.Seq
+		case "snapshot_begin":
+			inSnapshot, seen, pending = true, make(map[string]struct{}), nil
+		case "snapshot":
+			if !inSnapshot || ev.Mutation == nil {
+				continue
+			}
+			seen[ev.Mutation.Key] = struct{}{}
+			pending = append(pending, *ev.Mutation)
+			if len(pending) >= snapshotBatch {
+				if err := f.db.Write(pending); err != nil {
+					return err
+				}
+				pending = pending[:0]
+			}
+		case "snapshot_end":
+			if err := f.finishSnapshot(pending, seen); err != nil {
+				return err
+			}
+			inSnapshot, seen, pending = false, nil, nil
+			select {
+			case <-f.synced:
+			default:
+				close(f.synced)
+			}
+			if ev.Epoch != "" {
+				epoch = ev.Epoch
+			}
+			f.epoch, f.seq = epoch, ev.Seq
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return err
+	}
+	return fmt.Errorf("leader closed stream")
+}
+
+// finishSnapshot commits the tail of the snapshot and drops local keys the
+// leader no longer has. Local keys are walked with a scan, and stale ones
+// deleted in batches as they are found, so the whole local keyspace is never
+// held in memory.
+func (f *follower) finishSnapshot(pending []datastore.Mutation, seen map[string]struct{}) error {
+	var werr error
+	err := f.db.Scan("", "", func(k string, _ json.RawMessage) bool {
+		if _, ok := seen[k]; ok {
+			return true
+		}
+		pending = append(pending, datastore.Mutation{Key: k, Delete: true})
+		if len(pending) >= snapshotBatch {
+			if werr = f.db.Write(pending); werr != nil {
+				return false
+			}
+			pending = pending[:0]
+		}
+		return true
+	})
+	if werr != nil {
+		return werr
+	}
+	if err != nil {
+		return err
+	}
+	if len(pending) == 0 {
+		return nil
+	}
+	return f.db.Write(pending)
+}
@@ -0,0 +1,121 @@
+package replication
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/UltraSive/rocksdb-configuration-distribution/internal/datastore"
+)
+
+// EpochHeader carries the leader's change-log epoch on the stream response.
+const EpochHeader = "X-Replication-Epoch"
+
+// Event is one line of the newline-delimited replication stream.
+type Event struct {
+	Type     string              `json:"type"` // change | snapshot_begin | snapshot | snapshot_end | heartbeat
+	Seq      uint64              `json:"seq,omitempty"`
+	Mutation *datastore.Mutation `json:"mutation,omitempty"`
+	Epoch    string              `json:"epoch,omitempty"` // on snapshot_end: the epoch the snapshot belongs to
+}
+
+// Source is the leader-side view of the store needed to serve followers.
+type Source interface {
+	ChangeLog() *datastore.ChangeLog
+	Snapshot(fn func(datastore.Mutation) error) (uint64, error)
+}
+
+// Handler streams every write after the follower's `since` sequence. When
+// the follower's epoch doesn't match or it has fallen out of the change log,
+// a full snapshot is sent first and streaming resumes from there. The epoch
+// is checked again before every round, so a log reset while the follower is
+// connected (FLUSHALL) sends it a fresh snapshot too.
+func Handler(src Source, heartbeat time.Duration) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			// The handler package imports this one, so the error envelope
+			// is spelled out.
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"type":"ERR","code":"INTERNAL","error":"streaming unsupported","data":{}}`))
+			return
+		}
+		// The stream is meant to stay open; lift the server's write timeout.
+		_ = http.NewResponseController(w).SetWriteDeadline(time.Time{})
+		log := src.ChangeLog()
+		since, _ := strconv.ParseUint(r.URL.Query().Get("since"), 10, 64)
+		epoch := log.Epoch()
+		resync := r.URL.Query().Get("epoch") != epoch
+
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.Header().Set(EpochHeader, epoch)
+		enc := json.NewEncoder(w)
+
+		// Keep the durable log from being trimmed past this follower.
+		pin := log.Pin(since)
+		defer pin.Release()
+
+		t := time.NewTicker(heartbeat)
+		defer t.Stop()
+		for {
+			wait := log.Wait()
+			if e := log.Epoch(); e != epoch {
+				// The log was reset; the follower's history no longer
+				// describes the store.
+				epoch, resync = e, true
+			}
+			changes, ok := log.Since(since)
+			if resync || !ok {
+				seq, err := sendSnapshot(src, enc, epoch)
+				if err != nil {
+					return
+				}
+				since, resync = seq, false
+				pin.Move(since)
+				flusher.Flush()
+				continue
+			}
+			for i := range changes {
+				c := changes[i]
+				if err := enc.Encode(Event{Type: "change", Seq: c.Seq, Mutation: &c.Mutation}); err != nil {
+					return
+				}
+				since = c.Seq
+			}
+			pin.Move(since)
+			flusher.Flush()
+			if since < log.Seq() {
+				// A page from the durable log; keep catching up.
+				continue
+			}
+
+			select {
+			case <-wait:
+			case <-t.C:
+				if err := enc.Encode(Event{Type: "heartbeat", Seq: since}); err != nil {
+					return
+				}
+				flusher.Flush()
+			case <-r.Context().Done():
+				return
+			}
+		}
+	}
+}
+
+// sendSnapshot streams every entry of src, ending with the sequence the
+// snapshot is consistent at and epoch, which the follower adopts.
+func sendSnapshot(src Source, enc *json.Encoder, epoch string) (uint64, error) {
+	if err := enc.Encode(Event{Type: "snapshot_begin"}); err != nil {
+		return 0, err
+	}
+	seq, err := src.Snapshot(func(m datastore.Mutation) error {
+		return enc.Encode(Event{Type: "snapshot", Mutation: &m})
+	})
+	if err != nil {
+		return 0, err
+	}
+	return seq, enc.Encode(Event{Type: "snapshot_end", Seq: seq, Epoch: epoch})
+}
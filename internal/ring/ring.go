@@ -0,0 +1,133 @@
+// Package ring maps keys to kvstore instances with a consistent-hash ring, so
+// clients can route each key straight to the instance that owns it.
+//
+// The algorithm is fixed so that every client computes the same owners:
+//
+//   - hash(s) is the first 8 bytes of the MD5 digest of s, read as a
+//     big-endian uint64. MD5 is used for its spread, not for security.
+//   - Each node is placed on the ring at VNodes points. Point i of node addr
+//     is hash(addr + "#" + i), with i in decimal from 0.
+//   - A key hashes to hash(key).
+//   - The key belongs to the node of the first point at or after its hash,
+//     wrapping to the lowest point past the top of the ring. Points that
+//     collide are ordered by node address.
+//
+// Node addresses are used exactly as configured, so all instances and
+// clients must spell them the same way.
+package ring
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"errors"
+	"sort"
+	"strconv"
+)
+
+// DefaultVNodes is how many points each node gets when VNodes is 0.
+const DefaultVNodes = 128
+
+type point struct {
+	hash uint64
+	node string
+}
+
+// Ring is an immutable consistent-hash ring.
+type Ring struct {
+	nodes  []string
+	vnodes int
+	points []point
+}
+
+// New builds the ring for nodes with vnodes points each (0 = DefaultVNodes).
+func New(nodes []string, vnodes int) (*Ring, error) {
+	if len(nodes) == 0 {
+		return nil, errors.New("ring needs at least one node")
+	}
+	if vnodes <= 0 {
+		vnodes = DefaultVNodes
+	}
+	r := &Ring{vnodes: vnodes}
+	seen := make(map[string]bool, len(nodes))
+	for _, n := range nodes {
+		if n == "" || seen[n] {
+			return nil, errors.New("ring nodes must be unique and non-empty")
+		}
+		seen[n] = true
+		r.nodes = append(r.nodes, n)
+		for i := 0; i < vnodes; i++ {
+			r.points = append(r.points, point{hash: hash(n + "#" + strconv.Itoa(i)), node: n})
+		}
+	}
+	sort.Strings(r.nodes)
+	sort.Slice(r.points, func(i, j int) bool {
+		a, b := r.points[i], r.points[j]
+		return a.hash < b.hash || a.hash == b.hash && a.node < b.node
+	})
+	return r, nil
+}
+
+func hash(s string) uint64 {
+	sum := md5.Sum([]byte(s))
+	return binary.BigEndian.Uint64(sum[:8])
+}
+
+// Owner returns the node that owns key.
+func (r *Ring) Owner(key string) string {
+	h := hash(key)
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i].hash >= h })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.points[i].node
+}
+
+// Nodes returns the ring's nodes, sorted.
+func (r *Ring) Nodes() []string {
+	return append([]string(nil), r.nodes...)
+}
+
+// Range is a run of key hashes, Start to End inclusive, owned by Node. The
+// bounds are decimal strings because JSON numbers can't carry 64 bits
+// exactly in most clients.
+type Range struct {
+	Start string `json:"start"`
+	End   string `json:"end"`
+	Node  string `json:"node"`
+}
+
+// Topology is the ring as published to clients.
+type Topology struct {
+	Algorithm string   `json:"algorithm"`
+	VNodes    int      `json:"vnodes"`
+	Nodes     []string `json:"nodes"`
+	Ranges    []Range  `json:"ranges"`
+}
+
+// Topology lists the ring's hash ranges in order, covering 0 to 2^64-1.
+// Adjacent points of the same node are merged into one range.
+func (r *Ring) Topology() Topology {
+	t := Topology{Algorithm: "md5-64", VNodes: r.vnodes, Nodes: r.Nodes()}
+	var start uint64
+	for i, p := range r.points {
+		if i > 0 && r.points[i-1].hash == p.hash {
+			continue // a collision; the earlier point owns this hash
+		}
+		t.Ranges = appendRange(t.Ranges, start, p.hash, p.node)
+		start = p.hash + 1
+		if p.hash == ^uint64(0) {
+			return t
+		}
+	}
+	// Past the last point the ring wraps to the first.
+	t.Ranges = appendRange(t.Ranges, start, ^uint64(0), r.points[0].node)
+	return t
+}
+
+func appendRange(rs []Range, start, end uint64, node string) []Range {
+	if n := len(rs); n > 0 && rs[n-1].Node == node {
+		rs[n-1].End = strconv.FormatUint(end, 10)
+		return rs
+	}
+	return append(rs, Range{Start: strconv.FormatUint(start, 10), End: strconv.FormatUint(end, 10), Node: node})
+}
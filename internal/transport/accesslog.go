@@ -0,0 +1,54 @@
+package transport
+
+import (
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+// AccessLog says which HTTP requests are logged, in chi's request log
+// format. Failed (5xx) requests, and those taking at least Slow, are always
+// logged; of the rest, requests to an Exclude path are never logged and the
+// others are logged with probability SampleRate. The zero value logs only
+// failures.
+type AccessLog struct {
+	SampleRate float64       // 0 to 1
+	Exclude    []string      // exact paths, e.g. "/healthz"
+	Slow       time.Duration // 0 = no slow-request logging
+}
+
+var accessLogFormatter = &middleware.DefaultLogFormatter{Logger: log.New(os.Stdout, "", log.LstdFlags)}
+
+// Middleware logs each request a selects, once it has been served.
+func (a AccessLog) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		start := time.Now()
+		defer func() {
+			elapsed := time.Since(start)
+			status := ww.Status()
+			if status == 0 {
+				status = http.StatusOK // nothing written
+			}
+			if a.logs(r, status, elapsed) {
+				accessLogFormatter.NewLogEntry(r).Write(status, ww.BytesWritten(), ww.Header(), elapsed, nil)
+			}
+		}()
+		next.ServeHTTP(ww, r)
+	})
+}
+
+func (a AccessLog) logs(r *http.Request, status int, elapsed time.Duration) bool {
+	switch {
+	case status >= 500, a.Slow > 0 && elapsed >= a.Slow:
+		return true
+	case slices.Contains(a.Exclude, r.URL.Path):
+		return false
+	}
+	return a.SampleRate >= 1 || a.SampleRate > 0 && rand.Float64() < a.SampleRate
+}
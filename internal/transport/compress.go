@@ -0,0 +1,117 @@
+package transport
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// CompressionZstd is the frame compression a HELLO can negotiate.
+const CompressionZstd = "zstd"
+
+// frameCompressed is set in a frame's length prefix when its payload is
+// zstd compressed. Plain frames never set it: they are far below 2 GiB.
+const frameCompressed = 1 << 31
+
+// compressMinBytes is the smallest payload worth compressing.
+const compressMinBytes = 512
+
+// maxInflatedBytes caps a compressed frame's decompressed size when the
+// frame limit is 0 or higher, so a small frame can't make the server
+// inflate gigabytes.
+var maxInflatedBytes = 256 << 20
+
+// The zstd encoder is safe for concurrent EncodeAll and costly to set up, so
+// one is shared. Decoders stream, which isn't safe for concurrent use, so
+// they are pooled; each is limited to maxInflatedBytes of memory, which also
+// bounds the window a frame may ask for.
+var (
+	frameEncoder  = sync.OnceValues(func() (*zstd.Encoder, error) { return zstd.NewWriter(nil) })
+	frameDecoders = sync.Pool{New: func() any {
+		dec, err := zstd.NewReader(nil, zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxMemory(uint64(maxInflatedBytes)))
+		if err != nil {
+			return err
+		}
+		return dec
+	}}
+)
+
+// compressFrame returns data compressed, or nil when it is too small or
+// doesn't shrink.
+func compressFrame(data []byte) []byte {
+	if len(data) < compressMinBytes {
+		return nil
+	}
+	enc, err := frameEncoder()
+	if err != nil {
+		return nil
+	}
+	z := enc.EncodeAll(data, nil)
+	if len(z) >= len(data) {
+		return nil
+	}
+	return z
+}
+
+// decompressFrame inflates a compressed payload of at most max bytes once
+// decompressed, or maxInflatedBytes when max is 0 or larger. The declared
+// content size is only used to refuse an oversized frame early: the payload
+// is decoded as a stream through a limit, so the buffer grows with what the
+// frame really holds.
+func decompressFrame(z []byte, max int) ([]byte, error) {
+	if max <= 0 || max > maxInflatedBytes {
+		max = maxInflatedBytes
+	}
+	var hdr zstd.Header
+	if err := hdr.Decode(z); err != nil {
+		return nil, fmt.Errorf("compressed frame: %w", err)
+	}
+	if !hdr.HasFCS {
+		return nil, errors.New("compressed frame: content size missing")
+	}
+	if hdr.FrameContentSize > uint64(max) {
+		return nil, fmt.Errorf("%w: %d bytes decompressed, limit %d", ErrFrameTooLarge, hdr.FrameContentSize, max)
+	}
+	d := frameDecoders.Get()
+	dec, ok := d.(*zstd.Decoder)
+	if !ok {
+		return nil, d.(error)
+	}
+	defer func() {
+		_ = dec.Reset(nil)
+		frameDecoders.Put(dec)
+	}()
+	if err := dec.Reset(bytes.NewReader(z)); err != nil {
+		return nil, fmt.Errorf("compressed frame: %w", err)
+	}
+	out, err := io.ReadAll(io.LimitReader(dec, int64(max)+1))
+	if err != nil {
+		return nil, fmt.Errorf("compressed frame: %w", err)
+	}
+	if len(out) > max {
+		return nil, fmt.Errorf("%w: over %d bytes decompressed", ErrFrameTooLarge, max)
+	}
+	return out, nil
+}
+
+// hello is the framed protocol's negotiation frame, sent before anything
+// else: {"type":"HELLO","compression":"zstd"}.
+type hello struct {
+	Type        string `json:"type"`
+	Compression string `json:"compression"`
+}
+
+// parseHello reports whether msg is a HELLO frame, looking for the type
+// before decoding so other frames aren't parsed twice.
+func parseHello(msg []byte) (hello, bool) {
+	var h hello
+	if !bytes.Contains(msg, []byte(`"HELLO"`)) || json.Unmarshal(msg, &h) != nil || h.Type != "HELLO" {
+		return h, false
+	}
+	return h, true
+}
@@ -1,29 +1,233 @@
 package transport
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"net/http"
+	"time"
 
+	"github.com/UltraSive/rocksdb-configuration-distribution/internal/auth"
+	"github.com/UltraSive/rocksdb-configuration-distribution/internal/datastore"
+	"github.com/UltraSive/rocksdb-configuration-distribution/internal/handler"
+	"github.com/UltraSive/rocksdb-configuration-distribution/internal/metrics"
 	"github.com/go-chi/chi/v5"
-	"github.com/go-chi/chi/v5/middleware"
 )
 
-func NewHTTPRouter(serve func([]byte) ([]byte, error)) http.Handler {
+func NewHTTPRouter(serve func(context.Context, []byte) handler.Response, token string, accessLog AccessLog) chi.Router {
 	r := chi.NewRouter()
-	r.Use(middleware.Logger)
-	r.Post("/", func(w http.ResponseWriter, r *http.Request) {
+	r.Use(countInFlight)
+	r.Use(accessLog.Middleware)
+	r.Use(Recover)
+	r.NotFound(func(w http.ResponseWriter, r *http.Request) {
+		WriteResponse(w, errResponse(handler.CodeNotFound, "not found"))
+	})
+	r.MethodNotAllowed(methodNotAllowed(r))
+	r.Get("/", RootHandler(r))
+	r.With(Authenticate(token)).Post("/", func(w http.ResponseWriter, r *http.Request) {
 		var body json.RawMessage
 		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
-			http.Error(w, err.Error(), 400)
-			return
-		}
-		out, err := serve(body)
-		if err != nil {
-			http.Error(w, err.Error(), 500)
+			WriteResponse(w, errResponse(handler.CodeInvalidRequest, err.Error()))
 			return
 		}
-		w.Header().Set("Content-Type", "application/json")
-		w.Write(out)
+		WriteResponse(w, serve(r.Context(), body))
 	})
 	return r
 }
+
+var httpInFlight = metrics.NewGauge("kvstore_http_in_flight_requests", "HTTP requests being served, streams included.")
+
+func countInFlight(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		httpInFlight.Add(1)
+		defer httpInFlight.Add(-1)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// HTTPInFlight returns how many HTTP requests are being served.
+func HTTPInFlight() int64 {
+	return httpInFlight.Value()
+}
+
+// WriteResponse writes resp as JSON with the status matching its code.
+func WriteResponse(w http.ResponseWriter, resp handler.Response) {
+	writeJSON(w, statusFor(resp.Code), resp)
+}
+
+func writeJSON(w http.ResponseWriter, status int, resp handler.Response) {
+	out, err := json.Marshal(resp)
+	if err != nil {
+		status = http.StatusInternalServerError
+		out, _ = json.Marshal(errResponse(handler.CodeInternal, err.Error()))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(out)
+}
+
+func errResponse(code, msg string) handler.Response {
+	return handler.Response{Type: "ERR", Code: code, Error: msg, Data: map[string]interface{}{}}
+}
+
+// statusFor maps a Response error code to the HTTP status returned with it.
+func statusFor(code string) int {
+	switch code {
+	case "":
+		return http.StatusOK
+	case handler.CodeInvalidRequest:
+		return http.StatusBadRequest
+	case handler.CodeUpstreamError:
+		return http.StatusBadGateway
+	case handler.CodeRateLimited:
+		return http.StatusTooManyRequests
+	case handler.CodeTooLarge:
+		return http.StatusRequestEntityTooLarge
+	case handler.CodeReadOnly:
+		return http.StatusForbidden
+	case handler.CodeUnauthorized:
+		return http.StatusUnauthorized
+	case handler.CodeNotFound:
+		return http.StatusNotFound
+	case handler.CodeResync:
+		return http.StatusGone
+	case handler.CodeOverloaded, handler.CodeCanceled, handler.CodeNotReady:
+		return http.StatusServiceUnavailable
+	case handler.CodeQuotaExceeded:
+		return http.StatusInsufficientStorage
+	case handler.CodeOutOfRange, handler.CodeConflict:
+		return http.StatusConflict
+	case handler.CodeWrongShard:
+		return http.StatusMisdirectedRequest
+	case handler.CodeNoQuorum:
+		return http.StatusGatewayTimeout
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// ReadyHandler answers `GET /readyz` with 200 while check passes and 503
+// NOT_READY, carrying the reason, while it fails, for load balancers and
+// orchestrators.
+func ReadyHandler(check func() error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := check(); err != nil {
+			WriteResponse(w, errResponse(handler.CodeNotReady, err.Error()))
+			return
+		}
+		WriteResponse(w, handler.Response{Type: "OK", Data: map[string]interface{}{}})
+	}
+}
+
+// HealthHandler answers `GET /healthz` with 200 whenever the process can
+// serve HTTP at all. It is the liveness probe: a node that is merely not
+// ready, or busy compacting, stays alive.
+func HealthHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		WriteResponse(w, handler.Response{Type: "OK", Data: map[string]interface{}{}})
+	}
+}
+
+// ScanHandler streams `GET /scan?prefix=&cursor=` results as newline-delimited
+// {"key":...,"value":...} objects in key order, without buffering the set:
+// each record is written and flushed to the client as the scan yields it.
+func ScanHandler(scan func(ctx context.Context, prefix, cursor string, fn func(key string, value json.RawMessage) bool) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		rc := http.NewResponseController(w)
+		// A large scan can outlast the server's write timeout.
+		_ = rc.SetWriteDeadline(time.Time{})
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		enc := json.NewEncoder(w)
+		var werr error
+		err := scan(r.Context(), q.Get("prefix"), q.Get("cursor"), func(key string, value json.RawMessage) bool {
+			werr = enc.Encode(struct {
+				Key   string          `json:"key"`
+				Value json.RawMessage `json:"value"`
+			}{key, value})
+			if werr == nil {
+				if ferr := rc.Flush(); ferr != nil && !errors.Is(ferr, http.ErrNotSupported) {
+					werr = ferr
+				}
+			}
+			return werr == nil
+		})
+		if err != nil && werr == nil {
+			// Headers are usually already sent; report in-band as a final line.
+			_ = enc.Encode(map[string]string{"error": err.Error()})
+		}
+	}
+}
+
+// WatchHandler streams `GET /watch?key=a&key=b` as newline-delimited
+// handler.WatchEvent objects: each key's current value, then its changes.
+// Errors before the first event get a JSON error response; later ones are
+// reported in-band as a final {"error":...} line.
+func WatchHandler(watch func(ctx context.Context, keys []string, heartbeat time.Duration, emit func(handler.WatchEvent) error) error, heartbeat time.Duration) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			WriteResponse(w, errResponse(handler.CodeInternal, "streaming unsupported"))
+			return
+		}
+		// The stream is meant to stay open; lift the server's write timeout.
+		_ = http.NewResponseController(w).SetWriteDeadline(time.Time{})
+		enc := json.NewEncoder(w)
+		started := false
+		var werr error
+		err := watch(r.Context(), r.URL.Query()["key"], heartbeat, func(ev handler.WatchEvent) error {
+			if !started {
+				w.Header().Set("Content-Type", "application/x-ndjson")
+				started = true
+			}
+			if werr = enc.Encode(ev); werr == nil {
+				flusher.Flush()
+			}
+			return werr
+		})
+		switch {
+		case err == nil || werr != nil || errors.Is(err, context.Canceled):
+		case !started:
+			code := handler.CodeInternal
+			switch {
+			case errors.Is(err, handler.ErrNotReady):
+				code = handler.CodeNotReady
+			case errors.Is(err, handler.ErrNoChangeLog), errors.Is(err, datastore.ErrInvalidKey):
+				code = handler.CodeInvalidRequest
+			}
+			WriteResponse(w, errResponse(code, err.Error()))
+		default:
+			_ = enc.Encode(map[string]string{"error": err.Error()})
+		}
+	}
+}
+
+// RequireToken rejects requests without `Authorization: Bearer <token>`.
+// An empty token disables the check.
+func RequireToken(token string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !auth.Check(token, auth.BearerToken(r)) {
+				WriteResponse(w, errResponse(handler.CodeUnauthorized, "unauthorized"))
+				return
+			}
+			ctx := auth.WithPeer(r.Context(), auth.Peer{Transport: "http", Addr: r.RemoteAddr})
+			next.ServeHTTP(w, r.WithContext(auth.WithIdentity(ctx, auth.Granted(token))))
+		})
+	}
+}
+
+// Authenticate attaches an identity to requests that present the token (or
+// to all requests when token is empty) but lets the rest through, so the
+// handler can gate individual request types.
+func Authenticate(token string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := auth.WithPeer(r.Context(), auth.Peer{Transport: "http", Addr: r.RemoteAddr})
+			if auth.Check(token, auth.BearerToken(r)) {
+				ctx = auth.WithIdentity(ctx, auth.Granted(token))
+			}
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
@@ -0,0 +1,109 @@
+package transport
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// Split shares l between HTTP and the framed protocol, routing each accepted
+// connection by its first byte. HTTP requests open with a method name, so an
+// ASCII uppercase letter means HTTP. A frame opens with the high byte of its
+// big-endian length, which stays below 0x40 for any frame under 1 GiB, so
+// anything else means framed. The byte is peeked, not consumed. A connection
+// that sends nothing within timeout (0 = no limit) is closed. Temporary
+// accept errors are retried with backoff. Closing either returned listener
+// closes l and so both.
+func Split(l net.Listener, timeout time.Duration) (httpLn, framedLn net.Listener) {
+	s := &split{l: l, done: make(chan struct{})}
+	h := &splitListener{s: s, conns: make(chan net.Conn)}
+	f := &splitListener{s: s, conns: make(chan net.Conn)}
+	go func() {
+		var delay time.Duration
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				// Like net/http, ride out temporary errors such as running
+				// out of file descriptors rather than stop serving.
+				if ne, ok := err.(net.Error); ok && ne.Temporary() {
+					delay = min(max(2*delay, 5*time.Millisecond), time.Second)
+					fmt.Printf("shared port accept error: %v; retrying in %v\n", err, delay)
+					time.Sleep(delay)
+					continue
+				}
+				s.err = err
+				close(s.done)
+				return
+			}
+			delay = 0
+			go s.route(conn, timeout, h, f)
+		}
+	}()
+	return h, f
+}
+
+type split struct {
+	l    net.Listener
+	done chan struct{}
+	err  error // set before done is closed
+	once sync.Once
+}
+
+func (s *split) route(conn net.Conn, timeout time.Duration, h, f *splitListener) {
+	if timeout > 0 {
+		_ = conn.SetReadDeadline(time.Now().Add(timeout))
+	}
+	br := bufio.NewReader(conn)
+	first, err := br.Peek(1)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	_ = conn.SetReadDeadline(time.Time{})
+	to := f
+	if first[0] >= 'A' && first[0] <= 'Z' {
+		to = h
+	}
+	select {
+	case to.conns <- &peekedConn{Conn: conn, r: br}:
+	case <-s.done:
+		conn.Close()
+	}
+}
+
+// splitListener is one side of a Split listener.
+type splitListener struct {
+	s     *split
+	conns chan net.Conn
+}
+
+func (l *splitListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.s.done:
+		return nil, l.s.err
+	}
+}
+
+func (l *splitListener) Close() error {
+	var err error
+	l.s.once.Do(func() { err = l.s.l.Close() })
+	return err
+}
+
+func (l *splitListener) Addr() net.Addr {
+	return l.s.l.Addr()
+}
+
+// peekedConn reads through the buffer that holds the peeked bytes.
+type peekedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *peekedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
@@ -0,0 +1,86 @@
+package transport
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestSplitRoutesByFirstByte(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	httpLn, framedLn := Split(l, time.Second)
+	defer httpLn.Close()
+
+	dial := func(t *testing.T) net.Conn {
+		t.Helper()
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		return conn
+	}
+	accept := func(t *testing.T, ln net.Listener) net.Conn {
+		t.Helper()
+		got := make(chan net.Conn, 1)
+		go func() {
+			conn, err := ln.Accept()
+			if err != nil {
+				t.Error(err)
+			}
+			got <- conn
+		}()
+		select {
+		case conn := <-got:
+			if conn == nil {
+				t.FailNow()
+			}
+			t.Cleanup(func() { conn.Close() })
+			return conn
+		case <-time.After(2 * time.Second):
+			t.Fatalf("no connection on the %s side", map[net.Listener]string{httpLn: "HTTP", framedLn: "framed"}[ln])
+			return nil
+		}
+	}
+
+	t.Run("http", func(t *testing.T) {
+		if _, err := dial(t).Write([]byte("GET /readyz HTTP/1.1\r\nHost: x\r\n\r\n")); err != nil {
+			t.Fatal(err)
+		}
+		req, err := http.ReadRequest(bufio.NewReader(accept(t, httpLn)))
+		if err != nil || req.URL.Path != "/readyz" {
+			t.Fatalf("HTTP side read %v, %v", req, err)
+		}
+	})
+
+	t.Run("plain frame", func(t *testing.T) {
+		msg := []byte(`{"type":"PING"}`)
+		if err := WriteMessage(dial(t), msg); err != nil {
+			t.Fatal(err)
+		}
+		got, err := ReadMessage(accept(t, framedLn), 0)
+		if err != nil || !bytes.Equal(got, msg) {
+			t.Fatalf("framed side read %q, %v, want %q", got, err, msg)
+		}
+	})
+
+	t.Run("compressed frame", func(t *testing.T) {
+		msg := []byte(`{"type":"UPDATE","items":{"k":"` + string(bytes.Repeat([]byte("a"), 4096)) + `"}}`)
+		if compressFrame(msg) == nil {
+			t.Fatal("test frame doesn't compress")
+		}
+		if err := WriteFrame(dial(t), msg, true); err != nil {
+			t.Fatal(err)
+		}
+		got, err := ReadMessage(accept(t, framedLn), 0)
+		if err != nil || !bytes.Equal(got, msg) {
+			t.Fatalf("framed side read %d bytes, %v, want the %d byte message", len(got), err, len(msg))
+		}
+	})
+}
@@ -0,0 +1,72 @@
+package transport
+
+import (
+	"context"
+
+	"github.com/UltraSive/rocksdb-configuration-distribution/internal/handler"
+	"github.com/UltraSive/rocksdb-configuration-distribution/internal/metrics"
+)
+
+var (
+	framedQueued = metrics.NewGauge("kvstore_framed_requests_queued", "Framed requests waiting for a worker.")
+	framedShed   = metrics.NewCounter("kvstore_framed_requests_shed_total", "Framed requests answered OVERLOADED because the worker queue was full.")
+)
+
+// Pool runs framed requests on a fixed set of workers, so CPU use stays
+// bounded however many connections are open. A nil Pool runs each request
+// on its connection's goroutine.
+type Pool struct {
+	jobs chan func()
+}
+
+// NewPool starts workers goroutines serving a queue of up to queue requests.
+// The workers run for the life of the process.
+func NewPool(workers, queue int) *Pool {
+	p := &Pool{jobs: make(chan func(), queue)}
+	for i := 0; i < workers; i++ {
+		go func() {
+			for job := range p.jobs {
+				framedQueued.Add(-1)
+				job()
+			}
+		}()
+	}
+	return p
+}
+
+// Wrap returns serve dispatched to the pool: each request waits for a worker
+// and its connection waits for the reply, so replies stay in order. When
+// the queue is full the request is answered OVERLOADED straight away and the
+// connection stays open. A request that panics is logged and gets no reply,
+// which closes its connection; the worker carries on.
+func (p *Pool) Wrap(serve func(ctx context.Context, msg []byte) []byte) func(ctx context.Context, msg []byte) []byte {
+	if p == nil {
+		return serve
+	}
+	return func(ctx context.Context, msg []byte) []byte {
+		done := make(chan []byte, 1)
+		framedQueued.Add(1)
+		select {
+		case p.jobs <- func() {
+			defer func() {
+				if v := recover(); v != nil {
+					logPanic("framed request", v)
+					done <- nil
+				}
+			}()
+			done <- serve(ctx, msg)
+		}:
+		default:
+			framedQueued.Add(-1)
+			framedShed.Inc()
+			return marshalResponse(errResponse(handler.CodeOverloaded, "overloaded: too many framed requests queued"))
+		}
+		select {
+		case reply := <-done:
+			return reply
+		case <-ctx.Done():
+			// The peer hung up; the worker's reply has nowhere to go.
+			return nil
+		}
+	}
+}
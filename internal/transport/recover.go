@@ -0,0 +1,41 @@
+package transport
+
+import (
+	"fmt"
+	"net/http"
+	"runtime/debug"
+
+	"github.com/UltraSive/rocksdb-configuration-distribution/internal/handler"
+	"github.com/UltraSive/rocksdb-configuration-distribution/internal/metrics"
+)
+
+var panics = metrics.NewCounter("kvstore_panics_total", "Panics recovered while serving a request or connection.")
+
+// logPanic records a recovered panic with the stack of the goroutine that
+// raised it.
+func logPanic(where string, v interface{}) {
+	panics.Inc()
+	fmt.Printf("panic serving %s: %v\n%s", where, v, debug.Stack())
+}
+
+// Recover answers a request whose handler panics with INTERNAL, after
+// logging the panic and its stack, rather than letting net/http drop the
+// connection. If the handler had already started its response the client
+// gets that cut short. http.ErrAbortHandler is let through, since it is how
+// a handler asks for exactly that.
+func Recover(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			v := recover()
+			if v == nil {
+				return
+			}
+			if v == http.ErrAbortHandler {
+				panic(v)
+			}
+			logPanic(r.Method+" "+r.URL.Path, v)
+			WriteResponse(w, errResponse(handler.CodeInternal, "internal error"))
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
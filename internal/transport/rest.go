@@ -0,0 +1,179 @@
+package transport
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/UltraSive/rocksdb-configuration-distribution/internal/datastore"
+	"github.com/UltraSive/rocksdb-configuration-distribution/internal/handler"
+	"github.com/UltraSive/rocksdb-configuration-distribution/internal/upstream"
+	"github.com/go-chi/chi/v5"
+)
+
+// KVHandler serves `GET /kv/*` with the bare JSON value of one key. Responses
+// carry an ETag from the entry's write sequence and a Last-Modified from its
+// write time, and conditional requests that match get 304 Not Modified.
+// X-Expires gives the entry's expiry, and X-Pinned is set for keys pinned
+// never to expire.
+func KVHandler(lookup func(ctx context.Context, key string) (datastore.DBEntry, bool, error), pinned func(key string) bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key, err := url.PathUnescape(chi.URLParam(r, "*"))
+		if err != nil || key == "" {
+			WriteResponse(w, errResponse(handler.CodeInvalidRequest, "invalid key"))
+			return
+		}
+		e, ok, err := lookup(r.Context(), key)
+		if err != nil {
+			code := handler.CodeInternal
+			switch {
+			case errors.Is(err, upstream.ErrBusy):
+				code = handler.CodeOverloaded
+			case errors.Is(err, handler.ErrUpstream):
+				code = handler.CodeUpstreamError
+			case errors.Is(err, datastore.ErrInvalidKey):
+				code = handler.CodeInvalidRequest
+			case errors.Is(err, handler.ErrWrongShard):
+				code = handler.CodeWrongShard
+			}
+			WriteResponse(w, errResponse(code, err.Error()))
+			return
+		}
+		if !ok {
+			WriteResponse(w, errResponse(handler.CodeNotFound, "not found"))
+			return
+		}
+
+		etag := entryETag(e)
+		w.Header().Set("ETag", etag)
+		var modified time.Time
+		if e.Modified != 0 {
+			modified = time.Unix(0, e.Modified).UTC().Truncate(time.Second)
+			w.Header().Set("Last-Modified", modified.Format(http.TimeFormat))
+		}
+		if e.Expiry != math.MaxInt64 {
+			w.Header().Set("X-Expires", time.Unix(0, e.Expiry).UTC().Format(http.TimeFormat))
+		}
+		if pinned(key) {
+			w.Header().Set("X-Pinned", "true")
+		}
+		if notModified(r, etag, modified) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		if e.Encoding == datastore.EncodingBase64 {
+			var s string
+			if err := json.Unmarshal(e.Value, &s); err == nil {
+				if b, err := base64.StdEncoding.DecodeString(s); err == nil {
+					w.Header().Set("Content-Type", "application/octet-stream")
+					w.Write(b)
+					return
+				}
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(e.Value)
+	}
+}
+
+// KVPutHandler serves `PUT /kv/*`, storing the request body as the key's
+// value without a JSON envelope around it: the body is read straight into a
+// buffer sized from Content-Length, rather than decoded from a request
+// document and copied out of it. The store still copies it as it encodes
+// the entry and its change-log record, so a write holds several copies at
+// once; maxBytes should allow for that. It must be JSON, unless it is
+// sent as application/octet-stream, when it is stored as a binary value.
+// Bodies over maxBytes (0 = no limit) are refused with TOO_LARGE. The ttl query
+// parameter works like UPDATE's ttl; the write itself is an UPDATE of the
+// one key, so it is validated, audited and charged to quotas the same way.
+func KVPutHandler(serve func(context.Context, handler.Request) handler.Response, maxBytes int64) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key, err := url.PathUnescape(chi.URLParam(r, "*"))
+		if err != nil || key == "" {
+			WriteResponse(w, errResponse(handler.CodeInvalidRequest, "invalid key"))
+			return
+		}
+		if maxBytes > 0 && r.ContentLength > maxBytes {
+			WriteResponse(w, errResponse(handler.CodeTooLarge, fmt.Sprintf("value exceeds %d bytes", maxBytes)))
+			return
+		}
+		body := r.Body
+		if maxBytes > 0 {
+			body = http.MaxBytesReader(w, r.Body, maxBytes)
+		}
+		var buf bytes.Buffer
+		if r.ContentLength > 0 {
+			buf.Grow(int(r.ContentLength))
+		}
+		if _, err := buf.ReadFrom(body); err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				WriteResponse(w, errResponse(handler.CodeTooLarge, fmt.Sprintf("value exceeds %d bytes", maxBytes)))
+				return
+			}
+			WriteResponse(w, errResponse(handler.CodeInvalidRequest, "reading body: "+err.Error()))
+			return
+		}
+		req := handler.Request{
+			Type:  "UPDATE",
+			Items: map[string]json.RawMessage{key: buf.Bytes()},
+			TTL:   r.URL.Query().Get("ttl"),
+		}
+		if isBinary(r.Header.Get("Content-Type")) {
+			req.Items[key], _ = json.Marshal(base64.StdEncoding.EncodeToString(buf.Bytes()))
+			req.Encodings = map[string]string{key: datastore.EncodingBase64}
+		} else if !json.Valid(buf.Bytes()) {
+			WriteResponse(w, errResponse(handler.CodeInvalidRequest, "body is not valid JSON"))
+			return
+		}
+		WriteResponse(w, serve(r.Context(), req))
+	}
+}
+
+// isBinary reports whether a PUT body's content type asks for it to be
+// stored as a binary value.
+func isBinary(contentType string) bool {
+	mt, _, err := mime.ParseMediaType(contentType)
+	return err == nil && mt == "application/octet-stream"
+}
+
+// entryETag derives a strong ETag from the write sequence, which changes on
+// every write, falling back to a hash of the value for entries written
+// before sequences were stamped.
+func entryETag(e datastore.DBEntry) string {
+	if e.Seq != 0 {
+		return `"` + strconv.FormatUint(e.Seq, 10) + `"`
+	}
+	h := fnv.New64a()
+	h.Write(e.Value)
+	return `"h` + strconv.FormatUint(h.Sum64(), 16) + `"`
+}
+
+// notModified applies If-None-Match, or failing that If-Modified-Since.
+func notModified(r *http.Request, etag string, modified time.Time) bool {
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		for _, t := range strings.Split(inm, ",") {
+			t = strings.TrimPrefix(strings.TrimSpace(t), "W/")
+			if t == "*" || t == etag {
+				return true
+			}
+		}
+		return false
+	}
+	if ims := r.Header.Get("If-Modified-Since"); ims != "" && !modified.IsZero() {
+		t, err := http.ParseTime(ims)
+		return err == nil && !modified.After(t)
+	}
+	return false
+}
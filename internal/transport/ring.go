@@ -0,0 +1,27 @@
+package transport
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/UltraSive/rocksdb-configuration-distribution/internal/ring"
+)
+
+// RingHandler serves GET /cluster/ring: the consistent-hash ring clients use
+// to route keys, and this instance's own address in it. With ?key= it also
+// names the key's owner.
+func RingHandler(r *ring.Ring, self string) http.HandlerFunc {
+	topo := r.Topology()
+	return func(w http.ResponseWriter, req *http.Request) {
+		resp := struct {
+			ring.Topology
+			Self  string `json:"self,omitempty"`
+			Owner string `json:"owner,omitempty"`
+		}{Topology: topo, Self: self}
+		if k := req.URL.Query().Get("key"); k != "" {
+			resp.Owner = r.Owner(k)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(resp)
+	}
+}
@@ -0,0 +1,96 @@
+package transport
+
+import (
+	"net/http"
+	"runtime/debug"
+	"sort"
+	"strings"
+
+	"github.com/UltraSive/rocksdb-configuration-distribution/internal/handler"
+	"github.com/go-chi/chi/v5"
+)
+
+// ServiceName is how the root endpoint introduces the server.
+const ServiceName = "kvstore"
+
+// methods are the HTTP methods a route can be registered for, in the order
+// Allow lists them.
+var methods = []string{
+	http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch,
+	http.MethodDelete, http.MethodConnect, http.MethodOptions, http.MethodTrace,
+}
+
+// Version reports the build's module version, or "(devel)" for a build from
+// a checkout, followed by the VCS revision when the toolchain recorded one.
+func Version() string {
+	bi, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+	v := bi.Main.Version
+	for _, s := range bi.Settings {
+		if s.Key == "vcs.revision" {
+			rev := s.Value
+			if len(rev) > 12 {
+				rev = rev[:12]
+			}
+			v += " " + rev
+		}
+	}
+	return v
+}
+
+// RootHandler answers `GET /` with the service name, version and the
+// endpoints routes serves, each with its methods, so someone pointing a
+// browser or health checker at the server sees what it is. Routes are read
+// per request, so ones registered after this handler are listed too.
+func RootHandler(routes chi.Routes) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		byPath := make(map[string][]string)
+		_ = chi.Walk(routes, func(method, route string, _ http.Handler, _ ...func(http.Handler) http.Handler) error {
+			byPath[route] = append(byPath[route], method)
+			return nil
+		})
+		endpoints := make(map[string]interface{}, len(byPath))
+		for route, ms := range byPath {
+			if len(ms) >= len(methods) {
+				ms = []string{"*"}
+			}
+			sort.Strings(ms)
+			endpoints[route] = ms
+		}
+		WriteResponse(w, handler.Response{Type: "OK", Data: map[string]interface{}{
+			"service":   ServiceName,
+			"version":   Version(),
+			"endpoints": endpoints,
+		}})
+	}
+}
+
+// allowed lists the methods routes serves path with, for the Allow header of
+// a 405.
+func allowed(routes chi.Routes, r *http.Request) []string {
+	path := r.URL.RawPath
+	if path == "" {
+		path = r.URL.Path
+	}
+	var ok []string
+	for _, m := range methods {
+		if routes.Match(chi.NewRouteContext(), m, path) {
+			ok = append(ok, m)
+		}
+	}
+	return ok
+}
+
+// methodNotAllowed answers a known path requested with the wrong method: 405
+// with an Allow header naming the methods that path does take.
+func methodNotAllowed(routes chi.Routes) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ms := allowed(routes, r)
+		if len(ms) > 0 {
+			w.Header().Set("Allow", strings.Join(ms, ", "))
+		}
+		writeJSON(w, http.StatusMethodNotAllowed, errResponse(handler.CodeInvalidRequest, r.Method+" not allowed on "+r.URL.Path))
+	}
+}
@@ -1,51 +1,337 @@
 package transport
 
 import (
-    "bufio"
-    "encoding/binary"
-    "io"
-    "net"
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/UltraSive/rocksdb-configuration-distribution/internal/auth"
+	"github.com/UltraSive/rocksdb-configuration-distribution/internal/handler"
+	"github.com/UltraSive/rocksdb-configuration-distribution/internal/metrics"
 )
 
 // ServeUnix accepts a handler for net.Conn
 func ServeUnix(socketPath string, handler func(net.Conn)) error {
-    l, err := net.Listen("unix", socketPath)
-    if err != nil {
-        return err
-    }
-    defer l.Close()
+	l, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return err
+	}
+	return Serve(l, handler)
+}
+
+// Serve runs handler for each connection accepted on l, e.g. an inherited
+// systemd socket, until l fails. A handler that panics has the panic logged
+// and its connection closed; the listener and other connections carry on.
+func Serve(l net.Listener, handler func(net.Conn)) error {
+	defer l.Close()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			defer func() {
+				if v := recover(); v != nil {
+					logPanic("connection from "+conn.RemoteAddr().String(), v)
+					conn.Close()
+				}
+			}()
+			handler(conn)
+		}()
+	}
+}
+
+// Framed serves the framed protocol on any number of listeners and shuts
+// them down together, so the store isn't closed under a request in progress.
+type Framed struct {
+	handler func(ctx context.Context, conn net.Conn)
+	ctx     context.Context // done once Shutdown starts
+	cancel  context.CancelFunc
+
+	mu        sync.Mutex
+	listeners []net.Listener
+	conns     map[net.Conn]struct{}
+	wg        sync.WaitGroup
+}
 
-    for {
-        conn, err := l.Accept()
-        if err != nil {
-            return err
-        }
-        go handler(conn)
-    }
+// NewFramed returns a Framed running handler for each connection. The ctx
+// handed to handler is done once Shutdown starts; handler should then stop
+// taking requests, as ServeConn does.
+func NewFramed(handler func(ctx context.Context, conn net.Conn)) *Framed {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Framed{handler: handler, ctx: ctx, cancel: cancel, conns: make(map[net.Conn]struct{})}
+}
+
+// Serve accepts connections on l until l fails, or until Shutdown closes it,
+// when the error is net.ErrClosed.
+func (f *Framed) Serve(l net.Listener) error {
+	f.mu.Lock()
+	if f.ctx.Err() != nil {
+		f.mu.Unlock()
+		l.Close()
+		return net.ErrClosed
+	}
+	f.listeners = append(f.listeners, l)
+	f.mu.Unlock()
+	return Serve(l, func(conn net.Conn) {
+		f.mu.Lock()
+		if f.ctx.Err() != nil {
+			f.mu.Unlock()
+			conn.Close()
+			return
+		}
+		f.conns[conn] = struct{}{}
+		f.wg.Add(1)
+		f.mu.Unlock()
+		defer func() {
+			f.mu.Lock()
+			delete(f.conns, conn)
+			f.mu.Unlock()
+			f.wg.Done()
+		}()
+		f.handler(f.ctx, conn)
+	})
+}
+
+// Shutdown closes the listeners and waits for every open connection to
+// answer the request it is serving and close. If ctx ends first, the
+// connections left are closed and cut says how many; their requests may
+// still be running.
+func (f *Framed) Shutdown(ctx context.Context) (cut int, err error) {
+	f.mu.Lock()
+	f.cancel()
+	for _, l := range f.listeners {
+		l.Close()
+	}
+	f.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		f.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return 0, nil
+	case <-ctx.Done():
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for conn := range f.conns {
+		conn.Close()
+	}
+	return len(f.conns), ctx.Err()
+}
+
+var unixConns = metrics.NewGauge("kvstore_unix_connections", "Open connections on the framed-protocol listener.")
+
+// FramedConnections returns how many framed-protocol connections are open.
+func FramedConnections() int64 {
+	return unixConns.Value()
+}
+
+// ServeConn answers framed requests on conn, in order, until the peer hangs
+// up or lets idle pass without sending a frame (0 = no limit). A PING request
+// is a frame like any other, so it keeps an otherwise quiet connection open.
+// The ctx handed to serve is canceled as soon as the peer hangs up, so work
+// for abandoned requests can stop. When serve returns ok false, conn is
+// closed after writing the reply, if there is one. A frame longer than
+// maxFrame bytes (0 = no limit) is answered with TOO_LARGE and the
+// connection closed, since the stream can't be resynchronized. A HELLO frame
+// is answered here, not passed to serve; once it has negotiated compression,
+// large replies are sent compressed. Once parent is done, conn is closed
+// after the request in progress is answered; canceling parent doesn't
+// cancel that request.
+func ServeConn(parent context.Context, conn net.Conn, idle time.Duration, maxFrame int, serve func(ctx context.Context, msg []byte) (reply []byte, ok bool)) {
+	defer conn.Close()
+	unixConns.Add(1)
+	defer unixConns.Add(-1)
+
+	peer := auth.Peer{Transport: "framed"}
+	if a := conn.RemoteAddr(); a != nil {
+		peer.Addr = a.String()
+	}
+	ctx, cancel := context.WithCancel(auth.WithPeer(context.WithoutCancel(parent), peer))
+	defer cancel()
+	frames := make(chan []byte)
+	var tooLarge error // set before frames is closed
+	compress := false
+	go func() {
+		defer cancel()
+		defer close(frames)
+		defer func() {
+			// Nothing else recovers on this goroutine; a panic here would
+			// take down the server, not just this connection.
+			if v := recover(); v != nil {
+				logPanic("frames from "+conn.RemoteAddr().String(), v)
+			}
+		}()
+		br := bufio.NewReader(conn)
+		for {
+			msg, err := ReadMessage(br, maxFrame)
+			if err != nil {
+				if errors.Is(err, ErrFrameTooLarge) {
+					tooLarge = err
+				}
+				return
+			}
+			select {
+			case frames <- msg:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	for {
+		if parent.Err() != nil {
+			return
+		}
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if idle > 0 {
+			timer = time.NewTimer(idle)
+			timeout = timer.C
+		}
+		select {
+		case msg, ok := <-frames:
+			if timer != nil {
+				timer.Stop()
+			}
+			if !ok {
+				if tooLarge != nil {
+					_ = WriteMessage(conn, marshalResponse(errResponse(handler.CodeTooLarge, tooLarge.Error())))
+				}
+				return
+			}
+			if h, isHello := parseHello(msg); isHello {
+				compress = h.Compression == CompressionZstd
+				agreed := "none"
+				if compress {
+					agreed = CompressionZstd
+				}
+				if err := WriteMessage(conn, marshalResponse(handler.Response{Type: "OK", Data: map[string]interface{}{"compression": agreed}})); err != nil {
+					return
+				}
+				continue
+			}
+			resp, ok := serve(ctx, msg)
+			if resp != nil {
+				if err := WriteFrame(conn, resp, compress); err != nil {
+					return
+				}
+			}
+			if !ok {
+				return
+			}
+		case <-timeout:
+			return
+		case <-parent.Done():
+			if timer != nil {
+				timer.Stop()
+			}
+			return
+		}
+	}
+}
+
+// FramedAuth wraps serve with the framed protocol's handshake, returning a
+// serve func for one connection. When token is set, the first frame must be
+// {"type":"AUTH","token":"..."} carrying it; any other first frame, or a
+// wrong token, is answered with UNAUTHORIZED and the connection closed. Once
+// authenticated (immediately, when token is empty) requests run with an
+// identity, so debug request types are allowed.
+func FramedAuth(token string, serve func(ctx context.Context, msg []byte) []byte) func(ctx context.Context, msg []byte) ([]byte, bool) {
+	authed := token == ""
+	return func(ctx context.Context, msg []byte) ([]byte, bool) {
+		var req struct {
+			Type  string `json:"type"`
+			Token string `json:"token"`
+		}
+		_ = json.Unmarshal(msg, &req)
+		if req.Type == "AUTH" {
+			if !auth.Check(token, req.Token) {
+				return marshalResponse(errResponse(handler.CodeUnauthorized, "invalid token")), false
+			}
+			authed = true
+			return marshalResponse(handler.Response{Type: "OK", Data: map[string]interface{}{}}), true
+		}
+		if !authed {
+			return marshalResponse(errResponse(handler.CodeUnauthorized, "first frame must be AUTH")), false
+		}
+		resp := serve(auth.WithIdentity(ctx, auth.Granted(token)), msg)
+		return resp, resp != nil
+	}
+}
+
+func marshalResponse(resp handler.Response) []byte {
+	b, _ := json.Marshal(resp)
+	return b
 }
 
 // Simple framing helpers
-func ReadMessage(conn net.Conn) ([]byte, error) {
-    reader := bufio.NewReader(conn)
-    lengthBytes := make([]byte, 4)
-    if _, err := io.ReadFull(reader, lengthBytes); err != nil {
-        return nil, err
-    }
-    length := binary.BigEndian.Uint32(lengthBytes)
 
-    data := make([]byte, length)
-    if _, err := io.ReadFull(reader, data); err != nil {
-        return nil, err
-    }
-    return data, nil
+// ErrFrameTooLarge is returned by ReadMessage for a frame over its limit.
+var ErrFrameTooLarge = errors.New("frame too large")
+
+// ReadMessage reads one length-prefixed frame of at most max bytes (0 = no
+// limit). Pass the same reader for every frame on a connection; a reader that
+// buffers must not be recreated between frames or it loses what it read
+// ahead. The payload buffer grows as bytes arrive rather than being sized
+// from the untrusted length up front. Compressed frames are returned
+// decompressed, and max applies to both sizes; a decompressed frame is
+// capped at 256 MiB even when max is 0.
+func ReadMessage(r io.Reader, max int) ([]byte, error) {
+	lengthBytes := make([]byte, 4)
+	if _, err := io.ReadFull(r, lengthBytes); err != nil {
+		return nil, err
+	}
+	length := int64(binary.BigEndian.Uint32(lengthBytes))
+	compressed := length&frameCompressed != 0
+	length &^= frameCompressed
+	if max > 0 && length > int64(max) {
+		return nil, fmt.Errorf("%w: %d bytes, limit %d", ErrFrameTooLarge, length, max)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(r, length))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) < length {
+		return nil, io.ErrUnexpectedEOF
+	}
+	if compressed {
+		return decompressFrame(data, max)
+	}
+	return data, nil
 }
 
 func WriteMessage(conn net.Conn, data []byte) error {
-    length := make([]byte, 4)
-    binary.BigEndian.PutUint32(length, uint32(len(data)))
-    if _, err := conn.Write(length); err != nil {
-        return err
-    }
-    _, err := conn.Write(data)
-    return err
+	return WriteFrame(conn, data, false)
+}
+
+// WriteFrame writes data as one frame, compressed when compress is set and
+// that makes it smaller. Only send compressed frames to a peer that
+// negotiated compression with HELLO.
+func WriteFrame(conn net.Conn, data []byte, compress bool) error {
+	prefix := uint32(len(data))
+	if compress {
+		if z := compressFrame(data); z != nil {
+			data, prefix = z, uint32(len(z))|frameCompressed
+		}
+	}
+	length := make([]byte, 4)
+	binary.BigEndian.PutUint32(length, prefix)
+	if _, err := conn.Write(length); err != nil {
+		return err
+	}
+	_, err := conn.Write(data)
+	return err
 }
@@ -0,0 +1,123 @@
+package transport
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// frame prefixes payload with its length, or'ed with flags.
+func frame(payload []byte, flags uint32) []byte {
+	b := binary.BigEndian.AppendUint32(nil, uint32(len(payload))|flags)
+	return append(b, payload...)
+}
+
+func FuzzReadMessage(f *testing.F) {
+	const max = 1 << 10
+	f.Add([]byte{})
+	f.Add(frame([]byte(`{"type":"GET","key":"a"}`), 0))
+	f.Add(frame(make([]byte, max+1), 0))
+	f.Add([]byte{0xff, 0xff, 0xff, 0xff})
+	f.Add(frame(compressFrame(bytes.Repeat([]byte("a"), 600)), frameCompressed))
+	f.Add(frame(compressFrame(bytes.Repeat([]byte("a"), 2*max)), frameCompressed))
+	f.Add(frame([]byte{0x28, 0xb5, 0x2f, 0xfd, 0x00}, frameCompressed))
+	f.Fuzz(func(t *testing.T, b []byte) {
+		msg, err := ReadMessage(bytes.NewReader(b), max)
+		if (msg == nil) == (err == nil) {
+			t.Fatalf("ReadMessage = %d bytes, %v; want a frame or an error", len(msg), err)
+		}
+		if len(msg) > max {
+			t.Fatalf("ReadMessage returned %d bytes, limit %d", len(msg), max)
+		}
+
+		out, err := decompressFrame(b, max)
+		if (out == nil) == (err == nil) {
+			t.Fatalf("decompressFrame = %d bytes, %v; want a frame or an error", len(out), err)
+		}
+		if len(out) > max {
+			t.Fatalf("decompressFrame returned %d bytes, limit %d", len(out), max)
+		}
+	})
+}
+
+func TestReadMessageCapsUnlimitedCompressedFrames(t *testing.T) {
+	defer func(n int) { maxInflatedBytes = n }(maxInflatedBytes)
+	maxInflatedBytes = 1 << 20
+
+	// A raw one-byte block in a frame declaring 1 TiB of content.
+	huge := []byte{0x28, 0xb5, 0x2f, 0xfd, 0xc0, 0x00}
+	huge = binary.LittleEndian.AppendUint64(huge, 1<<40)
+	huge = append(huge, 0x09, 0x00, 0x00, 'a')
+
+	tests := []struct {
+		name    string
+		payload []byte
+	}{
+		{"declared size", huge},
+		{"content", compressFrame(make([]byte, 2<<20))},
+	}
+	for _, tt := range tests {
+		msg, err := ReadMessage(bytes.NewReader(frame(tt.payload, frameCompressed)), 0)
+		if !errors.Is(err, ErrFrameTooLarge) {
+			t.Errorf("%s: ReadMessage = %d bytes, %v; want ErrFrameTooLarge", tt.name, len(msg), err)
+		}
+	}
+}
+
+func TestFramedShutdownAnswersTheRequestInProgress(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	started, release := make(chan struct{}), make(chan struct{})
+	f := NewFramed(func(ctx context.Context, conn net.Conn) {
+		ServeConn(ctx, conn, 0, 0, func(ctx context.Context, msg []byte) ([]byte, bool) {
+			close(started)
+			<-release
+			if ctx.Err() != nil {
+				return []byte(`"canceled"`), true
+			}
+			return []byte(`"done"`), true
+		})
+	})
+	go f.Serve(l)
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := WriteMessage(conn, []byte(`{"type":"PING"}`)); err != nil {
+		t.Fatal(err)
+	}
+	<-started
+	type result struct {
+		cut int
+		err error
+	}
+	shut := make(chan result)
+	go func() {
+		cut, err := f.Shutdown(context.Background())
+		shut <- result{cut, err}
+	}()
+	select {
+	case r := <-shut:
+		t.Fatalf("Shutdown returned %+v with a request in progress", r)
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	reply, err := ReadMessage(conn, 0)
+	if err != nil || string(reply) != `"done"` {
+		t.Fatalf("reply = %q, %v, want \"done\"", reply, err)
+	}
+	if r := <-shut; r.cut != 0 || r.err != nil {
+		t.Errorf("Shutdown = %+v, want nothing cut", r)
+	}
+	if _, err := ReadMessage(conn, 0); err == nil {
+		t.Error("connection still open after Shutdown")
+	}
+}
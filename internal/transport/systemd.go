@@ -0,0 +1,43 @@
+package transport
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+)
+
+// listenFDsStart is the first file descriptor systemd passes (SD_LISTEN_FDS_START).
+const listenFDsStart = 3
+
+// SystemdListeners returns the sockets passed in by systemd socket activation
+// (LISTEN_PID/LISTEN_FDS), or nil when the process was not socket-activated.
+// The variables are unset so child processes do not inherit them.
+func SystemdListeners() ([]net.Listener, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n < 1 {
+		return nil, nil
+	}
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	ls := make([]net.Listener, 0, n)
+	for fd := listenFDsStart; fd < listenFDsStart+n; fd++ {
+		f := os.NewFile(uintptr(fd), "LISTEN_FD_"+strconv.Itoa(fd))
+		l, err := net.FileListener(f)
+		f.Close() // FileListener dups the descriptor
+		if err != nil {
+			for _, l := range ls {
+				l.Close()
+			}
+			return nil, fmt.Errorf("systemd fd %d: %w", fd, err)
+		}
+		ls = append(ls, l)
+	}
+	return ls, nil
+}
@@ -0,0 +1,91 @@
+package upstream
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/UltraSive/rocksdb-configuration-distribution/internal/metrics"
+)
+
+// ErrForwardUnsupported is returned by Forward in REST mode, where upstream
+// takes no request envelopes.
+var ErrForwardUnsupported = errors.New("upstream does not take forwarded requests")
+
+var forwarded = metrics.NewCounter("kvstore_upstream_forwarded_total", "Requests of unknown types forwarded to upstream.")
+
+// Forward sends body, a request envelope, to upstream unchanged and returns
+// upstream's response envelope unparsed, for request types this node doesn't
+// implement. It takes a fetch slot like Fetch and is bounded by the client's
+// timeout. A reply that isn't a JSON object with a type is malformed.
+func (c *Client) Forward(ctx context.Context, body []byte) (json.RawMessage, error) {
+	if c.Mode == ModeREST {
+		return nil, ErrForwardUnsupported
+	}
+	if err := c.acquire(ctx); err != nil {
+		return nil, err
+	}
+	defer c.release()
+	forwarded.Inc()
+	return c.post(ctx, body)
+}
+
+// Send makes the write request req on upstream, as an envelope like
+// Forward's, and fails unless upstream answers OK. It takes a fetch slot
+// too. REST-mode upstreams take
+// no writes and get ErrForwardUnsupported.
+func (c *Client) Send(ctx context.Context, req interface{}) error {
+	if c.Mode == ModeREST {
+		return ErrForwardUnsupported
+	}
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	if err := c.acquire(ctx); err != nil {
+		return err
+	}
+	defer c.release()
+	raw, err := c.post(ctx, body)
+	if err != nil {
+		return err
+	}
+	var r Response
+	if err := json.Unmarshal(raw, &r); err != nil {
+		return badShape("write: %v", err)
+	}
+	if r.Type != "OK" {
+		return upstreamError(fmt.Errorf("upstream answered %s: %s: %s", r.Type, r.Code, r.Error))
+	}
+	return nil
+}
+
+// post POSTs body to upstream and returns the response envelope unparsed.
+// The caller holds a fetch slot.
+func (c *Client) post(ctx context.Context, body []byte) (json.RawMessage, error) {
+	httpReq, err := http.NewRequestWithContext(ctx, "POST", c.URL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	resp, _, err := c.do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	raw, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	var env struct {
+		Type string `json:"type"`
+	}
+	if json.Unmarshal(raw, &env) != nil || env.Type == "" {
+		return nil, badShape("forwarded request: status %d: not a response envelope", resp.StatusCode)
+	}
+	return raw, nil
+}
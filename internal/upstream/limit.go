@@ -0,0 +1,75 @@
+package upstream
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+
+	"github.com/UltraSive/rocksdb-configuration-distribution/internal/metrics"
+)
+
+// ErrBusy is returned by Fetch and FetchPrefix when every upstream slot is
+// taken and the wait queue is full.
+var ErrBusy = errors.New("too many upstream fetches in flight")
+
+var (
+	inFlight = metrics.NewGauge("kvstore_upstream_fetches_in_flight", "Upstream fetches currently running.")
+	queued   = metrics.NewGauge("kvstore_upstream_fetches_queued", "Upstream fetches waiting for a free slot.")
+	rejected = metrics.NewCounter("kvstore_upstream_fetches_rejected_total", "Upstream fetches refused because the wait queue was full.")
+
+	fetchLatency = metrics.NewHistogram("kvstore_upstream_fetch_seconds", "Time upstream took to answer a key fetch, not counting time queued for a slot.", metrics.LatencyBuckets)
+)
+
+type limiter struct {
+	slots     chan struct{}
+	waiting   atomic.Int64
+	maxQueued int64
+}
+
+// Limit caps the fetches the client runs at once at maxInFlight (0 = no
+// limit). Up to maxQueued more wait for a slot, for as long as their context
+// allows; past that a fetch fails straight away with ErrBusy. Call it before
+// the client is used.
+func (c *Client) Limit(maxInFlight, maxQueued int) {
+	if maxInFlight <= 0 {
+		c.lim = nil
+		return
+	}
+	c.lim = &limiter{slots: make(chan struct{}, maxInFlight), maxQueued: int64(maxQueued)}
+}
+
+// acquire takes a fetch slot, queueing if allowed; release gives it back.
+func (c *Client) acquire(ctx context.Context) error {
+	if l := c.lim; l != nil {
+		select {
+		case l.slots <- struct{}{}:
+		default:
+			if l.waiting.Add(1) > l.maxQueued {
+				l.waiting.Add(-1)
+				rejected.Inc()
+				return ErrBusy
+			}
+			queued.Add(1)
+			var err error
+			select {
+			case l.slots <- struct{}{}:
+			case <-ctx.Done():
+				err = ctx.Err()
+			}
+			queued.Add(-1)
+			l.waiting.Add(-1)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	inFlight.Add(1)
+	return nil
+}
+
+func (c *Client) release() {
+	inFlight.Add(-1)
+	if l := c.lim; l != nil {
+		<-l.slots
+	}
+}
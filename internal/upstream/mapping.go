@@ -0,0 +1,132 @@
+package upstream
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/UltraSive/rocksdb-configuration-distribution/internal/metrics"
+)
+
+// ErrMalformed is returned when an upstream response doesn't have the shape
+// the client expects, as opposed to a miss or an upstream error.
+var ErrMalformed = errors.New("malformed upstream response")
+
+var (
+	malformed      = metrics.NewCounter("kvstore_upstream_malformed_responses_total", "Upstream responses that weren't valid JSON or didn't have the expected shape.")
+	errorResponses = metrics.NewCounter("kvstore_upstream_error_responses_total", "Upstream responses reporting an error: an error envelope or an unexpected HTTP status.")
+)
+
+// KeyPlaceholder in a Mapping's ValuePath stands for the key fetched.
+const KeyPlaceholder = "{key}"
+
+// Mapping says where an envelope-mode GET response keeps its answer, for
+// upstreams that don't speak this store's protocol exactly. The zero value
+// is this store's own response shape.
+type Mapping struct {
+	// StatusField names the top-level field that must equal StatusOK for
+	// the response to count as a success ("" skips the check). Defaults:
+	// "type" and "OK".
+	StatusField string
+	StatusOK    string
+	// ValuePath is the dotted path to the value, where a KeyPlaceholder
+	// segment is replaced by the key as a whole, dots and all; "" takes the
+	// whole response as the value. Default: "data.{key}".
+	ValuePath string
+}
+
+// DefaultMapping is this store's response shape.
+var DefaultMapping = Mapping{StatusField: "type", StatusOK: "OK", ValuePath: "data." + KeyPlaceholder}
+
+func (m Mapping) orDefault() Mapping {
+	if m == (Mapping{}) {
+		return DefaultMapping
+	}
+	return m
+}
+
+// badShape counts and logs a malformed response and returns the error for it.
+func badShape(format string, args ...interface{}) error {
+	err := fmt.Errorf("%w: %s", ErrMalformed, fmt.Sprintf(format, args...))
+	malformed.Inc()
+	fmt.Println("upstream:", err)
+	return err
+}
+
+// upstreamError counts and logs a response in which upstream reported an
+// error, and returns the error for it.
+func upstreamError(err error) error {
+	errorResponses.Inc()
+	fmt.Println("upstream:", err)
+	return err
+}
+
+// maxErrorBody bounds how much of an error reply is read for its message.
+const maxErrorBody = 64 << 10
+
+// statusError reports a GET reply for key whose status is neither 200 nor
+// 404. Upstream sends its error envelopes with error statuses, so the body
+// is checked for one and its message kept; a body that isn't one, such as
+// a proxy's error page, still leaves the status to go on.
+func (c *Client) statusError(resp *http.Response, key string) error {
+	err := fmt.Errorf("%w: GET %q: %d", ErrStatus, key, resp.StatusCode)
+	m := c.Mapping.orDefault()
+	var obj map[string]interface{}
+	if m.StatusField != "" && json.NewDecoder(io.LimitReader(resp.Body, maxErrorBody)).Decode(&obj) == nil {
+		if status, ok := obj[m.StatusField].(string); ok && status != m.StatusOK {
+			err = fmt.Errorf("%w: upstream answered %s %q: %v", err, m.StatusField, status, obj["error"])
+		}
+	}
+	return upstreamError(err)
+}
+
+// extract reads a GET response for key from body according to the client's
+// mapping. A path that ends early is a miss; one that runs into something
+// other than an object is malformed.
+func (c *Client) extract(body io.Reader, key string) ([]byte, bool, error) {
+	m := c.Mapping.orDefault()
+	var doc interface{}
+	dec := json.NewDecoder(body)
+	dec.UseNumber() // re-marshaled below; keep numbers exact
+	if err := dec.Decode(&doc); err != nil {
+		return nil, false, badShape("invalid JSON: %v", err)
+	}
+	obj, ok := doc.(map[string]interface{})
+	if !ok {
+		return nil, false, badShape("not a JSON object")
+	}
+	if m.StatusField != "" {
+		status, ok := obj[m.StatusField].(string)
+		if !ok {
+			return nil, false, badShape("no %q string field", m.StatusField)
+		}
+		if status != m.StatusOK {
+			return nil, false, upstreamError(fmt.Errorf("upstream answered %s %q: %v", m.StatusField, status, obj["error"]))
+		}
+	}
+	cur := doc
+	var path []string
+	if m.ValuePath != "" {
+		path = strings.Split(m.ValuePath, ".")
+	}
+	for _, seg := range path {
+		if seg == KeyPlaceholder {
+			seg = key
+		}
+		o, ok := cur.(map[string]interface{})
+		if !ok {
+			return nil, false, badShape("expected an object holding %q", seg)
+		}
+		if cur, ok = o[seg]; !ok {
+			return nil, false, nil
+		}
+	}
+	if cur == nil {
+		return nil, false, nil
+	}
+	raw, _ := json.Marshal(cur)
+	return raw, true, nil
+}
@@ -2,14 +2,49 @@ package upstream
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"net/http"
+	"net/url"
+	"strings"
+	"sync"
 	"time"
 )
 
+// Modes select how the client talks to upstream.
+const (
+	// ModeEnvelope POSTs a {"type":"GET"} envelope to URL.
+	ModeEnvelope = "envelope"
+	// ModeREST issues GET <URL>/kv/<key> and expects the bare value, with
+	// 404 meaning the key does not exist.
+	ModeREST = "rest"
+)
+
 type Client struct {
 	URL    string
+	Mode   string // ModeEnvelope (default) or ModeREST
 	Client *http.Client
+
+	// Mapping locates the value in envelope-mode GET responses; the zero
+	// value expects this store's own responses.
+	Mapping Mapping
+
+	mu   sync.Mutex
+	last *Health
+	lim  *limiter // nil = no limit, see Limit
+}
+
+// Health is the outcome of one upstream round trip. Any HTTP response below
+// 500, a 404 included, counts as reachable.
+type Health struct {
+	OK        bool      `json:"ok"`
+	Status    int       `json:"status,omitempty"`
+	LatencyMs float64   `json:"latencyMs"`
+	Error     string    `json:"error,omitempty"`
+	Checked   time.Time `json:"checked"`
 }
 
 func New(url string, timeout time.Duration) *Client {
@@ -22,46 +57,233 @@ func New(url string, timeout time.Duration) *Client {
 }
 
 type Request struct {
-	Type string   `json:"type"`
-	Keys []string `json:"keys,omitempty"`
+	Type   string   `json:"type"`
+	Keys   []string `json:"keys,omitempty"`
+	Prefix string   `json:"prefix,omitempty"`
+	Cursor string   `json:"cursor,omitempty"`
 }
 
 type Response struct {
-	Type string                 `json:"type"`
-	Data map[string]interface{} `json:"data,omitempty"`
-	Error string                `json:"error,omitempty"`
+	Type       string                 `json:"type"`
+	Code       string                 `json:"code,omitempty"`
+	Data       map[string]interface{} `json:"data,omitempty"`
+	Error      string                 `json:"error,omitempty"`
+	NextCursor string                 `json:"nextCursor,omitempty"`
 }
 
-func (c *Client) Fetch(key string) ([]byte, bool, error) {
+var (
+	// ErrPrefixUnsupported is returned by FetchPrefix when upstream can't
+	// list a prefix: REST mode, or an upstream that rejects SCAN.
+	ErrPrefixUnsupported = errors.New("upstream does not support prefix scans")
+	// ErrPrefixTooLarge is returned by FetchPrefix when the values under a
+	// prefix exceed its byte limit.
+	ErrPrefixTooLarge = errors.New("prefix exceeds the fetch limit")
+)
+
+// ErrStatus is returned for an upstream reply whose HTTP status is neither
+// 200 nor 404. Only a 404 means the key doesn't exist; any other failure,
+// such as a 5xx or 429, says nothing about the key and must not be taken for
+// a miss.
+var ErrStatus = errors.New("unexpected upstream status")
+
+// Fetch asks upstream for key. found is false only for a definite miss;
+// errors, unexpected statuses included, are returned as such. Canceling ctx
+// aborts the outbound call.
+func (c *Client) Fetch(ctx context.Context, key string) ([]byte, bool, error) {
 	if c == nil || c.URL == "" {
 		return nil, false, nil
 	}
+	if err := c.acquire(ctx); err != nil {
+		return nil, false, err
+	}
+	defer c.release()
+	defer fetchLatency.Since(time.Now())
+	if c.Mode == ModeREST {
+		return c.fetchREST(ctx, key)
+	}
 	req := Request{Type: "GET", Keys: []string{key}}
 	b, _ := json.Marshal(&req)
-	httpReq, _ := http.NewRequest("POST", c.URL, bytes.NewReader(b))
+	httpReq, err := http.NewRequestWithContext(ctx, "POST", c.URL, bytes.NewReader(b))
+	if err != nil {
+		return nil, false, err
+	}
 	httpReq.Header.Set("Content-Type", "application/json")
-	resp, err := c.Client.Do(httpReq)
+	resp, _, err := c.do(httpReq)
 	if err != nil {
 		return nil, false, err
 	}
 	defer resp.Body.Close()
-	if resp.StatusCode != 200 {
-		if resp.StatusCode == 404 {
-			return nil, false, nil
-		}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return c.extract(resp.Body, key)
+	case http.StatusNotFound:
 		return nil, false, nil
+	default:
+		return nil, false, c.statusError(resp, key)
+	}
+}
+
+// FetchPrefix asks upstream for every key under prefix with SCAN requests,
+// following nextCursor until upstream has sent them all. It fails with
+// ErrPrefixTooLarge once the keys and values received pass maxBytes (0 = no
+// limit), without reading further pages. The whole scan holds one fetch slot.
+func (c *Client) FetchPrefix(ctx context.Context, prefix string, maxBytes int) (map[string]json.RawMessage, error) {
+	if c == nil || c.URL == "" {
+		return nil, nil
+	}
+	if c.Mode == ModeREST {
+		return nil, ErrPrefixUnsupported
+	}
+	if err := c.acquire(ctx); err != nil {
+		return nil, err
+	}
+	defer c.release()
+	out := make(map[string]json.RawMessage)
+	size, cursor := 0, ""
+	for {
+		b, _ := json.Marshal(&Request{Type: "SCAN", Prefix: prefix, Cursor: cursor})
+		httpReq, err := http.NewRequestWithContext(ctx, "POST", c.URL, bytes.NewReader(b))
+		if err != nil {
+			return nil, err
+		}
+		httpReq.Header.Set("Content-Type", "application/json")
+		resp, _, err := c.do(httpReq)
+		if err != nil {
+			return nil, err
+		}
+		var r Response
+		dec := json.NewDecoder(resp.Body)
+		dec.UseNumber()
+		err = dec.Decode(&r)
+		resp.Body.Close()
+		if err != nil {
+			return nil, badShape("SCAN: status %d: %v", resp.StatusCode, err)
+		}
+		if r.Type != "OK" && r.Type != "ERR" {
+			return nil, badShape("SCAN: type %q", r.Type)
+		}
+		if r.Type == "ERR" {
+			if r.Code == "INVALID_REQUEST" && r.Error == "unknown type" {
+				return nil, ErrPrefixUnsupported
+			}
+			return nil, upstreamError(fmt.Errorf("upstream SCAN: %s", r.Error))
+		}
+		for k, v := range r.Data {
+			raw, _ := json.Marshal(v)
+			size += len(k) + len(raw)
+			if maxBytes > 0 && size > maxBytes {
+				return nil, fmt.Errorf("%w: more than %d bytes under %q", ErrPrefixTooLarge, maxBytes, prefix)
+			}
+			out[k] = raw
+		}
+		if r.NextCursor == "" || r.NextCursor == cursor {
+			return out, nil
+		}
+		cursor = r.NextCursor
+	}
+}
+
+func (c *Client) fetchREST(ctx context.Context, key string) ([]byte, bool, error) {
+	u := strings.TrimSuffix(c.URL, "/") + "/kv/" + url.PathEscape(key)
+	httpReq, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+	if err != nil {
+		return nil, false, err
 	}
-	var r Response
-	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+	resp, _, err := c.do(httpReq)
+	if err != nil {
 		return nil, false, err
 	}
-	if r.Type == "ERR" {
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
 		return nil, false, nil
+	default:
+		return nil, false, c.statusError(resp, key)
 	}
-	val, ok := r.Data[key]
-	if !ok || val == nil {
-		return nil, false, nil
+	raw, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, false, err
+	}
+	if !json.Valid(raw) {
+		return nil, false, badShape("invalid JSON for %q", key)
 	}
-	raw, _ := json.Marshal(val)
 	return raw, true, nil
 }
+
+// pingKey is the key a REST-mode ping asks for; upstream normally answers
+// 404.
+const pingKey = "kvstore-upstream-ping"
+
+// Ping makes one lightweight request upstream, bypassing the cache: a PING
+// envelope, or in REST mode a GET for a sentinel key.
+func (c *Client) Ping(ctx context.Context) Health {
+	var httpReq *http.Request
+	var err error
+	if c.Mode == ModeREST {
+		httpReq, err = http.NewRequestWithContext(ctx, "GET", strings.TrimSuffix(c.URL, "/")+"/kv/"+pingKey, nil)
+	} else {
+		httpReq, err = http.NewRequestWithContext(ctx, "POST", c.URL, strings.NewReader(`{"type":"PING"}`))
+		if err == nil {
+			httpReq.Header.Set("Content-Type", "application/json")
+		}
+	}
+	if err != nil {
+		return Health{Error: err.Error(), Checked: time.Now()}
+	}
+	resp, h, err := c.do(httpReq)
+	if err == nil {
+		_, _ = io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+	return h
+}
+
+// WaitReachable pings upstream until a ping succeeds or ctx ends, waiting
+// between attempts from one second up to ten, and returns the last ping's
+// result.
+func (c *Client) WaitReachable(ctx context.Context) Health {
+	backoff := time.Second
+	for {
+		h := c.Ping(ctx)
+		if h.OK {
+			return h
+		}
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return h
+		}
+		if backoff < 10*time.Second {
+			backoff *= 2
+		}
+	}
+}
+
+// LastHealth returns the outcome of the latest upstream request, fetch or
+// ping, if there has been one.
+func (c *Client) LastHealth() (Health, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.last == nil {
+		return Health{}, false
+	}
+	return *c.last, true
+}
+
+// do sends req and records how it went as the last known health.
+func (c *Client) do(req *http.Request) (*http.Response, Health, error) {
+	start := time.Now()
+	resp, err := c.Client.Do(req)
+	h := Health{LatencyMs: float64(time.Since(start).Microseconds()) / 1000, Checked: start}
+	if err != nil {
+		h.Error = err.Error()
+	} else {
+		h.Status = resp.StatusCode
+		h.OK = resp.StatusCode < 500
+	}
+	c.mu.Lock()
+	c.last = &h
+	c.mu.Unlock()
+	return resp, h, err
+}
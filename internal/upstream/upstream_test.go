@@ -0,0 +1,86 @@
+package upstream
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFetchMissOnlyOn404(t *testing.T) {
+	for _, mode := range []string{ModeEnvelope, ModeREST} {
+		for _, status := range []int{http.StatusNotFound, http.StatusInternalServerError, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusTooManyRequests} {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(status)
+			}))
+			c := New(srv.URL, time.Second)
+			c.Mode = mode
+			raw, found, err := c.Fetch(context.Background(), "k")
+			srv.Close()
+			if found || raw != nil {
+				t.Errorf("%s %d: found=%v raw=%q, want a miss or error", mode, status, found, raw)
+			}
+			if status == http.StatusNotFound {
+				if err != nil {
+					t.Errorf("%s 404: err = %v, want a clean miss", mode, err)
+				}
+				continue
+			}
+			if !errors.Is(err, ErrStatus) {
+				t.Errorf("%s %d: err = %v, want ErrStatus", mode, status, err)
+			}
+		}
+	}
+}
+
+func TestFetchFound(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			w.Write([]byte(`{"a":1}`))
+			return
+		}
+		w.Write([]byte(`{"type":"OK","data":{"k":{"a":1}}}`))
+	}))
+	defer srv.Close()
+	for _, mode := range []string{ModeEnvelope, ModeREST} {
+		c := New(srv.URL, time.Second)
+		c.Mode = mode
+		raw, found, err := c.Fetch(context.Background(), "k")
+		if err != nil || !found || string(raw) != `{"a":1}` {
+			t.Errorf("%s: Fetch = %q, %v, %v", mode, raw, found, err)
+		}
+	}
+}
+
+func TestFetchErrorEnvelopeCounted(t *testing.T) {
+	tests := []struct {
+		status int
+		body   string
+		msg    string
+	}{
+		{http.StatusOK, `{"type":"ERR","code":"INTERNAL","error":"disk on fire"}`, "disk on fire"},
+		{http.StatusInternalServerError, `{"type":"ERR","code":"INTERNAL","error":"disk on fire"}`, "disk on fire"},
+		{http.StatusBadGateway, `<html>bad gateway</html>`, "502"},
+	}
+	for _, tt := range tests {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(tt.status)
+			w.Write([]byte(tt.body))
+		}))
+		errs, bad := errorResponses.Value(), malformed.Value()
+		_, found, err := New(srv.URL, time.Second).Fetch(context.Background(), "k")
+		srv.Close()
+		if found || err == nil || !strings.Contains(err.Error(), tt.msg) {
+			t.Errorf("%d %s: found=%v err=%v, want an error mentioning %q", tt.status, tt.body, found, err, tt.msg)
+		}
+		if got := errorResponses.Value() - errs; got != 1 {
+			t.Errorf("%d %s: error responses counted %d times, want 1", tt.status, tt.body, got)
+		}
+		if got := malformed.Value() - bad; got != 0 {
+			t.Errorf("%d %s: counted as malformed", tt.status, tt.body)
+		}
+	}
+}
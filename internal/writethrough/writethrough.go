@@ -0,0 +1,421 @@
+// Package writethrough sends the writes clients make on this node on to
+// upstream, through a queue kept in the store so that neither an upstream
+// outage nor a restart loses them.
+package writethrough
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/UltraSive/rocksdb-configuration-distribution/internal/datastore"
+	"github.com/UltraSive/rocksdb-configuration-distribution/internal/metrics"
+	"github.com/UltraSive/rocksdb-configuration-distribution/internal/upstream"
+)
+
+var (
+	depth   = metrics.NewGauge("kvstore_writethrough_queue_depth", "Writes queued for sending to upstream.")
+	sent    = metrics.NewCounter("kvstore_writethrough_sent_total", "Queued writes sent to upstream.")
+	failed  = metrics.NewCounter("kvstore_writethrough_errors_total", "Failed attempts to send a queued write to upstream; each is retried.")
+	dropped = metrics.NewCounter("kvstore_writethrough_dropped_total", "Queued writes given up on after failing for longer than the max age.")
+)
+
+// ErrFull is returned by Enqueue when the queue holds its maximum number of
+// entries.
+var ErrFull = errors.New("upstream write-through queue is full")
+
+// Entry is a queued write: the keys a client write changed, or the prefix
+// it replaced, or the range [Start, End) it deleted. Only where the write
+// landed is queued, not what it wrote; the worker sends upstream what the
+// store holds there when it gets to the entry. Sending an entry again is
+// then harmless, and an older entry can never undo a newer write.
+type Entry struct {
+	Keys   []string `json:"keys,omitempty"`
+	Prefix string   `json:"prefix,omitempty"`
+	Start  string   `json:"start,omitempty"`
+	End    string   `json:"end,omitempty"`
+	Queued int64    `json:"queued"` // unix nanos
+}
+
+// Status is the queue's progress, for STATS.
+type Status struct {
+	Depth     int    `json:"depth"`
+	LastError string `json:"lastError,omitempty"`
+}
+
+// Queue holds writes still to be sent to upstream as entries under
+// datastore.WriteThroughPrefix, in the order they were queued, and drains
+// them with a single worker. An entry is deleted once upstream has taken
+// it, so every queued write reaches upstream at least once; one that keeps
+// failing for longer than the max age is dropped instead.
+type Queue struct {
+	db     datastore.Datastore
+	up     *upstream.Client
+	max    int
+	maxAge time.Duration
+
+	seq  atomic.Uint64 // sequence of the newest entry
+	wake chan struct{}
+
+	mu       sync.Mutex
+	depth    int
+	keys     map[string]int    // entries naming each key, see Pending
+	prefixes map[string]int    // entries naming each prefix
+	ranges   map[[2]string]int // entries naming each range
+	lastErr  string
+}
+
+// New returns the queue persisted in db, sending to up, that holds at most
+// limit entries (0 = no limit) and drops those older than maxAge that
+// upstream won't take. Entries left by an earlier run are picked up again.
+func New(db datastore.Datastore, up *upstream.Client, limit int, maxAge time.Duration) (*Queue, error) {
+	q := &Queue{
+		db:       db,
+		up:       up,
+		max:      limit,
+		maxAge:   maxAge,
+		wake:     make(chan struct{}, 1),
+		keys:     make(map[string]int),
+		prefixes: make(map[string]int),
+		ranges:   make(map[[2]string]int),
+	}
+	err := db.ScanRaw(datastore.WriteThroughPrefix, "", func(k string, stored []byte) bool {
+		seq, _ := strconv.ParseUint(strings.TrimPrefix(k, datastore.WriteThroughPrefix), 16, 64)
+		q.seq.Store(max(q.seq.Load(), seq))
+		// An unreadable entry isn't counted; the worker deletes it.
+		if e, err := decode(stored); err == nil {
+			q.depth++
+			q.track(e, 1)
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	depth.Set(int64(q.depth))
+	return q, nil
+}
+
+// Reservation is room held in the queue for one entry, until the write it
+// describes commits or fails.
+type Reservation struct {
+	q *Queue
+	e Entry
+
+	// Mutation stores the entry. The caller commits it in the same batch
+	// as the write, so that neither lands without the other.
+	Mutation datastore.Mutation
+}
+
+// Reserve makes room for an entry queuing a write that changes keys,
+// replaces prefix, or deletes [start, end), failing with ErrFull when there
+// is none. Commit or Cancel must follow once the write is done.
+func (q *Queue) Reserve(keys []string, prefix, start, end string) (*Reservation, error) {
+	q.mu.Lock()
+	if q.max > 0 && q.depth >= q.max {
+		q.mu.Unlock()
+		return nil, ErrFull
+	}
+	// Count the entry now, so concurrent writers can't overfill the queue.
+	q.depth++
+	q.mu.Unlock()
+	e := Entry{Keys: keys, Prefix: prefix, Start: start, End: end, Queued: time.Now().UnixNano()}
+	b, _ := json.Marshal(e)
+	m := datastore.Mutation{Key: entryKey(q.seq.Add(1)), Value: b, Expiry: math.MaxInt64}
+	return &Reservation{q: q, e: e, Mutation: m}, nil
+}
+
+// Commit records that the entry was written and wakes the worker.
+func (r *Reservation) Commit() {
+	r.q.mu.Lock()
+	r.q.track(r.e, 1)
+	r.q.mu.Unlock()
+	depth.Add(1)
+	select {
+	case r.q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Cancel gives the room back, for a write that failed.
+func (r *Reservation) Cancel() {
+	r.q.mu.Lock()
+	r.q.depth--
+	r.q.mu.Unlock()
+}
+
+// Pending reports whether a queued write names key, so the reconciler
+// doesn't overwrite a local change upstream hasn't seen yet.
+func (q *Queue) Pending(key string) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.keys[key] > 0 {
+		return true
+	}
+	for p := range q.prefixes {
+		if strings.HasPrefix(key, p) {
+			return true
+		}
+	}
+	for r := range q.ranges {
+		if key >= r[0] && key < r[1] {
+			return true
+		}
+	}
+	return false
+}
+
+// Status reports the queue's depth and the last error sending to upstream,
+// cleared once a send succeeds.
+func (q *Queue) Status() Status {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return Status{Depth: q.depth, LastError: q.lastErr}
+}
+
+// Start drains the queue until stop is closed, oldest entry first. A failed
+// send is retried with backoff, holding up the entries behind it, until it
+// goes through or the entry is older than the max age. The returned channel
+// is closed once the worker has stopped.
+func (q *Queue) Start(stop <-chan struct{}) <-chan struct{} {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-stop
+		cancel()
+	}()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		q.run(ctx)
+	}()
+	return done
+}
+
+func (q *Queue) run(ctx context.Context) {
+	backoff := time.Second
+	for {
+		key, e, ok, err := q.head()
+		if err == nil && !ok {
+			select {
+			case <-q.wake:
+			case <-ctx.Done():
+				return
+			}
+			continue
+		}
+		if err == nil {
+			if err = q.send(ctx, e); err == nil {
+				sent.Inc()
+				err = q.remove(key, e)
+			} else if ctx.Err() != nil {
+				return
+			} else if age := time.Since(time.Unix(0, e.Queued)); age > q.maxAge {
+				fmt.Println("write-through: dropping", describe(e), "after failing for", age.Round(time.Second), ":", err)
+				dropped.Inc()
+				err = q.remove(key, e)
+			}
+		}
+		if err == nil {
+			backoff = time.Second
+			q.mu.Lock()
+			q.lastErr = ""
+			q.mu.Unlock()
+			continue
+		}
+		failed.Inc()
+		fmt.Println("write-through error:", err)
+		q.mu.Lock()
+		q.lastErr = err.Error()
+		q.mu.Unlock()
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return
+		}
+		if backoff < 30*time.Second {
+			backoff *= 2
+		}
+	}
+}
+
+// head returns the oldest entry, if any. An entry that can't be read is
+// deleted rather than left to block the queue.
+func (q *Queue) head() (key string, e Entry, ok bool, err error) {
+	var stored []byte
+	err = q.db.ScanRaw(datastore.WriteThroughPrefix, "", func(k string, v []byte) bool {
+		key, stored = k, v
+		return false
+	})
+	if err != nil || stored == nil {
+		return "", Entry{}, false, err
+	}
+	e, err = decode(stored)
+	if err != nil {
+		fmt.Println("write-through: deleting unreadable entry", key, ":", err)
+		if err := q.db.Write([]datastore.Mutation{{Key: key, Delete: true}}); err != nil {
+			return "", Entry{}, false, err
+		}
+		return q.head()
+	}
+	return key, e, true, nil
+}
+
+// remove deletes the entry stored under key.
+func (q *Queue) remove(key string, e Entry) error {
+	if err := q.db.Write([]datastore.Mutation{{Key: key, Delete: true}}); err != nil {
+		return err
+	}
+	q.mu.Lock()
+	q.depth--
+	q.track(e, -1)
+	q.mu.Unlock()
+	depth.Add(-1)
+	return nil
+}
+
+// updateRequest and rangeRequest are the subsets of the request envelope
+// that send an entry.
+type updateRequest struct {
+	Type      string                     `json:"type"`
+	Items     map[string]json.RawMessage `json:"items,omitempty"`
+	TTLs      map[string]string          `json:"ttls,omitempty"`
+	Encodings map[string]string          `json:"encodings,omitempty"`
+	Delete    []string                   `json:"delete,omitempty"`
+	Prefix    string                     `json:"prefix,omitempty"`
+	Split     bool                       `json:"split,omitempty"`
+}
+
+type rangeRequest struct {
+	Type  string `json:"type"`
+	Start string `json:"start"`
+	End   string `json:"end"`
+}
+
+// send makes upstream hold what the store holds for e: a REPLACE_PREFIX
+// with the live keys under a replaced prefix, a DELETE_RANGE followed by an
+// UPDATE of any live keys a deleted range has again, or an UPDATE writing
+// the live keys and deleting the rest. Expiries go as the TTL left.
+func (q *Queue) send(ctx context.Context, e Entry) error {
+	now := time.Now().UnixNano()
+	req := updateRequest{Type: "UPDATE", Items: make(map[string]json.RawMessage), TTLs: make(map[string]string), Split: true}
+	put := func(k string, ent datastore.DBEntry) {
+		req.Items[k] = ent.Value
+		req.TTLs[k] = "0s"
+		if ent.Expiry != math.MaxInt64 {
+			req.TTLs[k] = time.Duration(ent.Expiry - now).String()
+		}
+		if ent.Encoding != "" {
+			if req.Encodings == nil {
+				req.Encodings = make(map[string]string)
+			}
+			req.Encodings[k] = ent.Encoding
+		}
+	}
+	var err error
+	switch {
+	case e.Prefix != "":
+		req.Type, req.Prefix, req.Split = "REPLACE_PREFIX", e.Prefix, false
+		err = q.scan(e.Prefix, "", "", now, put)
+	case e.End != "":
+		if err := q.up.Send(ctx, rangeRequest{Type: "DELETE_RANGE", Start: e.Start, End: e.End}); err != nil {
+			return err
+		}
+		err = q.scan("", e.Start, e.End, now, put)
+	}
+	if err != nil {
+		return err
+	}
+	for _, k := range e.Keys {
+		ent, ok, err := q.db.GetEntry(k)
+		if err != nil {
+			return err
+		}
+		if ok && !ent.Expired(now) {
+			put(k, ent)
+		} else {
+			req.Delete = append(req.Delete, k)
+		}
+	}
+	if req.Type == "UPDATE" && len(req.Items) == 0 && len(req.Delete) == 0 {
+		return nil
+	}
+	return q.up.Send(ctx, req)
+}
+
+// scan calls fn for every live client key under prefix from start, up to
+// end if set.
+func (q *Queue) scan(prefix, start, end string, now int64, fn func(string, datastore.DBEntry)) error {
+	var bad error
+	err := q.db.ScanRaw(prefix, start, func(k string, stored []byte) bool {
+		if end != "" && k >= end {
+			return false
+		}
+		if datastore.IsReserved(k) {
+			return true
+		}
+		ent, err := datastore.DecodeEntry(stored)
+		if err != nil {
+			bad = fmt.Errorf("%q: %w", k, err)
+			return false
+		}
+		if !ent.Expired(now) {
+			fn(k, ent)
+		}
+		return true
+	})
+	if err == nil {
+		err = bad
+	}
+	return err
+}
+
+// track adds n to the counts of entries naming what e names.
+func (q *Queue) track(e Entry, n int) {
+	for _, k := range e.Keys {
+		count(q.keys, k, n)
+	}
+	if e.Prefix != "" {
+		count(q.prefixes, e.Prefix, n)
+	}
+	if e.End != "" {
+		count(q.ranges, [2]string{e.Start, e.End}, n)
+	}
+}
+
+func count[K comparable](m map[K]int, k K, n int) {
+	if m[k] += n; m[k] <= 0 {
+		delete(m, k)
+	}
+}
+
+func entryKey(seq uint64) string {
+	return fmt.Sprintf("%s%016x", datastore.WriteThroughPrefix, seq)
+}
+
+func decode(stored []byte) (Entry, error) {
+	ent, err := datastore.DecodeEntry(stored)
+	if err != nil {
+		return Entry{}, err
+	}
+	var e Entry
+	err = json.Unmarshal(ent.Value, &e)
+	return e, err
+}
+
+// describe names what e queued, for logs.
+func describe(e Entry) string {
+	switch {
+	case e.Prefix != "":
+		return fmt.Sprintf("the replace of prefix %q", e.Prefix)
+	case e.End != "":
+		return fmt.Sprintf("the delete of [%q, %q)", e.Start, e.End)
+	}
+	return fmt.Sprintf("the write of %q", e.Keys)
+}
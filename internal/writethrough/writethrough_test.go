@@ -0,0 +1,180 @@
+package writethrough
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/UltraSive/rocksdb-configuration-distribution/internal/datastore"
+	"github.com/UltraSive/rocksdb-configuration-distribution/internal/upstream"
+)
+
+// fakeUpstream records the requests it takes and answers ERR while down.
+type fakeUpstream struct {
+	down atomic.Bool
+	mu   sync.Mutex
+	got  []updateRequest
+}
+
+func (f *fakeUpstream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if f.down.Load() {
+		w.Write([]byte(`{"type":"ERR","code":"INTERNAL","error":"down"}`))
+		return
+	}
+	var req updateRequest
+	json.NewDecoder(r.Body).Decode(&req)
+	f.mu.Lock()
+	f.got = append(f.got, req)
+	f.mu.Unlock()
+	w.Write([]byte(`{"type":"OK"}`))
+}
+
+func (f *fakeUpstream) requests() []updateRequest {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]updateRequest(nil), f.got...)
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// enqueue queues an entry the way a write does, committing it on its own.
+func enqueue(q *Queue, db datastore.Datastore, keys []string, prefix, start, end string) error {
+	r, err := q.Reserve(keys, prefix, start, end)
+	if err != nil {
+		return err
+	}
+	if err := db.Write([]datastore.Mutation{r.Mutation}); err != nil {
+		r.Cancel()
+		return err
+	}
+	r.Commit()
+	return nil
+}
+
+func TestQueueSurvivesRestartAndSendsCurrentState(t *testing.T) {
+	fake := &fakeUpstream{}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+	up := upstream.New(srv.URL, time.Second)
+
+	dir := t.TempDir()
+	db, err := datastore.NewRocksDB(dir, datastore.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	q, err := New(db, up, 10, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := q.Reserve([]string{"a", "b"}, "", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The entry is committed with the write it queues.
+	if err := db.Write([]datastore.Mutation{{Key: "a", Value: json.RawMessage(`1`), Expiry: math.MaxInt64}, r.Mutation}); err != nil {
+		t.Fatal(err)
+	}
+	r.Commit()
+	db.Close()
+
+	db, err = datastore.NewRocksDB(dir, datastore.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	q, err = New(db, up, 10, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := q.Status().Depth; d != 1 {
+		t.Fatalf("depth after restart = %d, want 1", d)
+	}
+	if !q.Pending("a") || q.Pending("c") {
+		t.Errorf("Pending(a), Pending(c) = %v, %v, want true, false", q.Pending("a"), q.Pending("c"))
+	}
+	// The entry sends what the store holds when it is drained.
+	if err := db.Put("a", json.RawMessage(`2`), 0); err != nil {
+		t.Fatal(err)
+	}
+	stop := make(chan struct{})
+	defer close(stop)
+	q.Start(stop)
+	waitFor(t, "the queue to drain", func() bool { return q.Status().Depth == 0 })
+
+	got := fake.requests()
+	if len(got) != 1 {
+		t.Fatalf("upstream got %d requests, want 1", len(got))
+	}
+	if r := got[0]; r.Type != "UPDATE" || string(r.Items["a"]) != "2" || r.TTLs["a"] != "0s" || len(r.Delete) != 1 || r.Delete[0] != "b" {
+		t.Errorf("upstream got %+v, want a=2 written and b deleted", r)
+	}
+	if q.Pending("a") {
+		t.Error("a is still pending after the queue drained")
+	}
+	n := 0
+	db.ScanRaw(datastore.WriteThroughPrefix, "", func(string, []byte) bool { n++; return true })
+	if n != 0 {
+		t.Errorf("%d entries left in the store, want 0", n)
+	}
+}
+
+func TestQueueIsBounded(t *testing.T) {
+	db, err := datastore.NewRocksDB(t.TempDir(), datastore.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	q, err := New(db, upstream.New("http://127.0.0.1:1", time.Second), 1, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := enqueue(q, db, []string{"a"}, "", "", ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := q.Reserve([]string{"b"}, "", "", ""); !errors.Is(err, ErrFull) {
+		t.Fatalf("Reserve on a full queue = %v, want ErrFull", err)
+	}
+}
+
+func TestQueueDropsEntriesPastMaxAge(t *testing.T) {
+	fake := &fakeUpstream{}
+	fake.down.Store(true)
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+
+	db, err := datastore.NewRocksDB(t.TempDir(), datastore.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	q, err := New(db, upstream.New(srv.URL, time.Second), 10, time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := enqueue(q, db, nil, "", "a", "b"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(5 * time.Millisecond)
+	stop := make(chan struct{})
+	defer close(stop)
+	q.Start(stop)
+	waitFor(t, "the entry to be dropped", func() bool { return q.Status().Depth == 0 })
+	if q.Pending("a0") {
+		t.Error("the dropped range is still pending")
+	}
+}